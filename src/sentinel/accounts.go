@@ -0,0 +1,69 @@
+// Copyright 2015 Lars Wiegman. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sentinel
+
+import (
+	"time"
+
+	"code.google.com/p/go-uuid/uuid"
+)
+
+// ArchiveGracePeriod is how long an archived account can be restored before
+// it's purged.
+const ArchiveGracePeriod = time.Hour * 24 * 30
+
+// AccountsService manages the lifecycle of user accounts. Every step is
+// recorded in the audit trail along with the change.
+type AccountsService interface {
+	// Archive archives the active user, archived users can't login. The
+	// event records who archived the account.
+	Archive(userUID uuid.UUID, e *Event) error
+	// Restore activates the archived user which isn't purged yet.
+	Restore(userUID uuid.UUID, e *Event) error
+	// Archived returns the archived users which aren't purged yet.
+	Archived() ([]*User, error)
+	// Purge deletes the users archived before the given time along with
+	// their emails, login sessions and tokens. The UIDs of the purged users
+	// are returned.
+	Purge(archivedBefore time.Time) ([]uuid.UUID, error)
+}
+
+// MockAccountsService is a mock of the AccountsService.
+type MockAccountsService struct {
+	ArchiveFn  func(userUID uuid.UUID, e *Event) error
+	RestoreFn  func(userUID uuid.UUID, e *Event) error
+	ArchivedFn func() ([]*User, error)
+	PurgeFn    func(archivedBefore time.Time) ([]uuid.UUID, error)
+}
+
+var _ AccountsService = &MockAccountsService{}
+
+func (s *MockAccountsService) Archive(userUID uuid.UUID, e *Event) error {
+	if s.ArchiveFn == nil {
+		return nil
+	}
+	return s.ArchiveFn(userUID, e)
+}
+
+func (s *MockAccountsService) Restore(userUID uuid.UUID, e *Event) error {
+	if s.RestoreFn == nil {
+		return nil
+	}
+	return s.RestoreFn(userUID, e)
+}
+
+func (s *MockAccountsService) Archived() ([]*User, error) {
+	if s.ArchivedFn == nil {
+		return nil, nil
+	}
+	return s.ArchivedFn()
+}
+
+func (s *MockAccountsService) Purge(archivedBefore time.Time) ([]uuid.UUID, error) {
+	if s.PurgeFn == nil {
+		return nil, nil
+	}
+	return s.PurgeFn(archivedBefore)
+}
@@ -0,0 +1,92 @@
+// Copyright 2015 Lars Wiegman. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"database/sql"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"time"
+
+	"sentinel"
+	"sentinel/datastore"
+)
+
+// serveArchiveUser archives the account of the authenticated user. The user
+// has to enter the password again. The account can be restored by an admin
+// until it's purged after the grace period.
+func serveArchiveUser(w http.ResponseWriter, r *http.Request) error {
+	user, err := Authorized(r)
+	if err != nil {
+		return err
+	}
+
+	expectMediatype := "application/x-www-form-urlencoded"
+	if mt, _, err := mime.ParseMediaType(r.Header.Get("Content-Type")); err != nil || mt != expectMediatype {
+		return ErrUnsupportedMediatype.Append("expected " + expectMediatype)
+	}
+
+	form, err := deleteForm(r)
+	if err != nil {
+		return err
+	}
+
+	// Re-authenticate the user
+	if err := datastore.ComparePassword(user, form.Get("password")); err != nil {
+		return ErrInvalidAuthenticationCredentials.Append("password is required to delete the account")
+	}
+
+	err = store.Accounts.Archive(user.UID, requestEvent(r, sentinel.ActorUser))
+	if err == sql.ErrNoRows {
+		return ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	// Log the user out everywhere
+	if err := store.Revocations.RevokeUser(user.UID, time.Now().Add(revokeUserTTL)); err != nil {
+		return err
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// deleteForm parses the form in the body of a DELETE request, which is
+// ignored by ParseForm.
+func deleteForm(r *http.Request) (url.Values, error) {
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, 1<<16))
+	if err != nil {
+		return nil, err
+	}
+	form, err := url.ParseQuery(string(body))
+	if err != nil {
+		return nil, ErrInvalidRequest.Append("malformed form")
+	}
+	return form, nil
+}
+
+// PurgeAccounts purges the accounts archived longer than the
+// sentinel.ArchiveGracePeriod at the given interval. It never returns.
+func PurgeAccounts(interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := purgeAccounts(); err != nil {
+			log.Println("purging archived accounts failed with error:", err)
+		}
+	}
+}
+
+func purgeAccounts() error {
+	purged, err := store.Accounts.Purge(time.Now().Add(-sentinel.ArchiveGracePeriod))
+	for _, uid := range purged {
+		log.Print("Purged archived account ", uid)
+	}
+	return err
+}
@@ -0,0 +1,92 @@
+// Copyright 2015 Lars Wiegman. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"sentinel"
+	"sentinel/router"
+
+	"code.google.com/p/go-uuid/uuid"
+)
+
+func TestArchiveUser(t *testing.T) {
+	setup()
+	mockRevocations()
+
+	user := &sentinel.User{ID: 1, UID: uuid.NewRandom(), PasswordHash: "plain:ninja"}
+	token := authorize(t, user)
+
+	var archived *sentinel.Event
+	store.Accounts.(*sentinel.MockAccountsService).ArchiveFn = func(userUID uuid.UUID, e *sentinel.Event) error {
+		if !uuid.Equal(userUID, user.UID) {
+			t.Errorf("Result should have been %v, but it was %v", user.UID, userUID)
+		}
+		archived = e
+		return nil
+	}
+
+	archive := func(password string) int {
+		u, _ := apiRouter.Get(router.ArchiveUser).URL()
+		form := url.Values{"password": {password}}
+		req, _ := http.NewRequest("DELETE", "http://sentinel.sh"+u.Path, strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("Authorization", "Bearer "+token)
+		req.Header.Set("User-Agent", "sentinel-test")
+		resp, err := httpClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	// The password is required
+	if status := archive("pirate"); status != http.StatusUnauthorized {
+		t.Errorf("Result should have been %v, but it was %v", http.StatusUnauthorized, status)
+	}
+	if archived != nil {
+		t.Fatalf("Result should have been nil, but it was %+v", archived)
+	}
+
+	nextSecond()
+	if status := archive("ninja"); status != http.StatusNoContent {
+		t.Fatalf("Result should have been %v, but it was %v", http.StatusNoContent, status)
+	}
+	if archived == nil {
+		t.Fatal("Result should have been an event, but it was nil")
+	}
+	if archived.Actor != sentinel.ActorUser || archived.UserAgent != "sentinel-test" {
+		t.Errorf("Result should have been an event of the user, but it was %+v", archived)
+	}
+
+	// The access token is revoked
+	if status := archive("ninja"); status != http.StatusUnauthorized {
+		t.Errorf("Result should have been %v, but it was %v", http.StatusUnauthorized, status)
+	}
+}
+
+func TestPurgeAccounts(t *testing.T) {
+	setup()
+
+	var before time.Time
+	store.Accounts.(*sentinel.MockAccountsService).PurgeFn = func(archivedBefore time.Time) ([]uuid.UUID, error) {
+		before = archivedBefore
+		return nil, nil
+	}
+	if err := purgeAccounts(); err != nil {
+		t.Fatal(err)
+	}
+
+	expect := time.Now().Add(-sentinel.ArchiveGracePeriod)
+	if d := expect.Sub(before); d < 0 || d > time.Minute {
+		t.Errorf("Result should have been %v, but it was %v", expect, before)
+	}
+}
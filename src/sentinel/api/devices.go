@@ -0,0 +1,180 @@
+// Copyright 2015 Lars Wiegman. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"database/sql"
+	"mime"
+	"net/http"
+
+	"sentinel"
+	"sentinel/datastore"
+	"sentinel/router"
+	"sentinel/validate"
+
+	"code.google.com/p/go-uuid/uuid"
+	"github.com/gorilla/mux"
+)
+
+// serveListDevices lists the devices of the authenticated user.
+func serveListDevices(w http.ResponseWriter, r *http.Request) error {
+	user, err := Authorized(r)
+	if err != nil {
+		return err
+	}
+
+	cr := NewContentRange("items", DefaultContentRangeLast)
+	if first, last, err := parseRange(r, "items"); err == nil {
+		cr.First = first
+		cr.Last = last
+	}
+	opt := sentinel.DeviceListOptions{
+		UserID: user.ID,
+		ListOptions: &sentinel.ListOptions{
+			First: cr.First,
+			Last:  cr.Last,
+		},
+	}
+
+	devices, err := store.Devices.List(opt)
+	if err != nil {
+		return err
+	}
+	cr.UpdateRange(len(devices))
+
+	cr.SetContentRange(w)
+	return writeJSON(w, http.StatusPartialContent, devices)
+}
+
+// serveRegisterDevice registers a device of the authenticated user, login
+// requests are pushed to all its active devices. Enrolling the public key
+// which signs the approvals of the device requires the password, a bearer
+// token alone can't add a signing key.
+func serveRegisterDevice(w http.ResponseWriter, r *http.Request) error {
+	user, err := Authorized(r)
+	if err != nil {
+		return err
+	}
+
+	expectMediatype := "application/x-www-form-urlencoded"
+	if mt, _, err := mime.ParseMediaType(r.Header.Get("Content-Type")); err != nil || mt != expectMediatype {
+		return ErrUnsupportedMediatype.Append("expected " + expectMediatype)
+	}
+
+	if err := r.ParseForm(); err != nil {
+		return err
+	}
+
+	opt := sentinel.DeviceOptions{}
+	if err := opt.ParseForm(r.PostForm); err != nil {
+		return ErrInvalidRequest.Append(`; ` + err.Error())
+	}
+	if opt.Platform == "" {
+		return ErrInvalidRequest.Append(`platform parameter should not be empty`)
+	}
+	if opt.PushToken == "" {
+		return ErrInvalidRequest.Append(`pushToken parameter should not be empty`)
+	}
+	if opt.PublicKey != "" {
+		// Re-authenticate the user
+		if err := datastore.ComparePassword(user, r.PostForm.Get("password")); err != nil {
+			return ErrInvalidAuthenticationCredentials.Append("password is required to enroll a device key")
+		}
+	}
+
+	device, err := store.Devices.Register(user.ID, opt)
+	if err != nil {
+		return err
+	}
+	detail := "device_id=" + device.UID.String()
+	if opt.PublicKey != "" {
+		detail += " key=enrolled"
+	}
+	recordEvent(r, user.UID, sentinel.EventDeviceAdded, detail)
+
+	u, err := apiRouter.Get(router.UpdateDevice).URL("uid", device.UID.String())
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Location", u.String())
+	return writeJSON(w, http.StatusCreated, device)
+}
+
+// serveUpdateDevice renames the device, its app also updates the push token
+// and app version.
+func serveUpdateDevice(w http.ResponseWriter, r *http.Request) error {
+	device, user, err := ownedDevice(r)
+	if err != nil {
+		return err
+	}
+
+	expectMediatype := "application/x-www-form-urlencoded"
+	if mt, _, err := mime.ParseMediaType(r.Header.Get("Content-Type")); err != nil || mt != expectMediatype {
+		return ErrUnsupportedMediatype.Append("expected " + expectMediatype)
+	}
+
+	if err := r.ParseForm(); err != nil {
+		return err
+	}
+
+	opt := sentinel.DeviceOptions{}
+	if err := opt.ParseForm(r.PostForm); err != nil {
+		return ErrInvalidRequest.Append(`; ` + err.Error())
+	}
+	if opt.Platform != "" || opt.PublicKey != "" {
+		return ErrInvalidRequest.Append(`platform and publicKey parameters can't be changed, register the device again`)
+	}
+
+	device, err = store.Devices.Update(device.UID, opt)
+	if err != nil {
+		return err
+	}
+	recordEvent(r, user.UID, sentinel.EventDeviceChanged, "device_id="+device.UID.String())
+
+	return writeJSON(w, http.StatusOK, device)
+}
+
+// serveDeleteDevice deletes the device, it doesn't receive login requests
+// anymore.
+func serveDeleteDevice(w http.ResponseWriter, r *http.Request) error {
+	device, user, err := ownedDevice(r)
+	if err != nil {
+		return err
+	}
+
+	if err := store.Devices.Delete(device.UID); err != nil {
+		return err
+	}
+	recordEvent(r, user.UID, sentinel.EventDeviceDeleted, "device_id="+device.UID.String())
+
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// ownedDevice returns the device identified by the uid path variable when
+// it's a device of the authenticated user.
+func ownedDevice(r *http.Request) (*sentinel.Device, *sentinel.User, error) {
+	user, err := Authorized(r)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	s := mux.Vars(r)["uid"]
+	if err := validate.UUIDv4(s); err != nil {
+		return nil, nil, ErrNotFound
+	}
+
+	device, err := store.Devices.Get(uuid.Parse(s))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil, ErrNotFound
+		}
+		return nil, nil, err
+	}
+	if device.UserID != user.ID {
+		return nil, nil, ErrNotFound
+	}
+	return device, user, nil
+}
@@ -0,0 +1,233 @@
+// Copyright 2015 Lars Wiegman. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"database/sql"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+
+	"sentinel"
+	"sentinel/push"
+	"sentinel/push/fcm"
+	"sentinel/router"
+
+	"code.google.com/p/go-uuid/uuid"
+)
+
+func TestRegisterDevice(t *testing.T) {
+	setup()
+
+	user := &sentinel.User{ID: 1, UID: uuid.NewRandom(), PasswordHash: "plain:princess123"}
+	token := authorize(t, user)
+
+	var events []sentinel.EventKind
+	store.Events.(*sentinel.MockEventsService).RecordFn = func(e *sentinel.Event) error {
+		events = append(events, e.Kind)
+		return nil
+	}
+	store.Devices.(*sentinel.MockDevicesService).RegisterFn = func(userID int, opt sentinel.DeviceOptions) (*sentinel.Device, error) {
+		if userID != user.ID {
+			t.Errorf("Result should have been %v, but it was %v", user.ID, userID)
+		}
+		return &sentinel.Device{
+			UID:       uuid.NewRandom(),
+			UserID:    userID,
+			Platform:  opt.Platform,
+			PushToken: opt.PushToken,
+			Name:      opt.Name,
+			PublicKey: opt.PublicKey,
+			IsActive:  true,
+		}, nil
+	}
+
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	b, _ := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	publicKey := string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: b}))
+	rsaKey := "-----BEGIN PUBLIC KEY-----\nMFwwDQYJKoZIhvcNAQEBBQADSwAwSAJBAKj34GkxFhD90vcNLYLInFEX6Ppy1tPf\n9Cnzj4p4WGeKLs1Pt8QuKUpRKfFLfRYC9AIKjbJTWit+CqvjWYzvQwECAwEAAQ==\n-----END PUBLIC KEY-----\n"
+
+	tests := []struct {
+		form   url.Values
+		status int
+	}{
+		{url.Values{"platform": {"android"}}, http.StatusUnprocessableEntity},
+		{url.Values{"platform": {"windows"}, "pushToken": {"f81d4fae"}}, http.StatusUnprocessableEntity},
+		{url.Values{"pushToken": {"f81d4fae"}}, http.StatusUnprocessableEntity},
+		{url.Values{"platform": {"android"}, "pushToken": {"bk3RNwTe3H0"}, "name": {"Jess's Pixel"}}, http.StatusCreated},
+		{url.Values{"platform": {"ios"}, "pushToken": {"e2f28cb7"}, "publicKey": {rsaKey}, "password": {"princess123"}}, http.StatusUnprocessableEntity},
+		{url.Values{"platform": {"ios"}, "pushToken": {"e2f28cb7"}, "publicKey": {publicKey}}, http.StatusUnauthorized},
+		{url.Values{"platform": {"ios"}, "pushToken": {"e2f28cb7"}, "publicKey": {publicKey}, "password": {"princess123"}}, http.StatusCreated},
+	}
+	for _, tt := range tests {
+		resp, _ := doRequest(t, "POST", router.RegisterDevice, nil, token, tt.form, nil)
+		if resp.StatusCode != tt.status {
+			t.Errorf("%v: Result should have been %v, but it was %v", tt.form, tt.status, resp.StatusCode)
+		}
+		if resp.StatusCode == http.StatusCreated && !strings.Contains(resp.Header.Get("Location"), "/user/devices/") {
+			t.Errorf("Result should have been the device location, but it was %v", resp.Header.Get("Location"))
+		}
+	}
+
+	if len(events) != 2 || events[0] != sentinel.EventDeviceAdded {
+		t.Errorf("Result should have been %v, but it was %v", sentinel.EventDeviceAdded, events)
+	}
+}
+
+func TestListDevices(t *testing.T) {
+	setup()
+
+	user := &sentinel.User{ID: 1, UID: uuid.NewRandom()}
+	token := authorize(t, user)
+
+	store.Devices.(*sentinel.MockDevicesService).ListFn = func(opt sentinel.DeviceListOptions) ([]*sentinel.Device, error) {
+		if opt.UserID != user.ID || opt.ActiveOnly {
+			t.Errorf("Result should have been all devices of user %v, but it was %+v", user.ID, opt)
+		}
+		if opt.First != 1 || opt.Last != 2 {
+			t.Errorf("Result should have been range 1-2, but it was %v-%v", opt.First, opt.Last)
+		}
+		return []*sentinel.Device{
+			{UID: uuid.NewRandom(), Platform: "ios", PushToken: "e2f28cb7", Name: "iPhone"},
+			{UID: uuid.NewRandom(), Platform: "android", PushToken: "bk3RNwTe", Name: "Pixel", Failures: 2, LastError: "fcm: UNAVAILABLE"},
+		}, nil
+	}
+
+	u, _ := apiRouter.Get(router.ListDevices).URL()
+	req, _ := http.NewRequest("GET", "http://sentinel.sh"+u.Path, nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Range-Unit", "items")
+	req.Header.Set("Range", "items=1-2")
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusPartialContent {
+		t.Fatalf("Result should have been %v, but it was %v", http.StatusPartialContent, resp.StatusCode)
+	}
+	var devices []map[string]interface{}
+	if err := json.NewDecoder(resp.Body).Decode(&devices); err != nil {
+		t.Fatal(err)
+	}
+	if len(devices) != 2 || devices[1]["name"] != "Pixel" {
+		t.Errorf("Result should have been the devices, but it was %v", devices)
+	}
+	if _, ok := devices[0]["pushToken"]; ok {
+		t.Error("Result should have been the devices without push tokens, but it had them")
+	}
+	if devices[1]["failures"] != 2.0 || devices[1]["lastError"] != "fcm: UNAVAILABLE" {
+		t.Errorf("Result should have been the delivery health, but it was %v", devices[1])
+	}
+}
+
+func TestUpdateDevice(t *testing.T) {
+	setup()
+
+	user := &sentinel.User{ID: 1, UID: uuid.NewRandom()}
+	token := authorize(t, user)
+
+	own := &sentinel.Device{UID: uuid.NewRandom(), UserID: user.ID, Platform: "ios", Name: "iPhone"}
+	other := &sentinel.Device{UID: uuid.NewRandom(), UserID: 2, Platform: "ios", Name: "iPad"}
+	store.Devices.(*sentinel.MockDevicesService).GetFn = func(uid uuid.UUID) (*sentinel.Device, error) {
+		for _, d := range []*sentinel.Device{own, other} {
+			if uuid.Equal(d.UID, uid) {
+				return d, nil
+			}
+		}
+		return nil, sql.ErrNoRows
+	}
+	calledUpdate := false
+	store.Devices.(*sentinel.MockDevicesService).UpdateFn = func(uid uuid.UUID, opt sentinel.DeviceOptions) (*sentinel.Device, error) {
+		calledUpdate = true
+		d := *own
+		d.Name = opt.Name
+		return &d, nil
+	}
+	calledDelete := false
+	store.Devices.(*sentinel.MockDevicesService).DeleteFn = func(uid uuid.UUID) error {
+		calledDelete = true
+		return nil
+	}
+
+	tests := []struct {
+		method string
+		uid    uuid.UUID
+		form   url.Values
+		status int
+	}{
+		{"PUT", other.UID, url.Values{"name": {"Mine now"}}, http.StatusNotFound},
+		{"PUT", uuid.NewRandom(), url.Values{"name": {"Mine now"}}, http.StatusNotFound},
+		{"DELETE", other.UID, nil, http.StatusNotFound},
+		{"PUT", own.UID, url.Values{"platform": {"android"}}, http.StatusUnprocessableEntity},
+		{"PUT", own.UID, url.Values{"name": {"Jess's iPhone"}}, http.StatusOK},
+		{"DELETE", own.UID, nil, http.StatusNoContent},
+	}
+	for _, tt := range tests {
+		name := router.UpdateDevice
+		if tt.method == "DELETE" {
+			name = router.DeleteDevice
+		}
+		var d sentinel.Device
+		resp, _ := doRequest(t, tt.method, name, []string{"uid", tt.uid.String()}, token, tt.form, &d)
+		if resp.StatusCode != tt.status {
+			t.Errorf("%s %v: Result should have been %v, but it was %v", tt.method, tt.form, tt.status, resp.StatusCode)
+		}
+		if resp.StatusCode == http.StatusOK && d.Name != "Jess's iPhone" {
+			t.Errorf("Result should have been %v, but it was %v", "Jess's iPhone", d.Name)
+		}
+	}
+
+	if !calledUpdate || !calledDelete {
+		t.Errorf("Result should have been updated and deleted, but it was %v/%v", calledUpdate, calledDelete)
+	}
+}
+
+func TestNotifyDevicesFailures(t *testing.T) {
+	setup()
+
+	n := push.NewMemoryNotifier()
+	notifier = n
+	defer func() { notifier = nil }()
+
+	user := &sentinel.User{ID: 1, UID: uuid.NewRandom()}
+	device := &sentinel.Device{UID: uuid.NewRandom(), UserID: user.ID, Platform: "android", PushToken: "bk3RNwTe3H0", IsActive: true}
+	store.Devices.(*sentinel.MockDevicesService).ListFn = func(opt sentinel.DeviceListOptions) ([]*sentinel.Device, error) {
+		return []*sentinel.Device{device}, nil
+	}
+	var deactivated []bool
+	store.Devices.(*sentinel.MockDevicesService).RecordFailureFn = func(uid uuid.UUID, pushToken, reason string, deactivate bool) error {
+		if !uuid.Equal(uid, device.UID) || pushToken != device.PushToken {
+			t.Errorf("Result should have been device %v, but it was %v", device.UID, uid)
+		}
+		deactivated = append(deactivated, deactivate)
+		return nil
+	}
+
+	// A rejected push token deactivates the device, other failures are only
+	// counted
+	for _, err := range []error{
+		&fcm.Error{StatusCode: 404, Code: fcm.CodeUnregistered},
+		&fcm.Error{StatusCode: 400, Code: fcm.CodeInvalidArgument},
+	} {
+		n.Err = err
+		notifyDevices(user, &push.Message{Kind: push.KindLoginNotice})
+		deliveries.Wait()
+	}
+
+	expect := []bool{true, false}
+	if !reflect.DeepEqual(expect, deactivated) {
+		t.Errorf("Result should have been %v, but it was %v", expect, deactivated)
+	}
+}
@@ -29,6 +29,21 @@ documentation:
       A one time login allows a user to authenticate without a password. This
       can be used to change a forgotten password, to securely login on a
       public WiFi.
+  - title: Service authentication
+    content: |
+      Services authenticate using the client credentials issued when the
+      service was registered. Either send the client ID and client secret
+      using HTTP Basic authentication or send a JWT assertion as Bearer token.
+      The assertion is signed with RS256 using the private key matching the
+      public key registered with the service, the iss claim holds the client
+      ID and the aud claim the issuer of the deployment, "https://sentinel.sh"
+      by default, see /.well-known/openid-configuration. The iat, exp and jti
+      claims are required; an assertion is valid for at most 5 minutes and
+      can be used once. Form encoded requests, like those to /token, may
+      include the assertion in the client_assertion parameter instead, with
+      client_assertion_type set to
+      "urn:ietf:params:oauth:client-assertion-type:jwt-bearer" (RFC 7523).
+      A request uses a single authentication method.
   - title: JWT
     content: |
       JSON Web tokens (JWT for short) are JSON objects signed by the Sentinel API.
@@ -39,6 +54,23 @@ documentation:
       in the API.
 mediaType: application/json; chartset=utf-8
 traits:
+  - service:
+      usage: Apply this to any method that is called by services
+      description: Requests are authenticated by the service's client credentials.
+      headers:
+        Authorization:
+          type: string
+          example: Basic OGM0YjNlMGYwZDBiNGU1YWExYjVjMmYzOWU0ZDdhNjE6NWUyZi4uLmM0MWE=
+      responses:
+        401:
+          body:
+            application/json; charset=utf-8:
+              schema: error
+              example: |
+                {
+                  "error": "invalid_client",
+                  "error_description": "client authentication failed"
+                }
   - secured:
       usage: Apply this to any method that needs to be secured
       description: Some requests require authentication.
@@ -64,6 +96,26 @@ traits:
                 }
         403:
           description: Unauthorized access.
+  - throttled:
+      usage: Apply this to any method that accepts credentials
+      description: |
+        Requests are rate limited per client IP address, email address and
+        client ID. Rate limited requests can be retried after the number of
+        seconds in the Retry-After header.
+      responses:
+        429:
+          headers:
+            Retry-After:
+              type: integer
+              example: 12
+          body:
+            application/json; charset=utf-8:
+              schema: error
+              example: |
+                {
+                  "error": "too_many_requests",
+                  "error_description": "too many requests, try again later; rate limit exceeded"
+                }
   - limited:
       usage: 
       description: |
@@ -109,11 +161,14 @@ schemas:
             "default": 0,
             "enum": [ 0, 1, 2, 3 ]
           },
-          "deviceToken": {
-            "description": "An APN device token or GCM registration token.",
-            "type": "string",
-            "maxLength": "256",
-            "minLength": "64"
+          "locale": {
+            "description": "Preferred language of the email messages to the user, e.g. en or nl-BE.",
+            "type": "string"
+          },
+          "totpEnabled": {
+            "description": "True when a TOTP code is required on login.",
+            "type": "boolean",
+            "default": false
           }
         }
       }
@@ -134,6 +189,11 @@ schemas:
             "description": "True when the email address is verified by the owner.",
             "type": "boolean",
             "default": false
+          },
+          "isPrimary": {
+            "description": "True for the verified email address which receives the notifications. The first verified email address becomes the primary email address.",
+            "type": "boolean",
+            "default": false
           }
         }
       }
@@ -147,9 +207,15 @@ schemas:
             "format": "uuid"
           },
           "serviceUrl": {
+            "description": "The status endpoint of the service.",
             "type": "string",
             "format": "uri"
           },
+          "redirectUris": {
+            "description": "The registered redirect URIs of the OpenID Connect flow.",
+            "type": "array",
+            "items": { "type": "string", "format": "uri" }
+          },
           "serviceLogoUrl": {
             "type": "string",
             "format": "uri"
@@ -165,6 +231,55 @@ schemas:
           }
         }
       }
+  - device: |
+      { "$schema": "http://json-schema.org/schema",
+        "type": "object",
+        "properties": {
+          "id": {
+            "description": "UUID version 4 identifier as defined in RFC4122.",
+            "type": "string",
+            "format": "uuid"
+          },
+          "platform": {
+            "type": "string",
+            "enum": [ "ios", "android" ]
+          },
+          "name": {
+            "type": "string"
+          },
+          "appVersion": {
+            "type": "string"
+          },
+          "publicKey": {
+            "description": "PEM encoded ECDSA P-256 or Ed25519 public key which verifies the approvals signed by the device.",
+            "type": "string"
+          },
+          "active": {
+            "description": "False when the push service rejected the push token.",
+            "type": "boolean"
+          },
+          "lastSeenDate": {
+            "type": "date"
+          },
+          "createdDate": {
+            "type": "date"
+          },
+          "failures": {
+            "description": "Number of push notifications which failed since the last delivery.",
+            "type": "integer"
+          },
+          "lastError": {
+            "description": "Reason of the last failed push notification.",
+            "type": "string"
+          },
+          "lastFailureDate": {
+            "type": "date"
+          },
+          "lastDeliveryDate": {
+            "type": "date"
+          }
+        }
+      }
   - error: |
       { "$schema": "http://json-schema.org/schema",
         "type": "object",
@@ -179,6 +294,7 @@ schemas:
       }
 /signup:
   post:
+    is: [ throttled ]
     description: |
       Signup for a Sentinel account with email and password. To verifiy the email
       address, an email message will be sent with a verification link.
@@ -198,6 +314,13 @@ schemas:
         description: Request the API to return the created resource
         type: string
         example: return=representation
+      Accept-Language:
+        description: |
+          The preferred languages of the user. The best match of the available
+          languages is stored as the locale of the user and used for the
+          verification email.
+        type: string
+        example: nl-BE,nl;q=0.9,en;q=0.8
     responses:
       201:
         description: |
@@ -215,11 +338,74 @@ schemas:
             schema: error
 /token:
   post:
-    description: Authenticate with email address and password to request an authentication token.
+    is: [ throttled ]
+    description: |
+      Authenticate with email address and password to request an
+      authentication token and a refresh token.
+
+      Use the refresh_token grant type to exchange a refresh token for a new
+      authentication token and refresh token.
+
+      Services use the authorization_code grant type to exchange an
+      authorization code from /authorize for an access token, an OpenID
+      Connect ID token and a refresh token. The service authenticates with
+      its client credentials using Basic authentication. This access token is
+      only accepted by /userinfo. Refreshing it returns an access token with
+      the same scope. Refresh tokens issued to a service can only be used by
+      the service, authenticated with its client credentials. A refresh token
+      can only be used once; when a used refresh token is presented again all refresh tokens
+      issued with it are revoked.
+
+      After 10 failed logins in a row the account is locked temporarily; a
+      login to a locked account is refused with 429 and a Retry-After.
+
+      When the user has TOTP enabled the password grant is responded with an
+      mfa_required error and an mfa_token. Use the mfa_otp grant type with
+      the mfa_token and a TOTP code or recovery code to get the tokens. The
+      mfa_token expires after 5 minutes and can be used once.
     headers:
       Authorization:
+        description: Required for the password grant type.
         type: string
         example: Basic dXNlcjpwYXNz
+    body:
+      application/x-www-form-urlencoded; chartset=utf-8:
+        formParameters:
+          grant_type:
+            type: string
+            enum: [ password, refresh_token, authorization_code, mfa_otp ]
+            default: password
+          refresh_token:
+            description: Required for the refresh_token grant type.
+            type: string
+          code:
+            description: Required for the authorization_code grant type.
+            type: string
+          redirect_uri:
+            description: |
+              Required for the authorization_code grant type, the redirect_uri
+              of the authorization request.
+            type: string
+          code_verifier:
+            description: |
+              Required for the authorization_code grant type, the PKCE code
+              verifier of the code challenge.
+            type: string
+          client_id:
+            description: Audience of the authentication token.
+            type: string
+            maxLength: 255
+          mfa_token:
+            description: Required for the mfa_otp grant type.
+            type: string
+          otp:
+            description: |
+              The TOTP code for the mfa_otp grant type, either otp or
+              recovery_code is required.
+            type: string
+          recovery_code:
+            description: A recovery code for the mfa_otp grant type.
+            type: string
     responses:
       200:
         body:
@@ -230,21 +416,206 @@ schemas:
                 "properties": {
                   "token_type": { "type": "string" },
                   "expires_in": { "type": "int" },
-                  "id_token": { "type": "string" }
+                  "id_token": { "type": "string" },
+                  "refresh_token": { "type": "string" }
                 }
               }
             example: |
               {
                 "token_type": "Bearer",
                 "expires_in": 3600,
-                "id_token": "eyJ..."
+                "id_token": "eyJ...",
+                "refresh_token": "9c2f0e4b3a..."
+              }
+      400:
+        description: |
+          The refresh token is invalid, expired or revoked (invalid_grant) or
+          the grant type is not supported (unsupported_grant_type).
+        body:
+          application/json; chartset=utf-8:
+            schema: error
+      403:
+        description: The user has TOTP enabled, a second factor is required.
+        body:
+          application/json; chartset=utf-8:
+            example: |
+              {
+                "error": "mfa_required",
+                "error_description": "a second factor is required, continue with the mfa_otp grant",
+                "mfa_token": "eyJ..."
+              }
+  /revoke:
+    post:
+      description: |
+        Revoke an authentication token or a refresh token, see RFC 7009.
+        Revoking a refresh token revokes all refresh tokens rotated from the
+        same token. Invalid tokens are ignored. Tokens issued to a service
+        can only be revoked by the service, authenticated with its client
+        credentials.
+      body:
+        application/x-www-form-urlencoded; chartset=utf-8:
+          formParameters:
+            token:
+              description: The token to revoke.
+              type: string
+              required: true
+            token_type_hint:
+              description: The type of the token, both types are tried regardless.
+              type: string
+              enum: [ access_token, refresh_token ]
+      responses:
+        200:
+        400:
+          description: The token type is not supported (unsupported_token_type).
+          body:
+            application/json; chartset=utf-8:
+              schema: error
+/.well-known/openid-configuration:
+  get:
+    description: |
+      The OpenID Connect discovery document. Sentinel is an OpenID Connect
+      provider supporting the authorization code flow with PKCE.
+    responses:
+      200:
+        body:
+          application/json; charset=utf-8:
+            example: |
+              {
+                "issuer": "https://sentinel.sh/api/v1",
+                "authorization_endpoint": "https://sentinel.sh/api/v1/authorize",
+                "token_endpoint": "https://sentinel.sh/api/v1/token",
+                "userinfo_endpoint": "https://sentinel.sh/api/v1/userinfo",
+                "jwks_uri": "https://sentinel.sh/api/v1/.well-known/jwks.json",
+                "response_types_supported": [ "code" ],
+                "code_challenge_methods_supported": [ "S256" ],
+                "token_endpoint_auth_methods_supported": [ "client_secret_basic", "private_key_jwt" ]
+              }
+/authorize:
+  get:
+    description: |
+      The authorization endpoint of the OpenID Connect authorization code
+      flow. The consent step is the approval of a login request on the
+      user's phone: the user agent gets a waiting page which reloads
+      /authorize/continue until the user approves or declines the login
+      request, or it times out. The continue step then redirects to the
+      redirect_uri with either the code and state or an error and state.
+
+      Invalid client_id or redirect_uri parameters are not redirected. The
+      redirect_uri must be one of the registered redirect URIs of the
+      service. The status endpoint of the service isn't called for these
+      login requests.
+
+      The login request always needs the approval of the user, services and
+      users with the notify auth level are raised to fast. Unknown users get
+      the waiting page as well. Unknown users, declined and expired login
+      requests all redirect with the access_denied error. Requests are rate
+      limited by IP address and login_hint.
+    queryParameters:
+      response_type:
+        type: string
+        enum: [ code ]
+        required: true
+      client_id:
+        type: string
+        required: true
+      redirect_uri:
+        type: string
+        required: true
+      scope:
+        description: Space delimited scopes, must include openid.
+        type: string
+        example: openid email profile
+        required: true
+      state:
+        type: string
+      nonce:
+        description: Included in the ID token.
+        type: string
+      code_challenge:
+        description: The PKCE code challenge, see RFC 7636.
+        type: string
+        required: true
+      code_challenge_method:
+        type: string
+        enum: [ S256 ]
+        required: true
+      login_hint:
+        description: The email address of the user.
+        type: string
+        required: true
+    responses:
+      200:
+        description: |
+          The waiting page, it reloads /authorize/continue with the
+          authorization request.
+        body:
+          text/html; charset=utf-8:
+      302:
+        description: |
+          Redirect to the redirect_uri with an error: login_required,
+          invalid_scope, invalid_request or unsupported_response_type.
+      422:
+        description: Invalid client_id or redirect_uri parameter.
+        body:
+          application/json; chartset=utf-8:
+            schema: error
+  /continue:
+    get:
+      description: |
+        Continue the authorization request of the waiting page. The waiting
+        page is written again while the login request is pending. Once it's
+        resolved the user agent is redirected to the redirect_uri, only
+        once.
+      queryParameters:
+        request:
+          description: The authorization request, issued by /authorize.
+          type: string
+          required: true
+      responses:
+        200:
+          description: The waiting page, the login request is pending.
+          body:
+            text/html; charset=utf-8:
+        302:
+          description: |
+            Redirect to the redirect_uri with the authorization code or the
+            access_denied error when the login request was declined or timed
+            out.
+        422:
+          description: Invalid or completed authorization request.
+          body:
+            application/json; chartset=utf-8:
+              schema: error
+/userinfo:
+  is: [ secured ]
+  get:
+    description: |
+      Claims about the authenticated user, limited to the scope the access
+      token was issued for. Only access tokens issued by the authorization_code
+      grant, or refreshed from one, are accepted.
+    responses:
+      200:
+        body:
+          application/json; charset=utf-8:
+            example: |
+              {
+                "sub": "373707eb-db20-4b1c-bf8c-505f19d9ccf5",
+                "name": "Anna",
+                "email": "anna@example.com",
+                "email_verified": true
               }
 /onetimelogin:
   post:
+    is: [ throttled ]
     description: |
       Request a one time login. An email message with a one time loging link
-      will be sent to the registered email address. This will allow the user
-      to be authenticated with any credentials for a single, limited time.
+      will be sent to the primary email address of the user, which is always
+      verified, whichever of the user's addresses is given. This will allow
+      the user to be authenticated with any credentials for a single, limited
+      time. The link expires
+      an hour after the request. For users with TOTP enabled the link holds
+      an mfa_token instead of an access token, use it with the mfa_otp grant
+      of /token.
     body:
       application/x-www-form-urlencoded; chartset=utf-8:
         formParameters:
@@ -252,6 +623,80 @@ schemas:
             description: An email address with which the user registered an account.
             type: string
             pattern: ^[^@\s]+@[^@\s]+$
+    headers:
+      Accept-Language:
+        description: |
+          The language of the email message when the user has no preferred
+          locale.
+        type: string
+        example: nl-BE,nl;q=0.9,en;q=0.8
+    responses:
+      204:
+      403:
+        description: The user has no verified primary email address.
+        body:
+          application/json; chartset=utf-8:
+            schema: error
+/password:
+  /forgot:
+    post:
+      is: [ throttled ]
+      description: |
+        Request a link to reset the password. An email message with a link to
+        choose a new password is sent to the primary email address of the user
+        with the given email address. The response doesn't reveal if the
+        address is registered.
+      body:
+        application/x-www-form-urlencoded; chartset=utf-8:
+          formParameters:
+            email:
+              description: An email address of the user.
+              type: string
+              pattern: ^[^@\s]+@[^@\s]+$
+      headers:
+        Accept-Language:
+          description: |
+            The language of the email message when the user has no preferred
+            locale.
+          type: string
+          example: nl-BE,nl;q=0.9,en;q=0.8
+      responses:
+        204:
+        422:
+          description: Invalid email address.
+          body:
+            application/json; chartset=utf-8:
+              schema: error
+  /reset:
+    post:
+      is: [ throttled ]
+      description: |
+        Set a new password with the token from the reset link. The token is
+        valid for 30 minutes and can be used once. All access and refresh
+        tokens issued to the user are revoked. Access tokens carry their issue
+        date in seconds, those issued in the second of the reset, like by a
+        login right after it, stay valid.
+      body:
+        application/x-www-form-urlencoded; chartset=utf-8:
+          formParameters:
+            token:
+              description: The base64 encoded JWT token which was sent in the reset email.
+              type: string
+              example: eyJ...
+            password:
+              description: The new password.
+              type: string
+              minLength: 8
+      responses:
+        204:
+        422:
+          description: |
+            Invalid, expired or used token, the email address in the token
+            is no longer a verified email address of the user, or the password
+            is too short.
+          body:
+            application/json; chartset=utf-8:
+              schema: error
 /user/self:
   is: [ secured ]
   get:
@@ -276,6 +721,13 @@ schemas:
               Default authentication level, options are 1:Notify, 2:Fast or 3:Secure.
             type: int
             enum: [ 1, 2, 3 ]
+          locale:
+            description: |
+              Preferred language of the email messages to the user, e.g. en or
+              nl-BE. Messages fall back to English when the language isn't
+              available.
+            type: string
+            pattern: ^[a-zA-Z]{2,3}([-_][a-zA-Z0-9]{2,8})*$
     responses:
       200:
         body:
@@ -287,6 +739,251 @@ schemas:
         body:
           application/json; chartset=utf-8:
             schema: error
+  delete:
+    description: |
+      Delete the account of the authenticated user. The account is archived;
+      the user is logged out everywhere and can't login anymore. An admin can
+      restore the account within 30 days, after that the account, its email
+      addresses and login sessions are deleted permanently.
+    body:
+      application/x-www-form-urlencoded; chartset=utf-8:
+        formParameters:
+          password:
+            description: The password of the user, to confirm the deletion.
+            type: string
+            required: true
+    responses:
+      204:
+      401:
+        description: The password was missing or invalid.
+        body:
+          application/json; chartset=utf-8:
+            schema: error
+  /logout:
+    post:
+      description: |
+        Log out everywhere. Revokes all authentication tokens and refresh
+        tokens issued to the authenticated user. Authentication tokens issued
+        in the second of the logout, like by a login right after it, stay
+        valid.
+      responses:
+        204:
+  /totp:
+    post:
+      description: |
+        Enroll a new TOTP secret, as defined in RFC 6238, for an authenticator
+        app. The secret isn't used until it's confirmed with a code.
+      body:
+        application/x-www-form-urlencoded; chartset=utf-8:
+          formParameters:
+            password:
+              description: The password of the user.
+              type: string
+              required: true
+      responses:
+        200:
+          body:
+            application/json; charset=utf-8:
+              example: |
+                {
+                  "secret": "JBSWY3DPEHPK3PXPJBSWY3DPEHPK3PXP",
+                  "uri": "otpauth://totp/Sentinel:jess@example.com?digits=6&issuer=Sentinel&period=30&secret=JBSWY3DPEHPK3PXPJBSWY3DPEHPK3PXP"
+                }
+        401:
+          description: The password was missing or invalid.
+        409:
+          description: TOTP is already enabled, it must be disabled first.
+    delete:
+      description: Disable TOTP, the recovery codes are deleted.
+      body:
+        application/x-www-form-urlencoded; chartset=utf-8:
+          formParameters:
+            otp:
+              description: A TOTP code, either otp or recovery_code is required.
+              type: string
+            recovery_code:
+              type: string
+      responses:
+        204:
+        400:
+          description: The code is invalid or was used before.
+    /confirm:
+      post:
+        description: |
+          Enable the enrolled TOTP secret with a code of the authenticator
+          app. The response contains 10 recovery codes which can be used once
+          instead of a code, they are only shown once.
+        body:
+          application/x-www-form-urlencoded; chartset=utf-8:
+            formParameters:
+              otp:
+                type: string
+                required: true
+        responses:
+          200:
+            body:
+              application/json; charset=utf-8:
+                example: |
+                  {
+                    "recoveryCodes": ["k3v7q-m2xpa", "..."]
+                  }
+          409:
+            description: TOTP is already enabled or no secret is enrolled.
+          422:
+            description: The code is invalid.
+/user/devices:
+  is: [ secured ]
+  get:
+    is: [ limited ]
+    description: |
+      List the devices of the authenticated user, the most recently seen
+      first. The delivery health of a device tells whether it receives the
+      push notifications; notifications which fail temporarily are sent
+      again, a device is deactivated when the push service rejects its push
+      token.
+    responses:
+      206:
+        body:
+          application/json; charset=utf-8:
+            example: |
+              [
+                {
+                  "id": "6f1b2c4e-8d3a-4f7b-9c2e-1a5d7e9f0b3c",
+                  "platform": "ios",
+                  "name": "Jess's iPhone",
+                  "appVersion": "1.2.0",
+                  "active": true,
+                  "lastSeenDate": "2015-06-01T12:00:00Z",
+                  "createdDate": "2015-05-01T12:00:00Z",
+                  "failures": 0,
+                  "lastFailureDate": "0001-01-01T00:00:00Z",
+                  "lastDeliveryDate": "2015-06-01T12:00:05Z"
+                }
+              ]
+  post:
+    description: |
+      Register a device of the authenticated user. Login requests are pushed
+      to all active devices of the user. Registering a push token again
+      updates and activates its device; a push token registered by another
+      user moves to the authenticated user.
+
+      The device enrolls the key which signs its approvals with the publicKey
+      parameter, this requires the password of the user. A device registered
+      again without a publicKey keeps its enrolled key.
+    body:
+      application/x-www-form-urlencoded; chartset=utf-8:
+        formParameters:
+          platform:
+            type: string
+            enum: [ ios, android ]
+            required: true
+          pushToken:
+            description: An APNs device token or an FCM registration token.
+            type: string
+            maxLength: 4096
+            required: true
+          name:
+            description: Name of the device shown to the user.
+            type: string
+            maxLength: 256
+          appVersion:
+            type: string
+            maxLength: 64
+          publicKey:
+            description: PEM encoded ECDSA P-256 or Ed25519 public key of the device.
+            type: string
+          password:
+            description: Password of the user, required with publicKey.
+            type: string
+    responses:
+      201:
+        body:
+          application/json; charset=utf-8:
+            schema: device
+      422:
+        description: Request had validation errors.
+        body:
+          application/json; chartset=utf-8:
+            schema: error
+  /{id}:
+    put:
+      description: |
+        Rename the device. The app also updates the push token and app
+        version, a new push token activates the device again. As on
+        registration, a push token registered by another device moves to this
+        device. The platform and public key can't be changed.
+      body:
+        application/x-www-form-urlencoded; chartset=utf-8:
+          formParameters:
+            name:
+              type: string
+              maxLength: 256
+            pushToken:
+              type: string
+              maxLength: 4096
+            appVersion:
+              type: string
+              maxLength: 64
+      responses:
+        200:
+          body:
+            application/json; charset=utf-8:
+              schema: device
+        404:
+          description: Unknown device.
+    delete:
+      description: Delete the device, it doesn't receive login requests anymore.
+      responses:
+        204:
+        404:
+          description: Unknown device.
+/user/activity:
+  is: [ secured ]
+  get:
+    is: [ limited ]
+    description: |
+      List the security events of the authenticated user, the most recent
+      first. Events include logins, issued tokens, changes to the email
+      addresses, password and device and the archiving of the account.
+    responses:
+      206:
+        body:
+          application/json; charset=utf-8:
+            example: |
+              [
+                {
+                  "userId": "0a991da9-b01d-418d-8d56-9fb56fa78b22",
+                  "kind": "email.added",
+                  "actor": "user",
+                  "ip": "192.0.2.1",
+                  "userAgent": "Mozilla/5.0",
+                  "detail": "email=jess@example.com",
+                  "createdDate": "2015-06-01T12:00:00Z"
+                }
+              ]
+/user/history:
+  is: [ secured ]
+  get:
+    is: [ limited ]
+    description: |
+      List the login history of the authenticated user, the most recent
+      first. Includes the succeeded and failed logins, sent login links and
+      approved or declined services.
+    responses:
+      206:
+        body:
+          application/json; charset=utf-8:
+            example: |
+              [
+                {
+                  "userId": "0a991da9-b01d-418d-8d56-9fb56fa78b22",
+                  "kind": "login.failed",
+                  "actor": "user",
+                  "ip": "192.0.2.1",
+                  "userAgent": "Mozilla/5.0",
+                  "createdDate": "2015-06-01T12:00:00Z"
+                }
+              ]
 /email:
   is: [ secured ]
   get:
@@ -337,9 +1034,53 @@ schemas:
             application/json; chartset=utf-8:
               schema: authemail
     delete:
-      description: Delete the email address.
+      description: |
+        Delete the email address. The only email address and the primary
+        email address can't be deleted; make another email address primary
+        first.
       responses:
         204:
+        409:
+          description: The email address is the only or the primary email address.
+          body:
+            application/json; chartset=utf-8:
+              schema: error
+    /primary:
+      post:
+        description: |
+          Make the verified email address the primary email address, which
+          receives the notifications.
+        responses:
+          204:
+          422:
+            description: The email address isn't verified.
+            body:
+              application/json; chartset=utf-8:
+                schema: error
+    /verify/resend:
+      post:
+        description: |
+          Send a new verification email to the unverified email address.
+          Verification emails to the same address are sent at most once every
+          5 minutes.
+        responses:
+          204:
+          422:
+            description: The email address is already verified.
+            body:
+              application/json; chartset=utf-8:
+                schema: error
+          429:
+            description: |
+              A verification email was sent recently, try again after the
+              number of seconds in the Retry-After header.
+            headers:
+              Retry-After:
+                type: integer
+                example: 300
+            body:
+              application/json; chartset=utf-8:
+                schema: error
 /verify:
   post:
     body:
@@ -352,7 +1093,9 @@ schemas:
     responses:
       204:
       422:
-        description: invalid token
+        description: |
+          Invalid, used or revoked token, or the email address in the token
+          doesn't belong to the user in the token.
         body:
           application/json; chartset=utf-8:
             schema: error
@@ -364,12 +1107,250 @@ schemas:
         body:
           application/json; charset=utf-8:
             schema: service
+  /auth:
+    is: [ service ]
+    post:
+      description: |
+        Create a login request for the user identified by their email address
+        and the service associated with the id. Same as /qauth/login, the id
+        must be the id of the authenticated service.
+      body:
+        application/json; charset=utf-8:
+          example: |
+            {
+              "email": "bob@example.com",
+              "secret1": "ffa6706ff2127a749973072756f83c532e43ed02"
+            }
+      responses:
+        200:
+          body:
+            application/json; charset=utf-8:
+              example: |
+                {
+                  "sessionID": "a5828e8b-b203-49ba-8aa0-60b9dfb20220"
+                }
+/services:
+  is: [ secured ]
+  get:
+    is: [ limited ]
+    description: List the services registered by the authenticated user.
+    queryParameters:
+      include_archived:
+        description: Include the archived services.
+        type: boolean
+        default: false
+    responses:
+      206:
+        body:
+          application/json; charset=utf-8:
+  post:
+    description: |
+      Register a service owned by the authenticated user. The service is
+      issued a client ID and client secret; the client secret is only
+      included in this response.
+    body:
+      application/x-www-form-urlencoded; chartset=utf-8:
+        formParameters:
+          name:
+            type: string
+            maxLength: 256
+            required: true
+          serviceUrl:
+            description: The status endpoint of the service.
+            type: string
+            required: true
+          serviceLogoUrl:
+            type: string
+          authLevel:
+            description: Authentication level, options are 1:notify 2:fast 3:secure
+            type: integer
+            enum: [ 1, 2, 3 ]
+          publicKey:
+            description: PEM encoded RSA public key to verify JWT assertions of the service.
+            type: string
+          redirectUri:
+            description: |
+              A redirect URI of the OpenID Connect flow, an absolute URL
+              without fragment. Repeat the parameter to register more than
+              one, they replace the registered redirect URIs.
+            type: string
+            repeat: true
+    responses:
+      201:
+        body:
+          application/json; charset=utf-8:
+            example: |
+              {
+                "id": "0a991da9-b01d-418d-8d56-9fb56fa78b22",
+                "name": "Shoeland",
+                "serviceUrl": "https://api.shoeland.example.com/status",
+                "redirectUris": [ "https://shoeland.example.com/oidc/callback" ],
+                "serviceLogoUrl": "https://cdn.shoeland.example.com/i/logo.png",
+                "authLevel": 2,
+                "lastEntryDate": "0001-01-01T00:00:00Z",
+                "clientID": "8c4b3e0f0d0b4e5aa1b5c2f39e4d7a61",
+                "clientSecret": "5e2f...c41a"
+              }
+      422:
+        description: Request had validation errors.
+        body:
+          application/json; chartset=utf-8:
+            schema: error
+  /{id}:
+    is: [ secured ]
+    put:
+      description: |
+        Update the service, takes the same parameters as registering a service
+        but none are required.
+      responses:
+        200:
+          body:
+            application/json; charset=utf-8:
+              schema: service
+    delete:
+      description: Archive the service; archived services can't be used to login.
+      responses:
+        204:
+    /secret:
+      post:
+        description: |
+          Issue a new client secret, the previous client secret is invalidated
+          right away.
+        responses:
+          200:
+            body:
+              application/json; charset=utf-8:
+                schema: service
+/qauth/login:
+  is: [ service ]
+  post:
+    description: |
+      Create a login request for the user identified by their email address
+      and the authenticated service; the optional serviceID must match the
+      authenticated service. The login request is pushed to
+      the user's active devices along with a token, the secret1 property
+      allows the device to validate the login request.
+
+      The auth level of the login request is the stricter of the user's
+      default auth level and the auth level of the service:
+        1:Notify, the login request is accepted right away and the user is
+          informed.
+        2:Fast, the user approves the login request with a single tap. This
+          is the default when neither level is set.
+        3:Secure, the user approves the login request with a signature made
+          by the device.
+    body:
+      application/json; charset=utf-8:
+        example: |
+          {
+            "serviceID": "0a991da9-b01d-418d-8d56-9fb56fa78b22",
+            "email": "bob@example.com",
+            "secret1": "ffa6706ff2127a749973072756f83c532e43ed02"
+          }
+    responses:
+      200:
+        description: |
+          The session ID identifies the login request when Sentinel calls the
+          status endpoint of the service.
+        body:
+          application/json; charset=utf-8:
+            example: |
+              {
+                "sessionID": "a5828e8b-b203-49ba-8aa0-60b9dfb20220",
+                "status": "pending",
+                "authLevel": 2
+              }
+      404:
+        description: Unknown service.
+/qauth/status:
+  is: [ secured ]
+  post:
+    description: |
+      Accept or decline a login request of the authenticated user. The login
+      request is identified by either the token which was pushed to the device
+      or by the sessionID. On success Sentinel posts the status, secret2 and
+      sessionID to the status endpoint of the service, the serviceUrl it was
+      registered with; on error the callback is retried with an increasing
+      delay.
+
+      Callbacks are signed, the Sentinel-Signature header holds a JWT with
+      the SHA-256 digest of the body in the body_sha256 claim. Verify it
+      using the public key from /pubkey.
+
+      Login requests which aren't confirmed within 5 minutes expire, Sentinel
+      then posts the login_timeout error and the sessionID to the status
+      endpoint of the service.
+
+      Login requests of the secure auth level have to be accepted or declined
+      with a signature of an active device with an enrolled key; a signature is
+      verified at any auth level when included. The signature is a compact
+      JWS signed with the device key, ES256 or EdDSA, with the device ID as
+      kid header and the sessionID, status, secret2, iat (seconds since the
+      epoch) and nonce (at least 16 characters) claims. The claims must match
+      the body, the signature is accepted for 5 minutes and once. The status
+      claim holds the canonical status, "accepted" or "declined", whether
+      the body uses accept/decline or accepted/declined.
+    body:
+      application/json; charset=utf-8:
+        example: |
+          {
+            "status": "accept",
+            "token": "eyJ...",
+            "secret2": "29df362b5cfa5c96d22f8d20f29d9a367dd0d359",
+            "enc1": "b9b0aa3e6a3a7c09",
+            "signature": "eyJhbGciOiJFUzI1NiIsImtpZCI6Ii4uLiJ9..."
+          }
+    responses:
+      204:
+      403:
+        description: |
+          The login request belongs to another user, requires a
+          device-signed approval or the device signature is invalid or
+          was used.
+      409:
+        description: |
+          The login request is no longer pending or was not confirmed within
+          the default timeout.
+        body:
+          application/json; charset=utf-8:
+            example: |
+              {
+                "error": "login_timeout",
+                "error_description": "login was not confirmed within default timeout"
+              }
 /pubkey:
   get:
-    description: Use this public key to validate the signature of JWT tokens created by the API.
+    description: |
+      The public key of the active signing key. Use the JWKS to validate the
+      signature of JWT tokens created by the API, it includes the retiring
+      keys which still verify tokens after a key rotation.
     responses:
       200:
         body:
           text/plain; charset=utf-8:
+/.well-known/jwks.json:
+  get:
+    description: |
+      The public keys which verify the signature of JWT tokens created by the
+      API as a JSON Web Key Set (RFC 7517). The kid header of a token names
+      the key which signed it. Keys are rotated; fetch the set again when a
+      token names an unknown key.
+    responses:
+      200:
+        body:
+          application/json; charset=utf-8:
+            example: |
+              {
+                "keys": [
+                  {
+                    "kty": "RSA",
+                    "use": "sig",
+                    "alg": "RS256",
+                    "kid": "NzbLsXh8uDCcd-6MNwXF4W_7noWXFZAfHkxZsRGC9Xs",
+                    "n": "0vx7agoebGcQSuuPiLJXZptN9nndrQmbXEps2aiAFbWhM78LhWx...",
+                    "e": "AQAB"
+                  }
+                ]
+              }
 `
 )
@@ -17,8 +17,18 @@ var (
 	ErrInvalidAuthenticationToken       = ErrInvalidClient.Append("authentication token was invalid")
 	ErrUnknownClient                    = ErrInvalidClient.Append("unknown client")
 
-	ErrUnauthorizedClient   = New("unauthorized_client", "client is not authorized", 403)
-	ErrUnsupportedMediatype = New("unsupported_mediatype", "provided mediatype is not supported", 415)
+	ErrUnauthorizedClient      = New("unauthorized_client", "client is not authorized", 403)
+	ErrDeviceSignatureRequired = ErrUnauthorizedClient.Append("login request requires a device-signed approval")
+	ErrInvalidDeviceSignature  = ErrUnauthorizedClient.Append("device signature is invalid")
+	ErrUnsupportedMediatype    = New("unsupported_mediatype", "provided mediatype is not supported", 415)
+
+	ErrInvalidGrant         = New("invalid_grant", "refresh token is invalid, expired or revoked", 400)
+	ErrUnsupportedGrantType = New("unsupported_grant_type", "grant type is not supported", 400)
+	ErrUnsupportedTokenType = New("unsupported_token_type", "token type is not supported", 400)
+
+	ErrInvalidAuthorizationCode = New("invalid_grant", "authorization code is invalid, expired or used", 400)
+	ErrInvalidMFACode           = New("invalid_grant", "one-time password or recovery code is invalid or used", 400)
+	ErrMFARequired              = New("mfa_required", "a second factor is required, continue with the mfa_otp grant", 403)
 
 	ErrInvalidToken    = New("invalid_token", "invalid JSON Web Token", 422)
 	ErrInvalidRequest  = New("invalid_request", "", 422)
@@ -27,9 +37,12 @@ var (
 	ErrEmailRegistered = ErrInvalidRequest.Append(`email already registered`)
 
 	ErrConfilt       = New("conflict", "", 409)
+	ErrLoginTimeout  = New("login_timeout", "login was not confirmed within default timeout", 409)
 	ErrNotAcceptable = New("not_acceptable", "resource not available in the requested mediatype.", 406)
 	ErrNotFound      = New("not_found", "resource not found", 404)
 	ErrServerError   = New("server_error", "unknown server error", 500)
+
+	ErrTooManyRequests = New("too_many_requests", "too many requests, try again later", 429)
 )
 
 // Error type implemented by the HTTP handlers
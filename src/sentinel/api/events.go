@@ -0,0 +1,75 @@
+// Copyright 2015 Lars Wiegman. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"log"
+	"net/http"
+
+	"sentinel"
+
+	"code.google.com/p/go-uuid/uuid"
+)
+
+// requestEvent returns an event of the actor with the origin of the request.
+func requestEvent(r *http.Request, actor string) *sentinel.Event {
+	return &sentinel.Event{
+		Actor:     actor,
+		IP:        remoteIP(r),
+		UserAgent: r.UserAgent(),
+	}
+}
+
+// recordEvent appends an event of the user to the audit trail. The change it
+// records is already made, so a failure is logged rather than returned.
+func recordEvent(r *http.Request, userUID uuid.UUID, kind sentinel.EventKind, detail string) {
+	e := requestEvent(r, sentinel.ActorUser)
+	e.UserUID = userUID
+	e.Kind = kind
+	e.Detail = detail
+	if err := store.Events.Record(e); err != nil {
+		log.Printf("recording event %s of user %s failed with error: %s", kind, userUID, err)
+	}
+}
+
+// serveGetActivity writes the audit trail of the authenticated user.
+func serveGetActivity(w http.ResponseWriter, r *http.Request) error {
+	return serveEvents(w, r, nil)
+}
+
+// serveGetHistory writes the login history of the authenticated user.
+func serveGetHistory(w http.ResponseWriter, r *http.Request) error {
+	return serveEvents(w, r, sentinel.HistoryEventKinds)
+}
+
+func serveEvents(w http.ResponseWriter, r *http.Request, kinds []sentinel.EventKind) error {
+	user, err := Authorized(r)
+	if err != nil {
+		return err
+	}
+
+	cr := NewContentRange("items", DefaultContentRangeLast)
+	if first, last, err := parseRange(r, "items"); err == nil {
+		cr.First = first
+		cr.Last = last
+	}
+	opt := sentinel.EventListOptions{
+		User:  user.UID,
+		Kinds: kinds,
+		ListOptions: &sentinel.ListOptions{
+			First: cr.First,
+			Last:  cr.Last,
+		},
+	}
+
+	events, err := store.Events.List(opt)
+	if err != nil {
+		return err
+	}
+	cr.UpdateRange(len(events))
+
+	cr.SetContentRange(w)
+	return writeJSON(w, http.StatusPartialContent, events)
+}
@@ -0,0 +1,100 @@
+// Copyright 2015 Lars Wiegman. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"reflect"
+	"testing"
+
+	"sentinel"
+
+	"code.google.com/p/go-uuid/uuid"
+)
+
+func TestLoginEvents(t *testing.T) {
+	setup()
+
+	user := &sentinel.User{
+		UID:          uuid.NewRandom(),
+		PasswordHash: "plain:princess123",
+		AuthEmailList: []*sentinel.AuthEmail{
+			&sentinel.AuthEmail{Email: "jess@example.com"},
+		},
+	}
+	mockRefreshTokens(user)
+	store.Users.(*sentinel.MockUsersService).ListFn = func(opt sentinel.UserListOptions) ([]*sentinel.User, error) {
+		return []*sentinel.User{user}, nil
+	}
+	var events []*sentinel.Event
+	store.Events.(*sentinel.MockEventsService).RecordFn = func(e *sentinel.Event) error {
+		events = append(events, e)
+		return nil
+	}
+
+	if err := apiClient.Authenticate("jess@example.com", "pirate123"); err == nil {
+		t.Fatal("Result should have been an error, but it was nil")
+	}
+	if err := apiClient.Authenticate("jess@example.com", "princess123"); err != nil {
+		t.Fatal(err)
+	}
+
+	expect := []sentinel.EventKind{sentinel.EventLoginFailed, sentinel.EventLogin}
+	if len(events) != len(expect) {
+		t.Fatalf("Result should have been %v events, but it was %v", len(expect), len(events))
+	}
+	for i, e := range events {
+		if e.Kind != expect[i] {
+			t.Errorf("Result should have been %v, but it was %v", expect[i], e.Kind)
+		}
+		if !uuid.Equal(e.UserUID, user.UID) {
+			t.Errorf("Result should have been %v, but it was %v", user.UID, e.UserUID)
+		}
+		if e.UserAgent == "" {
+			t.Error("Result should have been the user agent of the client, but it was empty")
+		}
+	}
+}
+
+func TestGetActivity(t *testing.T) {
+	setup()
+
+	user := &sentinel.User{ID: 1, UID: uuid.NewRandom()}
+	authorize(t, user)
+
+	events := []*sentinel.Event{
+		{UserUID: user.UID, Kind: sentinel.EventLogin, Actor: sentinel.ActorUser, IP: "192.0.2.1"},
+		{UserUID: user.UID, Kind: sentinel.EventEmailAdded, Actor: sentinel.ActorUser, Detail: "email=jess@example.com"},
+	}
+	var listed sentinel.EventListOptions
+	store.Events.(*sentinel.MockEventsService).ListFn = func(opt sentinel.EventListOptions) ([]*sentinel.Event, error) {
+		listed = opt
+		return events, nil
+	}
+
+	result, err := apiClient.Activity.Activity(&sentinel.ListOptions{First: 10, Last: 19})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result) != len(events) || result[1].Detail != events[1].Detail {
+		t.Errorf("Result should have been %v, but it was %v", events, result)
+	}
+	if !uuid.Equal(listed.User, user.UID) {
+		t.Errorf("Result should have been %v, but it was %v", user.UID, listed.User)
+	}
+	if listed.Kinds != nil {
+		t.Errorf("Result should have been nil, but it was %v", listed.Kinds)
+	}
+	if listed.First != 10 || listed.Last != 19 {
+		t.Errorf("Result should have been %v, but it was %v", "10-19", listed.ListOptions)
+	}
+
+	// The history is limited to the logins
+	if _, err := apiClient.Activity.History(nil); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(listed.Kinds, sentinel.HistoryEventKinds) {
+		t.Errorf("Result should have been %v, but it was %v", sentinel.HistoryEventKinds, listed.Kinds)
+	}
+}
@@ -9,6 +9,7 @@ import (
 	"net/http"
 	"net/url"
 
+	"sentinel/callback"
 	"sentinel/datastore"
 	"sentinel/router"
 
@@ -19,6 +20,10 @@ var (
 	store     = datastore.NewDatastore(nil)
 	baseURL   *url.URL
 	apiRouter = router.API(nil)
+
+	// callbacks stores and delivers the callbacks to the status endpoints of
+	// the services, it's shared by the handlers and DeliverCallbacks
+	callbacks *callback.Dispatcher
 )
 
 // SetbaseURL sets the given URL as the baseURL for the router.
@@ -29,20 +34,50 @@ func SetbaseURL(u *url.URL) {
 
 // Handler returns a router with predefined handlers.
 func Handler() *mux.Router {
+	callbacks = callback.NewDispatcher(store.Callbacks, keyring)
+
 	m := router.API(baseURL)
-	m.Get(router.Signup).Handler(handler(serveSignup))
+	m.Get(router.Signup).Handler(rateLimited(router.Signup, serveSignup))
 	m.Get(router.GetUserDetails).Handler(handler(serveGetUserDetails))
 	m.Get(router.UpdateUserDetails).Handler(handler(serveUpdateUserDetails))
-	m.Get(router.CreateToken).Handler(handler(serveCreateToken))
+	m.Get(router.ArchiveUser).Handler(handler(serveArchiveUser))
+	m.Get(router.GetActivity).Handler(handler(serveGetActivity))
+	m.Get(router.GetHistory).Handler(handler(serveGetHistory))
+	m.Get(router.CreateToken).Handler(rateLimited(router.CreateToken, serveCreateToken))
+	m.Get(router.RevokeToken).Handler(handler(serveRevokeToken))
+	m.Get(router.Logout).Handler(handler(serveLogout))
 	m.Get(router.AckEmail).Handler(handler(serveAckEmail))
 	m.Get(router.AddEmail).Handler(handler(serveAddEmail))
+	m.Get(router.ResendAckEmail).Handler(handler(serveResendAckEmail))
+	m.Get(router.PrimaryEmail).Handler(handler(serveSetPrimaryEmail))
+	m.Get(router.ForgotPassword).Handler(rateLimited(router.ForgotPassword, serveForgotPassword))
+	m.Get(router.ResetPassword).Handler(rateLimited(router.ResetPassword, serveResetPassword))
+	m.Get(router.EnrollTOTP).Handler(handler(serveEnrollTOTP))
+	m.Get(router.ConfirmTOTP).Handler(handler(serveConfirmTOTP))
+	m.Get(router.DisableTOTP).Handler(handler(serveDisableTOTP))
+	m.Get(router.ListDevices).Handler(handler(serveListDevices))
+	m.Get(router.RegisterDevice).Handler(handler(serveRegisterDevice))
+	m.Get(router.UpdateDevice).Handler(handler(serveUpdateDevice))
+	m.Get(router.DeleteDevice).Handler(handler(serveDeleteDevice))
 	m.Get(router.ListEmail).Handler(handler(serveListEmail))
 	m.Get(router.GetEmail).Handler(handler(serveGetEmail))
 	m.Get(router.DelEmail).Handler(handler(serveDelEmail))
 	m.Get(router.PublicKey).Handler(handler(servePublicKey))
+	m.Get(router.JWKS).Handler(handler(serveJWKS))
+	m.Get(router.OpenIDConfiguration).Handler(handler(serveOpenIDConfiguration))
+	m.Get(router.Authorize).Handler(rateLimited(router.Authorize, serveAuthorize))
+	m.Get(router.AuthorizeContinue).Handler(handler(serveAuthorizeContinue))
+	m.Get(router.UserInfo).Handler(handler(serveUserInfo))
 	m.Get(router.Service).Handler(handler(serveGetService))
 	m.Get(router.AuthService).Handler(handler(serveAuthService))
-	m.Get(router.OneTimeLogin).Handler(handler(serveOneTimeLogin))
+	m.Get(router.CreateService).Handler(handler(serveCreateService))
+	m.Get(router.ListServices).Handler(handler(serveListServices))
+	m.Get(router.UpdateService).Handler(handler(serveUpdateService))
+	m.Get(router.DeleteService).Handler(handler(serveDeleteService))
+	m.Get(router.RotateServiceSecret).Handler(handler(serveRotateServiceSecret))
+	m.Get(router.QAuthLogin).Handler(handler(serveQAuthLogin))
+	m.Get(router.QAuthStatus).Handler(handler(serveQAuthStatus))
+	m.Get(router.OneTimeLogin).Handler(rateLimited(router.OneTimeLogin, serveOneTimeLogin))
 	m.Get(router.APIDocs).Handler(handler(serveAPIDocs))
 	return m
 }
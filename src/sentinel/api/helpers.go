@@ -8,6 +8,7 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"mime"
 	"net/http"
 	"strconv"
 	"strings"
@@ -26,6 +27,19 @@ func writeJSON(w http.ResponseWriter, statusCode int, v interface{}) error {
 	return err
 }
 
+// readJSON decodes the JSON request body into v.
+func readJSON(r *http.Request, v interface{}) error {
+	expectMediatype := "application/json"
+	if mt, _, err := mime.ParseMediaType(r.Header.Get("Content-Type")); err != nil || mt != expectMediatype {
+		return ErrUnsupportedMediatype.Append("expected " + expectMediatype)
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		return ErrInvalidRequest.Append("malformed JSON body")
+	}
+	return nil
+}
+
 // setContentRange sets the Content-Range header using the given first, last and
 // length integers.
 // Example:
@@ -0,0 +1,220 @@
+// Copyright 2015 Lars Wiegman. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"sentinel"
+	"sentinel/mail"
+	"sentinel/outbox"
+	"sentinel/tokens"
+)
+
+var (
+	// mailer sends the messages to users, see SetMailer
+	mailer mail.Sender
+
+	// mailQueued wakes the outbox dispatcher when a message is stored
+	mailQueued = make(chan struct{}, 1)
+
+	// templates renders the messages to users, see LoadTemplates
+	templates = mail.NewTemplates()
+)
+
+func init() {
+	if rawurl := os.Getenv("MAIL_URL"); rawurl != "" {
+		if err := SetMailer(rawurl); err != nil {
+			log.Fatal("Error reading MAIL_URL: ", err)
+		}
+		return
+	}
+
+	key := os.Getenv("MANDRILL_KEY")
+	if key == "" {
+		key = "SANDBOX_ERROR"
+	}
+	mailer = mail.NewMandrillSender(key)
+}
+
+// SetMailer configures the delivery of messages to users using the mail URL,
+// see mail.New.
+func SetMailer(rawurl string) error {
+	s, err := mail.New(rawurl)
+	if err != nil {
+		return err
+	}
+	mailer = s
+	return nil
+}
+
+const (
+	FromEmailSupport = "no-reply@sentinel"
+	FromNameSupport  = "Sentinel Support"
+)
+
+// siteURL is the website of links in the messages to users when no base
+// URL is set.
+const siteURL = "https://sentinel.sh"
+
+// LoadTemplates adds the message templates in dir to the built-in templates,
+// see mail.Templates.
+func LoadTemplates(dir string) error {
+	return templates.LoadDir(dir)
+}
+
+// NewVerifyEmailMessage returns the message with the link to verify an email
+// address in the language of the locale.
+func NewVerifyEmailMessage(token, locale string) (*mail.Message, error) {
+	return newMessage(sentinel.MailVerifyEmail, locale, siteLink("/verify", token))
+}
+
+// NewEmailLoginLinkMessage returns the message with the one time login link
+// in the language of the locale.
+func NewEmailLoginLinkMessage(token, locale string) (*mail.Message, error) {
+	return newMessage(sentinel.MailLoginLink, locale, siteLink("/login", token))
+}
+
+// NewResetPasswordMessage returns the message with the link to set a new
+// password in the language of the locale.
+func NewResetPasswordMessage(token, locale string) (*mail.Message, error) {
+	return newMessage(sentinel.MailResetPassword, locale, siteLink("/reset-password", token))
+}
+
+func newMessage(kind sentinel.MailKind, locale, link string) (*mail.Message, error) {
+	m, err := templates.Render(string(kind), locale, map[string]string{"Link": link})
+	if err != nil {
+		return nil, err
+	}
+	m.From = mail.Address{Name: FromNameSupport, Email: FromEmailSupport}
+	return m, nil
+}
+
+// siteLink returns the link to the page at path of the website, on the host of
+// the base URL, with the token as query parameter.
+func siteLink(path, token string) string {
+	base := baseURL
+	if base == nil {
+		base, _ = url.Parse(siteURL)
+	}
+	u := base.ResolveReference(&url.URL{Path: path})
+	u.RawQuery = url.Values{"token": {token}}.Encode()
+	return u.String()
+}
+
+// requestLocale returns the locale with templates which best matches the
+// Accept-Language header of the request, or an empty string if none matches.
+func requestLocale(r *http.Request) string {
+	return templates.Match(r.Header.Get("Accept-Language"))
+}
+
+// DeliverMail sends the messages in the outbox every interval, or as soon as
+// a message is stored, using the given number of workers. It never returns.
+func DeliverMail(interval time.Duration, workers int) {
+	d := outbox.NewDispatcher(store.Outbox, mailer, composeMail)
+	d.Workers = workers
+	d.Wake = mailQueued
+	d.Run(interval)
+}
+
+// wakeMailer triggers the delivery of the messages stored in the outbox.
+func wakeMailer() {
+	select {
+	case mailQueued <- struct{}{}:
+	default:
+	}
+}
+
+// errMessageExpired is returned by composeMail when the token of a message
+// would already be expired at the time of delivery.
+var errMessageExpired = errors.New("token of the message expired before delivery")
+
+// composeMail returns the email message for a message in the outbox. The
+// tokens in the messages are signed at the time of delivery, they are never
+// stored. The tokens expire relative to the time the message was stored, a
+// retried delivery doesn't extend the validity of the link.
+func composeMail(m *sentinel.OutboxMessage) (*mail.Message, error) {
+	// The preference of the user takes precedence over the language of the
+	// request which triggered the message
+	user, err := store.Users.GetUserDetails(m.UserUID)
+	if err != nil {
+		return nil, err
+	}
+	locale := m.Locale
+	if user.Locale != "" {
+		locale = user.Locale
+	}
+
+	var msg *mail.Message
+	switch m.Kind {
+	case sentinel.MailVerifyEmail:
+		claims := tokens.Claims{
+			"email_id": m.EmailUID.String(),
+			"user_id":  m.UserUID.String(),
+		}
+		tokenStr, err := signMessageToken(m, claims, tokens.VerifyEmailOptions)
+		if err != nil {
+			return nil, err
+		}
+		msg, err = NewVerifyEmailMessage(tokenStr, locale)
+		if err != nil {
+			return nil, err
+		}
+	case sentinel.MailLoginLink:
+		claims := tokens.Claims{
+			"user_id": m.UserUID.String(),
+		}
+		// The link replaces the password, not the second factor. Users with
+		// TOTP enabled get a challenge token to complete with the mfa_otp
+		// grant instead of an access token, valid as long as the link.
+		opt := tokens.AccessTokenOptions
+		if user.TOTPEnabled {
+			claims["client_id"] = ""
+			opt = tokens.MFAChallengeOptions
+			opt.TTL = tokens.AccessTokenOptions.TTL
+		}
+		tokenStr, err := signMessageToken(m, claims, opt)
+		if err != nil {
+			return nil, err
+		}
+		msg, err = NewEmailLoginLinkMessage(tokenStr, locale)
+		if err != nil {
+			return nil, err
+		}
+	case sentinel.MailResetPassword:
+		claims := tokens.Claims{
+			"email_id": m.EmailUID.String(),
+			"user_id":  m.UserUID.String(),
+		}
+		tokenStr, err := signMessageToken(m, claims, tokens.ResetPasswordOptions)
+		if err != nil {
+			return nil, err
+		}
+		msg, err = NewResetPasswordMessage(tokenStr, locale)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown kind of message %q", m.Kind)
+	}
+	msg.AddRecipient(m.Recipient, user.Name)
+	return msg, nil
+}
+
+// signMessageToken signs the token of the message with the options, the token
+// expires the TTL of the options after the message was stored.
+func signMessageToken(m *sentinel.OutboxMessage, claims tokens.Claims, opt tokens.Options) (string, error) {
+	opt.TTL -= time.Since(m.CreatedAt)
+	if opt.TTL <= 0 {
+		return "", errMessageExpired
+	}
+	return keyring.Sign(claims, &opt)
+}
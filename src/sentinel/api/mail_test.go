@@ -0,0 +1,191 @@
+// Copyright 2015 Lars Wiegman. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"sentinel"
+	"sentinel/router"
+	"sentinel/tokens"
+
+	"code.google.com/p/go-uuid/uuid"
+)
+
+func TestOneTimeLoginOutbox(t *testing.T) {
+	setup()
+
+	user := &sentinel.User{
+		UID: uuid.NewRandom(),
+		AuthEmailList: []*sentinel.AuthEmail{
+			{UID: uuid.NewRandom(), Email: "jane@example.com", IsVerified: true},
+			{UID: uuid.NewRandom(), Email: "jess@example.com", IsVerified: true, IsPrimary: true},
+		},
+	}
+	store.Users.(*sentinel.MockUsersService).ListFn = func(opt sentinel.UserListOptions) ([]*sentinel.User, error) {
+		return []*sentinel.User{user}, nil
+	}
+	var queued *sentinel.OutboxMessage
+	store.Outbox.(*sentinel.MockOutboxService).EnqueueFn = func(m *sentinel.OutboxMessage) error {
+		queued = m
+		return nil
+	}
+
+	u, _ := apiRouter.Get(router.OneTimeLogin).URL()
+	form := url.Values{"email": {"jess@example.com"}}
+	req, _ := http.NewRequest("POST", "http://sentinel.sh"+u.Path, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept-Language", "nl-BE,nl;q=0.9,en;q=0.8")
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("Result should have been %v, but it was %v", http.StatusNoContent, resp.StatusCode)
+	}
+
+	if queued == nil {
+		t.Fatal("Result should have been a message in the outbox, but it was nil")
+	}
+	if queued.Kind != sentinel.MailLoginLink {
+		t.Errorf("Result should have been %v, but it was %v", sentinel.MailLoginLink, queued.Kind)
+	}
+	if !uuid.Equal(queued.UserUID, user.UID) {
+		t.Errorf("Result should have been %v, but it was %v", user.UID, queued.UserUID)
+	}
+	if !uuid.Equal(queued.EmailUID, user.AuthEmailList[1].UID) {
+		t.Errorf("Result should have been %v, but it was %v", user.AuthEmailList[1].UID, queued.EmailUID)
+	}
+	if queued.Locale != "nl" {
+		t.Errorf("Result should have been %v, but it was %v", "nl", queued.Locale)
+	}
+
+	// Login links are sent to the primary email
+	queued = nil
+	form = url.Values{"email": {"jane@example.com"}}
+	req, _ = http.NewRequest("POST", "http://sentinel.sh"+u.Path, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err = httpClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if queued == nil || queued.Recipient != "jess@example.com" {
+		t.Errorf("Result should have been %v, but it was %v", "jess@example.com", queued)
+	}
+
+	// Users without a primary email don't get a login link
+	queued = nil
+	user.AuthEmailList[1].IsPrimary = false
+	req, _ = http.NewRequest("POST", "http://sentinel.sh"+u.Path, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err = httpClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("Result should have been %v, but it was %v", http.StatusForbidden, resp.StatusCode)
+	}
+	if queued != nil {
+		t.Errorf("Result should have been nil, but it was %v", queued)
+	}
+}
+
+func TestComposeMail(t *testing.T) {
+	setup()
+
+	user := &sentinel.User{UID: uuid.NewRandom(), Name: "Jess"}
+	store.Users.(*sentinel.MockUsersService).GetUserDetailsFn = func(uid uuid.UUID) (*sentinel.User, error) {
+		return user, nil
+	}
+
+	m := &sentinel.OutboxMessage{
+		Kind:      sentinel.MailVerifyEmail,
+		Recipient: "jess@example.com",
+		UserUID:   user.UID,
+		EmailUID:  uuid.NewRandom(),
+		Locale:    "nl",
+		CreatedAt: time.Now(),
+	}
+	msg, err := composeMail(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msg.To) != 1 || msg.To[0].Email != m.Recipient {
+		t.Errorf("Result should have been %v, but it was %v", m.Recipient, msg.To)
+	}
+
+	if want := "Bevestig je e-mailadres"; msg.Subject != want {
+		t.Errorf("Result should have been %v, but it was %v", want, msg.Subject)
+	}
+	if msg.HTML == "" {
+		t.Error("Result should have been an HTML part, but it was empty")
+	}
+
+	// The message holds a verify-email token for the email
+	match := regexp.MustCompile(`https://sentinel\.sh/verify\?token=(\S+)`).FindStringSubmatch(msg.Text)
+	if match == nil {
+		t.Fatalf("Result should have been a link with a token, but it was %v", msg.Text)
+	}
+	claims, err := keyring.Verify(match[1], &tokens.VerifyEmailOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := claims["email_id"]; got != m.EmailUID.String() {
+		t.Errorf("Result should have been %v, but it was %v", m.EmailUID, got)
+	}
+
+	// The preference of the user takes precedence
+	user.Locale = "en"
+	msg, err = composeMail(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "Confirm your email"; msg.Subject != want {
+		t.Errorf("Result should have been %v, but it was %v", want, msg.Subject)
+	}
+
+	// Users with TOTP enabled get a challenge token instead of an access
+	// token in the login link
+	m.Kind = sentinel.MailLoginLink
+	for _, enabled := range []bool{false, true} {
+		user.TOTPEnabled = enabled
+		msg, err = composeMail(m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		match := regexp.MustCompile(`https://sentinel\.sh/login\?token=(\S+)`).FindStringSubmatch(msg.Text)
+		if match == nil {
+			t.Fatalf("Result should have been a link with a token, but it was %v", msg.Text)
+		}
+		_, err = keyring.Verify(match[1], &tokens.AccessTokenOptions)
+		if enabled == (err == nil) {
+			t.Errorf("Result should have been an access token %v, but it was %v", !enabled, err)
+		}
+		_, err = keyring.Verify(match[1], &tokens.MFAChallengeOptions)
+		if enabled != (err == nil) {
+			t.Errorf("Result should have been a challenge token %v, but it was %v", enabled, err)
+		}
+	}
+
+	// Retries don't extend the validity of the token
+	m.CreatedAt = time.Now().Add(-tokens.AccessTokenOptions.TTL)
+	if _, err := composeMail(m); err != errMessageExpired {
+		t.Errorf("Result should have been %v, but it was %v", errMessageExpired, err)
+	}
+	m.CreatedAt = time.Now()
+
+	m.Kind = "unknown"
+	if _, err := composeMail(m); err == nil {
+		t.Error("Result should have been an error, but it was nil")
+	}
+}
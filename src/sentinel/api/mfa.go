@@ -0,0 +1,296 @@
+// Copyright 2015 Lars Wiegman. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"sentinel"
+	"sentinel/datastore"
+	"sentinel/tokens"
+	"sentinel/totp"
+	"sentinel/validate"
+
+	"code.google.com/p/go-uuid/uuid"
+)
+
+// totpIssuer is the name of the account in authenticator apps.
+const totpIssuer = "Sentinel"
+
+// serveEnrollTOTP creates a new TOTP secret for the authenticated user. The
+// user has to enter the password again. The secret isn't used until it's
+// confirmed with a code.
+func serveEnrollTOTP(w http.ResponseWriter, r *http.Request) error {
+	user, err := Authorized(r)
+	if err != nil {
+		return err
+	}
+
+	expectMediatype := "application/x-www-form-urlencoded"
+	if mt, _, err := mime.ParseMediaType(r.Header.Get("Content-Type")); err != nil || mt != expectMediatype {
+		return ErrUnsupportedMediatype.Append("expected " + expectMediatype)
+	}
+	if err := r.ParseForm(); err != nil {
+		return err
+	}
+
+	// Re-authenticate the user
+	if err := datastore.ComparePassword(user, r.PostForm.Get("password")); err != nil {
+		return ErrInvalidAuthenticationCredentials.Append("password is required to enroll totp")
+	}
+
+	secret, err := totp.NewSecret()
+	if err != nil {
+		return err
+	}
+	err = store.MFA.EnrollTOTP(user.ID, secret)
+	if err == sentinel.ErrTOTPEnabled {
+		return ErrConfilt.Append("totp is already enabled")
+	}
+	if err != nil {
+		return err
+	}
+
+	account := user.UID.String()
+	if e := user.PrimaryEmail(); e != nil {
+		account = e.Email
+	}
+	data := map[string]string{
+		"secret": secret,
+		"uri":    totp.URI(secret, totpIssuer, account),
+	}
+	w.Header().Add("Cache-Control", "no-store")
+	return writeJSON(w, http.StatusOK, data)
+}
+
+// serveConfirmTOTP enables the enrolled TOTP secret of the authenticated
+// user with a code. The recovery codes are only included in this response.
+func serveConfirmTOTP(w http.ResponseWriter, r *http.Request) error {
+	user, err := Authorized(r)
+	if err != nil {
+		return err
+	}
+
+	expectMediatype := "application/x-www-form-urlencoded"
+	if mt, _, err := mime.ParseMediaType(r.Header.Get("Content-Type")); err != nil || mt != expectMediatype {
+		return ErrUnsupportedMediatype.Append("expected " + expectMediatype)
+	}
+	if err := r.ParseForm(); err != nil {
+		return err
+	}
+
+	if user.TOTPEnabled {
+		return ErrConfilt.Append("totp is already enabled")
+	}
+	if user.TOTPSecret == "" {
+		return ErrConfilt.Append("totp isn't enrolled")
+	}
+	step, err := totp.Validate(user.TOTPSecret, r.PostForm.Get("otp"), time.Now())
+	if err != nil {
+		return ErrInvalidRequest.Append("otp parameter is invalid")
+	}
+
+	codes, err := newRecoveryCodes()
+	if err != nil {
+		return err
+	}
+	err = store.MFA.EnableTOTP(user.ID, step, codes)
+	if err == sentinel.ErrTOTPNotEnrolled {
+		return ErrConfilt.Append("totp isn't enrolled")
+	}
+	if err != nil {
+		return err
+	}
+	recordEvent(r, user.UID, sentinel.EventTOTPEnabled, "")
+
+	w.Header().Add("Cache-Control", "no-store")
+	return writeJSON(w, http.StatusOK, map[string][]string{"recoveryCodes": codes})
+}
+
+// serveDisableTOTP disables TOTP for the authenticated user, which requires
+// a code or a recovery code.
+func serveDisableTOTP(w http.ResponseWriter, r *http.Request) error {
+	user, err := Authorized(r)
+	if err != nil {
+		return err
+	}
+
+	expectMediatype := "application/x-www-form-urlencoded"
+	if mt, _, err := mime.ParseMediaType(r.Header.Get("Content-Type")); err != nil || mt != expectMediatype {
+		return ErrUnsupportedMediatype.Append("expected " + expectMediatype)
+	}
+	form, err := deleteForm(r)
+	if err != nil {
+		return err
+	}
+
+	if !user.TOTPEnabled {
+		return ErrConfilt.Append("totp isn't enabled")
+	}
+	if err := checkSecondFactor(w, r, user, form); err != nil {
+		return err
+	}
+	if err := store.MFA.DisableTOTP(user.ID); err != nil {
+		return err
+	}
+	recordEvent(r, user.UID, sentinel.EventTOTPDisabled, "")
+
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// writeMFARequired responds to a password login of a user with TOTP enabled.
+// The response is an mfa_required error with a challenge token, which is
+// exchanged for the tokens together with a code using the mfa_otp grant.
+func writeMFARequired(w http.ResponseWriter, user *sentinel.User, clientID string) error {
+	claims := tokens.Claims{
+		"user_id":   user.UID.String(),
+		"client_id": clientID,
+	}
+	tokenStr, err := keyring.Sign(claims, &tokens.MFAChallengeOptions)
+	if err != nil {
+		return err
+	}
+
+	data := struct {
+		Error
+		MFAToken string `json:"mfa_token"`
+	}{ErrMFARequired, tokenStr}
+	w.Header().Add("Cache-Control", "no-store")
+	return writeJSON(w, ErrMFARequired.StatusCode, data)
+}
+
+// serveMFAGrant completes a password login with the challenge token of the
+// mfa_required error and a code or recovery code. The challenge token can be
+// used once.
+func serveMFAGrant(w http.ResponseWriter, r *http.Request) error {
+	token, err := keyring.VerifyToken(r.PostForm.Get("mfa_token"), &tokens.MFAChallengeOptions)
+	if err != nil {
+		return ErrInvalidGrant.Append("mfa_token is invalid or expired")
+	}
+	userIDStr, _ := token.Claims["user_id"].(string)
+	clientID, _ := token.Claims["client_id"].(string)
+	if err := validate.UUIDv4(userIDStr); err != nil {
+		return ErrInvalidGrant.Append("value of claim 'user_id' was invalid")
+	}
+
+	userID := uuid.Parse(userIDStr)
+	revoked, err := store.Revocations.IsRevoked(token.ID, userID, token.IssuedAt)
+	if err != nil {
+		return err
+	}
+	if revoked {
+		return ErrInvalidGrant.Append("mfa_token was used")
+	}
+	user, err := store.Users.GetUserDetails(userID)
+	if err == sql.ErrNoRows {
+		return ErrInvalidGrant.Append("user not found")
+	}
+	if err != nil {
+		return err
+	}
+	if !user.TOTPEnabled {
+		return ErrInvalidGrant.Append("totp isn't enabled")
+	}
+
+	if err := checkSecondFactor(w, r, user, r.PostForm); err != nil {
+		return err
+	}
+	unused, err := store.Revocations.Use(token.ID, userID, token.Expires)
+	if err != nil {
+		return err
+	}
+	if !unused {
+		return ErrInvalidGrant.Append("mfa_token was used")
+	}
+
+	rt, err := store.RefreshTokens.Issue(user.ID, clientID, "")
+	if err != nil {
+		return err
+	}
+	recordEvent(r, user.UID, sentinel.EventLogin, "client_id="+clientID+" mfa=totp")
+	return writeTokens(w, user.UID, clientID, rt)
+}
+
+// checkSecondFactor checks the otp or recovery_code parameter of the form
+// against the second factors of the user, each code can be used once. Like
+// passwords, the second factor is locked temporarily after repeated
+// failures.
+func checkSecondFactor(w http.ResponseWriter, r *http.Request, user *sentinel.User, form url.Values) error {
+	lockout := lockoutKey("totp:" + user.UID.String())
+	wait, err := store.RateLimits.Wait(lockout, sentinel.LockoutLimit)
+	if err != nil {
+		return err
+	}
+	if wait > 0 {
+		return tooManyRequests(w, wait, "second factor is temporarily locked after repeated failures")
+	}
+
+	otp, recoveryCode := form.Get("otp"), form.Get("recovery_code")
+	switch {
+	case otp != "":
+		var step int64
+		step, err = totp.Validate(user.TOTPSecret, otp, time.Now())
+		if err == nil {
+			err = store.MFA.UseTOTP(user.ID, step)
+		}
+	case recoveryCode != "":
+		err = store.MFA.UseRecoveryCode(user.ID, normalizeRecoveryCode(recoveryCode))
+		if err == nil {
+			recordEvent(r, user.UID, sentinel.EventRecoveryCodeUsed, "")
+		}
+	default:
+		return ErrInvalidRequest.Append("otp or recovery_code parameter is required")
+	}
+
+	switch err {
+	case nil:
+		return store.RateLimits.Reset(lockout)
+	case totp.ErrInvalidCode, sentinel.ErrTOTPReplayed, sentinel.ErrRecoveryCodeInvalid:
+		recordEvent(r, user.UID, sentinel.EventLoginFailed, "mfa=totp")
+		if _, err := store.RateLimits.Take(lockout, sentinel.LockoutLimit); err != nil {
+			return err
+		}
+		return ErrInvalidMFACode
+	}
+	return err
+}
+
+// newRecoveryCodes returns sentinel.RecoveryCodeCount random codes of 10
+// characters, formatted as two groups of 5.
+func newRecoveryCodes() ([]string, error) {
+	codes := make([]string, sentinel.RecoveryCodeCount)
+	b := make([]byte, 10*len(codes))
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+
+	// 5 bits of each byte, 50 bits per code
+	alphabet := "abcdefghijklmnopqrstuvwxyz234567"
+	for i := range codes {
+		c := make([]byte, 10)
+		for j := range c {
+			c[j] = alphabet[b[i*10+j]&0x1f]
+		}
+		codes[i] = string(c[:5]) + "-" + string(c[5:])
+	}
+	return codes, nil
+}
+
+// normalizeRecoveryCode returns the code as it was issued, whatever the case
+// or grouping the user entered.
+func normalizeRecoveryCode(code string) string {
+	code = strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+	if len(code) != 10 {
+		return code
+	}
+	return code[:5] + "-" + code[5:]
+}
@@ -0,0 +1,185 @@
+// Copyright 2015 Lars Wiegman. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"sentinel"
+	"sentinel/router"
+	"sentinel/totp"
+
+	"code.google.com/p/go-uuid/uuid"
+)
+
+// mockMFA keeps the second factors of the user in memory and mimics the
+// datastore.
+func mockMFA(user *sentinel.User) map[string]bool {
+	recoveryCodes := make(map[string]bool)
+
+	m := store.MFA.(*sentinel.MockMFAService)
+	m.EnrollTOTPFn = func(userID int, secret string) error {
+		if user.TOTPEnabled {
+			return sentinel.ErrTOTPEnabled
+		}
+		user.TOTPSecret = secret
+		return nil
+	}
+	m.EnableTOTPFn = func(userID int, step int64, codes []string) error {
+		user.TOTPEnabled, user.TOTPStep = true, step
+		for _, c := range codes {
+			recoveryCodes[c] = false
+		}
+		return nil
+	}
+	m.DisableTOTPFn = func(userID int) error {
+		user.TOTPSecret, user.TOTPEnabled = "", false
+		return nil
+	}
+	m.UseTOTPFn = func(userID int, step int64) error {
+		if step <= user.TOTPStep {
+			return sentinel.ErrTOTPReplayed
+		}
+		user.TOTPStep = step
+		return nil
+	}
+	m.UseRecoveryCodeFn = func(userID int, code string) error {
+		if used, ok := recoveryCodes[code]; !ok || used {
+			return sentinel.ErrRecoveryCodeInvalid
+		}
+		recoveryCodes[code] = true
+		return nil
+	}
+	return recoveryCodes
+}
+
+func TestEnrollTOTP(t *testing.T) {
+	setup()
+
+	user := &sentinel.User{
+		ID:           1,
+		UID:          uuid.NewRandom(),
+		PasswordHash: "plain:princess123",
+		AuthEmailList: []*sentinel.AuthEmail{
+			&sentinel.AuthEmail{Email: "jess@example.com", IsVerified: true, IsPrimary: true},
+		},
+	}
+	token := authorize(t, user)
+	recoveryCodes := mockMFA(user)
+
+	// The password is required
+	if resp, _ := doRequest(t, "POST", router.EnrollTOTP, nil, token, url.Values{"password": {"pirate123"}}, nil); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Result should have been %v, but it was %v", http.StatusUnauthorized, resp.StatusCode)
+	}
+
+	var enrolled struct{ Secret, URI string }
+	if resp, _ := doRequest(t, "POST", router.EnrollTOTP, nil, token, url.Values{"password": {"princess123"}}, &enrolled); resp.StatusCode != http.StatusOK {
+		t.Fatalf("Result should have been %v, but it was %v", http.StatusOK, resp.StatusCode)
+	}
+	if enrolled.Secret != user.TOTPSecret || !strings.Contains(enrolled.URI, "jess@example.com") {
+		t.Errorf("Result should have been the secret and URI, but it was %+v", enrolled)
+	}
+
+	// The secret is only enabled with a valid code
+	if resp, _ := doRequest(t, "POST", router.ConfirmTOTP, nil, token, url.Values{"otp": {"000000"}}, nil); resp.StatusCode != 422 || user.TOTPEnabled {
+		t.Errorf("Result should have been %v, but it was %v", 422, resp.StatusCode)
+	}
+	code, _ := totp.Code(user.TOTPSecret, totp.Step(time.Now()))
+	var confirmed struct{ RecoveryCodes []string }
+	if resp, _ := doRequest(t, "POST", router.ConfirmTOTP, nil, token, url.Values{"otp": {code}}, &confirmed); resp.StatusCode != http.StatusOK {
+		t.Fatalf("Result should have been %v, but it was %v", http.StatusOK, resp.StatusCode)
+	}
+	if !user.TOTPEnabled {
+		t.Error("Result should have been enabled, but it wasn't")
+	}
+	if len(confirmed.RecoveryCodes) != sentinel.RecoveryCodeCount || len(recoveryCodes) != sentinel.RecoveryCodeCount {
+		t.Errorf("Result should have been %v recovery codes, but it was %v", sentinel.RecoveryCodeCount, len(confirmed.RecoveryCodes))
+	}
+
+	// A new secret can't replace an enabled secret
+	if resp, _ := doRequest(t, "POST", router.EnrollTOTP, nil, token, url.Values{"password": {"princess123"}}, nil); resp.StatusCode != http.StatusConflict {
+		t.Errorf("Result should have been %v, but it was %v", http.StatusConflict, resp.StatusCode)
+	}
+
+	// Disabling requires a second factor, a recovery code in any case
+	if resp, _ := doRequest(t, "DELETE", router.DisableTOTP, nil, token, url.Values{"recovery_code": {"aaaaa-aaaaa"}}, nil); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Result should have been %v, but it was %v", http.StatusBadRequest, resp.StatusCode)
+	}
+	rc := strings.ToUpper(strings.Replace(confirmed.RecoveryCodes[0], "-", "", 1))
+	if resp, _ := doRequest(t, "DELETE", router.DisableTOTP, nil, token, url.Values{"recovery_code": {rc}}, nil); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("Result should have been %v, but it was %v", http.StatusNoContent, resp.StatusCode)
+	}
+	if user.TOTPEnabled || user.TOTPSecret != "" {
+		t.Error("Result should have been disabled, but it wasn't")
+	}
+}
+
+func TestMFALogin(t *testing.T) {
+	setup()
+	mockRevocations()
+
+	secret, _ := totp.NewSecret()
+	user := &sentinel.User{
+		ID:           1,
+		UID:          uuid.NewRandom(),
+		PasswordHash: "plain:princess123",
+		TOTPSecret:   secret,
+		TOTPEnabled:  true,
+	}
+	mockMFA(user)
+	store.Users.(*sentinel.MockUsersService).ListFn = func(opt sentinel.UserListOptions) ([]*sentinel.User, error) {
+		return []*sentinel.User{user}, nil
+	}
+	store.Users.(*sentinel.MockUsersService).GetUserDetailsFn = func(uid uuid.UUID) (*sentinel.User, error) {
+		return user, nil
+	}
+	var issued int
+	store.RefreshTokens.(*sentinel.MockRefreshTokensService).IssueFn = func(userID int, clientID, scope string) (*sentinel.RefreshToken, error) {
+		issued++
+		return &sentinel.RefreshToken{UserID: user.ID, UserUID: user.UID, Token: "refresh"}, nil
+	}
+
+	// The password alone doesn't issue tokens
+	err := apiClient.Authenticate("jess@example.com", "princess123")
+	errResp, ok := err.(*sentinel.ErrorResponse)
+	if !ok || errResp.Name != ErrMFARequired.Name || errResp.MFAToken == "" {
+		t.Fatalf("Result should have been %v with an mfa_token, but it was %v", ErrMFARequired.Name, err)
+	}
+	if issued != 0 {
+		t.Fatalf("Result should have been %v, but it was %v", 0, issued)
+	}
+	mfaToken := errResp.MFAToken
+
+	err = apiClient.AuthenticateMFA(mfaToken, "000000")
+	if errResp, ok := err.(*sentinel.ErrorResponse); !ok || errResp.Desc != ErrInvalidMFACode.Desc {
+		t.Fatalf("Result should have been %v, but it was %v", ErrInvalidMFACode, err)
+	}
+
+	code, _ := totp.Code(secret, totp.Step(time.Now()))
+	if err := apiClient.AuthenticateMFA(mfaToken, code); err != nil {
+		t.Fatal(err)
+	}
+	if issued != 1 {
+		t.Errorf("Result should have been %v, but it was %v", 1, issued)
+	}
+
+	// The challenge token and the code can only be used once
+	if err := apiClient.AuthenticateMFA(mfaToken, code); err == nil {
+		t.Error("Result should have been an error, but it was nil")
+	}
+	err = apiClient.Authenticate("jess@example.com", "princess123")
+	errResp, _ = err.(*sentinel.ErrorResponse)
+	if errResp == nil {
+		t.Fatalf("Result should have been %v, but it was %v", ErrMFARequired.Name, err)
+	}
+	err = apiClient.AuthenticateMFA(errResp.MFAToken, code)
+	if errResp, ok := err.(*sentinel.ErrorResponse); !ok || errResp.Desc != ErrInvalidMFACode.Desc {
+		t.Errorf("Result should have been %v, but it was %v", ErrInvalidMFACode, err)
+	}
+}
@@ -0,0 +1,443 @@
+// Copyright 2015 Lars Wiegman. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"html/template"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"sentinel"
+	"sentinel/router"
+	"sentinel/tokens"
+	"sentinel/validate"
+
+	"code.google.com/p/go-uuid/uuid"
+)
+
+// authorizePollInterval is the interval at which the waiting page of the
+// authorization endpoint checks whether the user resolved the login request.
+const authorizePollInterval = time.Second * 2
+
+// authorizePendingTemplate is the waiting page of the authorization endpoint,
+// it reloads the continue URL until the login request is resolved.
+var authorizePendingTemplate = template.Must(template.New("authorize").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta http-equiv="refresh" content="{{.Interval}};url={{.URL}}">
+<title>Approve the login request</title>
+</head>
+<body>
+<p>Approve the login request on your phone to continue.</p>
+<p><a href="{{.URL}}">Continue</a></p>
+</body>
+</html>
+`))
+
+// errAuthorizeDenied is the description of every access_denied error of the
+// authorization endpoint, it doesn't tell whether the user exists.
+const errAuthorizeDenied = "login request was not approved"
+
+// ruleCodeVerifier matches a PKCE code verifier, see RFC 7636 section 4.1.
+var ruleCodeVerifier = regexp.MustCompile(`^[A-Za-z0-9\-._~]{43,128}$`)
+
+// issuer returns the OpenID Connect issuer identifier, the base URL of the
+// API. It's the iss claim of the ID tokens.
+func issuer() string {
+	if baseURL == nil {
+		return tokens.IDTokenOptions.Issuer
+	}
+	return strings.TrimSuffix(baseURL.String(), "/")
+}
+
+// endpointURL returns the absolute URL of the named route.
+func endpointURL(name string) string {
+	u, err := apiRouter.Get(name).URL()
+	if err != nil {
+		return ""
+	}
+	if baseURL == nil {
+		return issuer() + u.Path
+	}
+	return u.String()
+}
+
+// serveOpenIDConfiguration writes the OpenID Connect discovery document.
+func serveOpenIDConfiguration(w http.ResponseWriter, r *http.Request) error {
+	data := map[string]interface{}{
+		"issuer":                                issuer(),
+		"authorization_endpoint":                endpointURL(router.Authorize),
+		"token_endpoint":                        endpointURL(router.CreateToken),
+		"userinfo_endpoint":                     endpointURL(router.UserInfo),
+		"jwks_uri":                              endpointURL(router.JWKS),
+		"revocation_endpoint":                   endpointURL(router.RevokeToken),
+		"response_types_supported":              []string{"code"},
+		"grant_types_supported":                 []string{"authorization_code", "refresh_token"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+		"scopes_supported":                      []string{"openid", "profile", "email"},
+		"claims_supported":                      []string{"sub", "iss", "aud", "exp", "iat", "auth_time", "nonce", "name", "email", "email_verified"},
+		"token_endpoint_auth_methods_supported": []string{"client_secret_basic", "private_key_jwt"},
+		"code_challenge_methods_supported":      []string{"S256"},
+	}
+	w.Header().Set("Cache-Control", "public, max-age=3600")
+	return writeJSON(w, http.StatusOK, data)
+}
+
+// serveAuthorize is the authorization endpoint of the authorization code
+// flow. The consent step is the approval of a login request on the user's
+// phone: the user is identified by the email address in login_hint and the
+// user agent gets a waiting page, which reloads the continue step until the
+// login request is resolved, see serveAuthorizeContinue. Only the S256 PKCE
+// method is supported and a code challenge is required.
+//
+// The user agent isn't authenticated, so the login request always needs an
+// explicit approval, at least at the Fast auth level, and the service learns
+// nothing but access_denied when no code is issued. Unknown users get the
+// waiting page as well until the login request would have timed out.
+func serveAuthorize(w http.ResponseWriter, r *http.Request) error {
+	if err := r.ParseForm(); err != nil {
+		return err
+	}
+
+	// Errors in the client or redirect URI are reported to the user agent,
+	// the others to the service
+	service, err := clientService(r.Form.Get("client_id"))
+	if err != nil {
+		return err
+	}
+	redirectURI := r.Form.Get("redirect_uri")
+	if err := checkRedirectURI(service, redirectURI); err != nil {
+		return err
+	}
+	state := r.Form.Get("state")
+	fail := func(code, desc string) error {
+		return redirectAuthorize(w, r, redirectURI, state, url.Values{"error": {code}, "error_description": {desc}})
+	}
+
+	if r.Form.Get("response_type") != "code" {
+		return fail("unsupported_response_type", "response_type should be code")
+	}
+	scope := r.Form.Get("scope")
+	if !hasScope(scope, "openid") {
+		return fail("invalid_scope", "scope should include openid")
+	}
+	challenge := r.Form.Get("code_challenge")
+	if r.Form.Get("code_challenge_method") != "S256" || !ruleCodeVerifier.MatchString(challenge) {
+		return fail("invalid_request", "code_challenge with code_challenge_method S256 is required")
+	}
+	email := r.Form.Get("login_hint")
+	if err := validate.Email(email); err != nil {
+		return fail("login_required", "login_hint should be the email address of the user")
+	}
+
+	// The parameters are needed once the login request is resolved
+	claims := tokens.Claims{
+		"client_id":      service.ClientID,
+		"redirect_uri":   redirectURI,
+		"scope":          scope,
+		"state":          state,
+		"nonce":          r.Form.Get("nonce"),
+		"code_challenge": challenge,
+		"expires_at":     time.Now().Add(sentinel.LoginTimeout).Unix(),
+	}
+
+	secret1, err := randomSecret()
+	if err != nil {
+		return err
+	}
+	session, err := beginLogin(service, email, secret1, true)
+	if err != nil {
+		// Unknown users wait as long as users who don't answer
+		if e, ok := err.(Error); !ok || e.StatusCode >= 500 {
+			return err
+		}
+	} else {
+		claims["session_id"] = session.UID.String()
+	}
+
+	request, err := keyring.Sign(claims, &tokens.AuthorizeRequestOptions)
+	if err != nil {
+		return err
+	}
+	return writeAuthorizePending(w, request)
+}
+
+// serveAuthorizeContinue continues the authorization request in the request
+// parameter, issued by serveAuthorize. It writes the waiting page again while
+// the login request is pending and redirects to the service with either an
+// authorization code or an error once it's resolved. The outcome is
+// redirected only once.
+func serveAuthorizeContinue(w http.ResponseWriter, r *http.Request) error {
+	request := r.URL.Query().Get("request")
+	token, err := keyring.VerifyToken(request, &tokens.AuthorizeRequestOptions)
+	if err != nil {
+		return ErrInvalidRequest.Append("request parameter should be an authorization request")
+	}
+	claim := func(k string) string {
+		s, _ := token.Claims[k].(string)
+		return s
+	}
+
+	service, err := clientService(claim("client_id"))
+	if err != nil {
+		return err
+	}
+
+	var session *sentinel.LoginSession
+	pending := false
+	if sessionID := claim("session_id"); sessionID != "" {
+		session, err = store.Sessions.Get(uuid.Parse(sessionID))
+		if err != nil {
+			return err
+		}
+		pending = session.Status == sentinel.LoginPending && time.Now().Before(session.ExpiresAt)
+	} else {
+		expiresAt, _ := token.Claims["expires_at"].(float64)
+		pending = time.Now().Unix() < int64(expiresAt)
+	}
+	if pending {
+		return writeAuthorizePending(w, request)
+	}
+
+	unused, err := store.Revocations.Use(token.ID, service.UID, token.Expires)
+	if err != nil {
+		return err
+	}
+	if !unused {
+		return ErrInvalidRequest.Append("authorization request was completed")
+	}
+
+	redirectURI, state := claim("redirect_uri"), claim("state")
+	if session == nil || session.Status != sentinel.LoginAccepted {
+		return redirectAuthorize(w, r, redirectURI, state, url.Values{"error": {"access_denied"}, "error_description": {errAuthorizeDenied}})
+	}
+
+	code := &sentinel.AuthorizationCode{
+		ServiceID:     service.ID,
+		UserID:        session.UserID,
+		SessionID:     session.ID,
+		RedirectURI:   redirectURI,
+		Scope:         claim("scope"),
+		Nonce:         claim("nonce"),
+		CodeChallenge: claim("code_challenge"),
+		AuthTime:      session.UpdatedAt,
+	}
+	if err := store.AuthCodes.Create(code); err != nil {
+		return err
+	}
+	return redirectAuthorize(w, r, redirectURI, state, url.Values{"code": {code.Code}})
+}
+
+// writeAuthorizePending writes the waiting page for the authorization request.
+func writeAuthorizePending(w http.ResponseWriter, request string) error {
+	data := struct {
+		Interval int
+		URL      string
+	}{
+		Interval: int(authorizePollInterval / time.Second),
+		URL:      endpointURL(router.AuthorizeContinue) + "?" + url.Values{"request": {request}}.Encode(),
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	return authorizePendingTemplate.Execute(w, data)
+}
+
+// redirectAuthorize redirects the user agent to the redirect URI of the
+// service with the values and the state of the authorization request.
+func redirectAuthorize(w http.ResponseWriter, r *http.Request, redirectURI, state string, v url.Values) error {
+	if state != "" {
+		v.Set("state", state)
+	}
+	http.Redirect(w, r, appendQuery(redirectURI, v), http.StatusFound)
+	return nil
+}
+
+// serveAuthorizationCodeGrant exchanges an authorization code for an access
+// token, an ID token and a refresh token. The service authenticates with its
+// client credentials and proves possession of the PKCE code verifier.
+func serveAuthorizationCodeGrant(w http.ResponseWriter, r *http.Request) error {
+	service, err := AuthorizedService(r)
+	if err != nil {
+		return err
+	}
+	if clientID := r.PostForm.Get("client_id"); clientID != "" && clientID != service.ClientID {
+		return ErrUnauthorizedClient
+	}
+
+	code, err := store.AuthCodes.Redeem(r.PostForm.Get("code"))
+	if err != nil {
+		if err == sentinel.ErrAuthorizationCodeInvalid {
+			return ErrInvalidAuthorizationCode
+		}
+		return err
+	}
+	if code.ServiceID != service.ID {
+		return ErrInvalidAuthorizationCode
+	}
+	if code.RedirectURI != r.PostForm.Get("redirect_uri") {
+		return ErrInvalidAuthorizationCode.Append("redirect_uri does not match")
+	}
+	if codeChallenge(r.PostForm.Get("code_verifier")) != code.CodeChallenge {
+		return ErrInvalidAuthorizationCode.Append("code_verifier does not match code_challenge")
+	}
+
+	user, err := store.Users.GetUserDetails(code.UserUID)
+	if err != nil {
+		return err
+	}
+	rt, err := store.RefreshTokens.Issue(code.UserID, service.ClientID, code.Scope)
+	if err != nil {
+		return err
+	}
+	recordEvent(r, user.UID, sentinel.EventTokenIssued, "grant_type=authorization_code client_id="+service.ClientID)
+
+	idOpt := tokens.IDTokenOptions
+	idOpt.Issuer = issuer()
+	idOpt.Audience = service.ClientID
+	claims := userClaims(user, code.Scope)
+	claims["auth_time"] = code.AuthTime.Unix()
+	if code.Nonce != "" {
+		claims["nonce"] = code.Nonce
+	}
+	idToken, err := keyring.Sign(claims, &idOpt)
+	if err != nil {
+		return err
+	}
+	return writeOIDCTokens(w, user.UID, service.ClientID, rt, idToken)
+}
+
+// writeOIDCTokens signs an access token for the userinfo endpoint with the
+// scope of the refresh token and writes it along with the refresh token and
+// the ID token, if any. The access token isn't accepted by other endpoints.
+func writeOIDCTokens(w http.ResponseWriter, userID uuid.UUID, clientID string, rt *sentinel.RefreshToken, idToken string) error {
+	opt := tokens.OIDCAccessTokenOptions
+	opt.Audience = clientID
+	accessToken, err := keyring.Sign(tokens.Claims{
+		"user_id": userID.String(),
+		"scope":   rt.Scope,
+	}, &opt)
+	if err != nil {
+		return err
+	}
+
+	w.Header().Add("Cache-Control", "no-store")
+	w.Header().Add("Pragma", "no-cache")
+	data := map[string]interface{}{
+		"access_token":  accessToken,
+		"token_type":    "Bearer",
+		"expires_in":    (opt.TTL / time.Second).Nanoseconds(),
+		"refresh_token": rt.Token,
+		"scope":         rt.Scope,
+	}
+	if idToken != "" {
+		data["id_token"] = idToken
+	}
+	return writeJSON(w, http.StatusOK, data)
+}
+
+// serveUserInfo writes the claims about the user authenticated by the access
+// token, limited to the scope the token was issued for.
+func serveUserInfo(w http.ResponseWriter, r *http.Request) error {
+	user, token, err := authorizedToken(r, &tokens.OIDCAccessTokenOptions)
+	if err != nil {
+		return err
+	}
+
+	scope, _ := token.Claims["scope"].(string)
+	return writeJSON(w, http.StatusOK, userClaims(user, scope))
+}
+
+// userClaims returns the OpenID Connect claims about the user for the scope.
+func userClaims(user *sentinel.User, scope string) tokens.Claims {
+	claims := tokens.Claims{
+		"sub": user.UID.String(),
+	}
+	if hasScope(scope, "profile") {
+		claims["name"] = user.Name
+	}
+	if hasScope(scope, "email") && len(user.AuthEmailList) > 0 {
+		// Prefer the primary email address, then any verified email address
+		email := user.PrimaryEmail()
+		if email == nil {
+			email = user.AuthEmailList[0]
+			for _, e := range user.AuthEmailList {
+				if e.IsVerified {
+					email = e
+					break
+				}
+			}
+		}
+		claims["email"] = email.Email
+		claims["email_verified"] = email.IsVerified
+	}
+	return claims
+}
+
+// checkRedirectURI checks whether the redirect URI is one of the redirect
+// URIs registered for the service, compared as strings.
+func checkRedirectURI(service *sentinel.Service, s string) error {
+	u, err := url.Parse(s)
+	if err != nil || !u.IsAbs() || u.Fragment != "" {
+		return ErrInvalidRequest.Append("redirect_uri parameter should be an absolute URL without fragment")
+	}
+	for _, uri := range service.RedirectURIs {
+		if s == uri {
+			return nil
+		}
+	}
+	return ErrInvalidRequest.Append("redirect_uri parameter should be a registered redirect URI of the service")
+}
+
+// hasScope reports whether the space delimited scope includes s.
+func hasScope(scope, s string) bool {
+	for _, v := range strings.Fields(scope) {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// codeChallenge returns the S256 code challenge of the PKCE code verifier.
+func codeChallenge(verifier string) string {
+	if !ruleCodeVerifier.MatchString(verifier) {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// appendQuery adds the values to the query of the URL.
+func appendQuery(s string, v url.Values) string {
+	u, err := url.Parse(s)
+	if err != nil {
+		return s
+	}
+	q := u.Query()
+	for k, vs := range v {
+		q[k] = vs
+	}
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+// randomSecret returns the secret1 of login sessions started by the
+// authorization endpoint.
+func randomSecret() (string, error) {
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,462 @@
+// Copyright 2015 Lars Wiegman. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"encoding/json"
+	"html"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"sentinel"
+	"sentinel/router"
+	"sentinel/tokens"
+
+	"code.google.com/p/go-uuid/uuid"
+)
+
+// noRedirectClient returns the redirect responses instead of following them.
+var noRedirectClient = http.Client{
+	Transport: httpClient.Transport,
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+// continueURL returns the URL reloaded by the waiting page of the
+// authorization endpoint.
+func continueURL(t *testing.T, resp *http.Response) string {
+	b, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	m := regexp.MustCompile(`<a href="([^"]+)">`).FindSubmatch(b)
+	if resp.StatusCode != http.StatusOK || m == nil {
+		t.Fatalf("Result should have been the waiting page, but it was %v %s", resp.StatusCode, b)
+	}
+	return html.UnescapeString(string(m[1]))
+}
+
+func TestServeOpenIDConfiguration(t *testing.T) {
+	setup()
+
+	u, _ := apiRouter.Get(router.OpenIDConfiguration).URL()
+	req, _ := apiClient.NewRequest("GET", u.Path, nil)
+	var data map[string]interface{}
+	if _, err := apiClient.Do(req, &data); err != nil {
+		t.Fatal(err)
+	}
+	if data["issuer"] != tokens.IDTokenOptions.Issuer {
+		t.Errorf("Result should have been %v, but it was %v", tokens.IDTokenOptions.Issuer, data["issuer"])
+	}
+	if expect := "https://sentinel.sh/.well-known/jwks.json"; data["jwks_uri"] != expect {
+		t.Errorf("Result should have been %v, but it was %v", expect, data["jwks_uri"])
+	}
+	expect := []interface{}{"client_secret_basic", "private_key_jwt"}
+	if result := data["token_endpoint_auth_methods_supported"]; !reflect.DeepEqual(expect, result) {
+		t.Errorf("Result should have been %v, but it was %v", expect, result)
+	}
+}
+
+func TestAuthorizationCodeFlow(t *testing.T) {
+	setup()
+	mockRevocations()
+
+	user := &sentinel.User{
+		ID:   1,
+		UID:  uuid.NewRandom(),
+		Name: "Anna",
+		AuthEmailList: []*sentinel.AuthEmail{
+			&sentinel.AuthEmail{Email: "anna@example.com", IsVerified: true},
+		},
+	}
+	service := &sentinel.Service{
+		ID:           2,
+		UID:          uuid.NewRandom(),
+		BaseURL:      "https://app.example.com/status",
+		AuthLevel:    sentinel.AuthLevelFast,
+		RedirectURIs: sentinel.RedirectURIs{"https://app.example.com/callback"},
+	}
+	authorizeService(t, service)
+	mockRefreshTokens(user)
+
+	store.Users.(*sentinel.MockUsersService).ListFn = func(opt sentinel.UserListOptions) ([]*sentinel.User, error) {
+		return []*sentinel.User{user}, nil
+	}
+	store.Users.(*sentinel.MockUsersService).GetUserDetailsFn = func(uid uuid.UUID) (*sentinel.User, error) {
+		return user, nil
+	}
+	session := &sentinel.LoginSession{
+		ID:        3,
+		UID:       uuid.NewRandom(),
+		UserID:    user.ID,
+		AuthLevel: sentinel.AuthLevelFast,
+		Status:    sentinel.LoginPending,
+		ExpiresAt: time.Now().Add(sentinel.LoginTimeout),
+		Service:   service,
+	}
+	store.Sessions.(*sentinel.MockSessionsService).CreateFn = func(serviceID, userID, authLevel int, email, secret1 string, isOIDC bool) (*sentinel.LoginSession, error) {
+		if !isOIDC {
+			t.Error("Result should have been an OpenID Connect session, but it wasn't")
+		}
+		s := *session
+		s.IsOIDC = isOIDC
+		return &s, nil
+	}
+	approved := false
+	store.Sessions.(*sentinel.MockSessionsService).GetFn = func(uid uuid.UUID) (*sentinel.LoginSession, error) {
+		s := *session
+		if approved {
+			s.Status = sentinel.LoginAccepted
+			s.UpdatedAt = time.Now()
+		}
+		return &s, nil
+	}
+
+	codes := make(map[string]*sentinel.AuthorizationCode)
+	m := store.AuthCodes.(*sentinel.MockAuthorizationCodesService)
+	m.CreateFn = func(c *sentinel.AuthorizationCode) error {
+		c.Code = "code-" + c.CodeChallenge
+		codes[c.Code] = c
+		return nil
+	}
+	m.RedeemFn = func(code string) (*sentinel.AuthorizationCode, error) {
+		c, ok := codes[code]
+		if !ok {
+			return nil, sentinel.ErrAuthorizationCodeInvalid
+		}
+		delete(codes, code)
+		c.UserUID = user.UID
+		return c, nil
+	}
+
+	verifier := strings.Repeat("v", 43)
+	redirectURI := "https://app.example.com/callback"
+
+	u, _ := apiRouter.Get(router.Authorize).URL()
+	q := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {service.ClientID},
+		"redirect_uri":          {redirectURI},
+		"scope":                 {"openid email"},
+		"state":                 {"xyz"},
+		"nonce":                 {"n-0S6_WzA2Mj"},
+		"code_challenge":        {codeChallenge(verifier)},
+		"code_challenge_method": {"S256"},
+		"login_hint":            {"anna@example.com"},
+	}
+	resp, err := noRedirectClient.Get("http://sentinel.sh" + u.Path + "?" + q.Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	next := continueURL(t, resp)
+
+	// The waiting page is written again while the login request is pending
+	resp, err = noRedirectClient.Get(next)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u := continueURL(t, resp); u != next {
+		t.Errorf("Result should have been %v, but it was %v", next, u)
+	}
+
+	// The user approves the login request on the phone
+	approved = true
+	resp, err = noRedirectClient.Get(next)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusFound {
+		t.Fatalf("Result should have been %v, but it was %v", http.StatusFound, resp.StatusCode)
+	}
+	location, _ := url.Parse(resp.Header.Get("Location"))
+	if location.Query().Get("state") != "xyz" {
+		t.Errorf("Result should have been %v, but it was %v", "xyz", location.Query().Get("state"))
+	}
+	code := location.Query().Get("code")
+
+	// The outcome is redirected once
+	resp, err = noRedirectClient.Get(next)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != ErrInvalidRequest.StatusCode {
+		t.Errorf("Result should have been %v, but it was %v", ErrInvalidRequest.StatusCode, resp.StatusCode)
+	}
+
+	exchange := func(verifier string) (map[string]interface{}, *sentinel.ErrorResponse) {
+		u, _ := apiRouter.Get(router.CreateToken).URL()
+		form := url.Values{
+			"grant_type":    {"authorization_code"},
+			"code":          {code},
+			"redirect_uri":  {redirectURI},
+			"code_verifier": {verifier},
+		}
+		req, _ := http.NewRequest("POST", "http://sentinel.sh"+u.Path, strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		apiClient.AuthorizeClient(req)
+		resp, err := httpClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if err := sentinel.CheckResponse(resp); err != nil {
+			return nil, err.(*sentinel.ErrorResponse)
+		}
+		data := make(map[string]interface{})
+		json.NewDecoder(resp.Body).Decode(&data)
+		return data, nil
+	}
+
+	data, errResp := exchange(verifier)
+	if errResp != nil {
+		t.Fatal(errResp)
+	}
+
+	opt := tokens.IDTokenOptions
+	opt.Audience = service.ClientID
+	idToken, err := keyring.VerifyToken(data["id_token"].(string), &opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if idToken.Subject != user.UID.String() {
+		t.Errorf("Result should have been %v, but it was %v", user.UID, idToken.Subject)
+	}
+	claims := idToken.Claims
+	expect := tokens.Claims{
+		"nonce":          "n-0S6_WzA2Mj",
+		"email":          "anna@example.com",
+		"email_verified": true,
+	}
+	for k, v := range expect {
+		if claims[k] != v {
+			t.Errorf("Result should have been %v, but it was %v", v, claims[k])
+		}
+	}
+
+	// The access token grants access to the userinfo endpoint
+	u, _ = apiRouter.Get(router.UserInfo).URL()
+	req, _ := http.NewRequest("GET", "http://sentinel.sh"+u.Path, nil)
+	req.Header.Set("Authorization", "Bearer "+data["access_token"].(string))
+	var info map[string]interface{}
+	if _, err := apiClient.Do(req, &info); err != nil {
+		t.Fatal(err)
+	}
+	if info["sub"] != user.UID.String() || info["email"] != "anna@example.com" {
+		t.Errorf("Result should have been %v, but it was %v", expect, info)
+	}
+	if _, ok := info["name"]; ok {
+		t.Errorf("name claim shouldn't be included without the profile scope, but it was %v", info["name"])
+	}
+
+	// The access token isn't accepted by the other endpoints
+	u, _ = apiRouter.Get(router.GetUserDetails).URL()
+	req, _ = http.NewRequest("GET", "http://sentinel.sh"+u.Path, nil)
+	req.Header.Set("Authorization", "Bearer "+data["access_token"].(string))
+	if _, err := apiClient.Do(req, nil); err == nil || err.(*sentinel.ErrorResponse).Name != ErrInvalidAuthenticationToken.Name {
+		t.Errorf("Result should have been %v, but it was %v", ErrInvalidAuthenticationToken.Name, err)
+	}
+
+	// The refresh token can only be used by the service
+	u, _ = apiRouter.Get(router.CreateToken).URL()
+	form := url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {data["refresh_token"].(string)},
+	}
+	req, _ = http.NewRequest("POST", "http://sentinel.sh"+u.Path, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if _, err := apiClient.Do(req, nil); err == nil || err.(*sentinel.ErrorResponse).Name != ErrNoAuthentionMethodIncluded.Name {
+		t.Errorf("Result should have been %v, but it was %v", ErrNoAuthentionMethodIncluded.Name, err)
+	}
+
+	// Refreshing keeps the scope of the access token
+	req, _ = http.NewRequest("POST", "http://sentinel.sh"+u.Path, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	apiClient.AuthorizeClient(req)
+	var refreshed map[string]interface{}
+	if _, err := apiClient.Do(req, &refreshed); err != nil {
+		t.Fatal(err)
+	}
+	if refreshed["scope"] != "openid email" {
+		t.Errorf("Result should have been %v, but it was %v", "openid email", refreshed["scope"])
+	}
+	u, _ = apiRouter.Get(router.UserInfo).URL()
+	req, _ = http.NewRequest("GET", "http://sentinel.sh"+u.Path, nil)
+	req.Header.Set("Authorization", "Bearer "+refreshed["access_token"].(string))
+	info = nil
+	if _, err := apiClient.Do(req, &info); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := info["name"]; ok || info["email"] != "anna@example.com" {
+		t.Errorf("Result should have been %v, but it was %v", expect, info)
+	}
+
+	// A code can only be exchanged once
+	if _, errResp := exchange(verifier); errResp == nil || errResp.Name != ErrInvalidAuthorizationCode.Name {
+		t.Errorf("Result should have been %v, but it was %v", ErrInvalidAuthorizationCode.Name, errResp)
+	}
+}
+
+func TestAuthorizeErrors(t *testing.T) {
+	setup()
+
+	service := &sentinel.Service{
+		ID:           2,
+		UID:          uuid.NewRandom(),
+		BaseURL:      "https://app.example.com/app",
+		RedirectURIs: sentinel.RedirectURIs{"https://app.example.com/app/cb"},
+	}
+	authorizeService(t, service)
+
+	authorize := func(redirectURI, challenge string) *http.Response {
+		u, _ := apiRouter.Get(router.Authorize).URL()
+		q := url.Values{
+			"response_type":         {"code"},
+			"client_id":             {service.ClientID},
+			"redirect_uri":          {redirectURI},
+			"scope":                 {"openid"},
+			"code_challenge":        {challenge},
+			"code_challenge_method": {"S256"},
+			"login_hint":            {"anna@example.com"},
+		}
+		resp, err := noRedirectClient.Get("http://sentinel.sh" + u.Path + "?" + q.Encode())
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	// Redirect URIs which aren't registered aren't redirected to
+	for _, s := range []string{"https://evil.example.com/app/cb", "https://app.example.com/app", "https://app.example.com/app/cb/other", "/app/cb"} {
+		if resp := authorize(s, codeChallenge(strings.Repeat("v", 43))); resp.StatusCode != ErrInvalidRequest.StatusCode {
+			t.Errorf("Result should have been %v for %s, but it was %v", ErrInvalidRequest.StatusCode, s, resp.StatusCode)
+		}
+	}
+
+	// PKCE is required
+	resp := authorize("https://app.example.com/app/cb", "")
+	location, _ := url.Parse(resp.Header.Get("Location"))
+	if resp.StatusCode != http.StatusFound || location.Query().Get("error") != "invalid_request" {
+		t.Errorf("Result should have been a redirect with error %v, but it was %v %v", "invalid_request", resp.StatusCode, location)
+	}
+}
+
+func TestAuthorizeRequiresApproval(t *testing.T) {
+	setup()
+
+	user := &sentinel.User{ID: 1, UID: uuid.NewRandom(), DefaultAuthLevel: sentinel.AuthLevelNotify}
+	service := &sentinel.Service{
+		ID:           2,
+		UID:          uuid.NewRandom(),
+		BaseURL:      "https://app.example.com/app",
+		AuthLevel:    sentinel.AuthLevelNotify,
+		RedirectURIs: sentinel.RedirectURIs{"https://app.example.com/app/cb"},
+	}
+	authorizeService(t, service)
+
+	var users []*sentinel.User
+	store.Users.(*sentinel.MockUsersService).ListFn = func(opt sentinel.UserListOptions) ([]*sentinel.User, error) {
+		return users, nil
+	}
+	var authLevel int
+	store.Sessions.(*sentinel.MockSessionsService).CreateFn = func(serviceID, userID, level int, email, secret1 string, isOIDC bool) (*sentinel.LoginSession, error) {
+		authLevel = level
+		return &sentinel.LoginSession{
+			UID:       uuid.NewRandom(),
+			UserID:    userID,
+			AuthLevel: level,
+			Status:    sentinel.LoginPending,
+			ExpiresAt: time.Now().Add(sentinel.LoginTimeout),
+		}, nil
+	}
+	store.Sessions.(*sentinel.MockSessionsService).TransitionFn = func(uid uuid.UUID, status sentinel.LoginStatus, secret2, enc1 string) (*sentinel.LoginSession, error) {
+		t.Error("login request was accepted without approval")
+		return nil, nil
+	}
+	// The user declines the login request on the phone
+	store.Sessions.(*sentinel.MockSessionsService).GetFn = func(uid uuid.UUID) (*sentinel.LoginSession, error) {
+		return &sentinel.LoginSession{UID: uid, UserID: user.ID, Status: sentinel.LoginDeclined}, nil
+	}
+
+	authorize := func() string {
+		u, _ := apiRouter.Get(router.Authorize).URL()
+		q := url.Values{
+			"response_type":         {"code"},
+			"client_id":             {service.ClientID},
+			"redirect_uri":          {"https://app.example.com/app/cb"},
+			"scope":                 {"openid"},
+			"code_challenge":        {codeChallenge(strings.Repeat("v", 43))},
+			"code_challenge_method": {"S256"},
+			"login_hint":            {"anna@example.com"},
+		}
+		resp, err := noRedirectClient.Get("http://sentinel.sh" + u.Path + "?" + q.Encode())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return continueURL(t, resp)
+	}
+	resolve := func(next string) (int, url.Values) {
+		resp, err := noRedirectClient.Get(next)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		location, _ := url.Parse(resp.Header.Get("Location"))
+		return resp.StatusCode, location.Query()
+	}
+
+	// Declining users get access_denied
+	users = []*sentinel.User{user}
+	if _, q := resolve(authorize()); q.Get("error") != "access_denied" || q.Get("error_description") != errAuthorizeDenied {
+		t.Errorf("Result should have been %v, but it was %v", errAuthorizeDenied, q)
+	}
+	if authLevel != sentinel.AuthLevelFast {
+		t.Errorf("Result should have been %v, but it was %v", sentinel.AuthLevelFast, authLevel)
+	}
+
+	// Unknown users wait like pending login requests, until they would
+	// have timed out
+	users = nil
+	next := authorize()
+	resp, err := noRedirectClient.Get(next)
+	if err != nil {
+		t.Fatal(err)
+	}
+	continueURL(t, resp)
+
+	request, err := keyring.Sign(tokens.Claims{
+		"client_id":    service.ClientID,
+		"redirect_uri": "https://app.example.com/app/cb",
+		"expires_at":   time.Now().Add(-time.Second).Unix(),
+	}, &tokens.AuthorizeRequestOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	next = endpointURL(router.AuthorizeContinue) + "?" + url.Values{"request": {request}}.Encode()
+	if status, q := resolve(next); status != http.StatusFound || q.Get("error") != "access_denied" || q.Get("error_description") != errAuthorizeDenied {
+		t.Errorf("Result should have been %v, but it was %v %v", errAuthorizeDenied, status, q)
+	}
+}
+
+func TestNotifyServiceOIDC(t *testing.T) {
+	setup()
+
+	store.Callbacks.(*sentinel.MockCallbacksService).EnqueueFn = func(c *sentinel.Callback, lease time.Duration) error {
+		t.Error("Result should have been no callback, but it was enqueued")
+		return nil
+	}
+	session := &sentinel.LoginSession{UID: uuid.NewRandom(), Status: sentinel.LoginDeclined, IsOIDC: true, Service: testServices[0]}
+	notifyService(session, map[string]string{
+		"status":    string(session.Status),
+		"sessionID": session.UID.String(),
+	})
+}
@@ -0,0 +1,162 @@
+// Copyright 2015 Lars Wiegman. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"database/sql"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+
+	"sentinel"
+	"sentinel/tokens"
+	"sentinel/validate"
+
+	"code.google.com/p/go-uuid/uuid"
+)
+
+// serveForgotPassword sends a link to set a new password to the primary email
+// address of the account with the given email address. The response is the
+// same whether or not the address is eligible, so it doesn't reveal which
+// addresses are registered.
+func serveForgotPassword(w http.ResponseWriter, r *http.Request) error {
+	expectMediatype := "application/x-www-form-urlencoded"
+	if mt, _, err := mime.ParseMediaType(r.Header.Get("Content-Type")); err != nil || mt != expectMediatype {
+		return ErrUnsupportedMediatype.Append("expected " + expectMediatype)
+	}
+
+	if err := r.ParseForm(); err != nil {
+		return err
+	}
+
+	// Get form input: email
+	email := strings.TrimSpace(r.PostForm.Get("email"))
+
+	// Validate form input
+	if err := validate.Email(email); err != nil {
+		return ErrInvalidEmail
+	}
+
+	users, err := store.Users.List(sentinel.UserListOptions{Email: []string{email}})
+	if err != nil {
+		return err
+	}
+	// The link is sent to the primary email, which is always verified, not
+	// to the email of the request
+	var user *sentinel.User
+	var primary *sentinel.AuthEmail
+	if len(users) == 1 {
+		user = users[0]
+		primary = user.PrimaryEmail()
+	}
+
+	if primary != nil {
+		err := store.Outbox.Enqueue(&sentinel.OutboxMessage{
+			Kind:      sentinel.MailResetPassword,
+			Recipient: primary.Email,
+			UserUID:   user.UID,
+			EmailUID:  primary.UID,
+			Locale:    requestLocale(r),
+		})
+		if err != nil {
+			return err
+		}
+		wakeMailer()
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// serveResetPassword sets a new password using the token of a password reset
+// link. The token can be used once. After the reset all tokens issued to the
+// user, including the refresh tokens, are revoked.
+func serveResetPassword(w http.ResponseWriter, r *http.Request) error {
+	expectMediatype := "application/x-www-form-urlencoded"
+	if mt, _, err := mime.ParseMediaType(r.Header.Get("Content-Type")); err != nil || mt != expectMediatype {
+		return ErrUnsupportedMediatype.Append("expected " + expectMediatype)
+	}
+
+	if err := r.ParseForm(); err != nil {
+		return err
+	}
+
+	// Get form input: token, password
+	tokenStr := r.PostForm.Get("token")
+	password := r.PostForm.Get("password")
+
+	// Validate form input
+	if err := validate.Password(password); err != nil {
+		return ErrInvalidPassword
+	}
+	token, err := keyring.VerifyToken(tokenStr, &tokens.ResetPasswordOptions)
+	if err != nil {
+		return ErrInvalidToken
+	}
+
+	emailIDStr, _ := token.Claims["email_id"].(string)
+	userIDStr, _ := token.Claims["user_id"].(string)
+
+	// Validate token data
+	if err := validate.UUIDv4(emailIDStr); err != nil {
+		return ErrInvalidToken.Append("value of claim 'email_id' was invalid")
+	}
+	if err := validate.UUIDv4(userIDStr); err != nil {
+		return ErrInvalidToken.Append("value of claim 'user_id' was invalid")
+	}
+
+	// The token can only be used once
+	userID := uuid.Parse(userIDStr)
+	revoked, err := store.Revocations.IsRevoked(token.ID, userID, token.IssuedAt)
+	if err != nil {
+		return err
+	}
+	if revoked {
+		return ErrInvalidToken.Append("token was revoked")
+	}
+
+	// The email must still be a verified email of the user
+	user, err := store.Users.GetUserDetails(userID)
+	if err == sql.ErrNoRows {
+		return ErrInvalidToken.Append("user not found")
+	}
+	if err != nil {
+		return err
+	}
+	email, err := store.Users.GetEmail(uuid.Parse(emailIDStr))
+	if err == sql.ErrNoRows {
+		return ErrInvalidToken.Append("email not found")
+	}
+	if err != nil {
+		return err
+	}
+	if email.UserID != user.ID || !email.IsVerified {
+		return ErrInvalidToken.Append("email isn't a verified email of the user")
+	}
+
+	unused, err := store.Revocations.Use(token.ID, userID, token.Expires)
+	if err != nil {
+		return err
+	}
+	if !unused {
+		return ErrInvalidToken.Append("token was revoked")
+	}
+	if _, err := store.Users.UpdateDetails(userID, sentinel.UserUpdateOptions{Password: password}); err != nil {
+		return err
+	}
+
+	// Log the user out everywhere
+	if err := store.Revocations.RevokeUser(userID, time.Now().Add(revokeUserTTL)); err != nil {
+		return err
+	}
+	if err := store.RefreshTokens.RevokeUser(user.ID); err != nil {
+		return err
+	}
+	recordEvent(r, userID, sentinel.EventPasswordReset, "email="+email.Email)
+
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
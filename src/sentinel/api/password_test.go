@@ -0,0 +1,191 @@
+// Copyright 2015 Lars Wiegman. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+
+	"sentinel"
+	"sentinel/router"
+	"sentinel/tokens"
+
+	"code.google.com/p/go-uuid/uuid"
+)
+
+func TestForgotPassword(t *testing.T) {
+	setup()
+
+	user := &sentinel.User{
+		UID: uuid.NewRandom(),
+		AuthEmailList: []*sentinel.AuthEmail{
+			{UID: uuid.NewRandom(), Email: "jane@example.com", IsVerified: true, IsPrimary: true},
+			{UID: uuid.NewRandom(), Email: "jess@example.com"},
+		},
+	}
+	store.Users.(*sentinel.MockUsersService).ListFn = func(opt sentinel.UserListOptions) ([]*sentinel.User, error) {
+		for _, e := range user.AuthEmailList {
+			if e.Email == opt.Email[0] {
+				return []*sentinel.User{user}, nil
+			}
+		}
+		return nil, nil
+	}
+	var queued []*sentinel.OutboxMessage
+	store.Outbox.(*sentinel.MockOutboxService).EnqueueFn = func(m *sentinel.OutboxMessage) error {
+		queued = append(queued, m)
+		return nil
+	}
+
+	tests := []struct {
+		email  string
+		queued bool
+	}{
+		{"jane@example.com", true},
+		{"jess@example.com", true}, // sent to the primary email
+		{"joe@example.com", false}, // not registered
+	}
+	for _, tt := range tests {
+		queued = nil
+		resp, _ := doRequest(t, "POST", router.ForgotPassword, nil, "", url.Values{"email": {tt.email}}, nil)
+		if resp.StatusCode != http.StatusNoContent {
+			t.Errorf("Result should have been %v, but it was %v", http.StatusNoContent, resp.StatusCode)
+		}
+		if got := len(queued) == 1; got != tt.queued {
+			t.Errorf("Result should have been %v, but it was %v", tt.queued, got)
+			continue
+		}
+		if tt.queued {
+			m := queued[0]
+			if m.Kind != sentinel.MailResetPassword {
+				t.Errorf("Result should have been %v, but it was %v", sentinel.MailResetPassword, m.Kind)
+			}
+			if !uuid.Equal(m.EmailUID, user.AuthEmailList[0].UID) || m.Recipient != "jane@example.com" {
+				t.Errorf("Result should have been %v, but it was %v", user.AuthEmailList[0].UID, m.EmailUID)
+			}
+		}
+	}
+
+	// Users without a primary email don't get a link
+	queued = nil
+	user.AuthEmailList[0].IsPrimary = false
+	doRequest(t, "POST", router.ForgotPassword, nil, "", url.Values{"email": {"jane@example.com"}}, nil)
+	if len(queued) != 0 {
+		t.Errorf("Result should have been no message, but it was %v", queued)
+	}
+
+	resp, name := doRequest(t, "POST", router.ForgotPassword, nil, "", url.Values{"email": {"jane"}}, nil)
+	if resp.StatusCode != http.StatusUnprocessableEntity || name != ErrInvalidEmail.Name {
+		t.Errorf("Result should have been %v, but it was %v", ErrInvalidEmail.Name, name)
+	}
+}
+
+func TestResetPassword(t *testing.T) {
+	setup()
+	mockRevocations()
+
+	email := &sentinel.AuthEmail{UID: uuid.NewRandom(), UserID: 1, Email: "jane@example.com", IsVerified: true}
+	user := &sentinel.User{ID: 1, UID: uuid.NewRandom(), AuthEmailList: []*sentinel.AuthEmail{email}}
+	store.Users.(*sentinel.MockUsersService).ListFn = func(opt sentinel.UserListOptions) ([]*sentinel.User, error) {
+		return []*sentinel.User{user}, nil
+	}
+	mockRefreshTokens(user)
+	store.Users.(*sentinel.MockUsersService).GetUserDetailsFn = func(uid uuid.UUID) (*sentinel.User, error) {
+		return user, nil
+	}
+	store.Users.(*sentinel.MockUsersService).GetEmailFn = func(uid uuid.UUID) (*sentinel.AuthEmail, error) {
+		return email, nil
+	}
+	var password string
+	store.Users.(*sentinel.MockUsersService).UpdateDetailsFn = func(uid uuid.UUID, opt sentinel.UserUpdateOptions) (*sentinel.User, error) {
+		password = opt.Password
+		user.PasswordHash = "plain:" + opt.Password
+		return user, nil
+	}
+	revokedRefresh := 0
+	store.RefreshTokens.(*sentinel.MockRefreshTokensService).RevokeUserFn = func(userID int) error {
+		revokedRefresh = userID
+		return nil
+	}
+
+	// An access token issued before the reset
+	accessToken, err := keyring.Sign(tokens.Claims{"user_id": user.UID.String()}, &tokens.AccessTokenOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sign := func(opt *tokens.Options) string {
+		claims := tokens.Claims{
+			"email_id": email.UID.String(),
+			"user_id":  user.UID.String(),
+		}
+		tokenStr, err := keyring.Sign(claims, opt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tokenStr
+	}
+	resetToken := sign(&tokens.ResetPasswordOptions)
+	nextSecond()
+
+	// Tokens of another kind are rejected
+	form := url.Values{"token": {sign(&tokens.AccessTokenOptions)}, "password": {"s3cr3t pa55"}}
+	if resp, name := doRequest(t, "POST", router.ResetPassword, nil, "", form, nil); resp.StatusCode != 422 || name != ErrInvalidToken.Name {
+		t.Errorf("Result should have been %v, but it was %v", ErrInvalidToken.Name, name)
+	}
+
+	form.Set("token", resetToken)
+	form.Set("password", "short")
+	if _, name := doRequest(t, "POST", router.ResetPassword, nil, "", form, nil); name != ErrInvalidPassword.Name {
+		t.Errorf("Result should have been %v, but it was %v", ErrInvalidPassword.Name, name)
+	}
+
+	form.Set("password", "s3cr3t pa55")
+	if resp, _ := doRequest(t, "POST", router.ResetPassword, nil, "", form, nil); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("Result should have been %v, but it was %v", http.StatusNoContent, resp.StatusCode)
+	}
+	if password != "s3cr3t pa55" {
+		t.Errorf("Result should have been %v, but it was %v", "s3cr3t pa55", password)
+	}
+	if revokedRefresh != user.ID {
+		t.Errorf("Result should have been %v, but it was %v", user.ID, revokedRefresh)
+	}
+
+	// Tokens issued before the reset are revoked
+	token, err := keyring.VerifyToken(accessToken, &tokens.AccessTokenOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	revoked, _ := store.Revocations.IsRevoked(token.ID, user.UID, token.IssuedAt)
+	if !revoked {
+		t.Error("Result should have been a revoked access token, but it wasn't")
+	}
+
+	// Logging in with the new password right after the reset works
+	if err := apiClient.Authenticate("jane@example.com", "s3cr3t pa55"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := apiClient.Users.GetUserDetails(user.UID); err != nil {
+		t.Errorf("Result should have been the user, but it was %v", err)
+	}
+
+	// Reset tokens can only be used once
+	password = ""
+	if _, name := doRequest(t, "POST", router.ResetPassword, nil, "", form, nil); name != ErrInvalidToken.Name {
+		t.Errorf("Result should have been %v, but it was %v", ErrInvalidToken.Name, name)
+	}
+	if password != "" {
+		t.Errorf("Result should have been an unchanged password, but it was %v", password)
+	}
+
+	// The email must still belong to the user and be verified
+	mockRevocations()
+	email.IsVerified = false
+	form.Set("token", sign(&tokens.ResetPasswordOptions))
+	if _, name := doRequest(t, "POST", router.ResetPassword, nil, "", form, nil); name != ErrInvalidToken.Name {
+		t.Errorf("Result should have been %v, but it was %v", ErrInvalidToken.Name, name)
+	}
+}
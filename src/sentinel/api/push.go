@@ -5,59 +5,142 @@
 package api
 
 import (
-	"io/ioutil"
 	"log"
-	"mime"
-	"net/http"
+	"strconv"
 
+	"sentinel"
+	"sentinel/push"
 	"sentinel/push/apn"
-	"sentinel/validate"
+	"sentinel/push/fcm"
 )
 
-func serveSendPush(w http.ResponseWriter, r *http.Request) error {
-	expectMediatype := "application/x-www-form-urlencoded"
-	if mt, _, err := mime.ParseMediaType(r.Header.Get("Content-Type")); err != nil || mt != expectMediatype {
-		return ErrUnsupportedMediatype.Append("expected " + expectMediatype)
+// notifier sends the push notifications, they aren't sent when it's nil.
+var notifier push.Notifier
+
+// deliveries sends the push notifications in the background and retries the
+// temporary failures.
+var deliveries = &push.Queue{}
+
+// setNotifier routes the push notifications of the platform to n.
+func setNotifier(p push.Platform, n push.Notifier) {
+	r, ok := notifier.(push.Router)
+	if !ok {
+		r = push.Router{}
+		notifier = r
 	}
+	r[p] = n
+}
 
-	if err := r.ParseForm(); err != nil {
+// SetAPNs configures the push notifications to Apple devices using the .p8
+// signing key of the team and the bundle ID of the app as topic.
+func SetAPNs(keyPath, keyID, teamID, topic string, production bool) error {
+	key, err := apn.LoadKey(keyPath)
+	if err != nil {
 		return err
 	}
-
-	// Get and validate form input
-	// tokenStr := r.PostForm.Get("token") // used to validate the request
-	serviceUIDStr := r.PostForm.Get("service_id")
-	email := r.PostForm.Get("email")
-	hash1 := r.PostForm.Get("hash1")
-
-	// Validate form input
-	if err := validate.Email(email); err != nil {
-		return ErrInvalidEmail
+	c := apn.NewClient(apn.NewTokenSource(key, keyID, teamID), topic)
+	if production {
+		c.Host = apn.ProductionHost
 	}
-	if err := validate.NotEmpty(hash1); err != nil {
-		e := ErrInvalidRequest.Append(`; hash1 parameter should not be empty`)
-		return e
+	setNotifier(push.PlatformIOS, &push.APNs{Client: c})
+	return nil
+}
+
+// SetFCM configures the push notifications to Android devices using the
+// JSON key file of a service account of the Firebase project.
+func SetFCM(credentialsPath string) error {
+	creds, err := fcm.LoadCredentials(credentialsPath)
+	if err != nil {
+		return err
 	}
-	if err := validate.UUIDv4(serviceUIDStr); err != nil {
-		e := ErrInvalidRequest.Append(`; service_id parameter should be a UUID verion 4`)
-		return e
+	tokens, err := fcm.NewTokenSource(creds)
+	if err != nil {
+		return err
 	}
+	setNotifier(push.PlatformAndroid, &push.FCM{Client: fcm.NewClient(tokens, creds.ProjectID)})
+	return nil
+}
 
-	//TODO: finish implementation
+// notifyDevices sends the message to all active devices of the user when
+// push notifications are configured. The result is recorded per device.
+func notifyDevices(user *sentinel.User, m *push.Message) {
+	if notifier == nil {
+		log.Println("push notifications aren't configured, dropping", m.Kind, "for user", user.UID)
+		return
+	}
 
-	// claims, err := tokens.Verify(tokenStr, publicKey, &tokens.PushNotificationOptions)
-	// if err != nil {
-	// 	return ErrInvalidToken
-	// }
+	devices, err := store.Devices.List(sentinel.DeviceListOptions{UserID: user.ID, ActiveOnly: true})
+	if err != nil {
+		log.Printf("listing devices of user %s failed with error: %s", user.UID, err)
+		return
+	}
+	if len(devices) == 0 {
+		log.Println("no active devices for user", user.UID)
+		return
+	}
+	for _, d := range devices {
+		d := d
+		t := push.Target{Platform: push.Platform(d.Platform), Token: d.PushToken}
+		deliveries.Send(notifier, t, m, func(res push.Result) {
+			recordDelivery(d, res)
+		})
+	}
+}
 
-	b, _ := ioutil.ReadAll(r.Body)
-	log.Println("received sendPush request", r.RequestURI, string(b))
+// recordDelivery stores the result of a push notification with the device.
+// A device whose push token was rejected for good is deactivated, it's
+// activated again when its app registers a new token.
+func recordDelivery(d *sentinel.Device, res push.Result) {
+	var err error
+	if res.Err == nil {
+		err = store.Devices.RecordDelivery(d.UID, res.Target.Token)
+	} else {
+		unregistered := push.Unregistered(res.Err)
+		log.Printf("sending %s to device %s failed after %d attempts with error: %s", res.Message.Kind, d.UID, res.Attempts, res.Err)
+		if unregistered {
+			log.Printf("deactivating device %s, the push service rejected its token", d.UID)
+		}
+		err = store.Devices.RecordFailure(d.UID, res.Target.Token, res.Err.Error(), unregistered)
+	}
+	if err != nil {
+		log.Printf("recording delivery to device %s failed with error: %s", d.UID, err)
+	}
+}
 
-	n := &apn.PushNotification{
-		AlertText: "Hello World!",
-		Token:     "d2a84f4b8b650937ec8f73cd8be2c74add5a911ba64df27458ed8229da804a26",
+// sendLoginRequest sends the login request to the user's devices, see step 3
+// of the qauth flow. The device returns the token in step 6.
+func sendLoginRequest(user *sentinel.User, session *sentinel.LoginSession, token string) {
+	m := &push.Message{
+		Kind:  push.KindLoginRequest,
+		Alert: "Login request for " + session.Service.Name,
+		Data: map[string]string{
+			"service":   session.Service.Name,
+			"serviceID": session.Service.UID.String(),
+			"sessionID": session.UID.String(),
+			"secret1":   session.Secret1,
+			"email":     session.Email,
+			"authLevel": strconv.Itoa(session.AuthLevel),
+			"token":     token,
+		},
+		CollapseKey: session.UID.String(),
+		TTL:         sentinel.LoginTimeout,
 	}
-	_ = n
+	notifyDevices(user, m)
+}
 
-	return nil
+// sendLoginNotice informs the user about a login request which was accepted
+// without approval, for services with the Notify auth level.
+func sendLoginNotice(user *sentinel.User, session *sentinel.LoginSession) {
+	m := &push.Message{
+		Kind:  push.KindLoginNotice,
+		Alert: "Logged in to " + session.Service.Name,
+		Data: map[string]string{
+			"service":   session.Service.Name,
+			"serviceID": session.Service.UID.String(),
+			"sessionID": session.UID.String(),
+			"email":     session.Email,
+			"authLevel": strconv.Itoa(session.AuthLevel),
+		},
+	}
+	notifyDevices(user, m)
 }
@@ -0,0 +1,346 @@
+// Copyright 2015 Lars Wiegman. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"database/sql"
+	"log"
+	"net/http"
+	"time"
+
+	"sentinel"
+	"sentinel/tokens"
+	"sentinel/validate"
+
+	"code.google.com/p/go-uuid/uuid"
+)
+
+// serveQAuthLogin creates a login request for the user identified by the
+// email address, see step 2 of the qauth flow. The service is identified by
+// its client credentials.
+func serveQAuthLogin(w http.ResponseWriter, r *http.Request) error {
+	service, err := AuthorizedService(r)
+	if err != nil {
+		return err
+	}
+
+	var body struct {
+		ServiceID string `json:"serviceID"`
+		Email     string `json:"email"`
+		Secret1   string `json:"secret1"`
+	}
+	if err := readJSON(r, &body); err != nil {
+		return err
+	}
+	// The serviceID is optional but must match the authenticated service
+	if body.ServiceID != "" {
+		if err := validate.UUIDv4(body.ServiceID); err != nil {
+			return ErrInvalidRequest.Append(`serviceID parameter should be a UUID version 4`)
+		}
+		if !uuid.Equal(service.UID, uuid.Parse(body.ServiceID)) {
+			return ErrUnauthorizedClient
+		}
+	}
+
+	return startLogin(w, service, body.Email, body.Secret1)
+}
+
+// startLogin creates a login session for the given service, sends the login
+// request to the user's devices and writes the pending session.
+func startLogin(w http.ResponseWriter, service *sentinel.Service, email, secret1 string) error {
+	session, err := beginLogin(service, email, secret1, false)
+	if err != nil {
+		return err
+	}
+
+	data := map[string]interface{}{
+		"sessionID": session.UID.String(),
+		"status":    session.Status,
+		"authLevel": session.AuthLevel,
+	}
+	return writeJSON(w, http.StatusOK, data)
+}
+
+// beginLogin creates a login session for the given service and sends the
+// login request to the user's devices. Notify sessions are accepted right
+// away. Sessions of the OpenID Connect flow need at least the Fast auth level
+// and their outcome isn't sent to the status endpoint of the service.
+func beginLogin(service *sentinel.Service, email, secret1 string, oidc bool) (*sentinel.LoginSession, error) {
+	if err := validate.Email(email); err != nil {
+		return nil, ErrInvalidEmail
+	}
+	if err := validate.NotEmpty(secret1); err != nil {
+		return nil, ErrInvalidRequest.Append(`secret1 parameter should not be empty`)
+	}
+
+	users, err := store.Users.List(sentinel.UserListOptions{Email: []string{email}})
+	if err != nil {
+		return nil, err
+	}
+	if len(users) != 1 {
+		return nil, ErrNotFound.Append("email address not registered")
+	}
+	user := users[0]
+
+	authLevel := sentinel.EffectiveAuthLevel(user, service)
+	if oidc && authLevel < sentinel.AuthLevelFast {
+		authLevel = sentinel.AuthLevelFast
+	}
+	session, err := store.Sessions.Create(service.ID, user.ID, authLevel, email, secret1, oidc)
+	if err != nil {
+		return nil, err
+	}
+	session.Service = service
+
+	switch session.AuthLevel {
+	case sentinel.AuthLevelNotify:
+		// The user is only informed, the login request is accepted right away
+		session, err = store.Sessions.Transition(session.UID, sentinel.LoginAccepted, "", "")
+		if err != nil {
+			return nil, err
+		}
+		go notifyService(session, map[string]string{
+			"status":    string(session.Status),
+			"sessionID": session.UID.String(),
+		})
+		go sendLoginNotice(user, session)
+	default:
+		// Create token, the device returns it in step 6
+		claims := tokens.Claims{
+			"session_id": session.UID.String(),
+			"service_id": service.UID.String(),
+			"email":      email,
+			"secret1":    secret1,
+		}
+		tokenStr, err := keyring.Sign(claims, &tokens.LoginRequestOptions)
+		if err != nil {
+			return nil, err
+		}
+		go sendLoginRequest(user, session, tokenStr)
+	}
+	return session, nil
+}
+
+// serveQAuthStatus accepts or declines a login request on behalf of the
+// authenticated user, see step 6 of the qauth flow. The outcome is passed on
+// to the service, see step 7.
+func serveQAuthStatus(w http.ResponseWriter, r *http.Request) error {
+	user, err := Authorized(r)
+	if err != nil {
+		return err
+	}
+
+	var body struct {
+		SessionID string `json:"sessionID"`
+		Status    string `json:"status"`
+		Token     string `json:"token"`
+		Secret2   string `json:"secret2"`
+		Enc1      string `json:"enc1"`
+		Signature string `json:"signature"`
+	}
+	if err := readJSON(r, &body); err != nil {
+		return err
+	}
+
+	var status sentinel.LoginStatus
+	switch sentinel.LoginStatus(body.Status) {
+	case "accept", sentinel.LoginAccepted:
+		status = sentinel.LoginAccepted
+	case "decline", sentinel.LoginDeclined:
+		status = sentinel.LoginDeclined
+	default:
+		return ErrInvalidRequest.Append(`status parameter should be either accept or decline`)
+	}
+	if err := validate.NotEmpty(body.Secret2); err != nil && status == sentinel.LoginAccepted {
+		return ErrInvalidRequest.Append(`secret2 parameter should not be empty`)
+	}
+
+	// The session is identified by the token from step 3 or by its ID
+	sessionIDStr := body.SessionID
+	if body.Token != "" {
+		claims, err := keyring.Verify(body.Token, &tokens.LoginRequestOptions)
+		if err != nil {
+			return ErrInvalidToken
+		}
+		s, _ := claims["session_id"].(string)
+		if sessionIDStr != "" && sessionIDStr != s {
+			return ErrInvalidToken.Append("value of claim 'session_id' does not match sessionID")
+		}
+		sessionIDStr = s
+	}
+	if err := validate.UUIDv4(sessionIDStr); err != nil {
+		return ErrInvalidRequest.Append(`sessionID parameter should be a UUID version 4`)
+	}
+	sessionID := uuid.Parse(sessionIDStr)
+
+	session, err := store.Sessions.Get(sessionID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return ErrNotFound
+		}
+		return err
+	}
+	if session.UserID != user.ID {
+		return ErrUnauthorizedClient
+	}
+	if err := checkApproval(session, body.Signature != ""); err != nil {
+		return err
+	}
+	if body.Signature != "" {
+		err := checkDeviceSignature(user, sessionID, status, body.Secret2, body.Signature)
+		if err != nil {
+			return err
+		}
+	}
+
+	session, err = store.Sessions.Transition(sessionID, status, body.Secret2, body.Enc1)
+	if err != nil {
+		switch err {
+		case sentinel.ErrLoginTimeout:
+			return ErrLoginTimeout
+		case sentinel.ErrLoginNotPending:
+			return ErrConfilt.Append(err.Error())
+		}
+		return err
+	}
+
+	go notifyService(session, map[string]string{
+		"status":    string(status),
+		"secret2":   body.Secret2,
+		"sessionID": sessionID.String(),
+	})
+	kind := sentinel.EventServiceApproved
+	if status == sentinel.LoginDeclined {
+		kind = sentinel.EventServiceDeclined
+	}
+	recordEvent(r, user.UID, kind, "session_id="+sessionID.String())
+
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// checkApproval checks whether the approval satisfies the auth level of the
+// login session. Notify sessions are accepted on creation, Fast sessions
+// need a one-tap approval and Secure sessions a device-signed approval or
+// decline.
+func checkApproval(session *sentinel.LoginSession, signed bool) error {
+	switch session.AuthLevel {
+	case sentinel.AuthLevelSecure:
+		if !signed {
+			return ErrDeviceSignatureRequired
+		}
+	}
+	return nil
+}
+
+// deviceSignatureMaxAge is the maximum age of a device signature, it can't
+// outlive the login request it was made for.
+const deviceSignatureMaxAge = sentinel.LoginTimeout
+
+// checkDeviceSignature verifies the approval signed by a device of the user.
+// The signature is a JWS with the device ID as kid header, its claims must
+// match the approval and its nonce can be used once. The status claim holds
+// the canonical status, accepted or declined, which the request status is
+// normalized to.
+func checkDeviceSignature(user *sentinel.User, sessionID uuid.UUID, status sentinel.LoginStatus, secret2, signature string) error {
+	kid, err := tokens.KeyID(signature)
+	if err != nil || validate.UUIDv4(kid) != nil {
+		return ErrInvalidDeviceSignature.Append("kid header should be the device ID")
+	}
+	device, err := store.Devices.Get(uuid.Parse(kid))
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	if err == sql.ErrNoRows || device.UserID != user.ID || device.PublicKey == "" {
+		return ErrInvalidDeviceSignature.Append("device has no enrolled key")
+	}
+	if !device.IsActive {
+		return ErrInvalidDeviceSignature.Append("device is inactive")
+	}
+
+	claims, err := tokens.VerifyDevice(signature, device.PublicKey)
+	if err != nil {
+		return ErrInvalidDeviceSignature
+	}
+	sid, _ := claims["sessionID"].(string)
+	st, _ := claims["status"].(string)
+	s2, _ := claims["secret2"].(string)
+	nonce, _ := claims["nonce"].(string)
+	iat, _ := claims["iat"].(float64)
+	if sid != sessionID.String() || st != string(status) || s2 != secret2 {
+		return ErrInvalidDeviceSignature.Append("signed claims don't match the approval")
+	}
+	issuedAt := time.Unix(int64(iat), 0)
+	if now := time.Now(); issuedAt.Before(now.Add(-deviceSignatureMaxAge)) || issuedAt.After(now.Add(time.Minute)) {
+		return ErrInvalidDeviceSignature.Append("value of claim 'iat' is outside the allowed window")
+	}
+	if len(nonce) < 16 {
+		return ErrInvalidDeviceSignature.Append("value of claim 'nonce' should be at least 16 characters")
+	}
+
+	// Used nonces are kept as revocations until the signature is too old to
+	// be accepted anyway
+	nonceID := "device-nonce:" + device.UID.String() + ":" + nonce
+	unused, err := store.Revocations.Use(nonceID, user.UID, issuedAt.Add(deviceSignatureMaxAge))
+	if err != nil {
+		return err
+	}
+	if !unused {
+		return ErrInvalidDeviceSignature.Append("signature was used")
+	}
+	return nil
+}
+
+// ExpireSessions expires the pending login sessions which weren't confirmed
+// within the sentinel.LoginTimeout every interval. It never returns.
+func ExpireSessions(interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := expireSessions(); err != nil {
+			log.Println("expiring login sessions failed with error:", err)
+		}
+	}
+}
+
+// expireSessions expires the pending login sessions which passed their expiry
+// date and informs the services with a login_timeout error.
+func expireSessions() error {
+	sessions, err := store.Sessions.Expire()
+	if err != nil {
+		return err
+	}
+	for _, session := range sessions {
+		go notifyService(session, map[string]string{
+			"error":             ErrLoginTimeout.Name,
+			"error_description": ErrLoginTimeout.Desc,
+			"sessionID":         session.UID.String(),
+		})
+	}
+	return nil
+}
+
+// notifyService stores a callback to the status endpoint of the session's
+// service, its BaseURL, and makes the first delivery attempt, see step 7 of the qauth flow.
+// Failed callbacks are retried by DeliverCallbacks. Sessions of the OpenID
+// Connect flow aren't sent, the authorization endpoint redirects instead.
+func notifyService(session *sentinel.LoginSession, v interface{}) {
+	if session.IsOIDC {
+		return
+	}
+	c, err := callbacks.Enqueue(session, v)
+	if err != nil {
+		log.Printf("storing callback for session %s failed with error: %s", session.UID, err)
+		return
+	}
+	if err := callbacks.Deliver(c); err != nil {
+		log.Printf("calling service %s failed with error: %s", session.Service.UID, err)
+	}
+}
+
+// DeliverCallbacks retries the failed callbacks which are due every interval.
+// It never returns. The dispatcher is created by Handler, so it should be
+// started after the handler.
+func DeliverCallbacks(interval time.Duration) {
+	callbacks.Run(interval)
+}
@@ -0,0 +1,124 @@
+// Copyright 2015 Lars Wiegman. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"sentinel"
+	"sentinel/datastore"
+	"sentinel/validate"
+)
+
+// Rate limits of the credential endpoints, per endpoint. An IP address can be
+// shared by many users behind a NAT, a client is shared by all its users.
+var (
+	ipRateLimit     = sentinel.RateLimit{Burst: 30, Interval: 2 * time.Second}
+	emailRateLimit  = sentinel.RateLimit{Burst: 5, Interval: time.Minute}
+	clientRateLimit = sentinel.RateLimit{Burst: 300, Interval: 100 * time.Millisecond}
+)
+
+// SetRateLimitStore sets where the token buckets of the rate limits are kept:
+// "postgres" shares them between the instances of the backend, "memory" keeps
+// them in the process.
+func SetRateLimitStore(name string) error {
+	switch name {
+	case "postgres":
+		store.RateLimits = datastore.NewDatastore(nil).RateLimits
+	case "memory":
+		store.RateLimits = datastore.NewMemoryRateLimits()
+	default:
+		return errors.New("unknown rate limit store " + name)
+	}
+	return nil
+}
+
+// rateLimited limits the requests to the handler by the IP address of the
+// client and by the email, or the login_hint of the authorization endpoint,
+// and client_id in the request. The name of the endpoint is part of the keys,
+// so each endpoint has its own buckets.
+func rateLimited(name string, h handler) handler {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		// The form is parsed again by the handler, the values in the body
+		// take precedence over the query
+		r.ParseForm()
+		email, clientID := r.Form.Get("email"), r.Form.Get("client_id")
+		if email == "" {
+			email = r.Form.Get("login_hint")
+		}
+		if username, _, ok := r.BasicAuth(); ok {
+			if validate.Email(username) == nil {
+				email = username
+			} else if clientID == "" {
+				clientID = username
+			}
+		}
+
+		keys := []string{name + ":ip:" + remoteIP(r)}
+		limits := []sentinel.RateLimit{ipRateLimit}
+		if email = strings.ToLower(strings.TrimSpace(email)); email != "" {
+			keys = append(keys, name+":email:"+email)
+			limits = append(limits, emailRateLimit)
+		}
+		if clientID != "" {
+			keys = append(keys, name+":client:"+clientID)
+			limits = append(limits, clientRateLimit)
+		}
+
+		// A rejected request doesn't take tokens from the other buckets, so
+		// all buckets are checked before any token is taken
+		var wait time.Duration
+		for i, key := range keys {
+			d, err := store.RateLimits.Wait(key, limits[i])
+			if err != nil {
+				return err
+			}
+			if d > wait {
+				wait = d
+			}
+		}
+		if wait > 0 {
+			return tooManyRequests(w, wait, "rate limit exceeded")
+		}
+		for i, key := range keys {
+			wait, err := store.RateLimits.Take(key, limits[i])
+			if err != nil {
+				return err
+			}
+			if wait > 0 {
+				return tooManyRequests(w, wait, "rate limit exceeded")
+			}
+		}
+		return h(w, r)
+	}
+}
+
+// tooManyRequests sets the Retry-After header in whole seconds, rounded up,
+// and returns ErrTooManyRequests with the given description.
+func tooManyRequests(w http.ResponseWriter, wait time.Duration, desc string) error {
+	seconds := int((wait + time.Second - 1) / time.Second)
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	return ErrTooManyRequests.Append(desc)
+}
+
+// lockoutKey is the key of the bucket of failed logins to the account with
+// the given email.
+func lockoutKey(email string) string {
+	return "lockout:" + strings.ToLower(email)
+}
+
+// remoteIP returns the IP address of the client of the request.
+func remoteIP(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return ip
+}
@@ -0,0 +1,186 @@
+// Copyright 2015 Lars Wiegman. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"sentinel"
+	"sentinel/datastore"
+	"sentinel/router"
+
+	"code.google.com/p/go-uuid/uuid"
+)
+
+func TestRateLimitOneTimeLogin(t *testing.T) {
+	setup()
+	store.RateLimits = datastore.NewMemoryRateLimits()
+
+	form := url.Values{"email": {"jess@example.com"}}
+	for i := 0; i < emailRateLimit.Burst; i++ {
+		if resp, _ := doRequest(t, "POST", router.OneTimeLogin, nil, "", form, nil); resp.StatusCode == 429 {
+			t.Fatalf("Result should have been allowed, but request %d was rate limited", i+1)
+		}
+	}
+
+	// The email has no tokens left, whatever the case
+	form.Set("email", "Jess@Example.com")
+	resp, name := doRequest(t, "POST", router.OneTimeLogin, nil, "", form, nil)
+	if resp.StatusCode != 429 || name != ErrTooManyRequests.Name {
+		t.Errorf("Result should have been %v, but it was %v %v", ErrTooManyRequests.Name, resp.StatusCode, name)
+	}
+
+	// Other emails have their own bucket
+	form.Set("email", "jane@example.com")
+	if resp, _ := doRequest(t, "POST", router.OneTimeLogin, nil, "", form, nil); resp.StatusCode == 429 {
+		t.Errorf("Result should have been allowed, but it was rate limited")
+	}
+}
+
+func TestRateLimitRejectedTakesNothing(t *testing.T) {
+	setup()
+
+	// The email bucket is empty, the request may not take tokens from the
+	// bucket of the IP address
+	var taken []string
+	store.RateLimits = &sentinel.MockRateLimitsService{
+		WaitFn: func(key string, limit sentinel.RateLimit) (time.Duration, error) {
+			if strings.Contains(key, ":email:") {
+				return time.Minute, nil
+			}
+			return 0, nil
+		},
+		TakeFn: func(key string, limit sentinel.RateLimit) (time.Duration, error) {
+			taken = append(taken, key)
+			return 0, nil
+		},
+	}
+
+	resp, _ := doRequest(t, "POST", router.OneTimeLogin, nil, "", url.Values{"email": {"jess@example.com"}}, nil)
+	if resp.StatusCode != 429 {
+		t.Errorf("Result should have been %v, but it was %v", 429, resp.StatusCode)
+	}
+	if len(taken) != 0 {
+		t.Errorf("Result should have been no tokens taken, but it was %v", taken)
+	}
+}
+
+func TestRateLimitResetPassword(t *testing.T) {
+	setup()
+	store.RateLimits = datastore.NewMemoryRateLimits()
+
+	// Guessing reset tokens is limited by the IP address
+	form := url.Values{"token": {"guess"}, "password": {"Alpha123!"}}
+	for i := 0; i < ipRateLimit.Burst; i++ {
+		if resp, _ := doRequest(t, "POST", router.ResetPassword, nil, "", form, nil); resp.StatusCode == 429 {
+			t.Fatalf("Result should have been allowed, but request %d was rate limited", i+1)
+		}
+	}
+	resp, name := doRequest(t, "POST", router.ResetPassword, nil, "", form, nil)
+	if resp.StatusCode != 429 || name != ErrTooManyRequests.Name {
+		t.Errorf("Result should have been %v, but it was %v %v", ErrTooManyRequests.Name, resp.StatusCode, name)
+	}
+}
+
+func TestRateLimitAuthorize(t *testing.T) {
+	setup()
+	store.RateLimits = datastore.NewMemoryRateLimits()
+
+	service := &sentinel.Service{
+		ID:           2,
+		UID:          uuid.NewRandom(),
+		BaseURL:      "https://app.example.com/app",
+		RedirectURIs: sentinel.RedirectURIs{"https://app.example.com/app/cb"},
+	}
+	authorizeService(t, service)
+
+	u, _ := apiRouter.Get(router.Authorize).URL()
+	q := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {service.ClientID},
+		"redirect_uri":          {"https://app.example.com/app/cb"},
+		"scope":                 {"openid"},
+		"code_challenge":        {codeChallenge(strings.Repeat("v", 43))},
+		"code_challenge_method": {"S256"},
+		"login_hint":            {"jess@example.com"},
+	}
+	status := func() int {
+		resp, err := noRedirectClient.Get("http://sentinel.sh" + u.Path + "?" + q.Encode())
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	// Login requests to a user are limited like other credential requests
+	for i := 0; i < emailRateLimit.Burst; i++ {
+		if code := status(); code == 429 {
+			t.Fatalf("Result should have been allowed, but request %d was rate limited", i+1)
+		}
+	}
+	if code := status(); code != 429 {
+		t.Errorf("Result should have been %v, but it was %v", 429, code)
+	}
+}
+
+func TestLockout(t *testing.T) {
+	setup()
+	store.RateLimits = datastore.NewMemoryRateLimits()
+	// Only test the lockout
+	emailLimit := emailRateLimit
+	emailRateLimit.Burst = 100
+	defer func() { emailRateLimit = emailLimit }()
+
+	user := &sentinel.User{
+		UID:          uuid.NewRandom(),
+		PasswordHash: "plain:princess123",
+	}
+	mockRefreshTokens(user)
+	store.Users.(*sentinel.MockUsersService).ListFn = func(opt sentinel.UserListOptions) ([]*sentinel.User, error) {
+		return []*sentinel.User{user}, nil
+	}
+	var locked int
+	store.Events.(*sentinel.MockEventsService).RecordFn = func(e *sentinel.Event) error {
+		if e.Kind == sentinel.EventAccountLocked {
+			locked++
+		}
+		return nil
+	}
+
+	fail := func() {
+		err := apiClient.Authenticate("jess@example.com", "pirate123")
+		if errResp, ok := err.(*sentinel.ErrorResponse); !ok || errResp.Name != ErrInvalidAuthenticationCredentials.Name {
+			t.Fatalf("Result should have been %v, but it was %v", ErrInvalidAuthenticationCredentials.Name, err)
+		}
+	}
+
+	// A successful login refills the bucket
+	fail()
+	fail()
+	if err := apiClient.Authenticate("jess@example.com", "princess123"); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < sentinel.LockoutLimit.Burst; i++ {
+		fail()
+	}
+	if locked != 1 {
+		t.Errorf("Result should have been %v, but it was %v", 1, locked)
+	}
+
+	// The right password is refused while the account is locked
+	err := apiClient.Authenticate("jess@example.com", "princess123")
+	errResp, ok := err.(*sentinel.ErrorResponse)
+	if !ok || errResp.Name != ErrTooManyRequests.Name {
+		t.Fatalf("Result should have been %v, but it was %v", ErrTooManyRequests.Name, err)
+	}
+	if got := errResp.Response.Header.Get("Retry-After"); got == "" {
+		t.Error("Result should have been a Retry-After header, but it was empty")
+	}
+}
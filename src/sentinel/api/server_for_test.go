@@ -6,12 +6,26 @@ package api
 
 import (
 	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
 
 	"sentinel"
+	"sentinel/callback"
 	"sentinel/datastore"
+	"sentinel/mail"
+	"sentinel/tokens"
+
+	"code.google.com/p/go-uuid/uuid"
+	"golang.org/x/crypto/bcrypt"
 )
 
 var (
@@ -26,6 +40,177 @@ func init() {
 
 func setup() {
 	store = datastore.NewMockDatastore()
+	callbacks = callback.NewDispatcher(store.Callbacks, keyring)
+	mailer = &mail.MockSender{}
+}
+
+// authorize signs an access token for the given user and sets it on the API
+// client. The user is returned by the mock store on authorization. The token
+// is returned.
+func authorize(t *testing.T, user *sentinel.User) string {
+	claims := tokens.Claims{
+		"user_id": user.UID.String(),
+	}
+	tokenStr, err := tokens.Sign(claims, privateKey, &tokens.AccessTokenOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	apiClient.SetToken(tokenStr)
+
+	store.Users.(*sentinel.MockUsersService).GetUserDetailsFn = func(uid uuid.UUID) (*sentinel.User, error) {
+		if !uuid.Equal(user.UID, uid) {
+			return nil, sql.ErrNoRows
+		}
+		return user, nil
+	}
+	return tokenStr
+}
+
+// doRequest sends the body to the named route with the given route variables
+// and returns the response along with the name of the error, if any. A
+// url.Values body is sent as a form and any other body as JSON. The token is
+// sent as a bearer token when it is not empty and a successful response is
+// decoded into v when v is not nil. The response body is closed.
+func doRequest(t *testing.T, method, name string, vars []string, token string, body, v interface{}) (*http.Response, string) {
+	u, err := apiRouter.Get(name).URL(vars...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var r io.Reader
+	contentType := "application/json"
+	switch body := body.(type) {
+	case nil:
+	case url.Values:
+		r = strings.NewReader(body.Encode())
+		contentType = "application/x-www-form-urlencoded"
+	default:
+		b, err := json.Marshal(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r = bytes.NewReader(b)
+	}
+	req, _ := http.NewRequest(method, "http://sentinel.sh"+u.Path, r)
+	if r != nil {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 400 {
+		var errResp sentinel.ErrorResponse
+		json.NewDecoder(resp.Body).Decode(&errResp)
+		return resp, errResp.Name
+	}
+	if v != nil && resp.StatusCode != http.StatusNoContent {
+		if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return resp, ""
+}
+
+// authorizeService issues client credentials for the given service and sets
+// them on the API client. The service is returned by the mock store on
+// authorization.
+func authorizeService(t *testing.T, service *sentinel.Service) {
+	if service.ClientID == "" {
+		service.ClientID = strings.Replace(service.UID.String(), "-", "", -1)
+	}
+	secret := "secret-" + service.ClientID
+	b, err := bcrypt.GenerateFromPassword([]byte(secret), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	service.ClientSecretHash = "bcrypt:" + string(b)
+	apiClient.SetClientCredentials(service.ClientID, secret)
+
+	store.Services.(*sentinel.MockServicesService).GetByClientIDFn = func(clientID string) (*sentinel.Service, error) {
+		if clientID != service.ClientID {
+			return nil, sql.ErrNoRows
+		}
+		return service, nil
+	}
+}
+
+// mockRefreshTokens keeps the refresh tokens issued for the given user in
+// memory and mimics their rotation by the datastore.
+func mockRefreshTokens(user *sentinel.User) {
+	used := make(map[string]bool)
+	issued := make(map[string]*sentinel.RefreshToken)
+	n := 0
+	issue := func(clientID, scope string) *sentinel.RefreshToken {
+		n++
+		token := fmt.Sprintf("refresh-%d", n)
+		used[token] = false
+		rt := &sentinel.RefreshToken{UserID: user.ID, UserUID: user.UID, Token: token, ClientID: clientID, Scope: scope}
+		issued[token] = rt
+		return rt
+	}
+
+	m := store.RefreshTokens.(*sentinel.MockRefreshTokensService)
+	m.IssueFn = func(userID int, clientID, scope string) (*sentinel.RefreshToken, error) {
+		return issue(clientID, scope), nil
+	}
+	m.GetFn = func(token string) (*sentinel.RefreshToken, error) {
+		rt, ok := issued[token]
+		if !ok {
+			return nil, sentinel.ErrRefreshTokenInvalid
+		}
+		return rt, nil
+	}
+	m.RotateFn = func(token string) (*sentinel.RefreshToken, error) {
+		isUsed, ok := used[token]
+		if !ok {
+			return nil, sentinel.ErrRefreshTokenInvalid
+		}
+		if isUsed {
+			return nil, sentinel.ErrRefreshTokenReused
+		}
+		used[token] = true
+		return issue(issued[token].ClientID, issued[token].Scope), nil
+	}
+}
+
+// mockRevocations keeps the revocations in memory and mimics the lookups by
+// the datastore.
+func mockRevocations() {
+	revoked := make(map[string]bool)
+	used := make(map[string]bool)
+	users := make(map[string]*sentinel.Revocation)
+
+	m := store.Revocations.(*sentinel.MockRevocationsService)
+	m.RevokeFn = func(jti string, userUID uuid.UUID, expiresAt time.Time) error {
+		revoked[jti] = true
+		return nil
+	}
+	m.RevokeUserFn = func(userUID uuid.UUID, expiresAt time.Time) error {
+		users[userUID.String()] = &sentinel.Revocation{UserUID: userUID, CreatedAt: time.Now()}
+		return nil
+	}
+	m.IsRevokedFn = func(jti string, userUID uuid.UUID, issuedAt time.Time) (bool, error) {
+		r, ok := users[userUID.String()]
+		return revoked[jti] || ok && r.RevokesIssuedAt(issuedAt), nil
+	}
+	m.UseFn = func(jti string, userUID uuid.UUID, expiresAt time.Time) (bool, error) {
+		unused := !used[jti]
+		used[jti] = true
+		return unused, nil
+	}
+}
+
+// nextSecond waits for the next second to start. Tokens carry their issue
+// date in seconds, tokens issued before it are revoked by a revocation of all
+// tokens of the user made after it.
+func nextSecond() {
+	now := time.Now()
+	time.Sleep(now.Truncate(time.Second).Add(time.Second).Sub(now))
 }
 
 type muxTransport http.ServeMux
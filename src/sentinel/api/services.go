@@ -5,10 +5,15 @@
 package api
 
 import (
-	"log"
+	"database/sql"
 	"mime"
 	"net/http"
+	"strings"
 
+	"sentinel"
+	"sentinel/datastore"
+	"sentinel/router"
+	"sentinel/tokens"
 	"sentinel/validate"
 
 	"code.google.com/p/go-uuid/uuid"
@@ -28,12 +33,160 @@ func serveGetService(w http.ResponseWriter, r *http.Request) error {
 	}
 
 	return writeJSON(w, http.StatusOK, service)
+}
 
-	return nil
+// ClientAssertionType is the client_assertion_type of a JWT assertion which
+// is included as form parameter, see RFC 7523.
+const ClientAssertionType = "urn:ietf:params:oauth:client-assertion-type:jwt-bearer"
+
+// AuthorizedService returns the service which authenticated the request,
+// either with its client ID and secret using HTTP Basic authentication or
+// with a JWT assertion signed with its private key. The assertion is included
+// with the Bearer scheme or as client_assertion form parameter.
+func AuthorizedService(r *http.Request) (*sentinel.Service, error) {
+	tokenStr, err := clientAssertion(r)
+	if err != nil {
+		return nil, err
+	}
+	if tokenStr == "" {
+		clientID, secret, _ := r.BasicAuth()
+		service, err := clientService(clientID)
+		if err != nil {
+			return nil, err
+		}
+		if err := datastore.CompareClientSecret(service, secret); err != nil {
+			return nil, ErrInvalidClient
+		}
+		return service, nil
+	}
+
+	// The issuer of the assertion is the client ID of the service
+	clientID, err := tokens.Issuer(tokenStr)
+	if err != nil {
+		return nil, ErrInvalidAuthenticationToken
+	}
+	service, err := clientService(clientID)
+	if err != nil {
+		return nil, err
+	}
+	if service.PublicKey == "" {
+		return nil, ErrInvalidAuthenticationToken.Append("service has no registered public key")
+	}
+	opt := tokens.ClientAssertionOptions
+	opt.Issuer = service.ClientID
+	opt.Audience = issuer()
+	token, err := tokens.VerifyToken(tokenStr, service.PublicKey, &opt)
+	if err != nil {
+		return nil, ErrInvalidAuthenticationToken
+	}
+	if token.Expires.Sub(token.IssuedAt) > tokens.ClientAssertionOptions.TTL {
+		return nil, ErrInvalidAuthenticationToken.Append("assertion is valid for too long")
+	}
+	if token.ID == "" {
+		return nil, ErrInvalidAuthenticationToken.Append("assertion has no jti")
+	}
+
+	// An assertion can be used once. The jti is chosen by the service, it's
+	// prefixed so it can't collide with the jti of the tokens of others.
+	unused, err := store.Revocations.Use(service.ClientID+":"+token.ID, service.UID, token.Expires)
+	if err != nil {
+		return nil, err
+	}
+	if !unused {
+		return nil, ErrInvalidAuthenticationToken.Append("assertion was used")
+	}
+
+	return service, nil
 }
 
+// clientAssertion returns the JWT assertion of the request, it's empty when
+// the service authenticates with HTTP Basic authentication. A request may
+// use a single authentication method.
+func clientAssertion(r *http.Request) (string, error) {
+	var assertion string
+	if mt, _, err := mime.ParseMediaType(r.Header.Get("Content-Type")); err == nil && mt == "application/x-www-form-urlencoded" {
+		if err := r.ParseForm(); err != nil {
+			return "", err
+		}
+		if assertionType := r.PostForm.Get("client_assertion_type"); assertionType != "" {
+			if assertionType != ClientAssertionType {
+				return "", ErrUnsupportedAuthenticationMethod
+			}
+			assertion = r.PostForm.Get("client_assertion")
+			if assertion == "" {
+				return "", ErrInvalidRequest.Append("client_assertion parameter should not be empty")
+			}
+		}
+	}
+
+	auth := r.Header.Get("Authorization")
+	if auth == "" {
+		if assertion == "" {
+			return "", ErrNoAuthentionMethodIncluded
+		}
+		return assertion, nil
+	}
+	if assertion != "" {
+		return "", ErrInvalidRequest.Append("more than one authentication method was included")
+	}
+	if _, _, ok := r.BasicAuth(); ok {
+		return "", nil
+	}
+	prefix := AuthenticationScheme + " "
+	if !strings.HasPrefix(auth, prefix) {
+		return "", ErrUnsupportedAuthenticationMethod
+	}
+	return strings.TrimPrefix(auth, prefix), nil
+}
+
+// clientService returns the service with the client ID. Unknown clients get
+// the same error as wrong credentials, so client IDs can't be enumerated.
+func clientService(clientID string) (*sentinel.Service, error) {
+	if clientID == "" {
+		return nil, ErrInvalidClient
+	}
+	service, err := store.Services.GetByClientID(clientID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrInvalidClient
+		}
+		return nil, err
+	}
+	return service, nil
+}
+
+// serveAuthService creates a login request for the service with the given
+// UUID, see serveQAuthLogin. Only the service itself can create login
+// requests.
 func serveAuthService(w http.ResponseWriter, r *http.Request) error {
-	_, err := Authorized(r)
+	service, err := AuthorizedService(r)
+	if err != nil {
+		return err
+	}
+
+	s := mux.Vars(r)["uid"]
+	if err := validate.UUIDv4(s); err != nil {
+		return ErrNotFound
+	}
+	if !uuid.Equal(service.UID, uuid.Parse(s)) {
+		return ErrUnauthorizedClient
+	}
+
+	var body struct {
+		Email   string `json:"email"`
+		Secret1 string `json:"secret1"`
+	}
+	if err := readJSON(r, &body); err != nil {
+		return err
+	}
+
+	return startLogin(w, service, body.Email, body.Secret1)
+}
+
+// serveCreateService registers a service owned by the authenticated user. The
+// response includes the client secret, it can't be retrieved later on.
+func serveCreateService(w http.ResponseWriter, r *http.Request) error {
+	user, err := Authorized(r)
 	if err != nil {
 		return err
 	}
@@ -47,32 +200,142 @@ func serveAuthService(w http.ResponseWriter, r *http.Request) error {
 		return err
 	}
 
-	// Get and validate form input
-	email := r.PostForm.Get("email")
-	status := r.PostForm.Get("status")
-	enc1 := r.PostForm.Get("enc1")
-	if err := validate.Email(email); err != nil {
-		return ErrInvalidEmail
+	opt := sentinel.ServiceUpdateOptions{}
+	if err := opt.ParseForm(r.PostForm); err != nil {
+		return ErrInvalidRequest.Append(`; ` + err.Error())
 	}
-	if err := validate.NotEmpty(status); err != nil {
-		e := ErrInvalidRequest.Append(`status parameter should not be empty`)
-		return e
+	if opt.Name == "" {
+		return ErrInvalidRequest.Append(`name parameter should not be empty`)
 	}
-	if err := validate.NotEmpty(enc1); err != nil {
-		e := ErrInvalidRequest.Append(`enc1 parameter should not be empty`)
-		return e
+	if opt.BaseURL == "" {
+		return ErrInvalidRequest.Append(`serviceUrl parameter should not be empty`)
 	}
 
-	//TODO: finish implementation
-	// check if email is associated by authenticated user
-	serviceUID := uuid.Parse(mux.Vars(r)["uid"])
-	_, err = store.Services.Get(serviceUID)
+	opt.Owner = &user.UID
+	service, err := store.Services.Create(opt)
+	if err != nil {
+		return err
+	}
+
+	u, err := apiRouter.Get(router.Service).URL("uid", service.UID.String())
 	if err != nil {
 		return err
 	}
+	w.Header().Set("Location", u.String())
+	return writeJSON(w, http.StatusCreated, service)
+}
 
-	log.Printf("serveAuthService called with params: id=%s, email:%s, status:%s, enc1: %s",
-		serviceUID, email, status, enc1,
-	)
+// serveListServices lists the services owned by the authenticated user.
+func serveListServices(w http.ResponseWriter, r *http.Request) error {
+	user, err := Authorized(r)
+	if err != nil {
+		return err
+	}
+
+	cr := NewContentRange("items", DefaultContentRangeLast)
+	if first, last, err := parseRange(r, "items"); err == nil {
+		cr.First = first
+		cr.Last = last
+	}
+	opt := sentinel.ServiceListOptions{
+		Owner:           &user.UID,
+		IncludeArchived: r.URL.Query().Get("include_archived") == "true",
+		ListOptions: sentinel.ListOptions{
+			First: cr.First,
+			Last:  cr.Last,
+		},
+	}
+
+	services, err := store.Services.List(opt)
+	if err != nil {
+		return err
+	}
+	cr.UpdateRange(len(services))
+
+	cr.SetContentRange(w)
+	return writeJSON(w, http.StatusPartialContent, services)
+}
+
+func serveUpdateService(w http.ResponseWriter, r *http.Request) error {
+	service, err := ownedService(r)
+	if err != nil {
+		return err
+	}
+
+	expectMediatype := "application/x-www-form-urlencoded"
+	if mt, _, err := mime.ParseMediaType(r.Header.Get("Content-Type")); err != nil || mt != expectMediatype {
+		return ErrUnsupportedMediatype.Append("expected " + expectMediatype)
+	}
+
+	if err := r.ParseForm(); err != nil {
+		return err
+	}
+
+	opt := sentinel.ServiceUpdateOptions{}
+	if err := opt.ParseForm(r.PostForm); err != nil {
+		return ErrInvalidRequest.Append(`; ` + err.Error())
+	}
+
+	service, err = store.Services.Update(service.UID, opt)
+	if err != nil {
+		return err
+	}
+
+	return writeJSON(w, http.StatusOK, service)
+}
+
+// serveDeleteService archives the service.
+func serveDeleteService(w http.ResponseWriter, r *http.Request) error {
+	service, err := ownedService(r)
+	if err != nil {
+		return err
+	}
+
+	if err := store.Services.Archive(service.UID); err != nil {
+		return err
+	}
+
+	w.WriteHeader(http.StatusNoContent)
 	return nil
 }
+
+// serveRotateServiceSecret issues a new client secret for the service.
+func serveRotateServiceSecret(w http.ResponseWriter, r *http.Request) error {
+	service, err := ownedService(r)
+	if err != nil {
+		return err
+	}
+
+	service, err = store.Services.RotateSecret(service.UID)
+	if err != nil {
+		return err
+	}
+
+	return writeJSON(w, http.StatusOK, service)
+}
+
+// ownedService returns the service identified by the uid path variable when
+// it's owned by the authenticated user.
+func ownedService(r *http.Request) (*sentinel.Service, error) {
+	user, err := Authorized(r)
+	if err != nil {
+		return nil, err
+	}
+
+	s := mux.Vars(r)["uid"]
+	if err := validate.UUIDv4(s); err != nil {
+		return nil, ErrNotFound
+	}
+
+	service, err := store.Services.Get(uuid.Parse(s))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	if service.OwnerID != user.ID {
+		return nil, ErrNotFound
+	}
+	return service, nil
+}
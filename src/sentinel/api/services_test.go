@@ -5,9 +5,28 @@
 package api
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"database/sql"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"sentinel"
+	"sentinel/callback"
+	"sentinel/push"
+	"sentinel/router"
+	"sentinel/tokens"
 
 	"code.google.com/p/go-uuid/uuid"
 )
@@ -59,34 +78,781 @@ func TestserveGetService(t *testing.T) {
 	}
 }
 
-func TestserveSetServiceStatus(t *testing.T) {
+func TestServeAuthService(t *testing.T) {
 	setup()
 
-	expectUID := uuid.NewRandom()
+	service := *testServices[0]
 	expectEmail := "jack@example.com"
-	expectStatus := "accepted"
+	expectSecret1 := "ffa6706ff2127a749973072756f83c532e43ed02"
+	expectSessionID := uuid.NewRandom()
 
-	calledSetServiceStatus := false
-	store.Services.(*sentinel.MockServicesService).AuthFn = func(uid uuid.UUID, email, status string) error {
-		if !uuid.Equal(expectUID, uid) {
-			t.Errorf("Result should have been %v, but it was %v", expectUID, uid)
+	user := &sentinel.User{
+		ID:  1,
+		UID: uuid.NewRandom(),
+		AuthEmailList: []*sentinel.AuthEmail{
+			&sentinel.AuthEmail{Email: expectEmail},
+		},
+	}
+	authorizeService(t, &service)
+
+	n := push.NewMemoryNotifier()
+	notifier = n
+	defer func() { notifier = nil }()
+
+	// The login request is sent to every active device
+	devices := []*sentinel.Device{
+		{UID: uuid.NewRandom(), Platform: "ios", PushToken: "e2f28cb73f1f47dd171f6749857ded7c"},
+		{UID: uuid.NewRandom(), Platform: "android", PushToken: "bk3RNwTe3H0:CI2k_HHwgIpoDKCIZvvDMExUdFQ3P1"},
+	}
+	store.Devices.(*sentinel.MockDevicesService).ListFn = func(opt sentinel.DeviceListOptions) ([]*sentinel.Device, error) {
+		if opt.UserID != user.ID || !opt.ActiveOnly {
+			t.Errorf("Result should have been the active devices of user %v, but it was %+v", user.ID, opt)
+		}
+		return devices, nil
+	}
+	var mu sync.Mutex
+	delivered := map[string]bool{}
+	store.Devices.(*sentinel.MockDevicesService).RecordDeliveryFn = func(uid uuid.UUID, pushToken string) error {
+		mu.Lock()
+		delivered[uid.String()+" "+pushToken] = true
+		mu.Unlock()
+		return nil
+	}
+
+	store.Users.(*sentinel.MockUsersService).ListFn = func(opt sentinel.UserListOptions) ([]*sentinel.User, error) {
+		return []*sentinel.User{user}, nil
+	}
+
+	calledLogin := false
+	store.Sessions.(*sentinel.MockSessionsService).CreateFn = func(serviceID, userID, authLevel int, email, secret1 string, isOIDC bool) (*sentinel.LoginSession, error) {
+		if service.ID != serviceID || user.ID != userID {
+			t.Errorf("Result should have been %v/%v, but it was %v/%v", service.ID, user.ID, serviceID, userID)
 		}
 		if expectEmail != email {
 			t.Errorf("Result should have been %v, but it was %v", expectEmail, email)
 		}
+		if expectSecret1 != secret1 {
+			t.Errorf("Result should have been %v, but it was %v", expectSecret1, secret1)
+		}
+		calledLogin = true
+		return &sentinel.LoginSession{
+			UID:     expectSessionID,
+			UserID:  user.ID,
+			Email:   email,
+			Secret1: secret1,
+			Status:  sentinel.LoginPending,
+			Service: &service,
+		}, nil
+	}
+
+	session, err := apiClient.Services.Login(service.UID, expectEmail, expectSecret1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !calledLogin {
+		t.Error("!calledLogin")
+	}
+
+	expect := expectSessionID
+	result := session.UID
+	if !uuid.Equal(expect, result) {
+		t.Errorf("Result should have been %v, but it was %v", expect, result)
+	}
+
+	// The devices are notified concurrently
+	targets := map[push.Target]bool{}
+	for _, d := range devices {
+		targets[push.Target{Platform: push.Platform(d.Platform), Token: d.PushToken}] = true
+	}
+	for range devices {
+		var sent push.Sent
+		select {
+		case sent = <-n.C():
+		case <-time.After(time.Second):
+			t.Fatal("login request was not sent")
+		}
+		if !targets[sent.Target] {
+			t.Errorf("Result should have been one of the devices %v, but it was %v", targets, sent.Target)
+		}
+		delete(targets, sent.Target)
+		m := sent.Message
+		if m.Kind != push.KindLoginRequest {
+			t.Errorf("Result should have been %v, but it was %v", push.KindLoginRequest, m.Kind)
+		}
+		expectData := map[string]string{
+			"service":   service.Name,
+			"sessionID": expectSessionID.String(),
+			"secret1":   expectSecret1,
+		}
+		for k, v := range expectData {
+			if m.Data[k] != v {
+				t.Errorf("%s: Result should have been %v, but it was %v", k, v, m.Data[k])
+			}
+		}
+		if m.Data["token"] == "" {
+			t.Error("Result should have been a login request token, but it was empty")
+		}
+	}
+
+	// The deliveries are recorded with the devices
+	deliveries.Wait()
+	for _, d := range devices {
+		if !delivered[d.UID.String()+" "+d.PushToken] {
+			t.Errorf("Result should have been a recorded delivery to %v, but it was %v", d.UID, delivered)
+		}
+	}
+}
+
+func TestServeQAuthStatus(t *testing.T) {
+	setup()
+
+	expectSessionID := uuid.NewRandom()
+	expectStatus := sentinel.LoginAccepted
+	expectSecret2 := "29df362b5cfa5c96d22f8d20f29d9a367dd0d359"
+	expectEnc1 := "b9b0aa3e6a3a7c09"
+
+	// Stand-in for the status endpoint of the service
+	callbacks := make(chan map[string]string, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if err := callback.Verify(r.Header.Get(callback.SignatureHeader), body, publicKey); err != nil {
+			t.Error(err)
+		}
+		var v map[string]string
+		json.Unmarshal(body, &v)
+		callbacks <- v
+	}))
+	defer ts.Close()
+
+	service := *testServices[1]
+	service.BaseURL = ts.URL
+
+	user := &sentinel.User{ID: 1, UID: uuid.NewRandom()}
+	authorize(t, user)
+
+	store.Sessions.(*sentinel.MockSessionsService).GetFn = func(sessionID uuid.UUID) (*sentinel.LoginSession, error) {
+		return &sentinel.LoginSession{
+			UID:     sessionID,
+			UserID:  user.ID,
+			Status:  sentinel.LoginPending,
+			Service: &service,
+		}, nil
+	}
+
+	calledAuth := false
+	store.Sessions.(*sentinel.MockSessionsService).TransitionFn = func(sessionID uuid.UUID, status sentinel.LoginStatus, secret2, enc1 string) (*sentinel.LoginSession, error) {
+		if !uuid.Equal(expectSessionID, sessionID) {
+			t.Errorf("Result should have been %v, but it was %v", expectSessionID, sessionID)
+		}
 		if expectStatus != status {
 			t.Errorf("Result should have been %v, but it was %v", expectStatus, status)
 		}
-		calledSetServiceStatus = true
-		return nil
+		if expectSecret2 != secret2 {
+			t.Errorf("Result should have been %v, but it was %v", expectSecret2, secret2)
+		}
+		if expectEnc1 != enc1 {
+			t.Errorf("Result should have been %v, but it was %v", expectEnc1, enc1)
+		}
+		calledAuth = true
+		return &sentinel.LoginSession{
+			UID:     sessionID,
+			UserID:  user.ID,
+			Secret2: secret2,
+			Enc1:    enc1,
+			Status:  status,
+			Service: &service,
+		}, nil
 	}
 
-	err := apiClient.Services.Auth(expectUID, expectEmail, expectStatus)
+	err := apiClient.Services.Auth(expectSessionID, "accept", expectSecret2, expectEnc1)
 	if err != nil {
-		t.Error(err)
+		t.Fatal(err)
+	}
+
+	if !calledAuth {
+		t.Error("!calledAuth")
+	}
+
+	select {
+	case v := <-callbacks:
+		expect := map[string]string{
+			"status":    string(expectStatus),
+			"secret2":   expectSecret2,
+			"sessionID": expectSessionID.String(),
+		}
+		if !reflect.DeepEqual(expect, v) {
+			t.Errorf("Result should have been %v, but it was %v", expect, v)
+		}
+	case <-time.After(time.Second):
+		t.Error("service was not called")
+	}
+}
+
+func TestServeQAuthStatusOtherUser(t *testing.T) {
+	setup()
+
+	user := &sentinel.User{ID: 1, UID: uuid.NewRandom()}
+	authorize(t, user)
+
+	store.Sessions.(*sentinel.MockSessionsService).GetFn = func(sessionID uuid.UUID) (*sentinel.LoginSession, error) {
+		return &sentinel.LoginSession{
+			UID:     sessionID,
+			UserID:  2,
+			Status:  sentinel.LoginPending,
+			Service: testServices[0],
+		}, nil
+	}
+	store.Sessions.(*sentinel.MockSessionsService).TransitionFn = func(sessionID uuid.UUID, status sentinel.LoginStatus, secret2, enc1 string) (*sentinel.LoginSession, error) {
+		t.Error("login request of another user was accepted")
+		return nil, nil
+	}
+
+	err := apiClient.Services.Auth(uuid.NewRandom(), "accept", "secret", "")
+
+	expect := ErrUnauthorizedClient.Name
+	result := ""
+	if e, ok := err.(*sentinel.ErrorResponse); ok {
+		result = e.Name
+	}
+	if expect != result {
+		t.Errorf("Result should have been %v, but it was %v", expect, result)
+	}
+}
+
+func TestServeQAuthStatusTimeout(t *testing.T) {
+	setup()
+
+	user := &sentinel.User{ID: 1, UID: uuid.NewRandom()}
+	authorize(t, user)
+
+	store.Sessions.(*sentinel.MockSessionsService).GetFn = func(sessionID uuid.UUID) (*sentinel.LoginSession, error) {
+		return &sentinel.LoginSession{
+			UID:     sessionID,
+			UserID:  user.ID,
+			Status:  sentinel.LoginPending,
+			Service: testServices[0],
+		}, nil
+	}
+	store.Sessions.(*sentinel.MockSessionsService).TransitionFn = func(sessionID uuid.UUID, status sentinel.LoginStatus, secret2, enc1 string) (*sentinel.LoginSession, error) {
+		return nil, sentinel.ErrLoginTimeout
+	}
+
+	err := apiClient.Services.Auth(uuid.NewRandom(), "accept", "secret", "")
+
+	expect := ErrLoginTimeout.Name
+	result := ""
+	if e, ok := err.(*sentinel.ErrorResponse); ok {
+		result = e.Name
+	}
+	if expect != result {
+		t.Errorf("Result should have been %v, but it was %v", expect, result)
+	}
+}
+
+func TestExpireSessions(t *testing.T) {
+	setup()
+
+	expectSessionID := uuid.NewRandom()
+
+	callbacks := make(chan map[string]string, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if err := callback.Verify(r.Header.Get(callback.SignatureHeader), body, publicKey); err != nil {
+			t.Error(err)
+		}
+		var v map[string]string
+		json.Unmarshal(body, &v)
+		callbacks <- v
+	}))
+	defer ts.Close()
+
+	service := *testServices[0]
+	service.BaseURL = ts.URL
+
+	store.Sessions.(*sentinel.MockSessionsService).ExpireFn = func() ([]*sentinel.LoginSession, error) {
+		return []*sentinel.LoginSession{
+			&sentinel.LoginSession{
+				UID:     expectSessionID,
+				Status:  sentinel.LoginExpired,
+				Service: &service,
+			},
+		}, nil
+	}
+
+	if err := expireSessions(); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case v := <-callbacks:
+		expect := map[string]string{
+			"error":             "login_timeout",
+			"error_description": "login was not confirmed within default timeout",
+			"sessionID":         expectSessionID.String(),
+		}
+		if !reflect.DeepEqual(expect, v) {
+			t.Errorf("Result should have been %v, but it was %v", expect, v)
+		}
+	case <-time.After(time.Second):
+		t.Error("service was not called")
+	}
+}
+
+func TestServeAuthServiceNotify(t *testing.T) {
+	setup()
+
+	callbacks := make(chan map[string]string, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var v map[string]string
+		json.NewDecoder(r.Body).Decode(&v)
+		callbacks <- v
+	}))
+	defer ts.Close()
+
+	service := *testServices[0]
+	service.BaseURL = ts.URL
+	service.AuthLevel = sentinel.AuthLevelNotify
+
+	user := &sentinel.User{
+		ID:               1,
+		UID:              uuid.NewRandom(),
+		DefaultAuthLevel: sentinel.AuthLevelNotify,
+	}
+	authorizeService(t, &service)
+
+	store.Users.(*sentinel.MockUsersService).ListFn = func(opt sentinel.UserListOptions) ([]*sentinel.User, error) {
+		return []*sentinel.User{user}, nil
+	}
+
+	expectSessionID := uuid.NewRandom()
+	store.Sessions.(*sentinel.MockSessionsService).CreateFn = func(serviceID, userID, authLevel int, email, secret1 string, isOIDC bool) (*sentinel.LoginSession, error) {
+		return &sentinel.LoginSession{
+			UID:       expectSessionID,
+			UserID:    userID,
+			Email:     email,
+			AuthLevel: authLevel,
+			Status:    sentinel.LoginPending,
+			Service:   &service,
+		}, nil
+	}
+	store.Sessions.(*sentinel.MockSessionsService).TransitionFn = func(sessionID uuid.UUID, status sentinel.LoginStatus, secret2, enc1 string) (*sentinel.LoginSession, error) {
+		if status != sentinel.LoginAccepted {
+			t.Errorf("Result should have been %v, but it was %v", sentinel.LoginAccepted, status)
+		}
+		return &sentinel.LoginSession{
+			UID:       sessionID,
+			UserID:    user.ID,
+			AuthLevel: sentinel.AuthLevelNotify,
+			Status:    status,
+			Service:   &service,
+		}, nil
+	}
+
+	session, err := apiClient.Services.Login(service.UID, "jack@example.com", "secret1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if session.Status != sentinel.LoginAccepted {
+		t.Errorf("Result should have been %v, but it was %v", sentinel.LoginAccepted, session.Status)
+	}
+	if session.AuthLevel != sentinel.AuthLevelNotify {
+		t.Errorf("Result should have been %v, but it was %v", sentinel.AuthLevelNotify, session.AuthLevel)
 	}
 
-	if !calledSetServiceStatus {
-		t.Error("!calledSetServiceStatus")
+	select {
+	case v := <-callbacks:
+		expect := map[string]string{
+			"status":    string(sentinel.LoginAccepted),
+			"sessionID": expectSessionID.String(),
+		}
+		if !reflect.DeepEqual(expect, v) {
+			t.Errorf("Result should have been %v, but it was %v", expect, v)
+		}
+	case <-time.After(time.Second):
+		t.Error("service was not called")
+	}
+}
+
+func TestServeQAuthStatusSecure(t *testing.T) {
+	setup()
+
+	user := &sentinel.User{ID: 1, UID: uuid.NewRandom()}
+	token := authorize(t, user)
+
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	otherKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	b, _ := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	own := &sentinel.Device{
+		UID:       uuid.NewRandom(),
+		UserID:    user.ID,
+		PublicKey: string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: b})),
+		IsActive:  true,
+	}
+	other := &sentinel.Device{UID: uuid.NewRandom(), UserID: 2, PublicKey: own.PublicKey, IsActive: true}
+	inactive := &sentinel.Device{UID: uuid.NewRandom(), UserID: user.ID, PublicKey: own.PublicKey}
+	store.Devices.(*sentinel.MockDevicesService).GetFn = func(uid uuid.UUID) (*sentinel.Device, error) {
+		for _, d := range []*sentinel.Device{own, other, inactive} {
+			if uuid.Equal(d.UID, uid) {
+				return d, nil
+			}
+		}
+		return nil, sql.ErrNoRows
+	}
+	mockRevocations()
+
+	// Stand-in for the status endpoint of the service
+	callbacks := make(chan struct{}, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		callbacks <- struct{}{}
+	}))
+	defer ts.Close()
+	service := *testServices[0]
+	service.BaseURL = ts.URL
+
+	sessionID := uuid.NewRandom()
+	store.Sessions.(*sentinel.MockSessionsService).GetFn = func(uid uuid.UUID) (*sentinel.LoginSession, error) {
+		return &sentinel.LoginSession{
+			UID:       uid,
+			UserID:    user.ID,
+			AuthLevel: sentinel.AuthLevelSecure,
+			Status:    sentinel.LoginPending,
+			Service:   &service,
+		}, nil
+	}
+	transitions := 0
+	store.Sessions.(*sentinel.MockSessionsService).TransitionFn = func(uid uuid.UUID, status sentinel.LoginStatus, secret2, enc1 string) (*sentinel.LoginSession, error) {
+		transitions++
+		return &sentinel.LoginSession{UID: uid, UserID: user.ID, Status: status, Service: &service}, nil
+	}
+
+	// The status claim holds the canonical status, whichever form the request uses
+	sign := func(device *sentinel.Device, k *ecdsa.PrivateKey, status, secret2 string, iat time.Time, nonce string) string {
+		s, err := tokens.SignDevice(tokens.Claims{
+			"sessionID": sessionID.String(),
+			"status":    status,
+			"secret2":   secret2,
+			"iat":       iat.Unix(),
+			"nonce":     nonce,
+		}, device.UID.String(), k)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+	now := time.Now()
+	valid := sign(own, key, "accepted", "secret", now, "3q2-7wAAAAAAAAAA")
+
+	tests := []struct {
+		signature string
+		status    int
+	}{
+		{"", http.StatusForbidden},
+		{sign(own, otherKey, "accepted", "secret", now, "3q2-7wAAAAAAAAAB"), http.StatusForbidden},
+		{sign(own, key, "accepted", "other", now, "3q2-7wAAAAAAAAAC"), http.StatusForbidden},
+		{sign(own, key, "accepted", "secret", now.Add(-sentinel.LoginTimeout*2), "3q2-7wAAAAAAAAAD"), http.StatusForbidden},
+		{sign(own, key, "accepted", "secret", now, "short"), http.StatusForbidden},
+		{sign(other, key, "accepted", "secret", now, "3q2-7wAAAAAAAAAE"), http.StatusForbidden},
+		{sign(inactive, key, "accepted", "secret", now, "3q2-7wAAAAAAAAAF"), http.StatusForbidden},
+		{sign(own, key, "accept", "secret", now, "3q2-7wAAAAAAAAAG"), http.StatusForbidden},
+		{sign(own, key, "declined", "secret", now, "3q2-7wAAAAAAAAAH"), http.StatusForbidden},
+		{valid, http.StatusNoContent},
+		{valid, http.StatusForbidden},
+	}
+	for i, tt := range tests {
+		resp, _ := doRequest(t, "POST", router.QAuthStatus, nil, token, map[string]string{
+			"sessionID": sessionID.String(),
+			"status":    "accept",
+			"secret2":   "secret",
+			"signature": tt.signature,
+		}, nil)
+		if resp.StatusCode != tt.status {
+			t.Errorf("%d: Result should have been %v, but it was %v", i, tt.status, resp.StatusCode)
+		}
+	}
+	if transitions != 1 {
+		t.Errorf("Result should have been %v, but it was %v", 1, transitions)
+	}
+
+	select {
+	case <-callbacks:
+	case <-time.After(time.Second):
+		t.Error("service was not called")
+	}
+}
+
+func TestEffectiveAuthLevel(t *testing.T) {
+	tests := []struct {
+		user, service, expect int
+	}{
+		{sentinel.AuthLevelUnknown, sentinel.AuthLevelUnknown, sentinel.AuthLevelFast},
+		{sentinel.AuthLevelNotify, sentinel.AuthLevelUnknown, sentinel.AuthLevelNotify},
+		{sentinel.AuthLevelNotify, sentinel.AuthLevelFast, sentinel.AuthLevelFast},
+		{sentinel.AuthLevelSecure, sentinel.AuthLevelNotify, sentinel.AuthLevelSecure},
+	}
+	for _, tt := range tests {
+		result := sentinel.EffectiveAuthLevel(
+			&sentinel.User{DefaultAuthLevel: tt.user},
+			&sentinel.Service{AuthLevel: tt.service},
+		)
+		if tt.expect != result {
+			t.Errorf("Result should have been %v, but it was %v", tt.expect, result)
+		}
+	}
+}
+
+func TestServeCreateService(t *testing.T) {
+	setup()
+
+	user := &sentinel.User{ID: 1, UID: uuid.NewRandom()}
+	authorize(t, user)
+
+	expectOpt := sentinel.ServiceUpdateOptions{
+		Name:         "Shoeland",
+		BaseURL:      "https://api.shoeland.example.com/status",
+		LogoURL:      "https://cdn.shoeland.example.com/i/logo.png",
+		AuthLevel:    sentinel.AuthLevelSecure,
+		RedirectURIs: []string{"https://shoeland.example.com/a", "https://shoeland.example.com/b"},
+	}
+
+	calledCreate := false
+	store.Services.(*sentinel.MockServicesService).CreateFn = func(opt sentinel.ServiceUpdateOptions) (*sentinel.Service, error) {
+		if opt.Owner == nil || !uuid.Equal(user.UID, *opt.Owner) {
+			t.Errorf("Result should have been %v, but it was %v", user.UID, opt.Owner)
+		}
+		opt.Owner = nil
+		if !reflect.DeepEqual(expectOpt, opt) {
+			t.Errorf("Result should have been %v, but it was %v", expectOpt, opt)
+		}
+		calledCreate = true
+		return &sentinel.Service{
+			UID:          uuid.NewRandom(),
+			Name:         opt.Name,
+			BaseURL:      opt.BaseURL,
+			LogoURL:      opt.LogoURL,
+			AuthLevel:    opt.AuthLevel,
+			ClientID:     "0b6c1e1d7f4a4b0d8f6f3e5d2a1c9b8e",
+			ClientSecret: "secret",
+			OwnerID:      user.ID,
+		}, nil
+	}
+
+	service, err := apiClient.Services.Create(expectOpt)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !calledCreate {
+		t.Error("!calledCreate")
+	}
+	if service.ClientID == "" || service.ClientSecret == "" {
+		t.Errorf("client credentials should have been issued, but they were %q and %q", service.ClientID, service.ClientSecret)
+	}
+}
+
+func TestServeListServices(t *testing.T) {
+	setup()
+
+	user := &sentinel.User{ID: 1, UID: uuid.NewRandom()}
+	authorize(t, user)
+
+	var listed sentinel.ServiceListOptions
+	store.Services.(*sentinel.MockServicesService).ListFn = func(opt sentinel.ServiceListOptions) ([]*sentinel.Service, error) {
+		listed = opt
+		return []*sentinel.Service{testServices[0]}, nil
+	}
+
+	opt := sentinel.ServiceListOptions{
+		IncludeArchived: true,
+		ListOptions:     sentinel.ListOptions{First: 10, Last: 19},
+	}
+	services, err := apiClient.Services.List(opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(services) != 1 {
+		t.Errorf("Result should have been %v, but it was %v", 1, len(services))
+	}
+	if listed.Owner == nil || !uuid.Equal(*listed.Owner, user.UID) {
+		t.Errorf("Result should have been %v, but it was %v", user.UID, listed.Owner)
+	}
+	if !listed.IncludeArchived || listed.First != 10 || listed.Last != 19 {
+		t.Errorf("Result should have been %+v, but it was %+v", opt, listed)
+	}
+}
+
+func TestServeRotateServiceSecretNotOwner(t *testing.T) {
+	setup()
+
+	user := &sentinel.User{ID: 1, UID: uuid.NewRandom()}
+	authorize(t, user)
+
+	service := *testServices[0]
+	service.OwnerID = 2
+	store.Services.(*sentinel.MockServicesService).GetFn = func(uid uuid.UUID) (*sentinel.Service, error) {
+		return &service, nil
+	}
+	store.Services.(*sentinel.MockServicesService).RotateSecretFn = func(uid uuid.UUID) (*sentinel.Service, error) {
+		t.Error("secret of a service owned by another user was rotated")
+		return nil, nil
+	}
+
+	_, err := apiClient.Services.RotateSecret(service.UID)
+
+	expect := ErrNotFound.Name
+	result := ""
+	if e, ok := err.(*sentinel.ErrorResponse); ok {
+		result = e.Name
+	}
+	if expect != result {
+		t.Errorf("Result should have been %v, but it was %v", expect, result)
+	}
+}
+
+func TestServeDeleteService(t *testing.T) {
+	setup()
+
+	user := &sentinel.User{ID: 1, UID: uuid.NewRandom()}
+	authorize(t, user)
+
+	service := *testServices[0]
+	service.OwnerID = user.ID
+	store.Services.(*sentinel.MockServicesService).GetFn = func(uid uuid.UUID) (*sentinel.Service, error) {
+		return &service, nil
+	}
+
+	calledArchive := false
+	store.Services.(*sentinel.MockServicesService).ArchiveFn = func(uid uuid.UUID) error {
+		if !uuid.Equal(service.UID, uid) {
+			t.Errorf("Result should have been %v, but it was %v", service.UID, uid)
+		}
+		calledArchive = true
+		return nil
+	}
+
+	if err := apiClient.Services.Archive(service.UID); err != nil {
+		t.Fatal(err)
+	}
+
+	if !calledArchive {
+		t.Error("!calledArchive")
+	}
+}
+
+func TestServeAuthServiceOtherService(t *testing.T) {
+	setup()
+
+	service := *testServices[0]
+	authorizeService(t, &service)
+
+	store.Sessions.(*sentinel.MockSessionsService).CreateFn = func(serviceID, userID, authLevel int, email, secret1 string, isOIDC bool) (*sentinel.LoginSession, error) {
+		t.Error("login request was created on behalf of another service")
+		return nil, nil
+	}
+
+	_, err := apiClient.Services.Login(testServices[1].UID, "jack@example.com", "secret1")
+
+	expect := ErrUnauthorizedClient.Name
+	result := ""
+	if e, ok := err.(*sentinel.ErrorResponse); ok {
+		result = e.Name
+	}
+	if expect != result {
+		t.Errorf("Result should have been %v, but it was %v", expect, result)
+	}
+}
+
+func TestAuthorizedService(t *testing.T) {
+	setup()
+	mockRevocations()
+
+	service := *testServices[0]
+	service.PublicKey = publicKey
+	authorizeService(t, &service)
+
+	used := func() string {
+		opt := tokens.ClientAssertionOptions
+		opt.Issuer = service.ClientID
+		s, _ := tokens.Sign(tokens.Claims{}, privateKey, &opt)
+		return s
+	}()
+
+	assertion := func() string {
+		opt := tokens.ClientAssertionOptions
+		opt.Issuer = service.ClientID
+		s, _ := tokens.Sign(tokens.Claims{}, privateKey, &opt)
+		return s
+	}
+	assertionForm := func(r *http.Request, assertionType, s string) {
+		form := url.Values{"client_assertion_type": {assertionType}, "client_assertion": {s}}
+		r.Body = ioutil.NopCloser(strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+
+	tests := []struct {
+		setAuth func(r *http.Request)
+		err     error
+	}{
+		// Client ID and secret
+		{func(r *http.Request) { apiClient.AuthorizeClient(r) }, nil},
+		{func(r *http.Request) { r.SetBasicAuth(service.ClientID, "wrong") }, ErrInvalidClient},
+		{func(r *http.Request) { r.SetBasicAuth("unknown", "secret") }, ErrInvalidClient},
+		// JWT assertion signed with the private key of the service
+		{func(r *http.Request) {
+			opt := tokens.ClientAssertionOptions
+			opt.Issuer = service.ClientID
+			s, _ := tokens.Sign(tokens.Claims{}, privateKey, &opt)
+			r.Header.Set("Authorization", "Bearer "+s)
+		}, nil},
+		{func(r *http.Request) {
+			opt := tokens.ClientAssertionOptions
+			opt.Issuer = service.ClientID
+			opt.Audience = "https://example.com"
+			s, _ := tokens.Sign(tokens.Claims{}, privateKey, &opt)
+			r.Header.Set("Authorization", "Bearer "+s)
+		}, ErrInvalidAuthenticationToken},
+		{func(r *http.Request) {
+			opt := tokens.ClientAssertionOptions
+			opt.Issuer = service.ClientID
+			opt.TTL = time.Hour
+			s, _ := tokens.Sign(tokens.Claims{}, privateKey, &opt)
+			r.Header.Set("Authorization", "Bearer "+s)
+		}, ErrInvalidAuthenticationToken.Append("assertion is valid for too long")},
+		{func(r *http.Request) {
+			opt := tokens.ClientAssertionOptions
+			opt.Issuer = "unknown"
+			s, _ := tokens.Sign(tokens.Claims{}, privateKey, &opt)
+			r.Header.Set("Authorization", "Bearer "+s)
+		}, ErrInvalidClient},
+		// An assertion can be used once
+		{func(r *http.Request) { r.Header.Set("Authorization", "Bearer "+used) }, nil},
+		{func(r *http.Request) { r.Header.Set("Authorization", "Bearer "+used) }, ErrInvalidAuthenticationToken.Append("assertion was used")},
+		// JWT assertion as form parameter
+		{func(r *http.Request) { assertionForm(r, ClientAssertionType, assertion()) }, nil},
+		{func(r *http.Request) { assertionForm(r, "urn:example", assertion()) }, ErrUnsupportedAuthenticationMethod},
+		{func(r *http.Request) { assertionForm(r, ClientAssertionType, "") }, ErrInvalidRequest.Append("client_assertion parameter should not be empty")},
+		{func(r *http.Request) {
+			assertionForm(r, ClientAssertionType, assertion())
+			apiClient.AuthorizeClient(r)
+		}, ErrInvalidRequest.Append("more than one authentication method was included")},
+		{func(r *http.Request) {}, ErrNoAuthentionMethodIncluded},
+	}
+	for i, tt := range tests {
+		r, _ := http.NewRequest("POST", "/qauth/login", nil)
+		tt.setAuth(r)
+		result, err := AuthorizedService(r)
+		if tt.err != nil {
+			if err != tt.err {
+				t.Errorf("%d: Result should have been %v, but it was %v", i, tt.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%d: %s", i, err)
+			continue
+		}
+		if !uuid.Equal(service.UID, result.UID) {
+			t.Errorf("%d: Result should have been %v, but it was %v", i, service.UID, result.UID)
+		}
 	}
 }
@@ -10,6 +10,7 @@ import (
 	"mime"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 
@@ -21,7 +22,6 @@ import (
 
 	"code.google.com/p/go-uuid/uuid"
 	"github.com/gorilla/mux"
-	"github.com/keighl/mandrill"
 	"github.com/lib/pq"
 )
 
@@ -30,55 +30,72 @@ const (
 	AuthenticationRealm  = "https://sentinel.sh"
 )
 
-var (
-	privateKey string
-	publicKey  string
+// revokeUserTTL is how long a revocation of all tokens of a user is kept, the
+// longest TTL of the tokens issued to users.
+var revokeUserTTL = tokens.VerifyEmailOptions.TTL
 
-	mc *mandrill.Client
+var (
+	// keyring signs and verifies the tokens issued by Sentinel
+	keyring = &tokens.Keyring{}
 )
 
 func init() {
-	privateKey = os.Getenv("PRIVATE_KEY")
-	publicKey = os.Getenv("PUBLIC_KEY")
-
-	key := os.Getenv("MANDRILL_KEY")
-	if key == "" {
-		key = "SANDBOX_ERROR"
+	if key := os.Getenv("PRIVATE_KEY"); key != "" {
+		k, err := tokens.KeyringFromPEM(key, os.Getenv("PUBLIC_KEY"))
+		if err != nil {
+			log.Fatal("Error reading PRIVATE_KEY: ", err)
+		}
+		keyring = k
 	}
-	mc = mandrill.ClientWithKey(key)
 }
 
 func Authorized(r *http.Request) (*sentinel.User, error) {
+	user, _, err := authorizedToken(r, &tokens.AccessTokenOptions)
+	return user, err
+}
+
+// authorizedToken returns the user authenticated by the access token of the
+// request along with the verified token. Only access tokens signed with the
+// given options are accepted.
+func authorizedToken(r *http.Request, opt *tokens.Options) (*sentinel.User, *tokens.Token, error) {
 	prefix := AuthenticationScheme + " "
 
 	auth := r.Header.Get("Authorization")
 	if auth == "" {
-		return nil, ErrNoAuthentionMethodIncluded
+		return nil, nil, ErrNoAuthentionMethodIncluded
 	}
 	if !strings.HasPrefix(auth, prefix) {
-		return nil, ErrUnsupportedAuthenticationMethod
+		return nil, nil, ErrUnsupportedAuthenticationMethod
 	}
 
 	tokenStr := strings.TrimPrefix(auth, prefix)
-	claims, err := tokens.Verify(tokenStr, publicKey, &tokens.AccessTokenOptions)
+	token, err := keyring.VerifyToken(tokenStr, opt)
 	if err != nil {
-		return nil, ErrInvalidAuthenticationToken
+		return nil, nil, ErrInvalidAuthenticationToken
 	}
-	userIDStr := claims["user_id"].(string)
+	userIDStr, _ := token.Claims["user_id"].(string)
 	if err := validate.UUIDv4(userIDStr); err != nil {
-		return nil, ErrInvalidAuthenticationToken.Append("value of claim 'user_id' was invalid")
+		return nil, nil, ErrInvalidAuthenticationToken.Append("value of claim 'user_id' was invalid")
 	}
 	userID := uuid.Parse(userIDStr)
 
+	revoked, err := store.Revocations.IsRevoked(token.ID, userID, token.IssuedAt)
+	if err != nil {
+		return nil, nil, err
+	}
+	if revoked {
+		return nil, nil, ErrInvalidAuthenticationToken.Append("token was revoked")
+	}
+
 	user, err := store.Users.GetUserDetails(userID)
 	if err != nil {
 		if err == sql.ErrNoRows {
-			return nil, ErrInvalidClient
+			return nil, nil, ErrInvalidClient
 		}
-		return nil, err
+		return nil, nil, err
 	}
 
-	return user, nil
+	return user, token, nil
 }
 
 func serveGetUserDetails(w http.ResponseWriter, r *http.Request) error {
@@ -124,6 +141,17 @@ func serveSignup(w http.ResponseWriter, r *http.Request) error {
 		return err
 	}
 
+	// The language of the request is the preference of the new user, the
+	// email verification is sent in it
+	if locale := requestLocale(r); locale != "" {
+		_, err := store.Users.UpdateDetails(user.UID, sentinel.UserUpdateOptions{Locale: locale})
+		if err != nil {
+			log.Println("storing the locale of a new user failed with error:", err)
+		} else {
+			user.Locale = locale
+		}
+	}
+
 	// Response
 	u, err := apiRouter.Get(router.GetUserDetails).URL()
 	if err != nil {
@@ -138,33 +166,38 @@ func serveSignup(w http.ResponseWriter, r *http.Request) error {
 		w.WriteHeader(http.StatusCreated)
 	}
 
-	// Create token
-	claims := tokens.Claims{
-		"email_id": user.AuthEmailList[0].UID.String(),
-		"user_id":  user.UID.String(),
-	}
-	tokenStr, err := tokens.Sign(claims, privateKey, &tokens.VerifyEmailOptions)
-	if err != nil {
-		log.Println("signing verify-email token failed due error:", err)
-		return nil
-	}
-
-	// Send email verification
-	msg := NewVerifyEmailMessage(tokenStr)
-	msg.AddRecipient(email, "", "to")
-	a, err := mc.MessagesSend(msg)
-	if err != nil {
-		log.Println("calling Mandrill failed with error:", err)
-		return nil
-	}
-	for _, e := range a {
-		log.Println("sent email-verification message with Mandrill id:", e.Id)
-	}
+	// Send email verification, stored in the outbox by Signup
+	wakeMailer()
 
 	return nil
 }
 
+// serveCreateToken issues an access token and a refresh token. The user
+// authenticates with either the email address and password or, using the
+// refresh_token grant type, a refresh token. Services exchange authorization
+// codes using the authorization_code grant type, see serveAuthorize.
 func serveCreateToken(w http.ResponseWriter, r *http.Request) error {
+	expectMediatype := "application/x-www-form-urlencoded"
+	if mt, _, err := mime.ParseMediaType(r.Header.Get("Content-Type")); err == nil && mt == expectMediatype {
+		if err := r.ParseForm(); err != nil {
+			return err
+		}
+	}
+
+	switch r.PostForm.Get("grant_type") {
+	case "", "password":
+		return servePasswordGrant(w, r)
+	case "refresh_token":
+		return serveRefreshTokenGrant(w, r)
+	case "authorization_code":
+		return serveAuthorizationCodeGrant(w, r)
+	case "mfa_otp":
+		return serveMFAGrant(w, r)
+	}
+	return ErrUnsupportedGrantType
+}
+
+func servePasswordGrant(w http.ResponseWriter, r *http.Request) error {
 	prefix := "Basic "
 
 	auth := r.Header.Get("Authorization")
@@ -198,30 +231,98 @@ func serveCreateToken(w http.ResponseWriter, r *http.Request) error {
 		return ErrUnknownClient
 	}
 	user := users[0]
+
+	// The account is locked temporarily after repeated failed logins
+	lockout := lockoutKey(email)
+	wait, err := store.RateLimits.Wait(lockout, sentinel.LockoutLimit)
+	if err != nil {
+		return err
+	}
+	if wait > 0 {
+		return tooManyRequests(w, wait, "account is temporarily locked after repeated failed logins")
+	}
 	if err := datastore.ComparePassword(user, password); err != nil {
+		recordEvent(r, user.UID, sentinel.EventLoginFailed, "")
+		if _, err := store.RateLimits.Take(lockout, sentinel.LockoutLimit); err != nil {
+			return err
+		}
+		if wait, err := store.RateLimits.Wait(lockout, sentinel.LockoutLimit); err == nil && wait > 0 {
+			recordEvent(r, user.UID, sentinel.EventAccountLocked, "until="+time.Now().Add(wait).UTC().Format(time.RFC3339))
+		}
 		return ErrInvalidAuthenticationCredentials
 	}
+	if err := store.RateLimits.Reset(lockout); err != nil {
+		return err
+	}
 
-	// Generate Token
-	// Set token options
-	opt := tokens.AccessTokenOptions
-	expectMediatype := "application/x-www-form-urlencoded"
-	if mt, _, err := mime.ParseMediaType(r.Header.Get("Content-Type")); err == nil || mt == expectMediatype {
-		if err := r.ParseForm(); err != nil {
-			return err
+	clientID := r.PostForm.Get("client_id")
+	if len(clientID) > 255 {
+		return ErrInvalidRequest.Append("client_id exceeds max of 255 characters")
+	}
+
+	// The password alone isn't enough when the user has a second factor
+	if user.TOTPEnabled {
+		return writeMFARequired(w, user, clientID)
+	}
+
+	rt, err := store.RefreshTokens.Issue(user.ID, clientID, "")
+	if err != nil {
+		return err
+	}
+	recordEvent(r, user.UID, sentinel.EventLogin, "client_id="+clientID)
+	return writeTokens(w, user.UID, clientID, rt)
+}
+
+// serveRefreshTokenGrant exchanges a refresh token for a new access token and
+// refresh token, the used refresh token can't be used again.
+func serveRefreshTokenGrant(w http.ResponseWriter, r *http.Request) error {
+	token := r.PostForm.Get("refresh_token")
+	if token == "" {
+		return ErrInvalidRequest.Append("refresh_token parameter should not be empty")
+	}
+
+	// Check the client before the token is used, a stolen token can't be
+	// used up without the credentials of the service
+	rt, err := store.RefreshTokens.Get(token)
+	if err != nil {
+		if err == sentinel.ErrRefreshTokenInvalid {
+			return ErrInvalidGrant
 		}
-		if s := r.PostForm.Get("client_id"); len(s) > 255 {
-			return ErrInvalidRequest.Append("client_id exceeds max of 255 characters")
-		} else {
-			opt.Audience = s
+		return err
+	}
+	if err := authorizeClient(r, rt.ClientID); err != nil {
+		return err
+	}
+
+	rt, err = store.RefreshTokens.Rotate(token)
+	if err != nil {
+		switch err {
+		case sentinel.ErrRefreshTokenReused:
+			log.Println("refresh token reused, revoked token family")
+			return ErrInvalidGrant
+		case sentinel.ErrRefreshTokenInvalid:
+			return ErrInvalidGrant
 		}
+		return err
 	}
-	// Set token claims
+	recordEvent(r, rt.UserUID, sentinel.EventTokenIssued, "grant_type=refresh_token client_id="+rt.ClientID)
+	return writeTokens(w, rt.UserUID, rt.ClientID, rt)
+}
+
+// writeTokens signs an access token for the user and writes it along with the
+// refresh token. Refresh tokens issued by the OpenID Connect flow get an
+// access token for the userinfo endpoint with the same scope.
+func writeTokens(w http.ResponseWriter, userID uuid.UUID, clientID string, rt *sentinel.RefreshToken) error {
+	if rt.Scope != "" {
+		return writeOIDCTokens(w, userID, clientID, rt, "")
+	}
+
+	opt := tokens.AccessTokenOptions
+	opt.Audience = clientID
 	claims := tokens.Claims{
-		"user_id": user.UID.String(),
+		"user_id": userID.String(),
 	}
-	// Sign token
-	tokenStr, err := tokens.Sign(claims, privateKey, &opt)
+	tokenStr, err := keyring.Sign(claims, &opt)
 	if err != nil {
 		return err
 	}
@@ -230,13 +331,112 @@ func serveCreateToken(w http.ResponseWriter, r *http.Request) error {
 	w.Header().Add("Cache-Control", "no-store")
 	w.Header().Add("Pragma", "no-cache")
 	data := map[string]interface{}{
-		"token_type": "Bearer",
-		"expires_in": (opt.TTL / time.Second).Nanoseconds(),
-		"id_token":   tokenStr,
+		"token_type":    "Bearer",
+		"expires_in":    (opt.TTL / time.Second).Nanoseconds(),
+		"id_token":      tokenStr,
+		"refresh_token": rt.Token,
+	}
+	return writeJSON(w, http.StatusOK, data)
+}
+
+// authorizeClient checks the client of a request which presents a token issued
+// to the client ID. Tokens issued to a registered service can only be used by
+// the service itself, authenticated with its client credentials.
+func authorizeClient(r *http.Request, clientID string) error {
+	if clientID == "" {
+		return nil
+	}
+	if _, err := store.Services.GetByClientID(clientID); err != nil {
+		if err == sql.ErrNoRows {
+			return nil
+		}
+		return err
 	}
-	if err := writeJSON(w, http.StatusOK, data); err != nil {
+	service, err := AuthorizedService(r)
+	if err != nil {
 		return err
 	}
+	if service.ClientID != clientID {
+		return ErrUnauthorizedClient.Append("token was issued to another client")
+	}
+	return nil
+}
+
+// serveRevokeToken revokes an access token or a refresh token as described in
+// RFC 7009. Revoking a refresh token revokes all refresh tokens rotated from
+// the same token. Invalid tokens are ignored as the client can't act on them.
+// Tokens issued to a registered service can only be revoked by the service.
+func serveRevokeToken(w http.ResponseWriter, r *http.Request) error {
+	expectMediatype := "application/x-www-form-urlencoded"
+	if mt, _, err := mime.ParseMediaType(r.Header.Get("Content-Type")); err != nil || mt != expectMediatype {
+		return ErrUnsupportedMediatype.Append("expected " + expectMediatype)
+	}
+
+	if err := r.ParseForm(); err != nil {
+		return err
+	}
+
+	tokenStr := r.PostForm.Get("token")
+	if err := validate.NotEmpty(tokenStr); err != nil {
+		return ErrInvalidRequest.Append(`token parameter should not be empty`)
+	}
+
+	// The hint only tells which type of token to try first, both types are
+	// tried regardless
+	switch r.PostForm.Get("token_type_hint") {
+	case "", "access_token", "refresh_token":
+	default:
+		return ErrUnsupportedTokenType
+	}
+
+	token, err := keyring.VerifyToken(tokenStr, &tokens.AccessTokenOptions)
+	if err != nil {
+		token, err = keyring.VerifyToken(tokenStr, &tokens.OIDCAccessTokenOptions)
+	}
+	if err == nil {
+		if err := authorizeClient(r, token.Audience); err != nil {
+			return err
+		}
+		userIDStr, _ := token.Claims["user_id"].(string)
+		if err := validate.UUIDv4(userIDStr); err == nil {
+			if err := store.Revocations.Revoke(token.ID, uuid.Parse(userIDStr), token.Expires); err != nil {
+				return err
+			}
+		}
+	} else if rt, err := store.RefreshTokens.Get(tokenStr); err == nil {
+		if err := authorizeClient(r, rt.ClientID); err != nil {
+			return err
+		}
+		if err := store.RefreshTokens.Revoke(tokenStr); err != nil {
+			return err
+		}
+	} else if err != sentinel.ErrRefreshTokenInvalid {
+		return err
+	}
+
+	w.Header().Add("Cache-Control", "no-store")
+	w.Header().Add("Pragma", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	return nil
+}
+
+// serveLogout logs the authorized user out everywhere by revoking all tokens
+// issued to the user until now, including the refresh tokens.
+func serveLogout(w http.ResponseWriter, r *http.Request) error {
+	user, err := Authorized(r)
+	if err != nil {
+		return err
+	}
+
+	if err := store.Revocations.RevokeUser(user.UID, time.Now().Add(revokeUserTTL)); err != nil {
+		return err
+	}
+	if err := store.RefreshTokens.RevokeUser(user.ID); err != nil {
+		return err
+	}
+	recordEvent(r, user.UID, sentinel.EventLogout, "")
+
+	w.WriteHeader(http.StatusNoContent)
 	return nil
 }
 
@@ -252,13 +452,13 @@ func serveAckEmail(w http.ResponseWriter, r *http.Request) error {
 
 	tokenStr := r.PostForm.Get("token")
 
-	claims, err := tokens.Verify(tokenStr, publicKey, &tokens.VerifyEmailOptions)
+	token, err := keyring.VerifyToken(tokenStr, &tokens.VerifyEmailOptions)
 	if err != nil {
 		return ErrInvalidToken
 	}
 
-	emailIDStr := claims["email_id"].(string)
-	userIDStr := claims["user_id"].(string)
+	emailIDStr, _ := token.Claims["email_id"].(string)
+	userIDStr, _ := token.Claims["user_id"].(string)
 
 	// Validate token data
 	if err := validate.UUIDv4(emailIDStr); err != nil {
@@ -268,8 +468,43 @@ func serveAckEmail(w http.ResponseWriter, r *http.Request) error {
 		return ErrInvalidToken.Append("value of claim 'user_id' was invalid")
 	}
 
-	// TODO: verify if the email address is associated with the user
+	// The token can only be used once
+	userID := uuid.Parse(userIDStr)
+	revoked, err := store.Revocations.IsRevoked(token.ID, userID, token.IssuedAt)
+	if err != nil {
+		return err
+	}
+	if revoked {
+		return ErrInvalidToken.Append("token was revoked")
+	}
+
+	// The email must belong to the user
 	emailID := uuid.Parse(emailIDStr)
+	email, err := store.Users.GetEmail(emailID)
+	if err == sql.ErrNoRows {
+		return ErrInvalidToken.Append("email not found")
+	}
+	if err != nil {
+		return err
+	}
+	user, err := store.Users.GetUserDetails(userID)
+	if err == sql.ErrNoRows {
+		return ErrInvalidToken.Append("user not found")
+	}
+	if err != nil {
+		return err
+	}
+	if email.UserID != user.ID {
+		return ErrInvalidToken.Append("email doesn't belong to the user")
+	}
+
+	unused, err := store.Revocations.Use(token.ID, userID, token.Expires)
+	if err != nil {
+		return err
+	}
+	if !unused {
+		return ErrInvalidToken.Append("token was revoked")
+	}
 
 	// Set authemail to verified
 	if err := store.Users.AckEmail(emailID); err != nil {
@@ -278,9 +513,94 @@ func serveAckEmail(w http.ResponseWriter, r *http.Request) error {
 		}
 		return err
 	}
+	recordEvent(r, user.UID, sentinel.EventEmailVerified, "email="+email.Email)
+
+	w.WriteHeader(http.StatusNoContent)
+
+	return nil
+}
+
+// serveResendAckEmail sends a new verification message to an unverified
+// email of the authenticated user. Messages to the same email are throttled,
+// see sentinel.ResendVerificationInterval.
+func serveResendAckEmail(w http.ResponseWriter, r *http.Request) error {
+	user, err := Authorized(r)
+	if err != nil {
+		return err
+	}
+
+	s := mux.Vars(r)["uid"]
+	if err := validate.UUIDv4(s); err != nil {
+		return ErrNotFound
+	}
+	emailID := uuid.Parse(s)
+	email, err := store.Users.GetEmail(emailID)
+	if err == sql.ErrNoRows {
+		return ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if email.UserID != user.ID {
+		return ErrUnauthorizedClient
+	}
+	if email.IsVerified {
+		return ErrInvalidRequest.Append("email already verified")
+	}
+
+	err = store.Users.ResendVerification(emailID)
+	if err == sentinel.ErrResendThrottled {
+		w.Header().Set("Retry-After", strconv.Itoa(int(sentinel.ResendVerificationInterval.Seconds())))
+		return ErrTooManyRequests.Append("a verification message was sent recently")
+	}
+	if err != nil {
+		return err
+	}
+	wakeMailer()
 
 	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+var errPrimaryEmail = ErrConfilt.Append("cannot delete the primary email address, make another email address primary first.")
+
+// serveSetPrimaryEmail makes a verified email of the user the primary email,
+// the email which receives the notifications.
+func serveSetPrimaryEmail(w http.ResponseWriter, r *http.Request) error {
+	user, err := Authorized(r)
+	if err != nil {
+		return err
+	}
+
+	s := mux.Vars(r)["uid"]
+	if err := validate.UUIDv4(s); err != nil {
+		return ErrNotFound
+	}
+	emailID := uuid.Parse(s)
+	email, err := store.Users.GetEmail(emailID)
+	if err == sql.ErrNoRows {
+		return ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if email.UserID != user.ID {
+		return ErrUnauthorizedClient
+	}
+	if !email.IsVerified {
+		return ErrInvalidRequest.Append("email must be verified to become the primary email")
+	}
 
+	err = store.Users.SetPrimaryEmail(emailID)
+	if err == sentinel.ErrEmailNotVerified {
+		return ErrInvalidRequest.Append("email must be verified to become the primary email")
+	}
+	if err != nil {
+		return err
+	}
+	recordEvent(r, user.UID, sentinel.EventEmailPrimary, "email="+email.Email)
+
+	w.WriteHeader(http.StatusNoContent)
 	return nil
 }
 
@@ -335,6 +655,7 @@ func serveAddEmail(w http.ResponseWriter, r *http.Request) error {
 	if err != nil {
 		return err
 	}
+	recordEvent(r, user.UID, sentinel.EventEmailAdded, "email="+email)
 
 	// Response
 	u, err := apiRouter.Get(router.GetEmail).URL("uid", authEmail.UID.String())
@@ -350,28 +671,8 @@ func serveAddEmail(w http.ResponseWriter, r *http.Request) error {
 		w.WriteHeader(http.StatusCreated)
 	}
 
-	// Create token
-	claims := tokens.Claims{
-		"email_id": authEmail.UID.String(),
-		"user_id":  user.UID.String(),
-	}
-	tokenStr, err := tokens.Sign(claims, privateKey, &tokens.VerifyEmailOptions)
-	if err != nil {
-		log.Println("failed to sign verify-email token due to error:", err)
-		return nil
-	}
-
-	// Send email verification
-	msg := NewVerifyEmailMessage(tokenStr)
-	msg.AddRecipient(email, "", "to")
-	a, err := mc.MessagesSend(msg)
-	if err != nil {
-		log.Println("calling Mandrill failed with error:", err)
-		return nil
-	}
-	for _, e := range a {
-		log.Println("sent email-verification message with Mandrill id:", e.Id)
-	}
+	// Send email verification, stored in the outbox by AddEmail
+	wakeMailer()
 
 	return nil
 }
@@ -405,9 +706,17 @@ func serveDelEmail(w http.ResponseWriter, r *http.Request) error {
 	if email != nil && len(emails) == 1 {
 		return ErrConfilt.Append("cannot delete the only email address associated with the user.")
 	}
-	if err := store.Users.DelEmail(emailID); err != nil {
+	if email.IsPrimary {
+		return errPrimaryEmail
+	}
+	err = store.Users.DelEmail(emailID)
+	if err == sentinel.ErrPrimaryEmail {
+		return errPrimaryEmail
+	}
+	if err != nil {
 		return err
 	}
+	recordEvent(r, user.UID, sentinel.EventEmailDeleted, "email="+email.Email)
 
 	w.WriteHeader(http.StatusNoContent)
 	return nil
@@ -443,12 +752,31 @@ func serveListEmail(w http.ResponseWriter, r *http.Request) error {
 	return nil
 }
 
+// servePublicKey writes the PEM encoded public key of the active signing key.
+// Use the JWKS to verify tokens signed with retiring keys.
 func servePublicKey(w http.ResponseWriter, r *http.Request) error {
+	key := keyring.Active()
+	if key == nil {
+		return ErrNotFound.Append("no active signing key")
+	}
 	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-	w.Write([]byte(publicKey))
+	w.Write([]byte(key.PublicKey))
 	return nil
 }
 
+// serveJWKS writes the public keys which verify the tokens issued by
+// Sentinel as a JSON Web Key Set. Tokens name their key in the kid header.
+func serveJWKS(w http.ResponseWriter, r *http.Request) error {
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	return writeJSON(w, http.StatusOK, keyring.JWKS())
+}
+
+// LoadKeyring replaces the signing keys with the keyring in the JSON file at
+// path. Call it again after rotating the keys to pick up the new active key.
+func LoadKeyring(path string) error {
+	return keyring.Load(path)
+}
+
 func serveUpdateUserDetails(w http.ResponseWriter, r *http.Request) error {
 	user, err := Authorized(r)
 	if err != nil {
@@ -473,6 +801,9 @@ func serveUpdateUserDetails(w http.ResponseWriter, r *http.Request) error {
 	if err != nil {
 		return err
 	}
+	if opt.Password != "" {
+		recordEvent(r, user.UID, sentinel.EventPasswordChanged, "")
+	}
 
 	if err := writeJSON(w, http.StatusOK, user); err != nil {
 		return err
@@ -508,27 +839,26 @@ func serveOneTimeLogin(w http.ResponseWriter, r *http.Request) error {
 	if len(users) != 1 {
 		return ErrUnknownClient
 	}
-	// TODO: decide if email needs to be verified to continue
-
-	// Generate AccessToken
-	claims := tokens.Claims{
-		"user_id": users[0].UID.String(),
-	}
-	tokenStr, err := tokens.Sign(claims, privateKey, &tokens.AccessTokenOptions)
-	if err != nil {
-		return err
+	// The link is sent to the primary email, which is always verified, not
+	// to the email of the request
+	primary := users[0].PrimaryEmail()
+	if primary == nil {
+		return ErrUnauthorizedClient.Append("user has no verified email")
 	}
 
 	// Send login link
-	msg := NewEmailLoginLinkMessage(tokenStr)
-	msg.AddRecipient(email, "", "to")
-	a, err := mc.MessagesSend(msg)
+	err = store.Outbox.Enqueue(&sentinel.OutboxMessage{
+		Kind:      sentinel.MailLoginLink,
+		Recipient: primary.Email,
+		UserUID:   users[0].UID,
+		EmailUID:  primary.UID,
+		Locale:    requestLocale(r),
+	})
 	if err != nil {
-		log.Println("calling Mandrill failed with error:", err)
-	}
-	for _, e := range a {
-		log.Println("sent email-verification message with Mandrill id:", e.Id)
+		return err
 	}
+	recordEvent(r, users[0].UID, sentinel.EventLoginLink, "email="+primary.Email)
+	wakeMailer()
 
 	w.WriteHeader(http.StatusNoContent)
 	return nil
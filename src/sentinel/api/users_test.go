@@ -5,17 +5,26 @@
 package api
 
 import (
+	"database/sql"
+	"encoding/json"
 	"io/ioutil"
 	"net/http"
+	"net/url"
+	"strings"
 	"testing"
 
 	"sentinel"
 	"sentinel/datastore"
+	"sentinel/router"
 	"sentinel/tokens"
 
 	"code.google.com/p/go-uuid/uuid"
 )
 
+var (
+	privateKey, publicKey string
+)
+
 func init() {
 	f, err := ioutil.ReadFile("../tokens/testdata/sentinel")
 	if err != nil {
@@ -27,6 +36,10 @@ func init() {
 		panic(err)
 	}
 	publicKey = string(f)
+	keyring, err = tokens.KeyringFromPEM(privateKey, publicKey)
+	if err != nil {
+		panic(err)
+	}
 }
 
 func TestUserGetUserDetails(t *testing.T) {
@@ -41,6 +54,7 @@ func TestUserGetUserDetails(t *testing.T) {
 		},
 	}
 	datastore.SetPassword(user, password)
+	mockRefreshTokens(user)
 
 	store.Users.(*sentinel.MockUsersService).ListFn = func(opt sentinel.UserListOptions) ([]*sentinel.User, error) {
 		users := []*sentinel.User{user}
@@ -200,6 +214,7 @@ func TestAuthenticate(t *testing.T) {
 			&sentinel.AuthEmail{Email: expectedEmail},
 		},
 	}
+	mockRefreshTokens(user)
 
 	store.Users.(*sentinel.MockUsersService).ListFn = func(opt sentinel.UserListOptions) ([]*sentinel.User, error) {
 		email := opt.Email[0]
@@ -285,6 +300,9 @@ func TestserveDelEmail(t *testing.T) {
 	if err := apiClient.Users.DelEmail(expectedEmailID); err != nil {
 		t.Error(err)
 	}
+	if !calledSubmit {
+		t.Error("!calledSubmit")
+	}
 }
 
 func TestserveUpdateUserDetails(t *testing.T) {
@@ -341,3 +359,391 @@ func TestserveUpdateUserDetails(t *testing.T) {
 func TestserveOneTimeLogin(t *testing.T) {
 	//TODO: implement
 }
+
+func TestCreateTokenRefresh(t *testing.T) {
+	setup()
+
+	user := &sentinel.User{ID: 1, UID: uuid.NewRandom()}
+	mockRefreshTokens(user)
+
+	refresh := func(token string) (map[string]interface{}, *sentinel.ErrorResponse) {
+		u, _ := apiRouter.Get(router.CreateToken).URL()
+		form := url.Values{
+			"grant_type":    {"refresh_token"},
+			"refresh_token": {token},
+		}
+		req, _ := http.NewRequest("POST", "http://sentinel.sh"+u.Path, strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		resp, err := httpClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if err := sentinel.CheckResponse(resp); err != nil {
+			return nil, err.(*sentinel.ErrorResponse)
+		}
+		data := make(map[string]interface{})
+		json.NewDecoder(resp.Body).Decode(&data)
+		return data, nil
+	}
+
+	rt, _ := store.RefreshTokens.Issue(user.ID, "", "")
+
+	data, errResp := refresh(rt.Token)
+	if errResp != nil {
+		t.Fatal(errResp)
+	}
+	claims, err := tokens.Verify(data["id_token"].(string), publicKey, &tokens.AccessTokenOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims["user_id"] != user.UID.String() {
+		t.Errorf("Result should have been %v, but it was %v", user.UID, claims["user_id"])
+	}
+	next, _ := data["refresh_token"].(string)
+	if next == "" || next == rt.Token {
+		t.Errorf("refresh token should have been rotated, but it was %q", next)
+	}
+
+	// Replaying the rotated refresh token is refused
+	if _, errResp := refresh(rt.Token); errResp == nil || errResp.Name != ErrInvalidGrant.Name {
+		t.Errorf("Result should have been %v, but it was %v", ErrInvalidGrant.Name, errResp)
+	}
+}
+
+func TestRevokeToken(t *testing.T) {
+	setup()
+	mockRevocations()
+
+	user := &sentinel.User{ID: 1, UID: uuid.NewRandom()}
+	tokenStr := authorize(t, user)
+	mockRefreshTokens(user)
+	rt, _ := store.RefreshTokens.Issue(user.ID, "", "")
+
+	revokedRefresh := ""
+	store.RefreshTokens.(*sentinel.MockRefreshTokensService).RevokeFn = func(token string) error {
+		revokedRefresh = token
+		return nil
+	}
+
+	revoke := func(form url.Values, client bool) int {
+		u, _ := apiRouter.Get(router.RevokeToken).URL()
+		req, _ := http.NewRequest("POST", "http://sentinel.sh"+u.Path, strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if client {
+			apiClient.AuthorizeClient(req)
+		}
+		resp, err := httpClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if _, err := apiClient.Users.GetUserDetails(user.UID); err != nil {
+		t.Fatal(err)
+	}
+
+	if code := revoke(url.Values{"token": {tokenStr}, "token_type_hint": {"access_token"}}, false); code != http.StatusOK {
+		t.Errorf("Result should have been %v, but it was %v", http.StatusOK, code)
+	}
+	_, err := apiClient.Users.GetUserDetails(user.UID)
+	if errResp, ok := err.(*sentinel.ErrorResponse); !ok || errResp.Name != ErrInvalidClient.Name {
+		t.Errorf("Result should have been %v, but it was %v", ErrInvalidClient.Name, err)
+	}
+
+	// Tokens which aren't access tokens are revoked as refresh tokens
+	if code := revoke(url.Values{"token": {rt.Token}}, false); code != http.StatusOK {
+		t.Errorf("Result should have been %v, but it was %v", http.StatusOK, code)
+	}
+	if revokedRefresh != rt.Token {
+		t.Errorf("Result should have been %v, but it was %v", rt.Token, revokedRefresh)
+	}
+
+	// Refresh tokens of a service can only be revoked by the service
+	service := &sentinel.Service{ID: 1, UID: uuid.NewRandom()}
+	authorizeService(t, service)
+	revokedRefresh = ""
+	rt, _ = store.RefreshTokens.Issue(user.ID, service.ClientID, "openid")
+	if code := revoke(url.Values{"token": {rt.Token}}, false); code != ErrNoAuthentionMethodIncluded.StatusCode {
+		t.Errorf("Result should have been %v, but it was %v", ErrNoAuthentionMethodIncluded.StatusCode, code)
+	}
+	if revokedRefresh != "" {
+		t.Errorf("Result should have been empty, but it was %v", revokedRefresh)
+	}
+	if code := revoke(url.Values{"token": {rt.Token}}, true); code != http.StatusOK {
+		t.Errorf("Result should have been %v, but it was %v", http.StatusOK, code)
+	}
+	if revokedRefresh != rt.Token {
+		t.Errorf("Result should have been %v, but it was %v", rt.Token, revokedRefresh)
+	}
+
+	if code := revoke(url.Values{"token": {tokenStr}, "token_type_hint": {"id_token"}}, false); code != ErrUnsupportedTokenType.StatusCode {
+		t.Errorf("Result should have been %v, but it was %v", ErrUnsupportedTokenType.StatusCode, code)
+	}
+}
+
+func TestLogout(t *testing.T) {
+	setup()
+	mockRevocations()
+
+	user := &sentinel.User{
+		ID:            1,
+		UID:           uuid.NewRandom(),
+		PasswordHash:  "plain:princess123",
+		AuthEmailList: []*sentinel.AuthEmail{{Email: "jess@example.com", IsVerified: true, IsPrimary: true}},
+	}
+	authorize(t, user)
+	mockRefreshTokens(user)
+	store.Users.(*sentinel.MockUsersService).ListFn = func(opt sentinel.UserListOptions) ([]*sentinel.User, error) {
+		return []*sentinel.User{user}, nil
+	}
+
+	revokedUser := 0
+	store.RefreshTokens.(*sentinel.MockRefreshTokensService).RevokeUserFn = func(userID int) error {
+		revokedUser = userID
+		return nil
+	}
+
+	nextSecond()
+	u, _ := apiRouter.Get(router.Logout).URL()
+	req, _ := apiClient.NewRequest("POST", u.Path, nil)
+	if err := apiClient.Authorize(req); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := apiClient.Do(req, nil); err != nil {
+		t.Fatal(err)
+	}
+	if revokedUser != user.ID {
+		t.Errorf("Result should have been %v, but it was %v", user.ID, revokedUser)
+	}
+
+	_, err := apiClient.Users.GetUserDetails(user.UID)
+	if errResp, ok := err.(*sentinel.ErrorResponse); !ok || errResp.Name != ErrInvalidClient.Name {
+		t.Errorf("Result should have been %v, but it was %v", ErrInvalidClient.Name, err)
+	}
+
+	// Logging in again right after logging out works
+	if err := apiClient.Authenticate("jess@example.com", "princess123"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := apiClient.Users.GetUserDetails(user.UID); err != nil {
+		t.Errorf("Result should have been the user, but it was %v", err)
+	}
+}
+
+func TestServeJWKS(t *testing.T) {
+	setup()
+
+	u, _ := apiRouter.Get(router.JWKS).URL()
+	req, _ := apiClient.NewRequest("GET", u.Path, nil)
+	var set tokens.JWKS
+	if _, err := apiClient.Do(req, &set); err != nil {
+		t.Fatal(err)
+	}
+	if len(set.Keys) != 1 {
+		t.Fatalf("Result should have been %v keys, but it was %v", 1, len(set.Keys))
+	}
+	if expect := keyring.Active().ID; set.Keys[0].KeyID != expect {
+		t.Errorf("Result should have been %v, but it was %v", expect, set.Keys[0].KeyID)
+	}
+}
+
+func TestAckEmailOwner(t *testing.T) {
+	setup()
+	mockRevocations()
+
+	user := &sentinel.User{ID: 1, UID: uuid.NewRandom()}
+	email := &sentinel.AuthEmail{UID: uuid.NewRandom(), UserID: 1, Email: "jane@example.com"}
+	store.Users.(*sentinel.MockUsersService).GetUserDetailsFn = func(uid uuid.UUID) (*sentinel.User, error) {
+		return user, nil
+	}
+	store.Users.(*sentinel.MockUsersService).GetEmailFn = func(uid uuid.UUID) (*sentinel.AuthEmail, error) {
+		return email, nil
+	}
+	acked := 0
+	store.Users.(*sentinel.MockUsersService).AckEmailFn = func(uid uuid.UUID) error {
+		acked++
+		return nil
+	}
+
+	ack := func() error {
+		claims := tokens.Claims{
+			"email_id": email.UID.String(),
+			"user_id":  user.UID.String(),
+		}
+		tokenStr, err := keyring.Sign(claims, &tokens.VerifyEmailOptions)
+		if err != nil {
+			t.Fatal(err)
+		}
+		apiClient.SetToken(tokenStr)
+		return apiClient.Users.AckEmail(email.UID)
+	}
+
+	if err := ack(); err != nil {
+		t.Fatal(err)
+	}
+	if acked != 1 {
+		t.Errorf("Result should have been %v, but it was %v", 1, acked)
+	}
+
+	// Tokens can only be used once
+	err := apiClient.Users.AckEmail(email.UID)
+	if errResp, ok := err.(*sentinel.ErrorResponse); !ok || errResp.Name != ErrInvalidToken.Name {
+		t.Errorf("Result should have been %v, but it was %v", ErrInvalidToken.Name, err)
+	}
+
+	// The email of another user isn't verified
+	email.UserID = 2
+	err = ack()
+	if errResp, ok := err.(*sentinel.ErrorResponse); !ok || errResp.Name != ErrInvalidToken.Name {
+		t.Errorf("Result should have been %v, but it was %v", ErrInvalidToken.Name, err)
+	}
+	if acked != 1 {
+		t.Errorf("Result should have been %v, but it was %v", 1, acked)
+	}
+}
+
+func TestResendAckEmail(t *testing.T) {
+	setup()
+
+	user := &sentinel.User{ID: 1, UID: uuid.NewRandom()}
+	authorize(t, user)
+
+	email := &sentinel.AuthEmail{UID: uuid.NewRandom(), UserID: 1, Email: "jane@example.com"}
+	store.Users.(*sentinel.MockUsersService).GetEmailFn = func(uid uuid.UUID) (*sentinel.AuthEmail, error) {
+		if !uuid.Equal(uid, email.UID) {
+			return nil, sql.ErrNoRows
+		}
+		return email, nil
+	}
+	var resent []uuid.UUID
+	store.Users.(*sentinel.MockUsersService).ResendVerificationFn = func(emailID uuid.UUID) error {
+		if len(resent) > 0 {
+			return sentinel.ErrResendThrottled
+		}
+		resent = append(resent, emailID)
+		return nil
+	}
+
+	if err := apiClient.Users.ResendVerification(email.UID); err != nil {
+		t.Fatal(err)
+	}
+	if len(resent) != 1 || !uuid.Equal(resent[0], email.UID) {
+		t.Errorf("Result should have been %v, but it was %v", email.UID, resent)
+	}
+
+	// Messages to the same email are throttled
+	err := apiClient.Users.ResendVerification(email.UID)
+	errResp, ok := err.(*sentinel.ErrorResponse)
+	if !ok || errResp.Name != ErrTooManyRequests.Name {
+		t.Fatalf("Result should have been %v, but it was %v", ErrTooManyRequests.Name, err)
+	}
+	if got := errResp.Response.Header.Get("Retry-After"); got != "300" {
+		t.Errorf("Result should have been %v, but it was %v", "300", got)
+	}
+
+	tests := []struct {
+		email   *sentinel.AuthEmail
+		errName string
+	}{
+		{&sentinel.AuthEmail{UID: email.UID, UserID: 1, IsVerified: true}, ErrInvalidRequest.Name},
+		{&sentinel.AuthEmail{UID: email.UID, UserID: 2}, ErrUnauthorizedClient.Name},
+		{&sentinel.AuthEmail{UID: uuid.NewRandom(), UserID: 1}, ErrNotFound.Name},
+	}
+	for _, tt := range tests {
+		if uuid.Equal(tt.email.UID, email.UID) {
+			email = tt.email
+		}
+		err := apiClient.Users.ResendVerification(tt.email.UID)
+		if errResp, ok := err.(*sentinel.ErrorResponse); !ok || errResp.Name != tt.errName {
+			t.Errorf("Result should have been %v, but it was %v", tt.errName, err)
+		}
+	}
+}
+
+func TestSetPrimaryEmail(t *testing.T) {
+	setup()
+
+	user := &sentinel.User{ID: 1, UID: uuid.NewRandom()}
+	authorize(t, user)
+
+	email := &sentinel.AuthEmail{UID: uuid.NewRandom(), UserID: 1, Email: "jane@example.com", IsVerified: true}
+	store.Users.(*sentinel.MockUsersService).GetEmailFn = func(uid uuid.UUID) (*sentinel.AuthEmail, error) {
+		if !uuid.Equal(uid, email.UID) {
+			return nil, sql.ErrNoRows
+		}
+		return email, nil
+	}
+	var primary uuid.UUID
+	store.Users.(*sentinel.MockUsersService).SetPrimaryEmailFn = func(emailID uuid.UUID) error {
+		primary = emailID
+		return nil
+	}
+
+	if err := apiClient.Users.SetPrimaryEmail(email.UID); err != nil {
+		t.Fatal(err)
+	}
+	if !uuid.Equal(primary, email.UID) {
+		t.Errorf("Result should have been %v, but it was %v", email.UID, primary)
+	}
+
+	tests := []struct {
+		email   *sentinel.AuthEmail
+		errName string
+	}{
+		{&sentinel.AuthEmail{UID: email.UID, UserID: 1}, ErrInvalidRequest.Name},
+		{&sentinel.AuthEmail{UID: email.UID, UserID: 2, IsVerified: true}, ErrUnauthorizedClient.Name},
+		{&sentinel.AuthEmail{UID: uuid.NewRandom(), UserID: 1, IsVerified: true}, ErrNotFound.Name},
+	}
+	for _, tt := range tests {
+		if uuid.Equal(tt.email.UID, email.UID) {
+			email = tt.email
+		}
+		primary = nil
+		err := apiClient.Users.SetPrimaryEmail(tt.email.UID)
+		if errResp, ok := err.(*sentinel.ErrorResponse); !ok || errResp.Name != tt.errName {
+			t.Errorf("Result should have been %v, but it was %v", tt.errName, err)
+		}
+		if primary != nil {
+			t.Errorf("Result should have been nil, but it was %v", primary)
+		}
+	}
+}
+
+func TestDelPrimaryEmail(t *testing.T) {
+	setup()
+
+	user := &sentinel.User{ID: 1, UID: uuid.NewRandom()}
+	authorize(t, user)
+
+	emails := []*sentinel.AuthEmail{
+		{UID: uuid.NewRandom(), UserID: 1, Email: "jane@example.com", IsVerified: true, IsPrimary: true},
+		{UID: uuid.NewRandom(), UserID: 1, Email: "jess@example.com"},
+	}
+	store.Users.(*sentinel.MockUsersService).ListEmailFn = func(opt *sentinel.AuthEmailListOptions) ([]*sentinel.AuthEmail, error) {
+		return emails, nil
+	}
+	var deleted uuid.UUID
+	store.Users.(*sentinel.MockUsersService).DelEmailFn = func(id uuid.UUID) error {
+		deleted = id
+		return nil
+	}
+
+	// The primary email can't be deleted
+	err := apiClient.Users.DelEmail(emails[0].UID)
+	if errResp, ok := err.(*sentinel.ErrorResponse); !ok || errResp.Name != ErrConfilt.Name {
+		t.Errorf("Result should have been %v, but it was %v", ErrConfilt.Name, err)
+	}
+	if deleted != nil {
+		t.Errorf("Result should have been nil, but it was %v", deleted)
+	}
+
+	if err := apiClient.Users.DelEmail(emails[1].UID); err != nil {
+		t.Fatal(err)
+	}
+	if !uuid.Equal(deleted, emails[1].UID) {
+		t.Errorf("Result should have been %v, but it was %v", emails[1].UID, deleted)
+	}
+}
@@ -0,0 +1,74 @@
+// Copyright 2015 Lars Wiegman. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sentinel
+
+import (
+	"errors"
+	"time"
+
+	"code.google.com/p/go-uuid/uuid"
+)
+
+// AuthorizationCodeTTL is the duration after which an unused authorization
+// code expires.
+const AuthorizationCodeTTL = time.Minute
+
+var (
+	ErrAuthorizationCodeInvalid = errors.New("authorization code is invalid, expired or used")
+)
+
+// AuthorizationCode is issued by the authorization endpoint once the user
+// approved the login request and is exchanged for tokens by the service. The
+// exchange requires the PKCE code verifier of the code challenge (RFC 7636).
+// Only the hash of the code is stored.
+type AuthorizationCode struct {
+	ID            int       `json:"-"`
+	Code          string    `db:"-" json:"-"`
+	CodeHash      string    `db:"code_hash" json:"-"`
+	ServiceID     int       `db:"service_id" json:"-"`
+	UserID        int       `db:"user_id" json:"-"`
+	UserUID       uuid.UUID `db:"-" json:"-"`
+	SessionID     int       `db:"session_id" json:"-"`
+	RedirectURI   string    `db:"redirect_uri" json:"-"`
+	Scope         string    `db:"scope" json:"-"`
+	Nonce         string    `db:"nonce" json:"-"`
+	CodeChallenge string    `db:"code_challenge" json:"-"`
+	AuthTime      time.Time `db:"auth_time" json:"-"`
+	IsUsed        bool      `db:"is_used" json:"-"`
+	ExpiresAt     time.Time `db:"expires_at" json:"-"`
+	CreatedAt     time.Time `db:"created_at" json:"-"`
+}
+
+// AuthorizationCodesService issues and redeems authorization codes.
+type AuthorizationCodesService interface {
+	// Create generates the code and stores the authorization code.
+	Create(c *AuthorizationCode) error
+	// Redeem marks the authorization code as used and returns it. A code
+	// can be redeemed once, ErrAuthorizationCodeInvalid is returned for
+	// unknown, expired or used codes.
+	Redeem(code string) (*AuthorizationCode, error)
+}
+
+// MockAuthorizationCodesService is a mock of the AuthorizationCodesService.
+type MockAuthorizationCodesService struct {
+	CreateFn func(c *AuthorizationCode) error
+	RedeemFn func(code string) (*AuthorizationCode, error)
+}
+
+var _ AuthorizationCodesService = &MockAuthorizationCodesService{}
+
+func (s *MockAuthorizationCodesService) Create(c *AuthorizationCode) error {
+	if s.CreateFn == nil {
+		return nil
+	}
+	return s.CreateFn(c)
+}
+
+func (s *MockAuthorizationCodesService) Redeem(code string) (*AuthorizationCode, error) {
+	if s.RedeemFn == nil {
+		return nil, nil
+	}
+	return s.RedeemFn(code)
+}
@@ -0,0 +1,215 @@
+// Copyright 2015 Lars Wiegman. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package callback delivers the status callbacks of the qauth flow to the
+// status endpoint of services.
+//
+// Callbacks are stored in an outbox before they are delivered and are retried
+// with an increasing delay until the service responds with a 2xx status or
+// the maximum number of attempts is reached. Every attempt is recorded.
+//
+// Each callback carries a signature in the Sentinel-Signature header. The
+// signature is a JWT signed with Sentinel's private key and holds the SHA-256
+// digest of the body in the body_sha256 claim, services verify it using the
+// public key from /pubkey.
+package callback
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"time"
+
+	"sentinel"
+	"sentinel/tokens"
+)
+
+// SignatureHeader is the HTTP header which holds the signature of a callback.
+const SignatureHeader = "Sentinel-Signature"
+
+const (
+	// DefaultMaxAttempts is the number of delivery attempts after which a
+	// callback is marked as failed.
+	DefaultMaxAttempts = 5
+
+	// lease is the duration for which a claimed callback isn't handed to
+	// another dispatcher.
+	lease = time.Minute
+
+	// batchSize is the maximum number of callbacks claimed at once.
+	batchSize = 50
+)
+
+var ErrInvalidSignature = errors.New("invalid callback signature")
+
+// DefaultClient is the HTTP client used to call services.
+var DefaultClient = &http.Client{Timeout: 10 * time.Second}
+
+// DefaultBackoff returns the delay before the next attempt after the given
+// number of failed attempts; 10s, 40s, 160s, etc.
+func DefaultBackoff(attempts int) time.Duration {
+	d := 10 * time.Second
+	for i := 1; i < attempts; i++ {
+		d *= 4
+	}
+	return d
+}
+
+// Dispatcher stores and delivers status callbacks.
+type Dispatcher struct {
+	Client      *http.Client
+	MaxAttempts int
+	Backoff     func(attempts int) time.Duration
+
+	store sentinel.CallbacksService
+	keys  *tokens.Keyring
+}
+
+// NewDispatcher returns a Dispatcher which stores callbacks in the given store
+// and signs them with the active key of the keyring.
+func NewDispatcher(store sentinel.CallbacksService, keys *tokens.Keyring) *Dispatcher {
+	return &Dispatcher{
+		Client:      DefaultClient,
+		MaxAttempts: DefaultMaxAttempts,
+		Backoff:     DefaultBackoff,
+		store:       store,
+		keys:        keys,
+	}
+}
+
+// Enqueue stores a callback with the JSON encoding of v for the status
+// endpoint of the session's service. The callback is claimed for the caller,
+// who should make the first attempt with Deliver.
+func (d *Dispatcher) Enqueue(session *sentinel.LoginSession, v interface{}) (*sentinel.Callback, error) {
+	if session.Service == nil {
+		return nil, errors.New("login session without service")
+	}
+	body, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &sentinel.Callback{
+		SessionID: session.ID,
+		URL:       session.Service.BaseURL,
+		Body:      string(body),
+	}
+	if err := d.store.Enqueue(c, lease); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Deliver makes a single delivery attempt and records the outcome. On error
+// the next attempt is scheduled unless the maximum number of attempts has
+// been reached.
+func (d *Dispatcher) Deliver(c *sentinel.Callback) error {
+	a := &sentinel.CallbackAttempt{CallbackID: c.ID}
+	statusCode, err := d.post(c)
+	a.StatusCode = statusCode
+
+	c.Attempts++
+	switch {
+	case err == nil:
+		c.Status = sentinel.CallbackDelivered
+		c.LastError = ""
+	case c.Attempts >= d.MaxAttempts:
+		c.Status = sentinel.CallbackFailed
+		c.LastError = err.Error()
+		a.Error = err.Error()
+	default:
+		c.Status = sentinel.CallbackPending
+		c.NextAttemptAt = time.Now().UTC().Add(d.Backoff(c.Attempts))
+		c.LastError = err.Error()
+		a.Error = err.Error()
+	}
+
+	if rerr := d.store.Record(c, a); rerr != nil {
+		return rerr
+	}
+	return err
+}
+
+// DeliverDue delivers the callbacks which are due.
+func (d *Dispatcher) DeliverDue() error {
+	callbacks, err := d.store.Due(batchSize, lease)
+	if err != nil {
+		return err
+	}
+	for _, c := range callbacks {
+		if err := d.Deliver(c); err != nil {
+			log.Printf("callback %d to %s failed with error: %s", c.ID, c.URL, err)
+		}
+	}
+	return nil
+}
+
+// Run delivers the callbacks which are due every interval. It never returns.
+func (d *Dispatcher) Run(interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := d.DeliverDue(); err != nil {
+			log.Println("delivering callbacks failed with error:", err)
+		}
+	}
+}
+
+func (d *Dispatcher) post(c *sentinel.Callback) (int, error) {
+	sig, err := Sign([]byte(c.Body), d.keys)
+	if err != nil {
+		return 0, err
+	}
+
+	req, err := http.NewRequest("POST", c.URL, bytes.NewReader([]byte(c.Body)))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json; charset=utf-8")
+	req.Header.Set(SignatureHeader, sig)
+
+	resp, err := d.Client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		return resp.StatusCode, fmt.Errorf("service responded with status %d", resp.StatusCode)
+	}
+	return resp.StatusCode, nil
+}
+
+// Sign returns the signature of the callback body. The kid header of the
+// signature names the key in Sentinel's JWKS which verifies it.
+func Sign(body []byte, keys *tokens.Keyring) (string, error) {
+	claims := tokens.Claims{
+		"body_sha256": digest(body),
+	}
+	return keys.Sign(claims, &tokens.CallbackOptions)
+}
+
+// Verify verifies the signature of the callback body using Sentinel's public
+// key.
+func Verify(sig string, body []byte, publicKey string) error {
+	claims, err := tokens.Verify(sig, publicKey, &tokens.CallbackOptions)
+	if err != nil {
+		return err
+	}
+	if s, _ := claims["body_sha256"].(string); s != digest(body) {
+		return ErrInvalidSignature
+	}
+	return nil
+}
+
+func digest(body []byte) string {
+	sum := sha256.Sum256(body)
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,169 @@
+// Copyright 2015 Lars Wiegman. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package callback
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"sentinel"
+	"sentinel/tokens"
+)
+
+var (
+	privateKey, publicKey string
+	keyring               *tokens.Keyring
+)
+
+func init() {
+	f, err := ioutil.ReadFile("../tokens/testdata/sentinel")
+	if err != nil {
+		panic(err)
+	}
+	privateKey = string(f)
+	f, err = ioutil.ReadFile("../tokens/testdata/sentinel.pub")
+	if err != nil {
+		panic(err)
+	}
+	publicKey = string(f)
+	keyring, err = tokens.KeyringFromPEM(privateKey, publicKey)
+	if err != nil {
+		panic(err)
+	}
+}
+
+func TestDeliver(t *testing.T) {
+	expectBody := `{"secret2":"29df362b5cfa5c96d22f8d20f29d9a367dd0d359","sessionID":"a5828e8b-b203-49ba-8aa0-60b9dfb20220","status":"accepted"}`
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if string(body) != expectBody {
+			t.Errorf("Result should have been %v, but it was %v", expectBody, string(body))
+		}
+		if err := Verify(r.Header.Get(SignatureHeader), body, publicKey); err != nil {
+			t.Error(err)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer ts.Close()
+
+	store := &sentinel.MockCallbacksService{}
+	var enqueued *sentinel.Callback
+	var leased time.Duration
+	store.EnqueueFn = func(c *sentinel.Callback, d time.Duration) error {
+		c.ID = 1
+		enqueued = c
+		leased = d
+		return nil
+	}
+	var attempts []*sentinel.CallbackAttempt
+	store.RecordFn = func(c *sentinel.Callback, a *sentinel.CallbackAttempt) error {
+		attempts = append(attempts, a)
+		return nil
+	}
+
+	d := NewDispatcher(store, keyring)
+	session := &sentinel.LoginSession{
+		ID:      1,
+		Service: &sentinel.Service{BaseURL: ts.URL},
+	}
+	c, err := d.Enqueue(session, map[string]string{
+		"status":    "accepted",
+		"secret2":   "29df362b5cfa5c96d22f8d20f29d9a367dd0d359",
+		"sessionID": "a5828e8b-b203-49ba-8aa0-60b9dfb20220",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c != enqueued {
+		t.Fatal("callback was not stored")
+	}
+	// The callback is stored claimed for the first attempt
+	if leased != lease {
+		t.Errorf("Result should have been %v, but it was %v", lease, leased)
+	}
+
+	if err := d.Deliver(c); err != nil {
+		t.Fatal(err)
+	}
+
+	if c.Status != sentinel.CallbackDelivered {
+		t.Errorf("Result should have been %v, but it was %v", sentinel.CallbackDelivered, c.Status)
+	}
+	if len(attempts) != 1 || attempts[0].StatusCode != http.StatusNoContent {
+		t.Errorf("Result should have been a single attempt with status 204, but it was %v", attempts)
+	}
+}
+
+func TestDeliverRetry(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer ts.Close()
+
+	store := &sentinel.MockCallbacksService{}
+	d := NewDispatcher(store, keyring)
+	d.MaxAttempts = 2
+
+	c := &sentinel.Callback{ID: 1, URL: ts.URL, Body: `{}`, Status: sentinel.CallbackPending}
+
+	before := time.Now().UTC()
+	if err := d.Deliver(c); err == nil {
+		t.Fatal("expected an error")
+	}
+	if c.Status != sentinel.CallbackPending {
+		t.Errorf("Result should have been %v, but it was %v", sentinel.CallbackPending, c.Status)
+	}
+	if c.NextAttemptAt.Before(before.Add(DefaultBackoff(1))) {
+		t.Errorf("next attempt at %v should be after the backoff of %v", c.NextAttemptAt, DefaultBackoff(1))
+	}
+
+	if err := d.Deliver(c); err == nil {
+		t.Fatal("expected an error")
+	}
+	if c.Status != sentinel.CallbackFailed {
+		t.Errorf("Result should have been %v, but it was %v", sentinel.CallbackFailed, c.Status)
+	}
+	if c.Attempts != 2 {
+		t.Errorf("Result should have been %v, but it was %v", 2, c.Attempts)
+	}
+}
+
+func TestDeliverDue(t *testing.T) {
+	called := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called++
+	}))
+	defer ts.Close()
+
+	store := &sentinel.MockCallbacksService{}
+	store.DueFn = func(limit int, lease time.Duration) ([]*sentinel.Callback, error) {
+		return []*sentinel.Callback{
+			&sentinel.Callback{ID: 1, URL: ts.URL, Body: `{}`},
+			&sentinel.Callback{ID: 2, URL: ts.URL, Body: `{}`},
+		}, nil
+	}
+
+	d := NewDispatcher(store, keyring)
+	if err := d.DeliverDue(); err != nil {
+		t.Fatal(err)
+	}
+	if called != 2 {
+		t.Errorf("Result should have been %v, but it was %v", 2, called)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	sig, err := Sign([]byte(`{"status":"accepted"}`), keyring)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Verify(sig, []byte(`{"status":"declined"}`), publicKey); err != ErrInvalidSignature {
+		t.Errorf("Result should have been %v, but it was %v", ErrInvalidSignature, err)
+	}
+}
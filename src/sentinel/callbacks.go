@@ -0,0 +1,98 @@
+// Copyright 2015 Lars Wiegman. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sentinel
+
+import (
+	"time"
+
+	"code.google.com/p/go-uuid/uuid"
+)
+
+// CallbackStatus is the delivery state of a status callback.
+type CallbackStatus string
+
+const (
+	CallbackPending   CallbackStatus = "pending"
+	CallbackDelivered CallbackStatus = "delivered"
+	CallbackFailed    CallbackStatus = "failed"
+)
+
+// Callback is a status callback to the status endpoint of a service, see step
+// 7 of the qauth flow. Callbacks are stored before delivery and retried until
+// the service responds with a 2xx status.
+type Callback struct {
+	ID            int            `json:"-"`
+	SessionID     int            `db:"session_id" json:"-"`
+	URL           string         `db:"url" json:"url"`
+	Body          string         `db:"body" json:"body"`
+	Status        CallbackStatus `json:"status"`
+	Attempts      int            `json:"attempts"`
+	LastError     string         `db:"last_error" json:"lastError,omitempty"`
+	NextAttemptAt time.Time      `db:"next_attempt_at" json:"nextAttemptDate"`
+	CreatedAt     time.Time      `db:"created_at" json:"-"`
+	UpdatedAt     time.Time      `db:"updated_at" json:"-"`
+}
+
+// CallbackAttempt is a single delivery attempt of a callback.
+type CallbackAttempt struct {
+	ID         int       `json:"-"`
+	CallbackID int       `db:"callback_id" json:"-"`
+	StatusCode int       `db:"status_code" json:"statusCode"`
+	Error      string    `json:"error,omitempty"`
+	CreatedAt  time.Time `db:"created_at" json:"date"`
+}
+
+// CallbacksService stores status callbacks and their delivery history.
+type CallbacksService interface {
+	// Enqueue stores the callback claimed for the duration of the lease, the
+	// caller makes the first delivery attempt. When the attempt isn't
+	// recorded the callback is due after the lease.
+	Enqueue(c *Callback, lease time.Duration) error
+	// Due claims at most limit pending callbacks which are due. Claimed
+	// callbacks aren't returned again for the duration of the lease.
+	Due(limit int, lease time.Duration) ([]*Callback, error)
+	// Record stores the attempt along with the updated state of the callback.
+	Record(c *Callback, a *CallbackAttempt) error
+	// History returns the delivery attempts for the login session.
+	History(sessionID uuid.UUID) ([]*CallbackAttempt, error)
+}
+
+// MockCallbacksService is a mock of the CallbacksService.
+type MockCallbacksService struct {
+	EnqueueFn func(c *Callback, lease time.Duration) error
+	DueFn     func(limit int, lease time.Duration) ([]*Callback, error)
+	RecordFn  func(c *Callback, a *CallbackAttempt) error
+	HistoryFn func(sessionID uuid.UUID) ([]*CallbackAttempt, error)
+}
+
+var _ CallbacksService = &MockCallbacksService{}
+
+func (s *MockCallbacksService) Enqueue(c *Callback, lease time.Duration) error {
+	if s.EnqueueFn == nil {
+		return nil
+	}
+	return s.EnqueueFn(c, lease)
+}
+
+func (s *MockCallbacksService) Due(limit int, lease time.Duration) ([]*Callback, error) {
+	if s.DueFn == nil {
+		return nil, nil
+	}
+	return s.DueFn(limit, lease)
+}
+
+func (s *MockCallbacksService) Record(c *Callback, a *CallbackAttempt) error {
+	if s.RecordFn == nil {
+		return nil
+	}
+	return s.RecordFn(c, a)
+}
+
+func (s *MockCallbacksService) History(sessionID uuid.UUID) ([]*CallbackAttempt, error) {
+	if s.HistoryFn == nil {
+		return nil, nil
+	}
+	return s.HistoryFn(sessionID)
+}
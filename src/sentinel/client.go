@@ -14,8 +14,12 @@ import (
 	"net/url"
 	"reflect"
 	"strings"
+	"sync"
+	"time"
 
 	"sentinel/router"
+	"sentinel/tokens"
+	"sentinel/totp"
 
 	"github.com/google/go-querystring/query"
 	"github.com/gorilla/mux"
@@ -24,6 +28,9 @@ import (
 const (
 	version   = "0.0.1"
 	userAgent = "sentinel-client/" + version
+
+	// tokenExpiryDelta is how long before its expiry a token is refreshed
+	tokenExpiryDelta = time.Minute
 )
 
 func NewClient(httpClient *http.Client) *Client {
@@ -34,22 +41,29 @@ func NewClient(httpClient *http.Client) *Client {
 	baseURL, _ := url.Parse("http://sentinel.sh/")
 	c := &Client{
 		BaseURL:    baseURL,
+		Issuer:     tokens.ClientAssertionOptions.Audience,
 		apiRouter:  router.API(baseURL),
 		UserAgent:  userAgent,
 		httpClient: httpClient,
 	}
 	c.Users = &usersService{c}
 	c.Services = &servicesService{c}
+	c.Activity = &activityService{c}
 	return c
 }
 
 type Client struct {
 	Users    UsersService
-	Services ServicesService
+	Services ServicesClient
+	Activity ActivityService
 
 	// BaseURL to Sentinel API
 	BaseURL *url.URL
 
+	// Issuer identifies the Sentinel deployment, it's the audience of the
+	// assertions signed with the private key of a service
+	Issuer string
+
 	// apiRouter is used to generate URLs for the Sentinel API
 	apiRouter *mux.Router
 
@@ -58,8 +72,16 @@ type Client struct {
 
 	httpClient *http.Client
 
-	// Token used to authenticate HTTP requests to Sentinel's API
-	token string
+	// Token used to authenticate HTTP requests to Sentinel's API, it is
+	// refreshed using the refresh token before it expires
+	token        string
+	tokenExpiry  time.Time
+	refreshToken string
+	mu           sync.Mutex
+
+	// Client credentials used to authenticate HTTP requests of a service,
+	// either the client secret or the private key is set
+	clientID, clientSecret, clientKey string
 }
 
 func (c *Client) url(apiRouterName string, routeVars map[string]string, opt interface{}) (*url.URL, error) {
@@ -169,8 +191,17 @@ func (c *Client) Do(req *http.Request, v interface{}) (*http.Response, error) {
 	return resp, nil
 }
 
-// Authorize sets the Authorization header for the given Request.
+// Authorize sets the Authorization header for the given Request. An expired
+// token is refreshed first when the client holds a refresh token.
 func (c *Client) Authorize(r *http.Request) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.refreshToken != "" && !c.tokenExpiry.IsZero() && time.Now().Add(tokenExpiryDelta).After(c.tokenExpiry) {
+		if err := c.refresh(); err != nil {
+			return err
+		}
+	}
 	if c.token == "" {
 		return errors.New("no valid token to sign request")
 	}
@@ -178,44 +209,134 @@ func (c *Client) Authorize(r *http.Request) error {
 	return nil
 }
 
+// Authenticate requests a token using the user's credentials. The token is
+// refreshed by Authorize before it expires.
 func (c *Client) Authenticate(email, password string) error {
-	token, err := c.createToken(email, password)
+	req, err := c.newTokenRequest(nil)
 	if err != nil {
 		return err
 	}
-	c.SetToken(token)
+	req.SetBasicAuth(email, password)
 
-	return nil
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.createToken(req)
 }
 
-func (c *Client) createToken(email, password string) (string, error) {
-	u, err := c.url(router.CreateToken, nil, nil)
+// AuthenticateMFA completes the authentication of a user with a second
+// factor. The mfaToken is included in the mfa_required error returned by
+// Authenticate, otp is a TOTP code or a recovery code.
+func (c *Client) AuthenticateMFA(mfaToken, otp string) error {
+	// Recovery codes are longer than TOTP codes
+	param := "otp"
+	if len(otp) > totp.Digits {
+		param = "recovery_code"
+	}
+	form := &url.Values{
+		"grant_type": {"mfa_otp"},
+		"mfa_token":  {mfaToken},
+		param:        {otp},
+	}
+	req, err := c.newTokenRequest(form)
 	if err != nil {
-		return "", err
+		return err
 	}
 
-	req, err := c.NewRequest("POST", u.String(), nil)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.createToken(req)
+}
+
+// refresh exchanges the refresh token for a new token and refresh token.
+func (c *Client) refresh() error {
+	form := &url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {c.refreshToken},
+	}
+	req, err := c.newTokenRequest(form)
 	if err != nil {
-		return "", err
+		return err
 	}
-	req.SetBasicAuth(email, password)
+	return c.createToken(req)
+}
+
+func (c *Client) newTokenRequest(form *url.Values) (*http.Request, error) {
+	u, err := c.url(router.CreateToken, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	if form == nil {
+		return c.NewRequest("POST", u.String(), nil)
+	}
+	return c.NewRequest("POST", u.String(), form)
+}
 
-	data := make(map[string]interface{})
+func (c *Client) createToken(req *http.Request) error {
+	var data struct {
+		Token        string `json:"id_token"`
+		ExpiresIn    int64  `json:"expires_in"`
+		RefreshToken string `json:"refresh_token"`
+	}
 	resp, err := c.Do(req, &data)
 	if err != nil {
-		return "", err
+		return err
 	}
 	if resp.StatusCode != http.StatusOK {
-		return "", errors.New("API reponded with status " + http.StatusText(resp.StatusCode))
+		return errors.New("API reponded with status " + http.StatusText(resp.StatusCode))
 	}
 
-	token := data["id_token"].(string)
-
-	return token, nil
+	c.token = data.Token
+	c.refreshToken = data.RefreshToken
+	c.tokenExpiry = time.Now().Add(time.Duration(data.ExpiresIn) * time.Second)
+	return nil
 }
 
+// SetToken sets the token used to authenticate requests, it won't be
+// refreshed.
 func (c *Client) SetToken(token string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	c.token = token
+	c.tokenExpiry = time.Time{}
+	c.refreshToken = ""
+}
+
+// SetClientCredentials sets the client ID and secret of the service used to
+// authenticate requests on behalf of the service.
+func (c *Client) SetClientCredentials(clientID, clientSecret string) {
+	c.clientID = clientID
+	c.clientSecret = clientSecret
+	c.clientKey = ""
+}
+
+// SetClientKey sets the client ID and private key of the service; requests
+// on behalf of the service are authenticated with a JWT assertion signed with
+// the private key.
+func (c *Client) SetClientKey(clientID, privateKey string) {
+	c.clientID = clientID
+	c.clientKey = privateKey
+	c.clientSecret = ""
+}
+
+// AuthorizeClient sets the Authorization header for requests on behalf of a
+// service.
+func (c *Client) AuthorizeClient(r *http.Request) error {
+	switch {
+	case c.clientID == "":
+		return errors.New("no client credentials to sign request")
+	case c.clientKey != "":
+		opt := tokens.ClientAssertionOptions
+		opt.Issuer = c.clientID
+		opt.Audience = c.Issuer
+		assertion, err := tokens.Sign(tokens.Claims{}, c.clientKey, &opt)
+		if err != nil {
+			return err
+		}
+		r.Header.Set("Authorization", "Bearer "+assertion)
+	default:
+		r.SetBasicAuth(c.clientID, c.clientSecret)
+	}
+	return nil
 }
 
 // DefaultPerPage is the default number of results to return in a result set.
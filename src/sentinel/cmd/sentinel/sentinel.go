@@ -11,10 +11,18 @@ import (
 	"net/http"
 	"net/url"
 	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
 
 	"sentinel"
 	"sentinel/api"
 	"sentinel/datastore"
+	"sentinel/outbox"
+	"sentinel/tokens"
+
+	"code.google.com/p/go-uuid/uuid"
 )
 
 var (
@@ -83,11 +91,29 @@ type subcmd struct {
 var subcmds = []subcmd{
 	{"serve", "run the API backend service", serveCmd},
 	{"createdb", "create the database schema", createDBCmd},
+	{"keys", "manage the token signing keys", keysCmd},
+	{"outbox", "inspect and replay email messages", outboxCmd},
+	{"accounts", "restore and purge archived user accounts", accountsCmd},
 }
 
 func serveCmd(args []string) {
 	fs := flag.NewFlagSet("serve", flag.ExitOnError)
 	httpAddr := fs.String("http", "localhost:6002", "HTTP service address")
+	expireInterval := fs.Duration("expire", time.Minute, "interval at which unconfirmed login requests are expired")
+	retryInterval := fs.Duration("retry", time.Second*10, "interval at which failed service callbacks are retried")
+	keyringPath := fs.String("keyring", os.Getenv("KEYRING"), "path of the signing keyring, replaces PRIVATE_KEY and PUBLIC_KEY; reloaded on SIGHUP")
+	mailInterval := fs.Duration("mailretry", time.Second*30, "interval at which failed email messages are retried")
+	mailWorkers := fs.Int("mailworkers", outbox.DefaultWorkers, "number of email messages sent concurrently")
+	mailTemplates := fs.String("templates", os.Getenv("MAIL_TEMPLATES"), "directory with a directory of email templates per locale, replacing the built-in templates")
+	mailURL := fs.String("mail", os.Getenv("MAIL_URL"), "mail delivery URL: mandrill://<key>, smtp://, smtps:// or dir:///<path>; Mandrill with MANDRILL_KEY when empty")
+	purgeInterval := fs.Duration("purge", time.Hour, "interval at which accounts archived longer than the grace period are purged")
+	rateLimitStore := fs.String("ratelimit", "postgres", "store of the rate limits of the credential endpoints: postgres, shared by all instances, or memory")
+	apnsKey := fs.String("apnskey", os.Getenv("APNS_KEY"), "path of the .p8 signing key for push notifications to Apple devices")
+	apnsKeyID := fs.String("apnskeyid", os.Getenv("APNS_KEY_ID"), "key ID of the APNs signing key")
+	apnsTeam := fs.String("apnsteam", os.Getenv("APNS_TEAM_ID"), "team ID of the APNs signing key")
+	apnsTopic := fs.String("apnstopic", os.Getenv("APNS_TOPIC"), "bundle ID of the app receiving the push notifications")
+	apnsProduction := fs.Bool("apnsproduction", false, "send push notifications to the production APNs instead of the sandbox")
+	fcmCredentials := fs.String("fcmcredentials", os.Getenv("FCM_CREDENTIALS"), "path of the service account key file for push notifications to Android devices")
 	fs.Parse(args)
 	fs.Usage = func() {
 		fmt.Fprintln(os.Stderr, `Usage: %s serve [options]
@@ -106,10 +132,46 @@ Options:
 
 	datastore.Connect()
 
+	if *keyringPath != "" {
+		if err := api.LoadKeyring(*keyringPath); err != nil {
+			log.Fatal("Error loading keyring: ", err)
+		}
+		go reloadKeyring(*keyringPath)
+	}
+
+	if *mailURL != "" {
+		if err := api.SetMailer(*mailURL); err != nil {
+			log.Fatal("Error configuring mail delivery: ", err)
+		}
+	}
+	if *apnsKey != "" {
+		if err := api.SetAPNs(*apnsKey, *apnsKeyID, *apnsTeam, *apnsTopic, *apnsProduction); err != nil {
+			log.Fatal("Error configuring push notifications: ", err)
+		}
+	}
+	if *fcmCredentials != "" {
+		if err := api.SetFCM(*fcmCredentials); err != nil {
+			log.Fatal("Error configuring push notifications: ", err)
+		}
+	}
+	if err := api.SetRateLimitStore(*rateLimitStore); err != nil {
+		log.Fatal("Error configuring rate limits: ", err)
+	}
+	if *mailTemplates != "" {
+		if err := api.LoadTemplates(*mailTemplates); err != nil {
+			log.Fatal("Error loading email templates: ", err)
+		}
+	}
+
 	m := http.NewServeMux()
 	api.SetbaseURL(baseURL.ResolveReference(&url.URL{Path: "/api/v1/"}))
 	m.Handle("/api/v1/", api.Handler())
 
+	go api.ExpireSessions(*expireInterval)
+	go api.DeliverCallbacks(*retryInterval)
+	go api.DeliverMail(*mailInterval, *mailWorkers)
+	go api.PurgeAccounts(*purgeInterval)
+
 	log.Print("Listening on ", *httpAddr)
 	err := http.ListenAndServe(*httpAddr, m)
 	if err != nil {
@@ -117,6 +179,20 @@ Options:
 	}
 }
 
+// reloadKeyring reloads the keyring at path on SIGHUP, so rotated keys are
+// picked up without a restart. It never returns.
+func reloadKeyring(path string) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP)
+	for range c {
+		if err := api.LoadKeyring(path); err != nil {
+			log.Println("reloading keyring failed with error:", err)
+			continue
+		}
+		log.Print("Reloaded keyring ", path)
+	}
+}
+
 func createDBCmd(args []string) {
 	fs := flag.NewFlagSet("createdb", flag.ExitOnError)
 	drop := fs.Bool("drop", false, "drop DB before creating")
@@ -142,3 +218,203 @@ Options:
 	}
 	datastore.Create()
 }
+
+func keysCmd(args []string) {
+	fs := flag.NewFlagSet("keys", flag.ExitOnError)
+	keyringPath := fs.String("keyring", os.Getenv("KEYRING"), "path of the signing keyring")
+	bits := fs.Int("bits", 2048, "size of new RSA keys in bits")
+	retire := fs.Duration("retire", tokens.DefaultOptions.TTL, "duration after which retiring keys are retired, at least the longest token TTL")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, `Usage: sentinel keys [options] list|rotate
+
+Manages the keyring with the keys which sign and verify tokens.
+
+The commands are:
+
+	list     list the keys and their status
+	rotate   add a new active key; the active key is retiring and verifies
+	         the tokens it signed until it's retired by a later rotation
+
+Send SIGHUP to a running "sentinel serve" to pick up a rotated key.
+
+Options:
+`)
+		fs.PrintDefaults()
+		os.Exit(1)
+	}
+	fs.Parse(args)
+
+	if fs.NArg() != 1 || *keyringPath == "" {
+		fs.Usage()
+	}
+
+	keyring, err := tokens.LoadKeyring(*keyringPath)
+	if os.IsNotExist(err) && fs.Arg(0) == "rotate" {
+		keyring, err = tokens.NewKeyring()
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	switch fs.Arg(0) {
+	case "list":
+	case "rotate":
+		key, err := keyring.Rotate(*bits, *retire)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := keyring.Save(*keyringPath); err != nil {
+			log.Fatal(err)
+		}
+		log.Print("Added active key ", key.ID)
+	default:
+		fs.Usage()
+	}
+
+	for _, key := range keyring.Keys() {
+		fmt.Printf("%s\t%-8s\t%s\n", key.ID, key.Status, key.UpdatedAt.Format(time.RFC3339))
+	}
+}
+
+func outboxCmd(args []string) {
+	fs := flag.NewFlagSet("outbox", flag.ExitOnError)
+	status := fs.String("status", string(sentinel.OutboxDead), "list messages with the status: pending, sent, dead or all")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, `Usage: sentinel outbox [options] list|replay [id ...]
+
+Inspects the outbox with the email messages to users.
+
+The commands are:
+
+	list     list the messages with the status
+	replay   schedule the dead messages with the ids, or all dead messages,
+	         for immediate delivery
+
+Options:
+`)
+		fs.PrintDefaults()
+		os.Exit(1)
+	}
+	fs.Parse(args)
+
+	if fs.NArg() < 1 {
+		fs.Usage()
+	}
+
+	datastore.Connect()
+	store := datastore.NewDatastore(nil)
+
+	switch fs.Arg(0) {
+	case "list":
+		if fs.NArg() != 1 {
+			fs.Usage()
+		}
+		s := sentinel.OutboxStatus(*status)
+		if s == "all" {
+			s = ""
+		}
+		messages, err := store.Outbox.List(s)
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, m := range messages {
+			fmt.Printf("%d\t%-7s\t%-12s\t%s\t%d\t%s\t%s\n", m.ID, m.Status, m.Kind, m.Recipient,
+				m.Attempts, m.UpdatedAt.Format(time.RFC3339), m.LastError)
+		}
+	case "replay":
+		var ids []int
+		for _, arg := range fs.Args()[1:] {
+			id, err := strconv.Atoi(arg)
+			if err != nil {
+				fs.Usage()
+			}
+			ids = append(ids, id)
+		}
+		if len(ids) == 0 {
+			messages, err := store.Outbox.List(sentinel.OutboxDead)
+			if err != nil {
+				log.Fatal(err)
+			}
+			for _, m := range messages {
+				ids = append(ids, m.ID)
+			}
+		}
+		for _, id := range ids {
+			if err := store.Outbox.Replay(id); err != nil {
+				log.Fatalf("replaying message %d failed with error: %s", id, err)
+			}
+			log.Print("Replaying message ", id)
+		}
+	default:
+		fs.Usage()
+	}
+}
+
+func accountsCmd(args []string) {
+	fs := flag.NewFlagSet("accounts", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, `Usage: sentinel accounts list|restore uid ...|purge
+
+Manages the archived user accounts. Archived accounts are purged after %s.
+
+The commands are:
+
+	list      list the archived accounts with the date they are purged
+	restore   restore the archived accounts with the uids
+	purge     purge the accounts archived longer than the grace period now
+
+`, sentinel.ArchiveGracePeriod)
+		os.Exit(1)
+	}
+	fs.Parse(args)
+
+	if fs.NArg() < 1 {
+		fs.Usage()
+	}
+
+	datastore.Connect()
+	store := datastore.NewDatastore(nil)
+
+	switch fs.Arg(0) {
+	case "list":
+		if fs.NArg() != 1 {
+			fs.Usage()
+		}
+		users, err := store.Accounts.Archived()
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, u := range users {
+			fmt.Printf("%s\t%s\t%s\n", u.UID, u.ArchivedAt.Format(time.RFC3339),
+				u.ArchivedAt.Add(sentinel.ArchiveGracePeriod).Format(time.RFC3339))
+		}
+	case "restore":
+		if fs.NArg() < 2 {
+			fs.Usage()
+		}
+		for _, arg := range fs.Args()[1:] {
+			uid := uuid.Parse(arg)
+			if uid == nil {
+				log.Fatalf("invalid uid %q", arg)
+			}
+			e := &sentinel.Event{Actor: sentinel.ActorAdmin, Detail: "restored with the accounts command"}
+			if err := store.Accounts.Restore(uid, e); err != nil {
+				log.Fatalf("restoring account %s failed with error: %s", uid, err)
+			}
+			log.Print("Restored account ", uid)
+		}
+	case "purge":
+		if fs.NArg() != 1 {
+			fs.Usage()
+		}
+		purged, err := store.Accounts.Purge(time.Now().Add(-sentinel.ArchiveGracePeriod))
+		for _, uid := range purged {
+			log.Print("Purged account ", uid)
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+	default:
+		fs.Usage()
+	}
+}
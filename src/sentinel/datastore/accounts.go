@@ -0,0 +1,169 @@
+// Copyright 2015 Lars Wiegman. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package datastore
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"sentinel"
+
+	"code.google.com/p/go-uuid/uuid"
+)
+
+type accountsStore struct {
+	*Datastore
+}
+
+// Archive archives the user, sql.ErrNoRows is returned when there's no active
+// user with the UID.
+func (s *accountsStore) Archive(userUID uuid.UUID, e *sentinel.Event) error {
+	tx, err := s.db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	now := time.Now().UTC()
+	var id int
+	err = tx.QueryRowx(`
+		UPDATE users SET is_archived=TRUE, archived_at=$2, updated_at=$2
+		WHERE uid=$1 AND is_archived=FALSE
+		RETURNING id`, userUID, now).Scan(&id)
+	if err != nil {
+		return err
+	}
+
+	// Archived users can't refresh their tokens
+	_, err = tx.Exec(`UPDATE refreshtokens SET is_revoked=TRUE, updated_at=$2 WHERE user_id=$1 AND is_revoked=FALSE`, id, now)
+	if err != nil {
+		return err
+	}
+
+	e.UserUID = userUID
+	e.Kind = sentinel.EventAccountArchived
+	if err := recordEvent(tx, e); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Restore activates the archived user, sql.ErrNoRows is returned when there's
+// no archived user with the UID.
+func (s *accountsStore) Restore(userUID uuid.UUID, e *sentinel.Event) error {
+	tx, err := s.db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`
+		UPDATE users SET is_archived=FALSE, archived_at=NULL, updated_at=$2
+		WHERE uid=$1 AND is_archived=TRUE`, userUID, time.Now().UTC())
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n != 1 {
+		return sql.ErrNoRows
+	}
+
+	e.UserUID = userUID
+	e.Kind = sentinel.EventAccountRestored
+	if err := recordEvent(tx, e); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *accountsStore) Archived() ([]*sentinel.User, error) {
+	var users []*sentinel.User
+	err := s.db.Select(&users, `SELECT * FROM users WHERE is_archived=TRUE ORDER BY archived_at, id`)
+	if err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+// Purge deletes the archived users one transaction per user, so a failure
+// doesn't undo the users which are already purged.
+func (s *accountsStore) Purge(archivedBefore time.Time) ([]uuid.UUID, error) {
+	var users []*sentinel.User
+	err := s.db.Select(&users, `
+		SELECT * FROM users
+		WHERE is_archived=TRUE AND archived_at < $1
+		ORDER BY archived_at, id`, archivedBefore.UTC())
+	if err != nil {
+		return nil, err
+	}
+
+	var purged []uuid.UUID
+	for _, user := range users {
+		if err := s.purge(user, archivedBefore); err == sql.ErrNoRows {
+			continue // restored meanwhile
+		} else if err != nil {
+			return purged, fmt.Errorf("purging user %s: %s", user.UID, err)
+		}
+		purged = append(purged, user.UID)
+	}
+	return purged, nil
+}
+
+func (s *accountsStore) purge(user *sentinel.User, archivedBefore time.Time) error {
+	tx, err := s.db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Lock the user and check it wasn't restored
+	var id int
+	err = tx.QueryRowx(`
+		SELECT id FROM users
+		WHERE uid=$1 AND is_archived=TRUE AND archived_at < $2
+		FOR UPDATE`, user.UID, archivedBefore.UTC()).Scan(&id)
+	if err != nil {
+		return err
+	}
+
+	// The services of the user are archived, they're still referenced by the
+	// sessions of other users. Archived services can't authenticate.
+	_, err = tx.Exec(`
+		UPDATE services SET is_archived=TRUE, owner_id=0, updated_at=$2
+		WHERE owner_id=$1`, id, time.Now().UTC())
+	if err != nil {
+		return err
+	}
+
+	// Authorization codes, refresh tokens, recovery codes, devices and
+	// callbacks are deleted along with the sessions and the user
+	stmts := []string{
+		`DELETE FROM sessions WHERE user_id=$1`,
+		`DELETE FROM authemails WHERE user_id=$1`,
+		`DELETE FROM users WHERE id=$1`,
+	}
+	for _, stmt := range stmts {
+		if _, err := tx.Exec(stmt, id); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.Exec(`DELETE FROM outbox WHERE user_uid=$1`, user.UID); err != nil {
+		return err
+	}
+
+	err = recordEvent(tx, &sentinel.Event{
+		UserUID: user.UID,
+		Kind:    sentinel.EventAccountPurged,
+		Actor:   sentinel.ActorSystem,
+	})
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
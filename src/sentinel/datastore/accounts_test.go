@@ -0,0 +1,132 @@
+// Copyright 2015 Lars Wiegman. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package datastore
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+
+	"sentinel"
+
+	"code.google.com/p/go-uuid/uuid"
+)
+
+func TestAccountsLifecycle(t *testing.T) {
+	d := NewDatastore(DB)
+
+	user, err := d.Users.Signup("archive@example.com", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	service, err := d.Services.Create(sentinel.ServiceUpdateOptions{
+		Name:    "Archive Box",
+		BaseURL: "https://api.archivebox.example.com/status",
+		Owner:   &user.UID,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e := &sentinel.Event{Actor: sentinel.ActorUser, IP: "192.0.2.1", UserAgent: "test"}
+	if err := d.Accounts.Archive(user.UID, e); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Accounts.Archive(user.UID, e); err != sql.ErrNoRows {
+		t.Errorf("Result should have been %v, but it was %v", sql.ErrNoRows, err)
+	}
+
+	// Archived users can't be found to login
+	if _, err := d.Users.GetUserDetails(user.UID); err != sql.ErrNoRows {
+		t.Errorf("Result should have been %v, but it was %v", sql.ErrNoRows, err)
+	}
+	found, err := d.Users.List(sentinel.UserListOptions{Email: []string{"archive@example.com"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(found) != 0 {
+		t.Errorf("Result should have been %v, but it was %v", 0, len(found))
+	}
+	found, err = d.Users.List(sentinel.UserListOptions{Email: []string{"archive@example.com"}, IncludeArchived: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(found) != 1 {
+		t.Errorf("Result should have been %v, but it was %v", 1, len(found))
+	}
+
+	if err := d.Accounts.Restore(user.UID, &sentinel.Event{Actor: sentinel.ActorAdmin}); err != nil {
+		t.Fatal(err)
+	}
+	restored, err := d.Users.GetUserDetails(user.UID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restored.ArchivedAt != nil {
+		t.Errorf("Result should have been %v, but it was %v", nil, restored.ArchivedAt)
+	}
+
+	// Users archived within the grace period aren't purged
+	if err := d.Accounts.Archive(user.UID, &sentinel.Event{Actor: sentinel.ActorUser}); err != nil {
+		t.Fatal(err)
+	}
+	purged, err := d.Accounts.Purge(time.Now().Add(-sentinel.ArchiveGracePeriod))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(purged) != 0 {
+		t.Errorf("Result should have been %v, but it was %v", 0, len(purged))
+	}
+
+	purged, err = d.Accounts.Purge(time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(purged) != 1 || !uuid.Equal(purged[0], user.UID) {
+		t.Fatalf("Result should have been %v, but it was %v", user.UID, purged)
+	}
+	if _, err := d.Users.GetEmail(user.AuthEmailList[0].UID); err != sql.ErrNoRows {
+		t.Errorf("Result should have been %v, but it was %v", sql.ErrNoRows, err)
+	}
+	if err := d.Accounts.Restore(user.UID, &sentinel.Event{Actor: sentinel.ActorAdmin}); err != sql.ErrNoRows {
+		t.Errorf("Result should have been %v, but it was %v", sql.ErrNoRows, err)
+	}
+
+	// The services of the user are archived without an owner
+	if _, err := d.Services.Get(service.UID); err != sql.ErrNoRows {
+		t.Errorf("Result should have been %v, but it was %v", sql.ErrNoRows, err)
+	}
+	var ownerID int
+	if err := DB.QueryRow(`SELECT owner_id FROM services WHERE uid=$1`, service.UID).Scan(&ownerID); err != nil {
+		t.Fatal(err)
+	}
+	if ownerID != 0 {
+		t.Errorf("Result should have been %v, but it was %v", 0, ownerID)
+	}
+
+	// The audit trail outlives the user
+	events, err := d.Events.List(sentinel.EventListOptions{User: user.UID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := []sentinel.EventKind{
+		sentinel.EventAccountPurged,
+		sentinel.EventAccountArchived,
+		sentinel.EventAccountRestored,
+		sentinel.EventAccountArchived,
+	}
+	if len(events) != len(expect) {
+		t.Fatalf("Result should have been %v events, but it was %v", len(expect), len(events))
+	}
+	for i, kind := range expect {
+		if events[i].Kind != kind {
+			t.Errorf("Result should have been %v, but it was %v", kind, events[i].Kind)
+		}
+	}
+	if last := events[3]; last.IP != e.IP || last.UserAgent != e.UserAgent {
+		t.Errorf("Result should have been %+v, but it was %+v", e, last)
+	}
+}
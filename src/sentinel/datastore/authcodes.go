@@ -0,0 +1,86 @@
+// Copyright 2015 Lars Wiegman. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package datastore
+
+import (
+	"database/sql"
+	"time"
+
+	"sentinel"
+)
+
+const authCodeTable = "authcodes"
+const authCodeTableCreateStmt = `
+CREATE TABLE authcodes (
+    id SERIAL PRIMARY KEY, -- internal identifier
+    code_hash TEXT UNIQUE NOT NULL, -- hex encoded SHA-256 hash of the code
+    service_id integer NOT NULL references services ON DELETE CASCADE,
+    user_id integer NOT NULL references users ON DELETE CASCADE,
+    session_id integer NOT NULL references sessions ON DELETE CASCADE,
+    redirect_uri TEXT NOT NULL,
+    scope TEXT NOT NULL DEFAULT '',
+    nonce TEXT NOT NULL DEFAULT '',
+    code_challenge TEXT NOT NULL, -- S256 PKCE code challenge
+    auth_time TIMESTAMP(0) NOT NULL, -- approval date of the login session
+    is_used BOOLEAN NOT NULL DEFAULT FALSE,
+    expires_at TIMESTAMP(0) NOT NULL,
+    created_at TIMESTAMP(0)
+);`
+
+const authCodeInsertStmt = `
+INSERT INTO authcodes(code_hash, service_id, user_id, session_id, redirect_uri,
+    scope, nonce, code_challenge, auth_time, is_used, expires_at, created_at)
+VALUES (:code_hash, :service_id, :user_id, :session_id, :redirect_uri,
+    :scope, :nonce, :code_challenge, :auth_time, :is_used, :expires_at, :created_at)
+RETURNING id
+;`
+
+type authCodesStore struct {
+	*Datastore
+}
+
+// Create generates the code of the authorization code, which expires after
+// sentinel.AuthorizationCodeTTL.
+func (s *authCodesStore) Create(c *sentinel.AuthorizationCode) error {
+	code, err := randomHex(32)
+	if err != nil {
+		return err
+	}
+	now := time.Now().UTC()
+	c.Code = code
+	c.CodeHash = hashToken(code)
+	c.IsUsed = false
+	c.ExpiresAt = now.Add(sentinel.AuthorizationCodeTTL)
+	c.CreatedAt = now
+
+	stmt, err := s.db.PrepareNamed(authCodeInsertStmt)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	return stmt.QueryRowx(c).Scan(&c.ID)
+}
+
+// Redeem marks the authorization code as used. The update is guarded in SQL
+// so a code can't be redeemed twice by concurrent requests.
+func (s *authCodesStore) Redeem(code string) (*sentinel.AuthorizationCode, error) {
+	var c sentinel.AuthorizationCode
+	err := s.db.QueryRowx(`
+UPDATE authcodes SET is_used=TRUE
+WHERE code_hash=$1 AND is_used=FALSE AND expires_at>$2
+RETURNING *
+;`, hashToken(code), time.Now().UTC()).StructScan(&c)
+	if err == sql.ErrNoRows {
+		return nil, sentinel.ErrAuthorizationCodeInvalid
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.db.QueryRowx(`SELECT uid FROM users WHERE id=$1`, c.UserID).Scan(&c.UserUID); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
@@ -0,0 +1,47 @@
+// Copyright 2015 Lars Wiegman. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package datastore
+
+import (
+	"testing"
+	"time"
+
+	"sentinel"
+)
+
+func TestAuthorizationCodeRedeem(t *testing.T) {
+	d := NewDatastore(DB)
+
+	userID := users[1].AuthEmailList[0].UserID
+	session, err := d.Sessions.Create(services[0].ID, userID, sentinel.AuthLevelFast, users[1].AuthEmailList[0].Email, "secret1", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := &sentinel.AuthorizationCode{
+		ServiceID:     services[0].ID,
+		UserID:        userID,
+		SessionID:     session.ID,
+		RedirectURI:   "https://example.com/callback",
+		Scope:         "openid",
+		CodeChallenge: "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM",
+		AuthTime:      time.Now().UTC(),
+	}
+	if err := d.AuthCodes.Create(c); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := d.AuthCodes.Redeem(c.Code)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.CodeChallenge != c.CodeChallenge || result.UserUID == nil {
+		t.Errorf("Result should have been %+v, but it was %+v", c, result)
+	}
+
+	if _, err := d.AuthCodes.Redeem(c.Code); err != sentinel.ErrAuthorizationCodeInvalid {
+		t.Errorf("Result should have been %v, but it was %v", sentinel.ErrAuthorizationCodeInvalid, err)
+	}
+}
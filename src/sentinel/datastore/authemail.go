@@ -12,18 +12,23 @@ CREATE TABLE authemails (
     user_id integer NOT NULL references users ON UPDATE CASCADE,
     email TEXT NOT NULL UNIQUE,
     is_verified BOOLEAN NOT NULL DEFAULT FALSE,
+    is_primary BOOLEAN NOT NULL DEFAULT FALSE CHECK (is_verified OR NOT is_primary),
     created_at TIMESTAMP(0),
     updated_at TIMESTAMP(0)
 );
+CREATE UNIQUE INDEX authemails_primary ON authemails (user_id) WHERE is_primary;
 `
 const authemailInsertStmt = `
-INSERT INTO authemails (uid, user_id, email, is_verified, created_at, updated_at)
-VALUES (:uid, :user_id, :email, :is_verified, :created_at, :updated_at)
+INSERT INTO authemails (uid, user_id, email, is_verified, is_primary, created_at, updated_at)
+VALUES (:uid, :user_id, :email, :is_verified, :is_primary, :created_at, :updated_at)
 ;`
 
 const authemailListStmt = `SELECT * FROM authemails`
 const authemailGetStmt = `SELECT * FROM authemails WHERE id=$1;`
 
+// authemailUserListStmt lists the emails of a user, the primary email first.
+const authemailUserListStmt = `SELECT * FROM authemails WHERE user_id=$1 ORDER BY is_primary DESC, id`
+
 const authemailCreateStmt = `
 INSERT INTO authemails (uid, user_id, email, is_verified, created_at, updated_at) (
     SELECT $1, id, $2, $3, $4, $5 FROM users WHERE uid=$6
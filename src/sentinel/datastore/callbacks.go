@@ -0,0 +1,149 @@
+// Copyright 2015 Lars Wiegman. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package datastore
+
+import (
+	"time"
+
+	"sentinel"
+
+	"code.google.com/p/go-uuid/uuid"
+)
+
+const callbackTable = "callbacks"
+const callbackTableCreateStmt = `
+CREATE TABLE callbacks (
+    id SERIAL PRIMARY KEY, -- internal identifier
+    session_id integer NOT NULL references sessions ON DELETE CASCADE,
+    url TEXT NOT NULL,
+    body TEXT NOT NULL,
+    status TEXT NOT NULL DEFAULT 'pending'
+        CHECK (status IN ('pending', 'delivered', 'failed')),
+    attempts INTEGER NOT NULL DEFAULT 0,
+    last_error TEXT NOT NULL DEFAULT '',
+    next_attempt_at TIMESTAMP(0) NOT NULL,
+    created_at TIMESTAMP(0),
+    updated_at TIMESTAMP(0)
+);
+CREATE INDEX callbacks_due ON callbacks (next_attempt_at) WHERE status='pending';
+`
+
+const callbackAttemptTable = "callback_attempts"
+const callbackAttemptTableCreateStmt = `
+CREATE TABLE callback_attempts (
+    id SERIAL PRIMARY KEY, -- internal identifier
+    callback_id integer NOT NULL references callbacks ON DELETE CASCADE,
+    status_code INTEGER NOT NULL DEFAULT 0, -- 0 when no response was received
+    error TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMP(0)
+);
+`
+
+const callbackInsertStmt = `
+INSERT INTO callbacks(session_id, url, body, status, attempts, last_error,
+    next_attempt_at, created_at, updated_at)
+VALUES (:session_id, :url, :body, :status, :attempts, :last_error,
+    :next_attempt_at, :created_at, :updated_at) RETURNING id
+;`
+
+const callbackAttemptInsertStmt = `
+INSERT INTO callback_attempts(callback_id, status_code, error, created_at)
+VALUES (:callback_id, :status_code, :error, :created_at)
+;`
+
+type callbacksStore struct {
+	*Datastore
+}
+
+// Enqueue stores the callback already claimed, so dispatchers don't deliver
+// it while the caller makes the first attempt.
+func (s *callbacksStore) Enqueue(c *sentinel.Callback, lease time.Duration) error {
+	now := time.Now().UTC()
+	c.Status = sentinel.CallbackPending
+	c.NextAttemptAt = now.Add(lease)
+	c.CreatedAt = now
+	c.UpdatedAt = now
+
+	stmt, err := s.db.PrepareNamed(callbackInsertStmt)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	return stmt.QueryRowx(c).Scan(&c.ID)
+}
+
+// Due claims pending callbacks by moving their next attempt beyond the lease,
+// concurrent dispatchers skip the rows claimed by another.
+func (s *callbacksStore) Due(limit int, lease time.Duration) ([]*sentinel.Callback, error) {
+	now := time.Now().UTC()
+	rows, err := s.db.Queryx(`
+		UPDATE callbacks SET next_attempt_at=$3
+		WHERE id IN (
+			SELECT id FROM callbacks
+			WHERE status='pending'
+			AND next_attempt_at <= $1
+			ORDER BY next_attempt_at
+			LIMIT $2
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING *`, now, limit, now.Add(lease))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var callbacks []*sentinel.Callback
+	for rows.Next() {
+		var c sentinel.Callback
+		if err := rows.StructScan(&c); err != nil {
+			return nil, err
+		}
+		callbacks = append(callbacks, &c)
+	}
+	return callbacks, rows.Err()
+}
+
+func (s *callbacksStore) Record(c *sentinel.Callback, a *sentinel.CallbackAttempt) error {
+	now := time.Now().UTC()
+	c.UpdatedAt = now
+	a.CallbackID = c.ID
+	if a.CreatedAt.IsZero() {
+		a.CreatedAt = now
+	}
+
+	tx, err := s.db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.NamedExec(callbackAttemptInsertStmt, a); err != nil {
+		return err
+	}
+	_, err = tx.Exec(`
+		UPDATE callbacks SET status=$2, attempts=$3, last_error=$4,
+		next_attempt_at=$5, updated_at=$6
+		WHERE id=$1`,
+		c.ID, c.Status, c.Attempts, c.LastError, c.NextAttemptAt, c.UpdatedAt)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *callbacksStore) History(sessionID uuid.UUID) ([]*sentinel.CallbackAttempt, error) {
+	var attempts []*sentinel.CallbackAttempt
+	err := s.db.Select(&attempts, `
+		SELECT a.* FROM callback_attempts a
+		JOIN callbacks c ON c.id=a.callback_id
+		JOIN sessions s ON s.id=c.session_id
+		WHERE s.uid=$1
+		ORDER BY a.created_at, a.id`, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	return attempts, nil
+}
@@ -0,0 +1,82 @@
+// Copyright 2015 Lars Wiegman. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package datastore
+
+import (
+	"testing"
+	"time"
+
+	"sentinel"
+)
+
+func TestCallbacks(t *testing.T) {
+	d := NewDatastore(DB)
+
+	session, err := d.Sessions.Create(services[0].ID, users[1].AuthEmailList[0].UserID, sentinel.AuthLevelFast, users[1].AuthEmailList[0].Email, "secret1", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The first attempt is made by the caller, the callback isn't due for
+	// the duration of the lease
+	claimed := &sentinel.Callback{
+		SessionID: session.ID,
+		URL:       services[0].BaseURL,
+		Body:      `{"status":"accepted"}`,
+	}
+	if err := d.Callbacks.Enqueue(claimed, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	c := &sentinel.Callback{
+		SessionID: session.ID,
+		URL:       services[0].BaseURL,
+		Body:      `{"status":"accepted"}`,
+	}
+	if err := d.Callbacks.Enqueue(c, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	due, err := d.Callbacks.Due(10, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var found bool
+	for _, v := range due {
+		switch v.ID {
+		case c.ID:
+			found = true
+		case claimed.ID:
+			t.Errorf("callback %d should have been claimed", claimed.ID)
+		}
+	}
+	if !found {
+		t.Fatalf("callback %d should have been due", c.ID)
+	}
+
+	// Claimed callbacks aren't due until the lease ends
+	due, err = d.Callbacks.Due(10, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range due {
+		if v.ID == c.ID {
+			t.Errorf("callback %d should have been claimed", c.ID)
+		}
+	}
+
+	c.Attempts = 1
+	c.Status = sentinel.CallbackDelivered
+	if err := d.Callbacks.Record(c, &sentinel.CallbackAttempt{StatusCode: 204}); err != nil {
+		t.Fatal(err)
+	}
+
+	history, err := d.Callbacks.History(session.UID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 1 || history[0].StatusCode != 204 {
+		t.Errorf("Result should have been a single attempt with status 204, but it was %v", history)
+	}
+}
@@ -11,9 +11,20 @@ import (
 )
 
 type Datastore struct {
-	Users    sentinel.UsersService
-	Services sentinel.ServicesService
-	db       *sqlx.DB
+	Users         sentinel.UsersService
+	Services      sentinel.ServicesStore
+	Sessions      sentinel.SessionsService
+	Callbacks     sentinel.CallbacksService
+	RefreshTokens sentinel.RefreshTokensService
+	Revocations   sentinel.RevocationsService
+	AuthCodes     sentinel.AuthorizationCodesService
+	Outbox        sentinel.OutboxService
+	Accounts      sentinel.AccountsService
+	Events        sentinel.EventsService
+	RateLimits    sentinel.RateLimitsService
+	MFA           sentinel.MFAService
+	Devices       sentinel.DevicesService
+	db            *sqlx.DB
 }
 
 func NewDatastore(db *sqlx.DB) *Datastore {
@@ -24,12 +35,34 @@ func NewDatastore(db *sqlx.DB) *Datastore {
 	d := &Datastore{db: db}
 	d.Users = &usersStore{Datastore: d}
 	d.Services = &servicesStore{Datastore: d}
+	d.Sessions = &sessionsStore{Datastore: d}
+	d.Callbacks = &callbacksStore{Datastore: d}
+	d.RefreshTokens = &refreshTokensStore{Datastore: d}
+	d.Revocations = &revocationsStore{Datastore: d}
+	d.AuthCodes = &authCodesStore{Datastore: d}
+	d.Outbox = &outboxStore{Datastore: d}
+	d.Accounts = &accountsStore{Datastore: d}
+	d.Events = &eventsStore{Datastore: d}
+	d.RateLimits = &rateLimitsStore{Datastore: d}
+	d.MFA = &mfaStore{Datastore: d}
+	d.Devices = &devicesStore{Datastore: d}
 	return d
 }
 
 func NewMockDatastore() *Datastore {
 	return &Datastore{
-		Users:    &sentinel.MockUsersService{},
-		Services: &sentinel.MockServicesService{},
+		Users:         &sentinel.MockUsersService{},
+		Services:      &sentinel.MockServicesService{},
+		Sessions:      &sentinel.MockSessionsService{},
+		Callbacks:     &sentinel.MockCallbacksService{},
+		RefreshTokens: &sentinel.MockRefreshTokensService{},
+		Revocations:   &sentinel.MockRevocationsService{},
+		AuthCodes:     &sentinel.MockAuthorizationCodesService{},
+		Outbox:        &sentinel.MockOutboxService{},
+		Accounts:      &sentinel.MockAccountsService{},
+		Events:        &sentinel.MockEventsService{},
+		RateLimits:    &sentinel.MockRateLimitsService{},
+		MFA:           &sentinel.MockMFAService{},
+		Devices:       &sentinel.MockDevicesService{},
 	}
 }
@@ -47,6 +47,17 @@ func Create() {
 		userTableCreateStmt,
 		authemailTableCreateStmt,
 		serviceTableCreateStmt,
+		sessionTableCreateStmt,
+		callbackTableCreateStmt,
+		callbackAttemptTableCreateStmt,
+		refreshTokenTableCreateStmt,
+		revocationTableCreateStmt,
+		authCodeTableCreateStmt,
+		outboxTableCreateStmt,
+		eventTableCreateStmt,
+		rateLimitTableCreateStmt,
+		recoveryCodeTableCreateStmt,
+		deviceTableCreateStmt,
 	}
 	for _, query := range createSQL {
 		if _, err := DB.Exec(query); err != nil {
@@ -59,6 +70,17 @@ func Create() {
 func Drop() {
 	// DB.Exec(`DROP INDEX IF EXISTS user_isarchived;`)
 	dropTables := []string{
+		deviceTable,
+		recoveryCodeTable,
+		rateLimitTable,
+		eventTable,
+		outboxTable,
+		authCodeTable,
+		revocationTable,
+		refreshTokenTable,
+		callbackAttemptTable,
+		callbackTable,
+		sessionTable,
 		authemailTable,
 		userTable,
 		serviceTable,
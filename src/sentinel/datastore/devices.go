@@ -0,0 +1,202 @@
+// Copyright 2015 Lars Wiegman. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package datastore
+
+import (
+	"time"
+
+	"sentinel"
+
+	"code.google.com/p/go-uuid/uuid"
+)
+
+const deviceTable = "devices"
+const deviceTableCreateStmt = `
+CREATE TABLE devices (
+    id SERIAL PRIMARY KEY, -- internal identifier
+    uid uuid UNIQUE NOT NULL, -- uuid identifier
+    user_id integer NOT NULL references users ON DELETE CASCADE,
+    platform TEXT NOT NULL CHECK (platform IN ('ios', 'android')),
+    push_token TEXT NOT NULL, -- APNs device token or FCM registration token
+    name TEXT NOT NULL DEFAULT '',
+    app_version TEXT NOT NULL DEFAULT '',
+    public_key TEXT NOT NULL DEFAULT '', -- PEM encoded key of the device
+    is_active BOOLEAN NOT NULL DEFAULT TRUE, -- false when the push token is rejected
+    lastseen_at TIMESTAMP(0) NOT NULL,
+    created_at TIMESTAMP(0),
+    updated_at TIMESTAMP(0),
+    failures integer NOT NULL DEFAULT 0, -- failed deliveries since the last delivery
+    last_error TEXT NOT NULL DEFAULT '',
+    failed_at TIMESTAMP(0) NOT NULL DEFAULT '0001-01-01',
+    delivered_at TIMESTAMP(0) NOT NULL DEFAULT '0001-01-01'
+);
+CREATE UNIQUE INDEX devices_push_token ON devices (platform, push_token);
+CREATE INDEX devices_user ON devices (user_id, lastseen_at);
+`
+
+// deviceRegisterStmt adds the device or, when its push token is registered
+// already, updates it. The uid, creation date and, unless a new one is
+// given, public key of a known device are kept.
+const deviceRegisterStmt = `
+INSERT INTO devices(uid, user_id, platform, push_token, name, app_version,
+    public_key, is_active, lastseen_at, created_at, updated_at)
+VALUES (:uid, :user_id, :platform, :push_token, :name, :app_version,
+    :public_key, TRUE, :lastseen_at, :created_at, :updated_at)
+ON CONFLICT (platform, push_token) DO UPDATE SET
+    name = CASE WHEN EXCLUDED.name = '' THEN devices.name ELSE EXCLUDED.name END,
+    app_version = EXCLUDED.app_version,
+    public_key = CASE WHEN EXCLUDED.public_key = '' THEN devices.public_key ELSE EXCLUDED.public_key END,
+    is_active = TRUE,
+    failures = 0,
+    lastseen_at = EXCLUDED.lastseen_at,
+    updated_at = EXCLUDED.updated_at
+RETURNING *
+;`
+
+const deviceUpdateStmt = `
+UPDATE devices SET
+    (push_token, name, app_version, is_active, failures, lastseen_at, updated_at) =
+    (:push_token, :name, :app_version, :is_active, :failures, :lastseen_at, :updated_at)
+WHERE id=:id
+;`
+
+// deviceFailureStmt counts the failure, is_active is only cleared when the
+// device is deactivated.
+const deviceFailureStmt = `
+UPDATE devices SET
+    failures = failures + 1,
+    last_error = $3,
+    failed_at = $4,
+    is_active = is_active AND NOT $5
+WHERE uid=$1 AND push_token=$2
+;`
+
+type devicesStore struct {
+	*Datastore
+}
+
+func (s *devicesStore) Register(userID int, opt sentinel.DeviceOptions) (*sentinel.Device, error) {
+	now := time.Now().UTC()
+	device := &sentinel.Device{
+		UID:        uuid.NewRandom(),
+		UserID:     userID,
+		Platform:   opt.Platform,
+		PushToken:  opt.PushToken,
+		Name:       opt.Name,
+		AppVersion: opt.AppVersion,
+		PublicKey:  opt.PublicKey,
+		LastSeenAt: now,
+		CreatedAt:  now,
+		UpdatedAt:  now,
+	}
+
+	tx, err := s.db.Beginx()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// The app of another user was signed in on the device before, the
+	// token isn't theirs anymore
+	_, err = tx.Exec(`DELETE FROM devices WHERE platform=$1 AND push_token=$2 AND user_id<>$3`,
+		device.Platform, device.PushToken, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	stmt, err := tx.PrepareNamed(deviceRegisterStmt)
+	if err != nil {
+		return nil, err
+	}
+	if err := stmt.Get(device, device); err != nil {
+		return nil, err
+	}
+	return device, tx.Commit()
+}
+
+func (s *devicesStore) Get(uid uuid.UUID) (*sentinel.Device, error) {
+	var device sentinel.Device
+	if err := s.db.Get(&device, `SELECT * FROM devices WHERE uid=$1`, uid); err != nil {
+		return nil, err
+	}
+	return &device, nil
+}
+
+func (s *devicesStore) List(opt sentinel.DeviceListOptions) ([]*sentinel.Device, error) {
+	sb := psq.Select("*").From(deviceTable).Where("user_id=?", opt.UserID).OrderBy("lastseen_at DESC", "id DESC")
+	if opt.ActiveOnly {
+		sb = sb.Where("is_active=TRUE")
+	}
+	if opt.ListOptions != nil {
+		sb = sb.Limit(opt.ListOptions.Limit()).Offset(opt.ListOptions.Offset())
+	}
+	query, args, err := sb.ToSql()
+	if err != nil {
+		return nil, err
+	}
+
+	var devices []*sentinel.Device
+	if err := s.db.Select(&devices, query, args...); err != nil {
+		return nil, err
+	}
+	return devices, nil
+}
+
+func (s *devicesStore) Update(uid uuid.UUID, opt sentinel.DeviceOptions) (*sentinel.Device, error) {
+	device, err := s.Get(uid)
+	if err != nil {
+		return nil, err
+	}
+
+	if opt.Name != "" {
+		device.Name = opt.Name
+	}
+	if opt.AppVersion != "" {
+		device.AppVersion = opt.AppVersion
+	}
+	if opt.PushToken != "" && opt.PushToken != device.PushToken {
+		// A new push token is tried again
+		device.PushToken = opt.PushToken
+		device.IsActive = true
+		device.Failures = 0
+	}
+	device.LastSeenAt = time.Now().UTC()
+	device.UpdatedAt = device.LastSeenAt
+
+	tx, err := s.db.Beginx()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// As on registration the push token moves to this device, another device
+	// with the token isn't reachable through it anymore
+	_, err = tx.Exec(`DELETE FROM devices WHERE platform=$1 AND push_token=$2 AND id<>$3`,
+		device.Platform, device.PushToken, device.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := tx.NamedExec(deviceUpdateStmt, device); err != nil {
+		return nil, err
+	}
+	return device, tx.Commit()
+}
+
+func (s *devicesStore) Delete(uid uuid.UUID) error {
+	_, err := s.db.Exec(`DELETE FROM devices WHERE uid=$1`, uid)
+	return err
+}
+
+func (s *devicesStore) RecordDelivery(uid uuid.UUID, pushToken string) error {
+	_, err := s.db.Exec(`UPDATE devices SET failures=0, delivered_at=$3 WHERE uid=$1 AND push_token=$2`,
+		uid, pushToken, time.Now().UTC())
+	return err
+}
+
+func (s *devicesStore) RecordFailure(uid uuid.UUID, pushToken, reason string, deactivate bool) error {
+	_, err := s.db.Exec(deviceFailureStmt, uid, pushToken, reason, time.Now().UTC(), deactivate)
+	return err
+}
@@ -0,0 +1,121 @@
+// Copyright 2015 Lars Wiegman. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package datastore
+
+import (
+	"database/sql"
+	"testing"
+
+	"sentinel"
+)
+
+func TestDevices(t *testing.T) {
+	d := NewDatastore(DB)
+	userID := users[0].AuthEmailList[0].UserID
+	otherID := users[1].AuthEmailList[0].UserID
+
+	publicKey := "-----BEGIN PUBLIC KEY-----\nMCowBQYDK2VwAyEAGb9ECWmEzf6FQbrBZ9w7lshQhqowtrbLDFw4rXAxZuE=\n-----END PUBLIC KEY-----\n"
+	opt := sentinel.DeviceOptions{Platform: "ios", PushToken: "e2f28cb73f1f47dd", Name: "iPhone", AppVersion: "1.0", PublicKey: publicKey}
+	first, err := d.Devices.Register(userID, opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Devices.Delete(first.UID)
+
+	// Registering the push token again updates the device, the enrolled key
+	// is kept
+	opt.Name, opt.AppVersion, opt.PublicKey = "", "1.1", ""
+	again, err := d.Devices.Register(userID, opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.ID != first.ID || again.Name != "iPhone" || again.AppVersion != "1.1" || again.PublicKey != publicKey {
+		t.Errorf("Result should have been the updated device, but it was %+v", again)
+	}
+
+	second, err := d.Devices.Register(userID, sentinel.DeviceOptions{Platform: "android", PushToken: "bk3RNwTe3H0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Devices.Delete(second.UID)
+
+	devices, err := d.Devices.List(sentinel.DeviceListOptions{UserID: userID, ActiveOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(devices) != 2 {
+		t.Errorf("Result should have been %v, but it was %v", 2, len(devices))
+	}
+
+	// The push token moves to the other user
+	moved, err := d.Devices.Register(otherID, sentinel.DeviceOptions{Platform: "android", PushToken: "bk3RNwTe3H0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Devices.Delete(moved.UID)
+	devices, err = d.Devices.List(sentinel.DeviceListOptions{UserID: userID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(devices) != 1 || devices[0].ID != first.ID {
+		t.Errorf("Result should have been the first device, but it was %v", devices)
+	}
+
+	renamed, err := d.Devices.Update(first.UID, sentinel.DeviceOptions{Name: "Jess's iPhone"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if renamed.Name != "Jess's iPhone" || renamed.PushToken != opt.PushToken {
+		t.Errorf("Result should have been the renamed device, but it was %+v", renamed)
+	}
+
+	// A new push token moves to the updated device, like on registration
+	other, err := d.Devices.Register(otherID, sentinel.DeviceOptions{Platform: "ios", PushToken: "9a3c04d1e5b7"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Devices.Delete(other.UID)
+	if _, err := d.Devices.Update(first.UID, sentinel.DeviceOptions{PushToken: other.PushToken}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Devices.Get(other.UID); err != sql.ErrNoRows {
+		t.Errorf("Result should have been %v, but it was %v", sql.ErrNoRows, err)
+	}
+	if _, err := d.Devices.Update(first.UID, sentinel.DeviceOptions{PushToken: opt.PushToken}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Failures are counted until the next delivery, results for a push token
+	// the device no longer has are ignored
+	for _, f := range []struct {
+		token, reason string
+		deactivate    bool
+	}{
+		{"e2f28cb7", "Unregistered", true},
+		{opt.PushToken, "ServiceUnavailable", false},
+		{opt.PushToken, "Unregistered", true},
+	} {
+		if err := d.Devices.RecordFailure(first.UID, f.token, f.reason, f.deactivate); err != nil {
+			t.Fatal(err)
+		}
+	}
+	failed, err := d.Devices.Get(first.UID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if failed.Failures != 2 || failed.LastError != "Unregistered" || failed.IsActive {
+		t.Errorf("Result should have been an inactive device with 2 failures, but it was %+v", failed)
+	}
+	if err := d.Devices.RecordDelivery(first.UID, opt.PushToken); err != nil {
+		t.Fatal(err)
+	}
+	delivered, err := d.Devices.Get(first.UID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if delivered.Failures != 0 || delivered.DeliveredAt.IsZero() {
+		t.Errorf("Result should have been a delivered device, but it was %+v", delivered)
+	}
+}
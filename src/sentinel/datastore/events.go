@@ -0,0 +1,85 @@
+// Copyright 2015 Lars Wiegman. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package datastore
+
+import (
+	"time"
+
+	"sentinel"
+
+	"github.com/jmoiron/sqlx"
+	sq "github.com/lann/squirrel"
+)
+
+// The events table has no reference to the users table, the audit trail is
+// kept after a user is purged.
+const eventTable = "events"
+const eventTableCreateStmt = `
+CREATE TABLE events (
+    id SERIAL PRIMARY KEY, -- internal identifier
+    user_uid uuid NOT NULL,
+    kind TEXT NOT NULL,
+    actor TEXT NOT NULL, -- user, admin or system
+    ip TEXT NOT NULL DEFAULT '',
+    user_agent TEXT NOT NULL DEFAULT '',
+    detail TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMP(0) NOT NULL
+);
+CREATE INDEX events_user ON events (user_uid, created_at);
+`
+
+const eventInsertStmt = `
+INSERT INTO events(user_uid, kind, actor, ip, user_agent, detail, created_at)
+VALUES (:user_uid, :kind, :actor, :ip, :user_agent, :detail, :created_at) RETURNING id
+;`
+
+type eventsStore struct {
+	*Datastore
+}
+
+// recordEvent appends the event using the transaction of the change it
+// records, the event is only stored when the change is committed.
+func recordEvent(tx *sqlx.Tx, e *sentinel.Event) error {
+	e.CreatedAt = time.Now().UTC()
+
+	stmt, err := tx.PrepareNamed(eventInsertStmt)
+	if err != nil {
+		return err
+	}
+	return stmt.QueryRowx(e).Scan(&e.ID)
+}
+
+func (s *eventsStore) Record(e *sentinel.Event) error {
+	tx, err := s.db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := recordEvent(tx, e); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *eventsStore) List(opt sentinel.EventListOptions) ([]*sentinel.Event, error) {
+	sb := psq.Select("*").From(eventTable).Where("user_uid=?", opt.User).OrderBy("created_at DESC", "id DESC")
+	if len(opt.Kinds) > 0 {
+		sb = sb.Where(sq.Eq{"kind": opt.Kinds})
+	}
+	if opt.ListOptions != nil {
+		sb = sb.Limit(opt.ListOptions.Limit()).Offset(opt.ListOptions.Offset())
+	}
+	query, args, err := sb.ToSql()
+	if err != nil {
+		return nil, err
+	}
+
+	var events []*sentinel.Event
+	if err := s.db.Select(&events, query, args...); err != nil {
+		return nil, err
+	}
+	return events, nil
+}
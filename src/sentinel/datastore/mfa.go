@@ -0,0 +1,135 @@
+// Copyright 2015 Lars Wiegman. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package datastore
+
+import (
+	"database/sql"
+	"time"
+
+	"sentinel"
+)
+
+const recoveryCodeTable = "recoverycodes"
+const recoveryCodeTableCreateStmt = `
+CREATE TABLE recoverycodes (
+    id SERIAL PRIMARY KEY, -- internal identifier
+    user_id integer NOT NULL references users ON DELETE CASCADE,
+    code_hash TEXT NOT NULL, -- hex encoded SHA-256 hash of the code
+    is_used BOOLEAN NOT NULL DEFAULT FALSE,
+    created_at TIMESTAMP(0),
+    updated_at TIMESTAMP(0)
+);
+CREATE INDEX recoverycodes_user ON recoverycodes (user_id);
+`
+
+type mfaStore struct {
+	*Datastore
+}
+
+func (s *mfaStore) EnrollTOTP(userID int, secret string) error {
+	var enabled bool
+	err := s.db.QueryRowx(`SELECT totp_enabled FROM users WHERE id=$1`, userID).Scan(&enabled)
+	if err != nil {
+		return err
+	}
+	if enabled {
+		return sentinel.ErrTOTPEnabled
+	}
+
+	// The secret is only replaced while TOTP isn't enabled
+	res, err := s.db.Exec(`
+		UPDATE users SET totp_secret=$1, totp_step=0, updated_at=$2
+		WHERE id=$3 AND totp_enabled=FALSE`, secret, time.Now().UTC(), userID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n != 1 {
+		return sentinel.ErrTOTPEnabled
+	}
+	return nil
+}
+
+func (s *mfaStore) EnableTOTP(userID int, step int64, recoveryCodes []string) error {
+	tx, err := s.db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	now := time.Now().UTC()
+	res, err := tx.Exec(`
+		UPDATE users SET totp_enabled=TRUE, totp_step=$1, updated_at=$2
+		WHERE id=$3 AND totp_secret<>''`, step, now, userID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n != 1 {
+		return sentinel.ErrTOTPNotEnrolled
+	}
+
+	if _, err := tx.Exec(`DELETE FROM recoverycodes WHERE user_id=$1`, userID); err != nil {
+		return err
+	}
+	for _, code := range recoveryCodes {
+		_, err := tx.Exec(`
+			INSERT INTO recoverycodes(user_id, code_hash, created_at, updated_at)
+			VALUES ($1, $2, $3, $3)`, userID, hashToken(code), now)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *mfaStore) DisableTOTP(userID int) error {
+	tx, err := s.db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		UPDATE users SET totp_secret='', totp_enabled=FALSE, totp_step=0, updated_at=$1
+		WHERE id=$2`, time.Now().UTC(), userID)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM recoverycodes WHERE user_id=$1`, userID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// UseTOTP only moves the step forward, of concurrent logins with the same
+// code only one succeeds.
+func (s *mfaStore) UseTOTP(userID int, step int64) error {
+	res, err := s.db.Exec(`
+		UPDATE users SET totp_step=$1
+		WHERE id=$2 AND totp_enabled=TRUE AND totp_step<$1`, step, userID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n != 1 {
+		return sentinel.ErrTOTPReplayed
+	}
+	return nil
+}
+
+func (s *mfaStore) UseRecoveryCode(userID int, code string) error {
+	var id int
+	err := s.db.QueryRowx(`
+		UPDATE recoverycodes SET is_used=TRUE, updated_at=$1
+		WHERE id=(
+			SELECT id FROM recoverycodes
+			WHERE user_id=$2 AND code_hash=$3 AND is_used=FALSE
+			LIMIT 1
+			FOR UPDATE
+		) AND is_used=FALSE
+		RETURNING id`, time.Now().UTC(), userID, hashToken(code)).Scan(&id)
+	if err == sql.ErrNoRows {
+		return sentinel.ErrRecoveryCodeInvalid
+	}
+	return err
+}
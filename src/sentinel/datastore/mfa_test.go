@@ -0,0 +1,55 @@
+// Copyright 2015 Lars Wiegman. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package datastore
+
+import (
+	"testing"
+
+	"sentinel"
+)
+
+func TestTOTP(t *testing.T) {
+	d := NewDatastore(DB)
+	userID := users[0].AuthEmailList[0].UserID
+	defer d.MFA.DisableTOTP(userID)
+
+	if err := d.MFA.EnableTOTP(userID, 1, nil); err != sentinel.ErrTOTPNotEnrolled {
+		t.Errorf("Result should have been %v, but it was %v", sentinel.ErrTOTPNotEnrolled, err)
+	}
+	if err := d.MFA.EnrollTOTP(userID, "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.MFA.EnableTOTP(userID, 100, []string{"aaaaa-aaaaa", "bbbbb-bbbbb"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.MFA.EnrollTOTP(userID, "GEZDGNBVGY3TQOJQ"); err != sentinel.ErrTOTPEnabled {
+		t.Errorf("Result should have been %v, but it was %v", sentinel.ErrTOTPEnabled, err)
+	}
+
+	// Time steps only move forward
+	if err := d.MFA.UseTOTP(userID, 100); err != sentinel.ErrTOTPReplayed {
+		t.Errorf("Result should have been %v, but it was %v", sentinel.ErrTOTPReplayed, err)
+	}
+	if err := d.MFA.UseTOTP(userID, 101); err != nil {
+		t.Errorf("Result should have been %v, but it was %v", nil, err)
+	}
+
+	// Recovery codes are used once
+	if err := d.MFA.UseRecoveryCode(userID, "aaaaa-aaaaa"); err != nil {
+		t.Errorf("Result should have been %v, but it was %v", nil, err)
+	}
+	for _, code := range []string{"aaaaa-aaaaa", "ccccc-ccccc"} {
+		if err := d.MFA.UseRecoveryCode(userID, code); err != sentinel.ErrRecoveryCodeInvalid {
+			t.Errorf("Result should have been %v, but it was %v", sentinel.ErrRecoveryCodeInvalid, err)
+		}
+	}
+
+	if err := d.MFA.DisableTOTP(userID); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.MFA.UseRecoveryCode(userID, "bbbbb-bbbbb"); err != sentinel.ErrRecoveryCodeInvalid {
+		t.Errorf("Result should have been %v, but it was %v", sentinel.ErrRecoveryCodeInvalid, err)
+	}
+}
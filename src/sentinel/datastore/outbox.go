@@ -0,0 +1,153 @@
+// Copyright 2015 Lars Wiegman. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package datastore
+
+import (
+	"errors"
+	"time"
+
+	"sentinel"
+
+	"github.com/jmoiron/sqlx"
+)
+
+const outboxTable = "outbox"
+const outboxTableCreateStmt = `
+CREATE TABLE outbox (
+    id SERIAL PRIMARY KEY, -- internal identifier
+    kind TEXT NOT NULL,
+    recipient TEXT NOT NULL,
+    user_uid uuid NOT NULL,
+    email_uid uuid NOT NULL,
+    locale TEXT NOT NULL DEFAULT '', -- the preference of the user takes precedence
+    status TEXT NOT NULL DEFAULT 'pending'
+        CHECK (status IN ('pending', 'sent', 'dead')),
+    attempts INTEGER NOT NULL DEFAULT 0,
+    last_error TEXT NOT NULL DEFAULT '',
+    next_attempt_at TIMESTAMP(0) NOT NULL,
+    created_at TIMESTAMP(0),
+    updated_at TIMESTAMP(0)
+);
+CREATE INDEX outbox_due ON outbox (next_attempt_at) WHERE status='pending';
+`
+
+const outboxInsertStmt = `
+INSERT INTO outbox(kind, recipient, user_uid, email_uid, locale, status,
+    attempts, last_error, next_attempt_at, created_at, updated_at)
+VALUES (:kind, :recipient, :user_uid, :email_uid, :locale, :status,
+    :attempts, :last_error, :next_attempt_at, :created_at, :updated_at) RETURNING id
+;`
+
+type outboxStore struct {
+	*Datastore
+}
+
+// enqueueMail stores the message using the transaction of the change which
+// triggers it, the message is only sent when the change is committed.
+func enqueueMail(tx *sqlx.Tx, m *sentinel.OutboxMessage) error {
+	now := time.Now().UTC()
+	m.Status = sentinel.OutboxPending
+	m.NextAttemptAt = now
+	m.CreatedAt = now
+	m.UpdatedAt = now
+
+	stmt, err := tx.PrepareNamed(outboxInsertStmt)
+	if err != nil {
+		return err
+	}
+	return stmt.QueryRowx(m).Scan(&m.ID)
+}
+
+func (s *outboxStore) Enqueue(m *sentinel.OutboxMessage) error {
+	tx, err := s.db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := enqueueMail(tx, m); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Due claims pending messages by moving their next attempt beyond the lease,
+// concurrent workers skip the rows claimed by another.
+func (s *outboxStore) Due(limit int, lease time.Duration) ([]*sentinel.OutboxMessage, error) {
+	now := time.Now().UTC()
+	rows, err := s.db.Queryx(`
+		UPDATE outbox SET next_attempt_at=$3
+		WHERE id IN (
+			SELECT id FROM outbox
+			WHERE status='pending'
+			AND next_attempt_at <= $1
+			ORDER BY next_attempt_at
+			LIMIT $2
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING *`, now, limit, now.Add(lease))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var messages []*sentinel.OutboxMessage
+	for rows.Next() {
+		var m sentinel.OutboxMessage
+		if err := rows.StructScan(&m); err != nil {
+			return nil, err
+		}
+		messages = append(messages, &m)
+	}
+	return messages, rows.Err()
+}
+
+func (s *outboxStore) Record(m *sentinel.OutboxMessage) error {
+	m.UpdatedAt = time.Now().UTC()
+	_, err := s.db.Exec(`
+		UPDATE outbox SET status=$2, attempts=$3, last_error=$4,
+		next_attempt_at=$5, updated_at=$6
+		WHERE id=$1`,
+		m.ID, m.Status, m.Attempts, m.LastError, m.NextAttemptAt, m.UpdatedAt)
+	return err
+}
+
+func (s *outboxStore) List(status sentinel.OutboxStatus) ([]*sentinel.OutboxMessage, error) {
+	sb := psq.Select("*").From(outboxTable).OrderBy("created_at", "id")
+	if status != "" {
+		sb = sb.Where("status=?", status)
+	}
+	query, args, err := sb.ToSql()
+	if err != nil {
+		return nil, err
+	}
+
+	var messages []*sentinel.OutboxMessage
+	if err := s.db.Select(&messages, query, args...); err != nil {
+		return nil, err
+	}
+	return messages, nil
+}
+
+// Replay resets the attempts of a dead message, so it gets the full number of
+// attempts again.
+func (s *outboxStore) Replay(id int) error {
+	now := time.Now().UTC()
+	result, err := s.db.Exec(`
+		UPDATE outbox SET status='pending', attempts=0, next_attempt_at=$2,
+		updated_at=$2
+		WHERE id=$1 AND status='dead'`, id, now)
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n != 1 {
+		return errors.New("dead message not found")
+	}
+	return nil
+}
@@ -0,0 +1,73 @@
+// Copyright 2015 Lars Wiegman. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package datastore
+
+import (
+	"testing"
+	"time"
+
+	"sentinel"
+)
+
+func TestOutbox(t *testing.T) {
+	d := NewDatastore(DB)
+
+	// Signup stores the verification message along with the user
+	user, err := d.Users.Signup("outbox@example.com", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	due, err := d.Outbox.Due(50, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var m *sentinel.OutboxMessage
+	for _, v := range due {
+		if v.Recipient == "outbox@example.com" {
+			m = v
+		}
+	}
+	if m == nil {
+		t.Fatal("Result should have been a verify-email message, but it was nil")
+	}
+	if m.Kind != sentinel.MailVerifyEmail || m.UserUID.String() != user.UID.String() {
+		t.Errorf("Result should have been a verify-email message for %v, but it was %+v", user.UID, m)
+	}
+
+	// Dead messages are listed and can be replayed
+	m.Attempts = 10
+	m.Status = sentinel.OutboxDead
+	m.LastError = "relay unavailable"
+	if err := d.Outbox.Record(m); err != nil {
+		t.Fatal(err)
+	}
+	dead, err := d.Outbox.List(sentinel.OutboxDead)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dead) != 1 || dead[0].ID != m.ID {
+		t.Errorf("Result should have been message %v, but it was %v", m.ID, dead)
+	}
+
+	if err := d.Outbox.Replay(m.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Outbox.Replay(m.ID); err == nil {
+		t.Error("Result should have been an error, but it was nil")
+	}
+	pending, err := d.Outbox.List(sentinel.OutboxPending)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var found bool
+	for _, v := range pending {
+		if v.ID == m.ID {
+			found = v.Attempts == 0
+		}
+	}
+	if !found {
+		t.Errorf("message %d should have been pending without attempts", m.ID)
+	}
+}
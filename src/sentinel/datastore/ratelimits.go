@@ -0,0 +1,169 @@
+// Copyright 2015 Lars Wiegman. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package datastore
+
+import (
+	"database/sql"
+	"sync"
+	"time"
+
+	"sentinel"
+)
+
+const rateLimitTable = "ratelimits"
+const rateLimitTableCreateStmt = `
+CREATE TABLE ratelimits (
+    key TEXT PRIMARY KEY, -- endpoint and IP address, email or client
+    tokens DOUBLE PRECISION NOT NULL,
+    updated_at TIMESTAMP NOT NULL,
+    full_at TIMESTAMP NOT NULL -- the bucket is removed after this date
+);
+CREATE INDEX ratelimits_full_at ON ratelimits (full_at);
+`
+
+// rateLimitPurgeInterval is the interval at which the buckets which are full
+// again are removed.
+const rateLimitPurgeInterval = time.Minute
+
+// rateLimitsStore keeps the token buckets in the database, so the limits are
+// shared by all instances of the backend.
+type rateLimitsStore struct {
+	*Datastore
+
+	mu       sync.Mutex
+	purgedAt time.Time
+}
+
+func (s *rateLimitsStore) Take(key string, limit sentinel.RateLimit) (time.Duration, error) {
+	if err := s.purge(); err != nil {
+		return 0, err
+	}
+
+	tx, err := s.db.Beginx()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	// Insert an unused bucket first, so concurrent requests lock the same row
+	_, err = tx.Exec(`
+		INSERT INTO ratelimits(key, tokens, updated_at, full_at)
+		VALUES ($1, 0, '0001-01-01', '0001-01-01')
+		ON CONFLICT (key) DO NOTHING`, key)
+	if err != nil {
+		return 0, err
+	}
+
+	var b sentinel.TokenBucket
+	err = tx.QueryRowx(`SELECT tokens, updated_at FROM ratelimits WHERE key=$1 FOR UPDATE`, key).StructScan(&b)
+	if err != nil {
+		return 0, err
+	}
+	wait := b.Take(limit, time.Now().UTC())
+
+	_, err = tx.Exec(`UPDATE ratelimits SET tokens=$1, updated_at=$2, full_at=$3 WHERE key=$4`,
+		b.Tokens, b.UpdatedAt, b.FullAt(limit), key)
+	if err != nil {
+		return 0, err
+	}
+	return wait, tx.Commit()
+}
+
+func (s *rateLimitsStore) Wait(key string, limit sentinel.RateLimit) (time.Duration, error) {
+	var b sentinel.TokenBucket
+	err := s.db.QueryRowx(`SELECT tokens, updated_at FROM ratelimits WHERE key=$1`, key).StructScan(&b)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return b.Wait(limit, time.Now().UTC()), nil
+}
+
+func (s *rateLimitsStore) Reset(key string) error {
+	_, err := s.db.Exec(`DELETE FROM ratelimits WHERE key=$1`, key)
+	return err
+}
+
+// purge removes the buckets which are full again, at most once every
+// rateLimitPurgeInterval.
+func (s *rateLimitsStore) purge() error {
+	now := time.Now().UTC()
+
+	s.mu.Lock()
+	if now.Sub(s.purgedAt) < rateLimitPurgeInterval {
+		s.mu.Unlock()
+		return nil
+	}
+	s.purgedAt = now
+	s.mu.Unlock()
+
+	_, err := s.db.Exec(`DELETE FROM ratelimits WHERE full_at<=$1`, now)
+	return err
+}
+
+// NewMemoryRateLimits returns a RateLimitsService which keeps the token
+// buckets in memory. The limits only apply to a single instance of the
+// backend and are lost on restart.
+func NewMemoryRateLimits() sentinel.RateLimitsService {
+	return &memoryRateLimits{buckets: make(map[string]*memoryBucket)}
+}
+
+type memoryBucket struct {
+	sentinel.TokenBucket
+	fullAt time.Time
+}
+
+type memoryRateLimits struct {
+	mu       sync.Mutex
+	buckets  map[string]*memoryBucket
+	purgedAt time.Time
+}
+
+func (s *memoryRateLimits) Take(key string, limit sentinel.RateLimit) (time.Duration, error) {
+	now := time.Now().UTC()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if now.Sub(s.purgedAt) >= rateLimitPurgeInterval {
+		for k, b := range s.buckets {
+			if !b.fullAt.After(now) {
+				delete(s.buckets, k)
+			}
+		}
+		s.purgedAt = now
+	}
+
+	b, ok := s.buckets[key]
+	if !ok {
+		b = &memoryBucket{}
+		s.buckets[key] = b
+	}
+	wait := b.Take(limit, now)
+	b.fullAt = b.FullAt(limit)
+	return wait, nil
+}
+
+func (s *memoryRateLimits) Wait(key string, limit sentinel.RateLimit) (time.Duration, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	b, ok := s.buckets[key]
+	if !ok {
+		return 0, nil
+	}
+	// Wait on a copy, the bucket isn't used
+	tb := b.TokenBucket
+	return tb.Wait(limit, time.Now().UTC()), nil
+}
+
+func (s *memoryRateLimits) Reset(key string) error {
+	s.mu.Lock()
+	delete(s.buckets, key)
+	s.mu.Unlock()
+	return nil
+}
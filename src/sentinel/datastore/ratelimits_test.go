@@ -0,0 +1,47 @@
+// Copyright 2015 Lars Wiegman. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package datastore
+
+import (
+	"testing"
+	"time"
+
+	"sentinel"
+
+	"code.google.com/p/go-uuid/uuid"
+)
+
+func TestRateLimits(t *testing.T) {
+	stores := map[string]sentinel.RateLimitsService{
+		"postgres": NewDatastore(DB).RateLimits,
+		"memory":   NewMemoryRateLimits(),
+	}
+	limit := sentinel.RateLimit{Burst: 2, Interval: time.Hour}
+
+	for name, s := range stores {
+		key := "test:" + uuid.NewRandom().String()
+
+		for i := 0; i < limit.Burst; i++ {
+			if wait, err := s.Take(key, limit); err != nil || wait != 0 {
+				t.Errorf("%s: Result should have been %v, but it was %v (%v)", name, 0, wait, err)
+			}
+		}
+		wait, err := s.Take(key, limit)
+		if err != nil || wait <= 0 || wait > limit.Interval {
+			t.Errorf("%s: Result should have been at most %v, but it was %v (%v)", name, limit.Interval, wait, err)
+		}
+		if wait, err := s.Wait(key, limit); err != nil || wait <= 0 {
+			t.Errorf("%s: Result should have been more than %v, but it was %v (%v)", name, 0, wait, err)
+		}
+
+		// A reset bucket is full
+		if err := s.Reset(key); err != nil {
+			t.Fatal(err)
+		}
+		if wait, err := s.Take(key, limit); err != nil || wait != 0 {
+			t.Errorf("%s: Result should have been %v, but it was %v (%v)", name, 0, wait, err)
+		}
+	}
+}
@@ -0,0 +1,184 @@
+// Copyright 2015 Lars Wiegman. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package datastore
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"time"
+
+	"sentinel"
+
+	"code.google.com/p/go-uuid/uuid"
+)
+
+const refreshTokenTable = "refreshtokens"
+const refreshTokenTableCreateStmt = `
+CREATE TABLE refreshtokens (
+    id SERIAL PRIMARY KEY, -- internal identifier
+    user_id integer NOT NULL references users ON DELETE CASCADE,
+    family uuid NOT NULL, -- tokens rotated from the same token share a family
+    token_hash TEXT UNIQUE NOT NULL, -- hex encoded SHA-256 hash of the token
+    client_id TEXT NOT NULL DEFAULT '',
+    scope TEXT NOT NULL DEFAULT '', -- OpenID Connect scope, empty for other tokens
+    is_used BOOLEAN NOT NULL DEFAULT FALSE,
+    is_revoked BOOLEAN NOT NULL DEFAULT FALSE,
+    expires_at TIMESTAMP(0) NOT NULL,
+    created_at TIMESTAMP(0),
+    updated_at TIMESTAMP(0)
+);
+CREATE INDEX refreshtokens_family ON refreshtokens (family);
+`
+
+const refreshTokenInsertStmt = `
+INSERT INTO refreshtokens(user_id, family, token_hash, client_id, scope,
+    is_used, is_revoked, expires_at, created_at, updated_at)
+VALUES (:user_id, :family, :token_hash, :client_id, :scope,
+    :is_used, :is_revoked, :expires_at, :created_at, :updated_at) RETURNING id
+;`
+
+type refreshTokensStore struct {
+	*Datastore
+}
+
+func (s *refreshTokensStore) Issue(userID int, clientID, scope string) (*sentinel.RefreshToken, error) {
+	rt, err := newRefreshToken(userID, uuid.NewRandom(), clientID, scope)
+	if err != nil {
+		return nil, err
+	}
+
+	stmt, err := s.db.PrepareNamed(refreshTokenInsertStmt)
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+	if err := stmt.QueryRowx(rt).Scan(&rt.ID); err != nil {
+		return nil, err
+	}
+
+	if err := s.db.QueryRowx(`SELECT uid FROM users WHERE id=$1`, userID).Scan(&rt.UserUID); err != nil {
+		return nil, err
+	}
+	return rt, nil
+}
+
+func (s *refreshTokensStore) Get(token string) (*sentinel.RefreshToken, error) {
+	var rt sentinel.RefreshToken
+	err := s.db.QueryRowx(`SELECT * FROM refreshtokens WHERE token_hash=$1`, hashToken(token)).StructScan(&rt)
+	if err == sql.ErrNoRows {
+		return nil, sentinel.ErrRefreshTokenInvalid
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &rt, nil
+}
+
+func (s *refreshTokensStore) Rotate(token string) (*sentinel.RefreshToken, error) {
+	tx, err := s.db.Beginx()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var used sentinel.RefreshToken
+	err = tx.QueryRowx(`SELECT * FROM refreshtokens WHERE token_hash=$1 FOR UPDATE`, hashToken(token)).StructScan(&used)
+	if err == sql.ErrNoRows {
+		return nil, sentinel.ErrRefreshTokenInvalid
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	switch {
+	case used.IsRevoked || !used.ExpiresAt.After(now):
+		return nil, sentinel.ErrRefreshTokenInvalid
+	case used.IsUsed:
+		// The token was stolen or replayed, revoke the whole family
+		_, err := tx.Exec(`UPDATE refreshtokens SET is_revoked=TRUE, updated_at=$2 WHERE family=$1`, used.Family, now)
+		if err != nil {
+			return nil, err
+		}
+		if err := tx.Commit(); err != nil {
+			return nil, err
+		}
+		return nil, sentinel.ErrRefreshTokenReused
+	}
+
+	var isArchived bool
+	err = tx.QueryRowx(`SELECT is_archived FROM users WHERE id=$1`, used.UserID).Scan(&isArchived)
+	if err != nil {
+		return nil, err
+	}
+	if isArchived {
+		return nil, sentinel.ErrRefreshTokenInvalid
+	}
+
+	if _, err := tx.Exec(`UPDATE refreshtokens SET is_used=TRUE, updated_at=$2 WHERE id=$1`, used.ID, now); err != nil {
+		return nil, err
+	}
+
+	rt, err := newRefreshToken(used.UserID, used.Family, used.ClientID, used.Scope)
+	if err != nil {
+		return nil, err
+	}
+	stmt, err := tx.PrepareNamed(refreshTokenInsertStmt)
+	if err != nil {
+		return nil, err
+	}
+	if err := stmt.QueryRowx(rt).Scan(&rt.ID); err != nil {
+		return nil, err
+	}
+	if err := tx.QueryRowx(`SELECT uid FROM users WHERE id=$1`, rt.UserID).Scan(&rt.UserUID); err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return rt, nil
+}
+
+// Revoke revokes the family of the refresh token.
+func (s *refreshTokensStore) Revoke(token string) error {
+	_, err := s.db.Exec(`
+UPDATE refreshtokens SET is_revoked=TRUE, updated_at=$2
+WHERE family=(SELECT family FROM refreshtokens WHERE token_hash=$1)
+;`, hashToken(token), time.Now().UTC())
+	return err
+}
+
+// RevokeUser revokes all refresh tokens of the user.
+func (s *refreshTokensStore) RevokeUser(userID int) error {
+	_, err := s.db.Exec(`UPDATE refreshtokens SET is_revoked=TRUE, updated_at=$2 WHERE user_id=$1 AND is_revoked=FALSE;`, userID, time.Now().UTC())
+	return err
+}
+
+func newRefreshToken(userID int, family uuid.UUID, clientID, scope string) (*sentinel.RefreshToken, error) {
+	token, err := randomHex(32)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	return &sentinel.RefreshToken{
+		UserID:    userID,
+		Family:    family,
+		Token:     token,
+		TokenHash: hashToken(token),
+		ClientID:  clientID,
+		Scope:     scope,
+		ExpiresAt: now.Add(sentinel.RefreshTokenTTL),
+		CreatedAt: now,
+		UpdatedAt: now,
+	}, nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
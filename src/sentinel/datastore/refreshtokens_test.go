@@ -0,0 +1,53 @@
+// Copyright 2015 Lars Wiegman. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package datastore
+
+import (
+	"testing"
+
+	"sentinel"
+
+	"code.google.com/p/go-uuid/uuid"
+)
+
+func TestRefreshTokenRotation(t *testing.T) {
+	d := NewDatastore(DB)
+
+	user := users[0]
+	rt, err := d.RefreshTokens.Issue(user.AuthEmailList[0].UserID, "", "openid email")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !uuid.Equal(user.UID, rt.UserUID) {
+		t.Errorf("Result should have been %v, but it was %v", user.UID, rt.UserUID)
+	}
+
+	got, err := d.RefreshTokens.Get(rt.Token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.ID != rt.ID || got.IsUsed {
+		t.Errorf("Result should have been unused token %v, but it was %+v", rt.ID, got)
+	}
+
+	next, err := d.RefreshTokens.Rotate(rt.Token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next.Token == rt.Token || !uuid.Equal(next.Family, rt.Family) {
+		t.Errorf("refresh token should have been rotated within family %v, but it was %+v", rt.Family, next)
+	}
+	if next.Scope != rt.Scope {
+		t.Errorf("Result should have been %v, but it was %v", rt.Scope, next.Scope)
+	}
+
+	// Reusing a rotated token revokes the family
+	if _, err := d.RefreshTokens.Rotate(rt.Token); err != sentinel.ErrRefreshTokenReused {
+		t.Errorf("Result should have been %v, but it was %v", sentinel.ErrRefreshTokenReused, err)
+	}
+	if _, err := d.RefreshTokens.Rotate(next.Token); err != sentinel.ErrRefreshTokenInvalid {
+		t.Errorf("Result should have been %v, but it was %v", sentinel.ErrRefreshTokenInvalid, err)
+	}
+}
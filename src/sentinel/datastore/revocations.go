@@ -0,0 +1,192 @@
+// Copyright 2015 Lars Wiegman. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package datastore
+
+import (
+	"database/sql"
+	"sync"
+	"time"
+
+	"sentinel"
+
+	"code.google.com/p/go-uuid/uuid"
+)
+
+const revocationTable = "revocations"
+const revocationTableCreateStmt = `
+CREATE TABLE revocations (
+    id SERIAL PRIMARY KEY, -- internal identifier
+    jti TEXT NOT NULL DEFAULT '', -- token identifier, empty when all tokens of the user are revoked
+    user_uid uuid NOT NULL,
+    is_used BOOLEAN NOT NULL DEFAULT FALSE, -- a used single-use token, these aren't cached
+    expires_at TIMESTAMP(0) NOT NULL, -- the revocation is removed after this date
+    created_at TIMESTAMP(6) NOT NULL -- tokens of the user issued before this second are revoked when jti is empty
+);
+CREATE INDEX revocations_expires_at ON revocations (expires_at);
+CREATE UNIQUE INDEX revocations_jti ON revocations (jti) WHERE jti <> '';
+`
+
+// revocationInsertStmt inserts the revocation, a token which is revoked
+// already isn't inserted again and no row is returned.
+const revocationInsertStmt = `
+INSERT INTO revocations(jti, user_uid, is_used, expires_at, created_at)
+VALUES (:jti, :user_uid, :is_used, :expires_at, :created_at)
+ON CONFLICT (jti) WHERE jti <> '' DO NOTHING
+RETURNING id
+;`
+
+// revocationCacheTTL is the duration after which the revocation cache is
+// reloaded from the database. Revocations made by other instances take
+// effect within this duration.
+const revocationCacheTTL = time.Second * 10
+
+// revocationsStore stores the revoked tokens. Lookups are served from an
+// in-memory copy of the revocations which haven't expired, so checking a
+// token doesn't cost a query on every request. Single-use tokens are marked
+// used in the database only, see Use.
+type revocationsStore struct {
+	*Datastore
+
+	loading  sync.Mutex // held while the cache is reloaded
+	mu       sync.RWMutex
+	tokens   map[string]time.Time            // revoked until, by jti
+	users    map[string]*sentinel.Revocation // latest revocation of all tokens, by user uid
+	loadedAt time.Time
+}
+
+func (s *revocationsStore) Revoke(jti string, userUID uuid.UUID, expiresAt time.Time) error {
+	r := &sentinel.Revocation{
+		JTI:       jti,
+		UserUID:   userUID,
+		ExpiresAt: expiresAt.UTC(),
+		CreatedAt: time.Now().UTC(),
+	}
+	if _, err := s.insert(r); err != nil {
+		return err
+	}
+	s.cache(r)
+	return nil
+}
+
+// Use inserts the token as a used revocation, the unique index on jti lets
+// only one insert of the token succeed. Used tokens aren't cached, the insert
+// decides whether a token was used before.
+func (s *revocationsStore) Use(jti string, userUID uuid.UUID, expiresAt time.Time) (bool, error) {
+	r := &sentinel.Revocation{
+		JTI:       jti,
+		UserUID:   userUID,
+		IsUsed:    true,
+		ExpiresAt: expiresAt.UTC(),
+		CreatedAt: time.Now().UTC(),
+	}
+	return s.insert(r)
+}
+
+// cache adds the token revocation to the in-memory copy.
+func (s *revocationsStore) cache(r *sentinel.Revocation) {
+	s.mu.Lock()
+	if s.tokens != nil {
+		s.tokens[r.JTI] = r.ExpiresAt
+	}
+	s.mu.Unlock()
+}
+
+func (s *revocationsStore) RevokeUser(userUID uuid.UUID, expiresAt time.Time) error {
+	r := &sentinel.Revocation{
+		UserUID:   userUID,
+		ExpiresAt: expiresAt.UTC(),
+		CreatedAt: time.Now().UTC(),
+	}
+	if _, err := s.insert(r); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	if s.users != nil {
+		s.users[userUID.String()] = r
+	}
+	s.mu.Unlock()
+	return nil
+}
+
+// insert stores the revocation and reports whether it was inserted, it isn't
+// when the token was revoked before.
+func (s *revocationsStore) insert(r *sentinel.Revocation) (bool, error) {
+	stmt, err := s.db.PrepareNamed(revocationInsertStmt)
+	if err != nil {
+		return false, err
+	}
+	defer stmt.Close()
+	err = stmt.QueryRowx(r).Scan(&r.ID)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// IsRevoked reports whether the token was revoked by its ID or by a
+// revocation of all tokens of the user issued before issuedAt.
+func (s *revocationsStore) IsRevoked(jti string, userUID uuid.UUID, issuedAt time.Time) (bool, error) {
+	if s.stale() {
+		if err := s.load(); err != nil {
+			return false, err
+		}
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if _, ok := s.tokens[jti]; jti != "" && ok {
+		return true, nil
+	}
+	if r, ok := s.users[userUID.String()]; ok && r.RevokesIssuedAt(issuedAt) {
+		return true, nil
+	}
+	return false, nil
+}
+
+func (s *revocationsStore) stale() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return time.Since(s.loadedAt) > revocationCacheTTL
+}
+
+// load replaces the cache with the revocations which haven't expired and
+// removes the expired revocations. Only one load runs at a time, requests
+// which find the cache stale meanwhile wait for it instead of loading again.
+func (s *revocationsStore) load() error {
+	s.loading.Lock()
+	defer s.loading.Unlock()
+	if !s.stale() {
+		return nil
+	}
+
+	now := time.Now().UTC()
+	if _, err := s.db.Exec(`DELETE FROM revocations WHERE expires_at<=$1;`, now); err != nil {
+		return err
+	}
+
+	var revocations []*sentinel.Revocation
+	if err := s.db.Select(&revocations, `SELECT * FROM revocations WHERE NOT is_used;`); err != nil {
+		return err
+	}
+
+	tokens := make(map[string]time.Time)
+	users := make(map[string]*sentinel.Revocation)
+	for _, r := range revocations {
+		if r.JTI != "" {
+			tokens[r.JTI] = r.ExpiresAt
+			continue
+		}
+		k := r.UserUID.String()
+		if latest, ok := users[k]; !ok || r.CreatedAt.After(latest.CreatedAt) {
+			users[k] = r
+		}
+	}
+
+	s.mu.Lock()
+	s.tokens, s.users, s.loadedAt = tokens, users, now
+	s.mu.Unlock()
+	return nil
+}
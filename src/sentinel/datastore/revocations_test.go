@@ -0,0 +1,82 @@
+// Copyright 2015 Lars Wiegman. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package datastore
+
+import (
+	"testing"
+	"time"
+
+	"code.google.com/p/go-uuid/uuid"
+)
+
+func TestRevocations(t *testing.T) {
+	d := NewDatastore(DB)
+	userUID := uuid.NewRandom()
+	expiresAt := time.Now().Add(time.Hour)
+
+	jti := uuid.NewRandom().String()
+	if err := d.Revocations.Revoke(jti, userUID, expiresAt); err != nil {
+		t.Fatal(err)
+	}
+
+	// A fresh store reads the revocation from the database
+	d = NewDatastore(DB)
+	if revoked, err := d.Revocations.IsRevoked(jti, userUID, time.Now()); err != nil || !revoked {
+		t.Errorf("Result should have been %v, but it was %v (%v)", true, revoked, err)
+	}
+	if revoked, err := d.Revocations.IsRevoked(uuid.NewRandom().String(), userUID, time.Now()); err != nil || revoked {
+		t.Errorf("Result should have been %v, but it was %v (%v)", false, revoked, err)
+	}
+
+	issuedAt := time.Now().Add(-time.Minute)
+	if err := d.Revocations.RevokeUser(userUID, expiresAt); err != nil {
+		t.Fatal(err)
+	}
+	if revoked, err := d.Revocations.IsRevoked(uuid.NewRandom().String(), userUID, issuedAt); err != nil || !revoked {
+		t.Errorf("Result should have been %v, but it was %v (%v)", true, revoked, err)
+	}
+	if revoked, err := d.Revocations.IsRevoked(uuid.NewRandom().String(), userUID, time.Now().Add(time.Minute)); err != nil || revoked {
+		t.Errorf("Result should have been %v, but it was %v (%v)", false, revoked, err)
+	}
+
+	// A token issued right after the revocation stays valid, also once the
+	// revocation is read from the database
+	now := time.Now().Truncate(time.Second)
+	if revoked, err := d.Revocations.IsRevoked(uuid.NewRandom().String(), userUID, now); err != nil || revoked {
+		t.Errorf("Result should have been %v, but it was %v (%v)", false, revoked, err)
+	}
+	d = NewDatastore(DB)
+	if revoked, err := d.Revocations.IsRevoked(uuid.NewRandom().String(), userUID, now); err != nil || revoked {
+		t.Errorf("Result should have been %v, but it was %v (%v)", false, revoked, err)
+	}
+
+	// A single-use token is used once, also by concurrent requests
+	jti = uuid.NewRandom().String()
+	results := make(chan bool, 4)
+	for i := 0; i < cap(results); i++ {
+		go func() {
+			ok, err := NewDatastore(DB).Revocations.Use(jti, userUID, expiresAt)
+			if err != nil {
+				t.Error(err)
+			}
+			results <- ok
+		}()
+	}
+	used := 0
+	for i := 0; i < cap(results); i++ {
+		if <-results {
+			used++
+		}
+	}
+	if used != 1 {
+		t.Errorf("Result should have been %v, but it was %v", 1, used)
+	}
+
+	// Used tokens are decided by Use only and aren't cached as revocations
+	d = NewDatastore(DB)
+	if revoked, err := d.Revocations.IsRevoked(jti, uuid.NewRandom(), time.Now()); err != nil || revoked {
+		t.Errorf("Result should have been %v, but it was %v (%v)", false, revoked, err)
+	}
+}
@@ -5,12 +5,17 @@
 package datastore
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"errors"
+	"strings"
 	"time"
 
 	"sentinel"
 
 	"code.google.com/p/go-uuid/uuid"
+	sq "github.com/lann/squirrel"
+	"golang.org/x/crypto/bcrypt"
 )
 
 const serviceTable = "services"
@@ -21,8 +26,13 @@ CREATE TABLE services (
     name TEXT NOT NULL,
     baseurl TEXT NOT NULL,
     logourl TEXT NOT NULL,
-    authlevel INTEGER NOT NULL DEFAULT 0, -- 0:notify 1:fast 2:secure
+    authlevel INTEGER NOT NULL DEFAULT 0, -- 0:unknown 1:notify 2:fast 3:secure
     lastentry_at TIMESTAMP(0),
+    client_id TEXT UNIQUE NOT NULL,
+    client_secret_hash TEXT NOT NULL DEFAULT '', -- format: <hash type>:<secret hash>
+    owner_id INTEGER NOT NULL DEFAULT 0, -- users.id, 0 for services registered without an owner
+    public_key TEXT NOT NULL DEFAULT '', -- PEM encoded key to verify JWT assertions
+    redirect_uris TEXT NOT NULL DEFAULT '', -- space delimited redirect URIs of the OpenID Connect flow
     created_at TIMESTAMP(0),
     updated_at TIMESTAMP(0),
     is_archived BOOLEAN NOT NULL DEFAULT FALSE
@@ -31,11 +41,49 @@ CREATE TABLE services (
 
 const serviceInsertStmt = `
 INSERT INTO services(uid, name, baseurl, logourl, authlevel, lastentry_at, 
+    client_id, client_secret_hash, owner_id, public_key, redirect_uris,
     created_at, updated_at, is_archived)
 VALUES (:uid, :name, :baseurl, :logourl, :authlevel, :lastentry_at,
+    :client_id, :client_secret_hash, :owner_id, :public_key, :redirect_uris,
     :created_at, :updated_at, :is_archived) RETURNING id
 ;`
 
+const serviceUpdateStmt = `
+UPDATE services SET
+	(name, baseurl, logourl, authlevel, client_secret_hash, public_key, redirect_uris, updated_at, is_archived) =
+	(:name, :baseurl, :logourl, :authlevel, :client_secret_hash, :public_key, :redirect_uris, :updated_at, :is_archived)
+WHERE id=:id
+;`
+
+const sessionTable = "sessions"
+const sessionTableCreateStmt = `
+CREATE TABLE sessions (
+    id SERIAL PRIMARY KEY, -- internal identifier
+    uid uuid UNIQUE not null, -- uuid identifier, the session ID
+    service_id integer NOT NULL references services ON UPDATE CASCADE,
+    user_id integer NOT NULL references users ON UPDATE CASCADE,
+    email TEXT NOT NULL,
+    secret1 TEXT NOT NULL,
+    secret2 TEXT NOT NULL DEFAULT '',
+    enc1 TEXT NOT NULL DEFAULT '',
+    authlevel INTEGER NOT NULL CHECK (authlevel BETWEEN 1 AND 3), -- 1:notify 2:fast 3:secure
+    status TEXT NOT NULL DEFAULT 'pending'
+        CHECK (status IN ('pending', 'accepted', 'declined', 'expired')),
+    is_oidc BOOLEAN NOT NULL DEFAULT FALSE, -- the outcome isn't sent to the status endpoint
+    expires_at TIMESTAMP(0) NOT NULL,
+    created_at TIMESTAMP(0),
+    updated_at TIMESTAMP(0)
+);
+CREATE INDEX sessions_pending ON sessions (expires_at) WHERE status='pending';
+`
+
+const sessionInsertStmt = `
+INSERT INTO sessions(uid, service_id, user_id, email, secret1, secret2, enc1,
+    authlevel, status, is_oidc, expires_at, created_at, updated_at)
+VALUES (:uid, :service_id, :user_id, :email, :secret1, :secret2, :enc1,
+    :authlevel, :status, :is_oidc, :expires_at, :created_at, :updated_at) RETURNING id
+;`
+
 type servicesStore struct {
 	*Datastore
 }
@@ -46,6 +94,11 @@ func (s *servicesStore) submit(service *sentinel.Service) (*sentinel.Service, er
 	if service.UID == nil {
 		service.UID = uuid.NewRandom()
 	}
+	if service.ClientID == "" {
+		if service.ClientID, err = randomHex(16); err != nil {
+			return nil, err
+		}
+	}
 
 	now := time.Now().UTC()
 	if service.ID == 0 {
@@ -57,6 +110,7 @@ func (s *servicesStore) submit(service *sentinel.Service) (*sentinel.Service, er
 	if err != nil {
 		return nil, err
 	}
+	defer stmt.Close()
 	var serviceID int
 	err = stmt.QueryRowx(service).Scan(&serviceID)
 	if err != nil {
@@ -77,24 +131,162 @@ func (s *servicesStore) Get(uid uuid.UUID) (*sentinel.Service, error) {
 	return &service, nil
 }
 
-func (s *servicesStore) Auth(uid uuid.UUID, email, status string) error {
+func (s *servicesStore) GetByClientID(clientID string) (*sentinel.Service, error) {
+	var service sentinel.Service
+	err := s.db.QueryRowx(`SELECT * FROM services WHERE is_archived=FALSE AND client_id=$1;`, clientID).StructScan(&service)
+	if err != nil {
+		return nil, err
+	}
+
+	return &service, nil
+}
+
+// Create registers a service owned by the user and issues its client
+// credentials. The client secret is only returned here and by RotateSecret.
+func (s *servicesStore) Create(opt sentinel.ServiceUpdateOptions) (*sentinel.Service, error) {
+	if opt.Name == "" || opt.BaseURL == "" {
+		return nil, errors.New("name and base URL are required")
+	}
+	if opt.Owner == nil {
+		return nil, errors.New("owner is required")
+	}
+
+	owner, err := s.Datastore.Users.GetUserDetails(*opt.Owner)
+	if err != nil {
+		return nil, err
+	}
+
+	service := &sentinel.Service{
+		Name:         opt.Name,
+		BaseURL:      opt.BaseURL,
+		LogoURL:      opt.LogoURL,
+		AuthLevel:    opt.AuthLevel,
+		OwnerID:      owner.ID,
+		PublicKey:    opt.PublicKey,
+		RedirectURIs: opt.RedirectURIs,
+	}
+	if err := setClientSecret(service); err != nil {
+		return nil, err
+	}
+
+	return s.submit(service)
+}
+
+func (s *servicesStore) List(opt sentinel.ServiceListOptions) ([]*sentinel.Service, error) {
+	sb := psq.Select("services.*").From("services")
+	if opt.Owner != nil {
+		sb = sb.Join("users ON(users.id = services.owner_id)").Where(sq.Eq{"users.uid": opt.Owner})
+	}
+	if !opt.IncludeArchived {
+		sb = sb.Where(sq.Eq{"services.is_archived": false})
+	}
+	sb = sb.OrderBy("services.id").Limit(opt.ListOptions.Limit()).Offset(opt.ListOptions.Offset())
+
+	sql, args, err := sb.ToSql()
+	if err != nil {
+		return nil, err
+	}
+
+	var services []*sentinel.Service
+	if err := s.db.Select(&services, sql, args...); err != nil {
+		return nil, err
+	}
+	return services, nil
+}
+
+func (s *servicesStore) Update(uid uuid.UUID, opt sentinel.ServiceUpdateOptions) (*sentinel.Service, error) {
 	service, err := s.Get(uid)
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	if opt.Name != "" {
+		service.Name = opt.Name
+	}
+	if opt.BaseURL != "" {
+		service.BaseURL = opt.BaseURL
+	}
+	if opt.LogoURL != "" {
+		service.LogoURL = opt.LogoURL
+	}
+	if opt.AuthLevel != sentinel.AuthLevelUnknown {
+		service.AuthLevel = opt.AuthLevel
+	}
+	if opt.PublicKey != "" {
+		service.PublicKey = opt.PublicKey
 	}
+	if opt.RedirectURIs != nil {
+		service.RedirectURIs = opt.RedirectURIs
+	}
+
+	if err := s.update(service); err != nil {
+		return nil, err
+	}
+	return service, nil
+}
 
-	opt := &sentinel.UserListOptions{Email: []string{email}}
-	users, err := s.Datastore.Users.List(*opt)
+// Archive archives the service, archived services can't be used to login.
+func (s *servicesStore) Archive(uid uuid.UUID) error {
+	service, err := s.Get(uid)
 	if err != nil {
 		return err
 	}
+	service.IsArchived = true
+	return s.update(service)
+}
 
-	if len(users) == 0 {
-		return errors.New("email address not found")
+func (s *servicesStore) RotateSecret(uid uuid.UUID) (*sentinel.Service, error) {
+	service, err := s.Get(uid)
+	if err != nil {
+		return nil, err
+	}
+	if err := setClientSecret(service); err != nil {
+		return nil, err
+	}
+	if err := s.update(service); err != nil {
+		return nil, err
 	}
+	return service, nil
+}
 
-	//TODO: finish implement
-	_ = service
+func (s *servicesStore) update(service *sentinel.Service) error {
+	service.UpdatedAt = time.Now().UTC()
+	_, err := s.db.NamedExec(serviceUpdateStmt, service)
+	return err
+}
 
+// setClientSecret generates a new client secret for the service and sets its
+// hash.
+func setClientSecret(service *sentinel.Service) error {
+	secret, err := randomHex(32)
+	if err != nil {
+		return err
+	}
+	b, err := bcrypt.GenerateFromPassword([]byte(secret), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	service.ClientSecret = secret
+	service.ClientSecretHash = "bcrypt:" + string(b)
 	return nil
 }
+
+// CompareClientSecret compares the client secret with the hash stored for the
+// service.
+func CompareClientSecret(service *sentinel.Service, secret string) error {
+	if strings.HasPrefix(service.ClientSecretHash, "bcrypt:") {
+		p := strings.TrimPrefix(service.ClientSecretHash, "bcrypt:")
+		if err := bcrypt.CompareHashAndPassword([]byte(p), []byte(secret)); err == nil {
+			return nil
+		}
+	}
+	return errors.New("invalid client secret")
+}
+
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -7,6 +7,10 @@ package datastore
 import (
 	"reflect"
 	"testing"
+
+	"sentinel"
+
+	"code.google.com/p/go-uuid/uuid"
 )
 
 func TestGet(t *testing.T) {
@@ -23,13 +27,47 @@ func TestGet(t *testing.T) {
 	}
 }
 
-func TestSetStatus(t *testing.T) {
+func TestCreateAndRotateSecret(t *testing.T) {
 	d := NewDatastore(DB)
 
-	service := services[0]
-	user := users[0]
-	err := d.Services.Auth(service.UID, user.AuthEmailList[0].Email, "Accepted")
+	owner := users[0]
+	opt := sentinel.ServiceUpdateOptions{
+		Name:      "Photo Box",
+		BaseURL:   "https://api.photobox.example.com/status",
+		AuthLevel: sentinel.AuthLevelFast,
+		Owner:     &owner.UID,
+	}
+	service, err := d.Services.Create(opt)
 	if err != nil {
+		t.Fatal(err)
+	}
+	if service.ClientID == "" || service.ClientSecret == "" {
+		t.Fatalf("client credentials should have been issued, but they were %q and %q", service.ClientID, service.ClientSecret)
+	}
+	if err := CompareClientSecret(service, service.ClientSecret); err != nil {
 		t.Error(err)
 	}
+
+	list, err := d.Services.List(sentinel.ServiceListOptions{Owner: &owner.UID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || !uuid.Equal(list[0].UID, service.UID) {
+		t.Errorf("Result should have been [%v], but it was %v", service, list)
+	}
+
+	rotated, err := d.Services.RotateSecret(service.UID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := CompareClientSecret(rotated, service.ClientSecret); err == nil {
+		t.Error("previous client secret should have been invalidated")
+	}
+
+	if err := d.Services.Archive(service.UID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Services.Get(service.UID); err == nil {
+		t.Error("archived service should not be returned")
+	}
 }
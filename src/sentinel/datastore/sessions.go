@@ -0,0 +1,171 @@
+// Copyright 2015 Lars Wiegman. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package datastore
+
+import (
+	"database/sql"
+	"time"
+
+	"sentinel"
+
+	"code.google.com/p/go-uuid/uuid"
+)
+
+// sessionsStore stores the login sessions, the sessions table is defined
+// along with the services table. Status changes are guarded in SQL so
+// concurrent requests can't both move a session out of pending.
+type sessionsStore struct {
+	*Datastore
+}
+
+// Create creates a pending login session which expires after the
+// sentinel.LoginTimeout.
+func (s *sessionsStore) Create(serviceID, userID, authLevel int, email, secret1 string, isOIDC bool) (*sentinel.LoginSession, error) {
+	now := time.Now().UTC()
+	session := &sentinel.LoginSession{
+		UID:       uuid.NewRandom(),
+		ServiceID: serviceID,
+		UserID:    userID,
+		Email:     email,
+		Secret1:   secret1,
+		AuthLevel: authLevel,
+		Status:    sentinel.LoginPending,
+		IsOIDC:    isOIDC,
+		ExpiresAt: now.Add(sentinel.LoginTimeout),
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+
+	stmt, err := s.db.PrepareNamed(sessionInsertStmt)
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+	if err := stmt.QueryRowx(session).Scan(&session.ID); err != nil {
+		return nil, err
+	}
+
+	return session, nil
+}
+
+func (s *sessionsStore) Get(uid uuid.UUID) (*sentinel.LoginSession, error) {
+	var session sentinel.LoginSession
+	err := s.db.QueryRowx(`SELECT * FROM sessions WHERE uid=$1;`, uid).StructScan(&session)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.loadService(&session); err != nil {
+		return nil, err
+	}
+	return &session, nil
+}
+
+func (s *sessionsStore) loadService(session *sentinel.LoginSession) error {
+	var service sentinel.Service
+	err := s.db.QueryRowx(`SELECT * FROM services WHERE id=$1;`, session.ServiceID).StructScan(&service)
+	if err != nil {
+		return err
+	}
+	session.Service = &service
+	return nil
+}
+
+// Transition moves a pending login session to the given status. It returns
+// sentinel.ErrLoginTimeout when the session passed its expiry date and
+// sentinel.ErrLoginNotPending when the session was already resolved.
+func (s *sessionsStore) Transition(uid uuid.UUID, status sentinel.LoginStatus, secret2, enc1 string) (*sentinel.LoginSession, error) {
+	if !sentinel.LoginPending.CanTransition(status) || status == sentinel.LoginExpired {
+		// Sessions only expire through Expire
+		return nil, sentinel.ErrInvalidTransition
+	}
+
+	now := time.Now().UTC()
+	tx, err := s.db.Beginx()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var session sentinel.LoginSession
+	err = tx.QueryRowx(`
+		UPDATE sessions SET status=$2, secret2=$3, enc1=$4, updated_at=$5
+		WHERE uid=$1
+		AND status='pending'
+		AND expires_at > $5
+		RETURNING *`, uid, status, secret2, enc1, now).StructScan(&session)
+	if err == sql.ErrNoRows {
+		return nil, s.transitionError(uid, now)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if status == sentinel.LoginAccepted {
+		_, err := tx.Exec(`UPDATE services SET lastentry_at=$2 WHERE id=$1`, session.ServiceID, now)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	if err := s.loadService(&session); err != nil {
+		return nil, err
+	}
+	return &session, nil
+}
+
+// transitionError explains why the session with the given uid could not be
+// moved out of pending.
+func (s *sessionsStore) transitionError(uid uuid.UUID, now time.Time) error {
+	var session sentinel.LoginSession
+	err := s.db.QueryRowx(`SELECT * FROM sessions WHERE uid=$1;`, uid).StructScan(&session)
+	if err != nil {
+		return err
+	}
+
+	if session.Status == sentinel.LoginExpired ||
+		(session.Status == sentinel.LoginPending && !session.ExpiresAt.After(now)) {
+		return sentinel.ErrLoginTimeout
+	}
+	return sentinel.ErrLoginNotPending
+}
+
+// Expire moves all pending login sessions which passed their expiry date to
+// expired and returns them.
+func (s *sessionsStore) Expire() ([]*sentinel.LoginSession, error) {
+	now := time.Now().UTC()
+	rows, err := s.db.Queryx(`
+		UPDATE sessions SET status='expired', updated_at=$1
+		WHERE status='pending'
+		AND expires_at <= $1
+		RETURNING *`, now)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var sessions []*sentinel.LoginSession
+	for rows.Next() {
+		var session sentinel.LoginSession
+		if err := rows.StructScan(&session); err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, &session)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, session := range sessions {
+		if err := s.loadService(session); err != nil {
+			return nil, err
+		}
+	}
+	return sessions, nil
+}
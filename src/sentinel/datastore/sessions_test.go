@@ -0,0 +1,83 @@
+// Copyright 2015 Lars Wiegman. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package datastore
+
+import (
+	"testing"
+	"time"
+
+	"sentinel"
+
+	"code.google.com/p/go-uuid/uuid"
+)
+
+func TestSessionTransition(t *testing.T) {
+	d := NewDatastore(DB)
+
+	session, err := d.Sessions.Create(services[0].ID, users[1].AuthEmailList[0].UserID, sentinel.AuthLevelFast, users[1].AuthEmailList[0].Email, "secret1", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if session.Status != sentinel.LoginPending {
+		t.Errorf("Result should have been %v, but it was %v", sentinel.LoginPending, session.Status)
+	}
+
+	if _, err := d.Sessions.Transition(session.UID, sentinel.LoginExpired, "", ""); err != sentinel.ErrInvalidTransition {
+		t.Errorf("Result should have been %v, but it was %v", sentinel.ErrInvalidTransition, err)
+	}
+
+	result, err := d.Sessions.Transition(session.UID, sentinel.LoginDeclined, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Status != sentinel.LoginDeclined {
+		t.Errorf("Result should have been %v, but it was %v", sentinel.LoginDeclined, result.Status)
+	}
+
+	if _, err := d.Sessions.Transition(session.UID, sentinel.LoginAccepted, "secret2", ""); err != sentinel.ErrLoginNotPending {
+		t.Errorf("Result should have been %v, but it was %v", sentinel.ErrLoginNotPending, err)
+	}
+}
+
+func TestSessionExpire(t *testing.T) {
+	d := NewDatastore(DB)
+
+	session, err := d.Sessions.Create(services[0].ID, users[1].AuthEmailList[0].UserID, sentinel.AuthLevelFast, users[1].AuthEmailList[0].Email, "secret1", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	past := time.Now().UTC().Add(-time.Minute)
+	if _, err := DB.Exec(`UPDATE sessions SET expires_at=$2 WHERE uid=$1`, session.UID, past); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := d.Sessions.Transition(session.UID, sentinel.LoginAccepted, "secret2", ""); err != sentinel.ErrLoginTimeout {
+		t.Errorf("Result should have been %v, but it was %v", sentinel.ErrLoginTimeout, err)
+	}
+
+	expired, err := d.Sessions.Expire()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var found bool
+	for _, s := range expired {
+		if uuid.Equal(s.UID, session.UID) {
+			found = true
+			if s.Status != sentinel.LoginExpired {
+				t.Errorf("Result should have been %v, but it was %v", sentinel.LoginExpired, s.Status)
+			}
+			if s.Service == nil {
+				t.Error("expired session should include its service")
+			}
+		}
+	}
+	if !found {
+		t.Errorf("session %s should have been expired", session.UID)
+	}
+
+	if _, err := d.Sessions.Transition(session.UID, sentinel.LoginAccepted, "secret2", ""); err != sentinel.ErrLoginTimeout {
+		t.Errorf("Result should have been %v, but it was %v", sentinel.ErrLoginTimeout, err)
+	}
+}
@@ -5,6 +5,7 @@
 package datastore
 
 import (
+	"database/sql"
 	"errors"
 	"strings"
 	"time"
@@ -23,26 +24,31 @@ CREATE TABLE users (
 	uid uuid UNIQUE not null, -- uuid identifier
 	name TEXT NOT NULL,
 	password_hash TEXT NOT NULL DEFAULT 'plain:secret', -- format: <hash type>:<password hash>
-	devicetoken TEXT NOT NULL DEFAULT '', -- device token for push services like APN and GCM
 	lastlogin_at TIMESTAMP(0),
 	defaultauthlevel INTEGER NOT NULL DEFAULT 0, -- 0:unknown 1:notify 2:fast 3:secure
+	locale TEXT NOT NULL DEFAULT '', -- preferred language, e.g. en or nl-BE
 	created_at TIMESTAMP(0),
 	updated_at TIMESTAMP(0),
-	is_archived BOOLEAN NOT NULL DEFAULT FALSE
-);`
+	is_archived BOOLEAN NOT NULL DEFAULT FALSE,
+	archived_at TIMESTAMP(0), -- set while archived, NULL otherwise
+	totp_secret TEXT NOT NULL DEFAULT '', -- base32 TOTP secret, set on enrollment
+	totp_enabled BOOLEAN NOT NULL DEFAULT FALSE, -- set when the secret is confirmed with a code
+	totp_step BIGINT NOT NULL DEFAULT 0 -- time step of the code used last, codes can't be replayed
+);
+CREATE INDEX users_archived ON users (archived_at) WHERE is_archived;`
 
 const userInsertStmt = `
-INSERT INTO users(uid, name, password_hash, devicetoken, lastlogin_at, defaultauthlevel,
-	created_at, updated_at, is_archived)
-VALUES (:uid, :name, :password_hash, :devicetoken, :lastlogin_at,
-	:defaultauthlevel, :created_at, :updated_at, :is_archived)
+INSERT INTO users(uid, name, password_hash, lastlogin_at, defaultauthlevel,
+	locale, created_at, updated_at, is_archived, archived_at)
+VALUES (:uid, :name, :password_hash, :lastlogin_at,
+	:defaultauthlevel, :locale, :created_at, :updated_at, :is_archived, :archived_at)
 RETURNING id
 ;`
 
 const userUpdateStmt = `
 UPDATE users SET
-	(name, password_hash, devicetoken, lastlogin_at, defaultauthlevel, is_archived) =
-	(:name, :password_hash, :devicetoken, :lastlogin_at, :defaultauthlevel, :is_archived)
+	(name, password_hash, lastlogin_at, defaultauthlevel, locale, is_archived) =
+	(:name, :password_hash, :lastlogin_at, :defaultauthlevel, :locale, :is_archived)
 WHERE uid=:uid
 ;`
 
@@ -75,6 +81,7 @@ func (s *usersStore) Signup(email, password string) (*sentinel.User, error) {
 	if err != nil {
 		return nil, err
 	}
+	defer tx.Rollback()
 
 	var id int
 	stmt, err := tx.PrepareNamed(userInsertStmt)
@@ -97,6 +104,17 @@ func (s *usersStore) Signup(email, password string) (*sentinel.User, error) {
 		return nil, err
 	}
 
+	// Ask the user to verify the email
+	err = enqueueMail(tx, &sentinel.OutboxMessage{
+		Kind:      sentinel.MailVerifyEmail,
+		Recipient: email,
+		UserUID:   user.UID,
+		EmailUID:  authEmail.UID,
+	})
+	if err != nil {
+		return nil, err
+	}
+
 	if err := tx.Commit(); err != nil {
 		return nil, err
 	}
@@ -113,7 +131,7 @@ func (s *usersStore) GetUserDetails(uid uuid.UUID) (*sentinel.User, error) {
 		return nil, err
 	}
 
-	rows, err := s.db.Queryx(`SELECT * FROM authemails WHERE user_id=$1`, user.ID)
+	rows, err := s.db.Queryx(authemailUserListStmt, user.ID)
 	defer rows.Close()
 	if err != nil {
 		return nil, err
@@ -142,7 +160,7 @@ func (s *usersStore) get(id int) (*sentinel.User, error) {
 	}
 
 	var a []*sentinel.AuthEmail
-	rows, err := s.db.Queryx(`SELECT * FROM authemails WHERE user_id=$1`, user.ID)
+	rows, err := s.db.Queryx(authemailUserListStmt, user.ID)
 	defer rows.Close()
 	if err != nil {
 		return nil, err
@@ -220,14 +238,14 @@ func (s *usersStore) UpdateDetails(uid uuid.UUID, opt sentinel.UserUpdateOptions
 		SetPassword(user, opt.Password)
 	}
 
-	if opt.DeviceToken != "" {
-		user.DeviceToken = opt.DeviceToken
-	}
-
 	if opt.DefaultAuthLevel != 0 {
 		user.DefaultAuthLevel = int(opt.DefaultAuthLevel)
 	}
 
+	if opt.Locale != "" {
+		user.Locale = opt.Locale
+	}
+
 	if err := s.Update(user); err != nil {
 		return nil, err
 	}
@@ -261,8 +279,8 @@ func (s *usersStore) List(opt sentinel.UserListOptions) ([]*sentinel.User, error
 		sb = sb.Where(sq.Eq{"authemails.email": opt.Email})
 	}
 
-	if opt.IncludeArchived {
-		sb = sb.Where(sq.Eq{"users.is_archived": true})
+	if !opt.IncludeArchived {
+		sb = sb.Where(sq.Eq{"users.is_archived": false})
 	}
 
 	sql, args, err := sb.ToSql()
@@ -284,7 +302,7 @@ func (s *usersStore) List(opt sentinel.UserListOptions) ([]*sentinel.User, error
 
 	for _, user := range users {
 		var a []*sentinel.AuthEmail
-		rows, err := s.db.Queryx(`SELECT * FROM authemails WHERE user_id=$1`, user.ID)
+		rows, err := s.db.Queryx(authemailUserListStmt, user.ID)
 		defer rows.Close()
 		if err != nil {
 			return nil, err
@@ -304,9 +322,17 @@ func (s *usersStore) List(opt sentinel.UserListOptions) ([]*sentinel.User, error
 	return users, nil
 }
 
+// AckEmail verifies the email. The first verified email of a user becomes
+// the primary email.
 func (s *usersStore) AckEmail(uid uuid.UUID) error {
+	tx, err := s.db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
 	var isVerified bool
-	if err := s.db.QueryRowx(`
+	if err := tx.QueryRowx(`
 		UPDATE authemails SET is_verified=TRUE
 		WHERE uid=$1
 		AND is_verified=FALSE
@@ -316,7 +342,95 @@ func (s *usersStore) AckEmail(uid uuid.UUID) error {
 	if !isVerified {
 		return errors.New("verfied remains false")
 	}
-	return nil
+
+	_, err = tx.Exec(`
+		UPDATE authemails e SET is_primary=TRUE
+		WHERE e.uid=$1
+		AND NOT EXISTS (
+			SELECT 1 FROM authemails p
+			WHERE p.user_id=e.user_id AND p.is_primary
+		)`, uid)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// SetPrimaryEmail moves the primary flag to the email. The emails of the user
+// are locked, so concurrent changes can't leave the user with two primary
+// emails or none.
+func (s *usersStore) SetPrimaryEmail(emailID uuid.UUID) error {
+	tx, err := s.db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var userID int
+	var isVerified bool
+	err = tx.QueryRowx(`SELECT user_id, is_verified FROM authemails WHERE uid=$1`, emailID).Scan(&userID, &isVerified)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`SELECT id FROM authemails WHERE user_id=$1 FOR UPDATE`, userID); err != nil {
+		return err
+	}
+	if !isVerified {
+		return sentinel.ErrEmailNotVerified
+	}
+
+	now := time.Now().UTC()
+	_, err = tx.Exec(`
+		UPDATE authemails SET is_primary=FALSE, updated_at=$2
+		WHERE user_id=$1 AND is_primary`, userID, now)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`
+		UPDATE authemails SET is_primary=TRUE, updated_at=$2
+		WHERE uid=$1`, emailID, now)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// ResendVerification stores a new verification message in the outbox. The
+// email is locked while checking for recent messages, so concurrent requests
+// can't both pass the check.
+func (s *usersStore) ResendVerification(emailID uuid.UUID) error {
+	tx, err := s.db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	m := &sentinel.OutboxMessage{Kind: sentinel.MailVerifyEmail}
+	err = tx.QueryRowx(`
+		SELECT e.email, e.uid, u.uid FROM authemails e
+		JOIN users u ON u.id=e.user_id
+		WHERE e.uid=$1 AND e.is_verified=FALSE
+		FOR UPDATE OF e`, emailID).Scan(&m.Recipient, &m.EmailUID, &m.UserUID)
+	if err != nil {
+		return err
+	}
+
+	var recent int
+	err = tx.QueryRowx(`
+		SELECT count(*) FROM outbox
+		WHERE kind=$1 AND email_uid=$2 AND created_at > $3`,
+		m.Kind, emailID, time.Now().UTC().Add(-sentinel.ResendVerificationInterval)).Scan(&recent)
+	if err != nil {
+		return err
+	}
+	if recent > 0 {
+		return sentinel.ErrResendThrottled
+	}
+
+	if err := enqueueMail(tx, m); err != nil {
+		return err
+	}
+	return tx.Commit()
 }
 
 func (s *usersStore) GetEmail(uid uuid.UUID) (*sentinel.AuthEmail, error) {
@@ -331,7 +445,8 @@ func (s *usersStore) GetEmail(uid uuid.UUID) (*sentinel.AuthEmail, error) {
 }
 
 func (s *usersStore) ListEmail(opt *sentinel.AuthEmailListOptions) ([]*sentinel.AuthEmail, error) {
-	sb := psq.Select("authemails.*").From("authemails").Join("users ON(users.id = authemails.user_id)")
+	sb := psq.Select("authemails.*").From("authemails").Join("users ON(users.id = authemails.user_id)").
+		OrderBy("authemails.is_primary DESC", "authemails.id")
 	if opt != nil {
 		if opt.User != nil {
 			sb = sb.Where(sq.Eq{"users.uid": opt.User})
@@ -371,8 +486,14 @@ func (s *usersStore) AddEmail(userID uuid.UUID, email string) (*sentinel.AuthEma
 		UpdatedAt: now,
 	}
 
+	tx, err := s.db.Beginx()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
 	var id int
-	err := s.db.QueryRowx(authemailCreateStmt,
+	err = tx.QueryRowx(authemailCreateStmt,
 		e.UID,
 		e.Email,
 		e.IsVerified,
@@ -384,23 +505,46 @@ func (s *usersStore) AddEmail(userID uuid.UUID, email string) (*sentinel.AuthEma
 	}
 	e.ID = id
 
+	// Ask the user to verify the email
+	err = enqueueMail(tx, &sentinel.OutboxMessage{
+		Kind:      sentinel.MailVerifyEmail,
+		Recipient: email,
+		UserUID:   userID,
+		EmailUID:  e.UID,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
 	return e, nil
 }
 
 func (s *usersStore) DelEmail(id uuid.UUID) error {
-	result, err := s.db.Exec(`DELETE FROM authemails WHERE uid=$1`, id)
+	tx, err := s.db.Beginx()
 	if err != nil {
 		return err
 	}
-	n, err := result.RowsAffected()
+	defer tx.Rollback()
+
+	var isPrimary bool
+	err = tx.QueryRowx(`SELECT is_primary FROM authemails WHERE uid=$1 FOR UPDATE`, id).Scan(&isPrimary)
+	if err == sql.ErrNoRows {
+		return errors.New("email not found")
+	}
 	if err != nil {
 		return err
 	}
-	if n != 1 {
-		return errors.New("email not found")
+	if isPrimary {
+		return sentinel.ErrPrimaryEmail
 	}
 
-	return nil
+	if _, err := tx.Exec(`DELETE FROM authemails WHERE uid=$1`, id); err != nil {
+		return err
+	}
+	return tx.Commit()
 }
 
 func SetPassword(u *sentinel.User, password string) error {
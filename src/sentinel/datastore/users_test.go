@@ -10,6 +10,8 @@ import (
 	"testing"
 
 	"sentinel"
+
+	"code.google.com/p/go-uuid/uuid"
 )
 
 func TestUsersStoreGetUserDetails(t *testing.T) {
@@ -90,6 +92,15 @@ func TestAckEmail(t *testing.T) {
 	if err != sql.ErrNoRows {
 		t.Fatal(err)
 	}
+
+	// The first verified email becomes the primary email
+	email, err := d.Users.GetEmail(emailID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !email.IsPrimary {
+		t.Errorf("Result should have been %v, but it was %v", true, email.IsPrimary)
+	}
 }
 
 func TestAddEmail(t *testing.T) {
@@ -108,15 +119,98 @@ func TestAddEmail(t *testing.T) {
 	}
 }
 
-func TestDelEmail(t *testing.T) {
+func TestResendVerification(t *testing.T) {
+	d := NewDatastore(DB)
+
+	// Submitted emails have no verification message in the outbox yet
+	if err := d.Users.ResendVerification(users[1].AuthEmailList[0].UID); err != nil {
+		t.Fatal(err)
+	}
+
+	// AddEmail stores a verification message
+	authEmail, err := d.Users.AddEmail(users[1].UID, "jane.doe@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = d.Users.ResendVerification(authEmail.UID)
+	if err != sentinel.ErrResendThrottled {
+		t.Errorf("Result should have been %v, but it was %v", sentinel.ErrResendThrottled, err)
+	}
+
+	// Verified emails don't get a message
+	if err := d.Users.AckEmail(authEmail.UID); err != nil {
+		t.Fatal(err)
+	}
+	err = d.Users.ResendVerification(authEmail.UID)
+	if err != sql.ErrNoRows {
+		t.Errorf("Result should have been %v, but it was %v", sql.ErrNoRows, err)
+	}
+}
+
+func TestSetPrimaryEmail(t *testing.T) {
 	d := NewDatastore(DB)
 
 	user := users[0]
-	authEmail := user.AuthEmailList[0]
-	err := d.Users.DelEmail(authEmail.UID)
+	authEmail, err := d.Users.AddEmail(user.UID, "bob.primary@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = d.Users.SetPrimaryEmail(authEmail.UID)
+	if err != sentinel.ErrEmailNotVerified {
+		t.Errorf("Result should have been %v, but it was %v", sentinel.ErrEmailNotVerified, err)
+	}
+
+	if err := d.Users.AckEmail(authEmail.UID); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Users.SetPrimaryEmail(authEmail.UID); err != nil {
+		t.Fatal(err)
+	}
+
+	u, err := d.Users.GetUserDetails(user.UID)
 	if err != nil {
 		t.Fatal(err)
 	}
+	primary := 0
+	for _, e := range u.AuthEmailList {
+		if e.IsPrimary {
+			primary++
+		}
+	}
+	if primary != 1 {
+		t.Errorf("Result should have been %v, but it was %v", 1, primary)
+	}
+	if result := u.AuthEmailList[0].UID; !uuid.Equal(result, authEmail.UID) {
+		t.Errorf("Result should have been %v, but it was %v", authEmail.UID, result)
+	}
+}
+
+func TestDelEmail(t *testing.T) {
+	d := NewDatastore(DB)
+
+	user, err := d.Users.GetUserDetails(users[0].UID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var primary, other *sentinel.AuthEmail
+	for _, e := range user.AuthEmailList {
+		if e.IsPrimary {
+			primary = e
+		} else {
+			other = e
+		}
+	}
+	if primary == nil || other == nil {
+		t.Fatalf("Result should have been a primary and another email, but it was %v", user.AuthEmailList)
+	}
+
+	err = d.Users.DelEmail(primary.UID)
+	if err != sentinel.ErrPrimaryEmail {
+		t.Errorf("Result should have been %v, but it was %v", sentinel.ErrPrimaryEmail, err)
+	}
+	if err := d.Users.DelEmail(other.UID); err != nil {
+		t.Fatal(err)
+	}
 }
 
 func TestListEmail(t *testing.T) {
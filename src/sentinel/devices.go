@@ -0,0 +1,189 @@
+// Copyright 2015 Lars Wiegman. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sentinel
+
+import (
+	"errors"
+	"net/url"
+	"time"
+
+	"sentinel/push"
+	"sentinel/tokens"
+
+	"code.google.com/p/go-uuid/uuid"
+)
+
+// Device is a phone or tablet of a user which receives the login requests
+// by push notification. A push token belongs to a single device.
+//
+// The delivery health tells whether the device receives the notifications:
+// Failures counts the deliveries which failed since the last successful
+// delivery, a device is deactivated when the push service rejects its token.
+type Device struct {
+	ID         int       `json:"-"`
+	UID        uuid.UUID `db:"uid" json:"id"`
+	UserID     int       `db:"user_id" json:"-"`
+	Platform   string    `json:"platform"` // ios or android
+	PushToken  string    `db:"push_token" json:"-"`
+	Name       string    `json:"name"`
+	AppVersion string    `db:"app_version" json:"appVersion"`
+	PublicKey  string    `db:"public_key" json:"publicKey,omitempty"`
+	IsActive   bool      `db:"is_active" json:"active"`
+	LastSeenAt time.Time `db:"lastseen_at" json:"lastSeenDate"`
+	CreatedAt  time.Time `db:"created_at" json:"createdDate"`
+	UpdatedAt  time.Time `db:"updated_at" json:"-"`
+
+	Failures    int       `json:"failures"`
+	LastError   string    `db:"last_error" json:"lastError,omitempty"`
+	FailedAt    time.Time `db:"failed_at" json:"lastFailureDate"`
+	DeliveredAt time.Time `db:"delivered_at" json:"lastDeliveryDate"`
+}
+
+// DeviceOptions holds the properties of a device set by its app. The
+// platform and public key are only set on registration, the public key is an
+// ECDSA P-256 or Ed25519 key which verifies the approvals signed by the
+// device.
+type DeviceOptions struct {
+	Platform, PushToken, Name, AppVersion, PublicKey string
+}
+
+func (o *DeviceOptions) ParseForm(v url.Values) error {
+	var parsed bool
+	if s := v.Get("platform"); s != "" {
+		if !push.Platform(s).Valid() {
+			return errors.New("invalid platform parameter; options are ios or android")
+		}
+		o.Platform = s
+		parsed = true
+	}
+	if s := v.Get("pushToken"); s != "" {
+		if len(s) > 4096 {
+			return errors.New("invalid pushToken parameter; exceeds maximum of 4096 characters")
+		}
+		o.PushToken = s
+		parsed = true
+	}
+	if s := v.Get("name"); s != "" {
+		if len(s) > 256 {
+			return errors.New("invalid name parameter; exceeds maximum of 256 characters")
+		}
+		o.Name = s
+		parsed = true
+	}
+	if s := v.Get("appVersion"); s != "" {
+		if len(s) > 64 {
+			return errors.New("invalid appVersion parameter; exceeds maximum of 64 characters")
+		}
+		o.AppVersion = s
+		parsed = true
+	}
+	if s := v.Get("publicKey"); s != "" {
+		if _, _, err := tokens.ParseDeviceKey(s); err != nil {
+			return errors.New("invalid publicKey parameter; expected a PEM encoded ECDSA P-256 or Ed25519 public key")
+		}
+		o.PublicKey = s
+		parsed = true
+	}
+	if !parsed {
+		return errors.New("found no paramters to parse")
+	}
+	return nil
+}
+
+// DeviceListOptions is an instance to filter the devices of a user.
+type DeviceListOptions struct {
+	UserID int
+
+	// ActiveOnly excludes the devices which can't receive push
+	// notifications
+	ActiveOnly bool
+
+	*ListOptions
+}
+
+// DevicesService stores the devices of the users.
+type DevicesService interface {
+	// Register adds the device of the user, a device with the same push
+	// token is updated and activated instead. The push token moves to the
+	// user when it was registered by another user.
+	Register(userID int, opt DeviceOptions) (*Device, error)
+	Get(uid uuid.UUID) (*Device, error)
+	// List returns the devices of the user, the most recently seen first.
+	List(opt DeviceListOptions) ([]*Device, error)
+	// Update changes the name, push token and app version of the device.
+	Update(uid uuid.UUID, opt DeviceOptions) (*Device, error)
+	Delete(uid uuid.UUID) error
+	// RecordDelivery resets the failures of the device after a push
+	// notification was delivered to the push token.
+	RecordDelivery(uid uuid.UUID, pushToken string) error
+	// RecordFailure counts a failed push notification to the push token of
+	// the device along with the reason. The device is deactivated when
+	// deactivate is set. Results for a push token the device no longer
+	// has are ignored.
+	RecordFailure(uid uuid.UUID, pushToken, reason string, deactivate bool) error
+}
+
+// MockDevicesService is a mock of the DevicesService.
+type MockDevicesService struct {
+	RegisterFn func(userID int, opt DeviceOptions) (*Device, error)
+	GetFn      func(uid uuid.UUID) (*Device, error)
+	ListFn     func(opt DeviceListOptions) ([]*Device, error)
+	UpdateFn   func(uid uuid.UUID, opt DeviceOptions) (*Device, error)
+	DeleteFn   func(uid uuid.UUID) error
+
+	RecordDeliveryFn func(uid uuid.UUID, pushToken string) error
+	RecordFailureFn  func(uid uuid.UUID, pushToken, reason string, deactivate bool) error
+}
+
+var _ DevicesService = &MockDevicesService{}
+
+func (s *MockDevicesService) Register(userID int, opt DeviceOptions) (*Device, error) {
+	if s.RegisterFn == nil {
+		return nil, nil
+	}
+	return s.RegisterFn(userID, opt)
+}
+
+func (s *MockDevicesService) Get(uid uuid.UUID) (*Device, error) {
+	if s.GetFn == nil {
+		return nil, nil
+	}
+	return s.GetFn(uid)
+}
+
+func (s *MockDevicesService) List(opt DeviceListOptions) ([]*Device, error) {
+	if s.ListFn == nil {
+		return nil, nil
+	}
+	return s.ListFn(opt)
+}
+
+func (s *MockDevicesService) Update(uid uuid.UUID, opt DeviceOptions) (*Device, error) {
+	if s.UpdateFn == nil {
+		return nil, nil
+	}
+	return s.UpdateFn(uid, opt)
+}
+
+func (s *MockDevicesService) Delete(uid uuid.UUID) error {
+	if s.DeleteFn == nil {
+		return nil
+	}
+	return s.DeleteFn(uid)
+}
+
+func (s *MockDevicesService) RecordDelivery(uid uuid.UUID, pushToken string) error {
+	if s.RecordDeliveryFn == nil {
+		return nil
+	}
+	return s.RecordDeliveryFn(uid, pushToken)
+}
+
+func (s *MockDevicesService) RecordFailure(uid uuid.UUID, pushToken, reason string, deactivate bool) error {
+	if s.RecordFailureFn == nil {
+		return nil
+	}
+	return s.RecordFailureFn(uid, pushToken, reason, deactivate)
+}
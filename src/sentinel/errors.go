@@ -15,6 +15,7 @@ type ErrorResponse struct {
 	Response *http.Response `json:",omitempty"`
 	Name     string         `json:"error"`
 	Desc     string         `json:"error_description"`
+	MFAToken string         `json:"mfa_token,omitempty"` // set with mfa_required, see Client.AuthenticateMFA
 }
 
 func (r *ErrorResponse) Error() string {
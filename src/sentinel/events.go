@@ -0,0 +1,173 @@
+// Copyright 2015 Lars Wiegman. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sentinel
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"sentinel/router"
+
+	"code.google.com/p/go-uuid/uuid"
+)
+
+// EventKind is the kind of an event in the audit trail of a user.
+type EventKind string
+
+const (
+	EventAccountArchived EventKind = "account.archived"
+	EventAccountRestored EventKind = "account.restored"
+	EventAccountPurged   EventKind = "account.purged"
+	EventAccountLocked   EventKind = "account.locked" // repeated failed logins
+
+	EventLogin           EventKind = "login.succeeded"
+	EventLoginFailed     EventKind = "login.failed" // invalid password
+	EventLoginLink       EventKind = "login.link_sent"
+	EventLogout          EventKind = "logout"
+	EventTokenIssued     EventKind = "token.issued"
+	EventServiceApproved EventKind = "service.approved"
+	EventServiceDeclined EventKind = "service.declined"
+
+	EventEmailAdded    EventKind = "email.added"
+	EventEmailVerified EventKind = "email.verified"
+	EventEmailDeleted  EventKind = "email.deleted"
+	EventEmailPrimary  EventKind = "email.primary_changed"
+
+	EventPasswordChanged EventKind = "password.changed"
+	EventPasswordReset   EventKind = "password.reset"
+
+	EventDeviceAdded   EventKind = "device.added"
+	EventDeviceChanged EventKind = "device.changed"
+	EventDeviceDeleted EventKind = "device.deleted"
+
+	EventTOTPEnabled      EventKind = "mfa.totp_enabled"
+	EventTOTPDisabled     EventKind = "mfa.totp_disabled"
+	EventRecoveryCodeUsed EventKind = "mfa.recovery_code_used"
+)
+
+// HistoryEventKinds are the kinds of events in the login history of a user.
+var HistoryEventKinds = []EventKind{
+	EventLogin,
+	EventLoginFailed,
+	EventLoginLink,
+	EventAccountLocked,
+	EventServiceApproved,
+	EventServiceDeclined,
+}
+
+// The actors of events, besides the user itself.
+const (
+	ActorUser   = "user"
+	ActorAdmin  = "admin"
+	ActorSystem = "system" // scheduled jobs of the backend
+)
+
+// Event is an entry in the audit trail of a user. Events are never changed or
+// deleted, they outlive the user.
+type Event struct {
+	ID        int       `json:"-"`
+	UserUID   uuid.UUID `db:"user_uid" json:"userId"`
+	Kind      EventKind `json:"kind"`
+	Actor     string    `json:"actor"`
+	IP        string    `json:"ip,omitempty"`
+	UserAgent string    `db:"user_agent" json:"userAgent,omitempty"`
+	Detail    string    `json:"detail,omitempty"`
+	CreatedAt time.Time `db:"created_at" json:"createdDate"`
+}
+
+// EventListOptions is an instance to filter the events of a user.
+type EventListOptions struct {
+	User uuid.UUID
+
+	// Kinds of events to include, all kinds when empty
+	Kinds []EventKind
+
+	*ListOptions
+}
+
+// EventsService stores the audit trail of the users.
+type EventsService interface {
+	// Record appends the event to the audit trail.
+	Record(e *Event) error
+	// List returns the events of the user, the most recent first.
+	List(opt EventListOptions) ([]*Event, error)
+}
+
+// MockEventsService is a mock of the EventsService.
+type MockEventsService struct {
+	RecordFn func(e *Event) error
+	ListFn   func(opt EventListOptions) ([]*Event, error)
+}
+
+var _ EventsService = &MockEventsService{}
+
+func (s *MockEventsService) Record(e *Event) error {
+	if s.RecordFn == nil {
+		return nil
+	}
+	return s.RecordFn(e)
+}
+
+func (s *MockEventsService) List(opt EventListOptions) ([]*Event, error) {
+	if s.ListFn == nil {
+		return nil, nil
+	}
+	return s.ListFn(opt)
+}
+
+// ActivityService reads the audit trail of the authenticated user from
+// Sentinel's API.
+type ActivityService interface {
+	// Activity returns all events of the user, the most recent first.
+	Activity(opt *ListOptions) ([]*Event, error)
+	// History returns the logins of the user, the most recent first.
+	History(opt *ListOptions) ([]*Event, error)
+}
+
+type activityService struct {
+	client *Client
+}
+
+var _ ActivityService = &activityService{}
+
+func (s *activityService) Activity(opt *ListOptions) ([]*Event, error) {
+	return s.list(router.GetActivity, opt)
+}
+
+func (s *activityService) History(opt *ListOptions) ([]*Event, error) {
+	return s.list(router.GetHistory, opt)
+}
+
+func (s *activityService) list(name string, opt *ListOptions) ([]*Event, error) {
+	u, err := s.client.url(name, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := s.client.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if opt != nil {
+		req.Header.Set("Range-Unit", "items")
+		req.Header.Set("Range", "items="+strconv.FormatUint(opt.First, 10)+"-"+strconv.FormatUint(opt.Last, 10))
+	}
+
+	if err := s.client.Authorize(req); err != nil {
+		return nil, err
+	}
+
+	var events []*Event
+	resp, err := s.client.Do(req, &events)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusPartialContent {
+		return nil, errors.New("API reponded with status " + http.StatusText(resp.StatusCode))
+	}
+	return events, nil
+}
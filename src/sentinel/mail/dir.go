@@ -0,0 +1,39 @@
+// Copyright 2015 Lars Wiegman. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package mail
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// DirSender writes messages to a spool directory instead of delivering them,
+// one .eml file per message. Use it for development and tests.
+type DirSender struct {
+	Dir string
+}
+
+func (s *DirSender) Send(m *Message) error {
+	data, err := m.Bytes()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(s.Dir, 0700); err != nil {
+		return err
+	}
+
+	b := make([]byte, 4)
+	if _, err := rand.Read(b); err != nil {
+		return err
+	}
+	// Names sort by the time the message was sent
+	name := fmt.Sprintf("%s-%s.eml", time.Now().UTC().Format("20060102T150405.000000000"), hex.EncodeToString(b))
+	return ioutil.WriteFile(filepath.Join(s.Dir, name), data, 0600)
+}
@@ -0,0 +1,206 @@
+// Copyright 2015 Lars Wiegman. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package mail sends email messages. Senders deliver messages using Mandrill,
+// an SMTP relay or, for development and tests, by writing them to a spool
+// directory. Templates render the messages in the language of the recipient.
+package mail
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/textproto"
+	"net/url"
+	"strings"
+	"time"
+
+	netmail "net/mail"
+)
+
+// Sender sends email messages.
+type Sender interface {
+	Send(m *Message) error
+}
+
+// Address is an email address with an optional display name.
+type Address struct {
+	Name  string
+	Email string
+}
+
+// String formats the address for use in a message header.
+func (a Address) String() string {
+	return (&netmail.Address{Name: a.Name, Address: a.Email}).String()
+}
+
+// Message is an email message with a plain text body and an optional HTML
+// body.
+type Message struct {
+	From    Address
+	To      []Address
+	Subject string
+	Text    string
+	HTML    string
+	Headers map[string]string
+}
+
+// AddRecipient adds a recipient to the message.
+func (m *Message) AddRecipient(email, name string) {
+	m.To = append(m.To, Address{Name: name, Email: email})
+}
+
+// Bytes returns the message in the Internet Message Format (RFC 5322).
+func (m *Message) Bytes() ([]byte, error) {
+	if len(m.To) == 0 {
+		return nil, errors.New("message has no recipients")
+	}
+
+	to := make([]string, len(m.To))
+	for i, a := range m.To {
+		to[i] = a.String()
+	}
+	id, err := messageID(m.From.Email)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	h := [][2]string{
+		{"From", m.From.String()},
+		{"To", strings.Join(to, ", ")},
+		{"Subject", mime.QEncoding.Encode("utf-8", m.Subject)},
+		{"Date", time.Now().Format(time.RFC1123Z)},
+		{"Message-Id", id},
+		{"Mime-Version", "1.0"},
+	}
+	for k, v := range m.Headers {
+		h = append(h, [2]string{textproto.CanonicalMIMEHeaderKey(k), v})
+	}
+
+	if m.HTML == "" {
+		h = append(h,
+			[2]string{"Content-Type", "text/plain; charset=utf-8"},
+			[2]string{"Content-Transfer-Encoding", "quoted-printable"},
+		)
+		writeHeader(&buf, h)
+		if err := writeQuotedPrintable(&buf, m.Text); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+
+	w := multipart.NewWriter(&buf)
+	h = append(h, [2]string{"Content-Type", "multipart/alternative; boundary=" + w.Boundary()})
+	writeHeader(&buf, h)
+	for _, part := range []struct{ contentType, body string }{
+		{"text/plain; charset=utf-8", m.Text},
+		{"text/html; charset=utf-8", m.HTML},
+	} {
+		pw, err := w.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {part.contentType},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		if err := writeQuotedPrintable(pw, part.body); err != nil {
+			return nil, err
+		}
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func writeHeader(buf *bytes.Buffer, h [][2]string) {
+	for _, kv := range h {
+		fmt.Fprintf(buf, "%s: %s\r\n", kv[0], kv[1])
+	}
+	buf.WriteString("\r\n")
+}
+
+func writeQuotedPrintable(w io.Writer, s string) error {
+	qp := quotedprintable.NewWriter(w)
+	if _, err := qp.Write([]byte(s)); err != nil {
+		return err
+	}
+	return qp.Close()
+}
+
+func messageID(from string) (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	domain := "sentinel.sh"
+	if i := strings.LastIndex(from, "@"); i >= 0 && i < len(from)-1 {
+		domain = from[i+1:]
+	}
+	return "<" + hex.EncodeToString(b) + "@" + domain + ">", nil
+}
+
+// New returns the sender configured by the URL. The schemes are:
+//
+//	mandrill://<api key>
+//	smtp://[user:password@]host[:port]   STARTTLS when offered, port 587 by default;
+//	                                     add ?starttls=required to refuse plain connections
+//	smtps://[user:password@]host[:port]  implicit TLS, port 465 by default
+//	dir:///path/to/spool                 writes messages to the directory
+func New(rawurl string) (Sender, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+
+	switch u.Scheme {
+	case "mandrill":
+		return NewMandrillSender(u.Host), nil
+	case "smtp", "smtps":
+		s := &SMTPSender{
+			Addr:        u.Host,
+			ImplicitTLS: u.Scheme == "smtps",
+			RequireTLS:  u.Query().Get("starttls") == "required",
+		}
+		if u.User != nil {
+			s.Username = u.User.Username()
+			s.Password, _ = u.User.Password()
+		}
+		if u.Port() == "" {
+			port := "587"
+			if s.ImplicitTLS {
+				port = "465"
+			}
+			s.Addr = u.Hostname() + ":" + port
+		}
+		return s, nil
+	case "dir":
+		if u.Path == "" {
+			return nil, errors.New("dir mail URL has no path")
+		}
+		return &DirSender{Dir: u.Path}, nil
+	}
+	return nil, fmt.Errorf("unsupported mail URL scheme %q", u.Scheme)
+}
+
+// MockSender is a mock of the Sender.
+type MockSender struct {
+	SendFn func(m *Message) error
+}
+
+var _ Sender = &MockSender{}
+
+func (s *MockSender) Send(m *Message) error {
+	if s.SendFn == nil {
+		return nil
+	}
+	return s.SendFn(m)
+}
@@ -0,0 +1,47 @@
+// Copyright 2015 Lars Wiegman. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package mail
+
+import (
+	"fmt"
+
+	"github.com/keighl/mandrill"
+)
+
+// MandrillSender sends messages using the Mandrill API.
+type MandrillSender struct {
+	Client *mandrill.Client
+}
+
+// NewMandrillSender returns a sender using the Mandrill API key.
+func NewMandrillSender(key string) *MandrillSender {
+	return &MandrillSender{Client: mandrill.ClientWithKey(key)}
+}
+
+func (s *MandrillSender) Send(m *Message) error {
+	msg := &mandrill.Message{
+		FromEmail: m.From.Email,
+		FromName:  m.From.Name,
+		Subject:   m.Subject,
+		Text:      m.Text,
+		HTML:      m.HTML,
+		Headers:   m.Headers,
+	}
+	for _, a := range m.To {
+		msg.AddRecipient(a.Email, a.Name, "to")
+	}
+
+	responses, err := s.Client.MessagesSend(msg)
+	if err != nil {
+		return err
+	}
+	for _, r := range responses {
+		switch r.Status {
+		case "rejected", "invalid":
+			return fmt.Errorf("mandrill: message to %s was %s: %s", r.Email, r.Status, r.RejectionReason)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,113 @@
+// Copyright 2015 Lars Wiegman. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package mail
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/smtp"
+	"time"
+)
+
+// DefaultDialTimeout is the timeout for connecting to the SMTP relay.
+const DefaultDialTimeout = time.Second * 30
+
+// SMTPSender sends messages through an SMTP relay. The connection is upgraded
+// using STARTTLS when the relay offers it, or uses TLS from the start when
+// ImplicitTLS is set. Credentials are only sent over TLS connections, except
+// to localhost.
+type SMTPSender struct {
+	Addr               string // host:port of the relay
+	Username, Password string
+	ImplicitTLS        bool
+	RequireTLS         bool // refuse relays which don't offer STARTTLS
+	TLSConfig          *tls.Config
+	DialTimeout        time.Duration
+}
+
+func (s *SMTPSender) Send(m *Message) error {
+	data, err := m.Bytes()
+	if err != nil {
+		return err
+	}
+
+	host, _, err := net.SplitHostPort(s.Addr)
+	if err != nil {
+		return err
+	}
+	c, err := s.dial(host)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	if !s.ImplicitTLS {
+		if ok, _ := c.Extension("STARTTLS"); ok {
+			if err := c.StartTLS(s.tlsConfig(host)); err != nil {
+				return err
+			}
+		} else if s.RequireTLS {
+			return errors.New("smtp: relay doesn't support STARTTLS")
+		}
+	}
+	if s.Username != "" {
+		if err := c.Auth(smtp.PlainAuth("", s.Username, s.Password, host)); err != nil {
+			return err
+		}
+	}
+
+	if err := c.Mail(m.From.Email); err != nil {
+		return err
+	}
+	for _, a := range m.To {
+		if err := c.Rcpt(a.Email); err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(data); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+func (s *SMTPSender) dial(host string) (*smtp.Client, error) {
+	timeout := s.DialTimeout
+	if timeout == 0 {
+		timeout = DefaultDialTimeout
+	}
+	d := &net.Dialer{Timeout: timeout}
+
+	var conn net.Conn
+	var err error
+	if s.ImplicitTLS {
+		conn, err = tls.DialWithDialer(d, "tcp", s.Addr, s.tlsConfig(host))
+	} else {
+		conn, err = d.Dial("tcp", s.Addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+func (s *SMTPSender) tlsConfig(host string) *tls.Config {
+	if s.TLSConfig != nil {
+		return s.TLSConfig
+	}
+	return &tls.Config{ServerName: host}
+}
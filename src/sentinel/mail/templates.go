@@ -0,0 +1,213 @@
+// Copyright 2015 Lars Wiegman. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package mail
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	htmltemplate "html/template"
+	texttemplate "text/template"
+)
+
+// DefaultLocale is the locale of the messages for users whose language isn't
+// available.
+const DefaultLocale = "en"
+
+// Templates renders the messages to users in their language. Each message has
+// a text template and an HTML template per locale. The text template defines
+// the subject in a template named "subject".
+//
+// On disk the templates of a message are stored as <locale>/<name>.txt and
+// <locale>/<name>.html.
+type Templates struct {
+	DefaultLocale string
+
+	mu   sync.RWMutex
+	text map[string]*texttemplate.Template // by locale/name
+	html map[string]*htmltemplate.Template // by locale/name
+}
+
+// NewTemplates returns the built-in templates.
+func NewTemplates() *Templates {
+	t := &Templates{
+		DefaultLocale: DefaultLocale,
+		text:          make(map[string]*texttemplate.Template),
+		html:          make(map[string]*htmltemplate.Template),
+	}
+	for _, v := range builtinTemplates {
+		if err := t.Add(v.locale, v.name, v.text, v.html); err != nil {
+			panic(err)
+		}
+	}
+	return t
+}
+
+// Add parses and adds the templates of the named message for the locale,
+// replacing existing templates.
+func (t *Templates) Add(locale, name, text, html string) error {
+	locale = canonicalLocale(locale)
+	key := locale + "/" + name
+
+	tt, err := texttemplate.New(key).Parse(text)
+	if err != nil {
+		return err
+	}
+	if tt.Lookup("subject") == nil {
+		return fmt.Errorf("template %s doesn't define a subject", key)
+	}
+	ht, err := htmltemplate.New(key).Parse(html)
+	if err != nil {
+		return err
+	}
+
+	t.mu.Lock()
+	t.text[key] = tt
+	t.html[key] = ht
+	t.mu.Unlock()
+	return nil
+}
+
+// LoadDir adds the templates in dir, which holds a directory per locale.
+func (t *Templates) LoadDir(dir string) error {
+	textFiles, err := filepath.Glob(filepath.Join(dir, "*", "*.txt"))
+	if err != nil {
+		return err
+	}
+	if len(textFiles) == 0 {
+		return fmt.Errorf("no templates found in %s", dir)
+	}
+
+	for _, path := range textFiles {
+		locale := filepath.Base(filepath.Dir(path))
+		name := strings.TrimSuffix(filepath.Base(path), ".txt")
+
+		text, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		html, err := ioutil.ReadFile(strings.TrimSuffix(path, ".txt") + ".html")
+		if os.IsNotExist(err) {
+			return fmt.Errorf("template %s has no HTML part", path)
+		}
+		if err != nil {
+			return err
+		}
+		if err := t.Add(locale, name, string(text), string(html)); err != nil {
+			return fmt.Errorf("%s: %s", path, err)
+		}
+	}
+	return nil
+}
+
+// Locales returns the locales for which there are templates.
+func (t *Templates) Locales() []string {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	seen := make(map[string]bool)
+	var locales []string
+	for key := range t.text {
+		locale := key[:strings.Index(key, "/")]
+		if !seen[locale] {
+			seen[locale] = true
+			locales = append(locales, locale)
+		}
+	}
+	sort.Strings(locales)
+	return locales
+}
+
+// Render returns the named message in the language of the locale. It falls
+// back to the base language, "nl" for "nl-BE", and then to the default
+// locale.
+func (t *Templates) Render(name, locale string, data interface{}) (*Message, error) {
+	tt, ht := t.lookup(name, locale)
+	if tt == nil {
+		return nil, fmt.Errorf("no template for message %s", name)
+	}
+
+	var subject, text, html bytes.Buffer
+	if err := tt.ExecuteTemplate(&subject, "subject", data); err != nil {
+		return nil, err
+	}
+	if err := tt.Execute(&text, data); err != nil {
+		return nil, err
+	}
+	if err := ht.Execute(&html, data); err != nil {
+		return nil, err
+	}
+
+	return &Message{
+		Subject: strings.TrimSpace(subject.String()),
+		Text:    strings.TrimLeft(text.String(), "\r\n"),
+		HTML:    html.String(),
+	}, nil
+}
+
+func (t *Templates) lookup(name, locale string) (*texttemplate.Template, *htmltemplate.Template) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	locale = canonicalLocale(locale)
+	candidates := []string{locale}
+	if i := strings.Index(locale, "-"); i > 0 {
+		candidates = append(candidates, locale[:i])
+	}
+	candidates = append(candidates, canonicalLocale(t.DefaultLocale))
+	for _, l := range candidates {
+		if tt, ok := t.text[l+"/"+name]; ok {
+			return tt, t.html[l+"/"+name]
+		}
+	}
+	return nil, nil
+}
+
+// Match returns the locale with templates which best matches the languages
+// in the Accept-Language header, or an empty string if none matches.
+func (t *Templates) Match(acceptLanguage string) string {
+	available := make(map[string]bool)
+	for _, l := range t.Locales() {
+		available[l] = true
+	}
+
+	best, bestQ := "", 0.0
+	for _, part := range strings.Split(acceptLanguage, ",") {
+		fields := strings.Split(strings.TrimSpace(part), ";")
+		tag := canonicalLocale(fields[0])
+		q := 1.0
+		for _, f := range fields[1:] {
+			f = strings.TrimSpace(f)
+			if strings.HasPrefix(f, "q=") {
+				if v, err := strconv.ParseFloat(f[2:], 64); err == nil {
+					q = v
+				}
+			}
+		}
+		if tag == "" || tag == "*" || q <= bestQ {
+			continue
+		}
+
+		if available[tag] {
+			best, bestQ = tag, q
+		} else if i := strings.Index(tag, "-"); i > 0 && available[tag[:i]] {
+			best, bestQ = tag[:i], q
+		}
+	}
+	return best
+}
+
+// canonicalLocale returns the locale in lower case with hyphens, e.g. "nl-be"
+// for "nl_BE".
+func canonicalLocale(locale string) string {
+	return strings.ToLower(strings.Replace(strings.TrimSpace(locale), "_", "-", -1))
+}
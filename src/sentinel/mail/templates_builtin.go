@@ -0,0 +1,144 @@
+// Copyright 2015 Lars Wiegman. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package mail
+
+// builtinTemplates are the templates of the messages to users which are
+// compiled into the binary. Templates loaded from disk replace them.
+var builtinTemplates = []struct {
+	locale, name, text, html string
+}{
+	{"en", "verify-email", verifyEmailTextEN, verifyEmailHTMLEN},
+	{"en", "login-link", loginLinkTextEN, loginLinkHTMLEN},
+	{"en", "reset-password", resetPasswordTextEN, resetPasswordHTMLEN},
+	{"nl", "verify-email", verifyEmailTextNL, verifyEmailHTMLNL},
+	{"nl", "login-link", loginLinkTextNL, loginLinkHTMLNL},
+	{"nl", "reset-password", resetPasswordTextNL, resetPasswordHTMLNL},
+}
+
+const verifyEmailTextEN = `{{define "subject"}}Confirm your email{{end}}
+Hey, welcome to Sentinel! Before you get started, please verify your email address by visiting the following link:
+
+    {{.Link}}
+
+Sentinel Bot
+`
+
+const verifyEmailHTMLEN = `<!DOCTYPE html>
+<html lang="en">
+<head><meta charset="utf-8"><title>Confirm your email</title></head>
+<body>
+<p>Hey, welcome to Sentinel! Before you get started, please verify your email address.</p>
+<p><a href="{{.Link}}">Verify your email address</a></p>
+<p>Sentinel Bot</p>
+</body>
+</html>
+`
+
+const loginLinkTextEN = `{{define "subject"}}Login link{{end}}
+Hey, you requested that we send you a link to login to our application without a password. Here you go:
+
+    {{.Link}}
+
+Using the one time login link can be convenient when you can't remember your password or when you don't want to enter your password on a public WiFi.
+
+Sentinel Bot
+`
+
+const loginLinkHTMLEN = `<!DOCTYPE html>
+<html lang="en">
+<head><meta charset="utf-8"><title>Login link</title></head>
+<body>
+<p>Hey, you requested that we send you a link to login to our application without a password. Here you go:</p>
+<p><a href="{{.Link}}">Login to Sentinel</a></p>
+<p>Using the one time login link can be convenient when you can't remember your password or when you don't want to enter your password on a public WiFi.</p>
+<p>Sentinel Bot</p>
+</body>
+</html>
+`
+
+const resetPasswordTextEN = `{{define "subject"}}Reset your password{{end}}
+Hey, you requested a link to choose a new password. The link is valid for 30 minutes and can only be used once:
+
+    {{.Link}}
+
+After the reset you're logged out on all your devices. If you didn't request a new password, you can ignore this message; your password remains unchanged.
+
+Sentinel Bot
+`
+
+const resetPasswordHTMLEN = `<!DOCTYPE html>
+<html lang="en">
+<head><meta charset="utf-8"><title>Reset your password</title></head>
+<body>
+<p>Hey, you requested a link to choose a new password. The link is valid for 30 minutes and can only be used once.</p>
+<p><a href="{{.Link}}">Choose a new password</a></p>
+<p>After the reset you're logged out on all your devices. If you didn't request a new password, you can ignore this message; your password remains unchanged.</p>
+<p>Sentinel Bot</p>
+</body>
+</html>
+`
+
+const verifyEmailTextNL = `{{define "subject"}}Bevestig je e-mailadres{{end}}
+Hoi, welkom bij Sentinel! Bevestig je e-mailadres voordat je begint door de volgende link te openen:
+
+    {{.Link}}
+
+Sentinel Bot
+`
+
+const verifyEmailHTMLNL = `<!DOCTYPE html>
+<html lang="nl">
+<head><meta charset="utf-8"><title>Bevestig je e-mailadres</title></head>
+<body>
+<p>Hoi, welkom bij Sentinel! Bevestig je e-mailadres voordat je begint.</p>
+<p><a href="{{.Link}}">Bevestig je e-mailadres</a></p>
+<p>Sentinel Bot</p>
+</body>
+</html>
+`
+
+const loginLinkTextNL = `{{define "subject"}}Inloglink{{end}}
+Hoi, je hebt gevraagd om een link waarmee je zonder wachtwoord inlogt. Alsjeblieft:
+
+    {{.Link}}
+
+De eenmalige inloglink is handig als je je wachtwoord niet meer weet of als je je wachtwoord niet wilt invoeren op een openbaar wifi-netwerk.
+
+Sentinel Bot
+`
+
+const loginLinkHTMLNL = `<!DOCTYPE html>
+<html lang="nl">
+<head><meta charset="utf-8"><title>Inloglink</title></head>
+<body>
+<p>Hoi, je hebt gevraagd om een link waarmee je zonder wachtwoord inlogt. Alsjeblieft:</p>
+<p><a href="{{.Link}}">Inloggen bij Sentinel</a></p>
+<p>De eenmalige inloglink is handig als je je wachtwoord niet meer weet of als je je wachtwoord niet wilt invoeren op een openbaar wifi-netwerk.</p>
+<p>Sentinel Bot</p>
+</body>
+</html>
+`
+
+const resetPasswordTextNL = `{{define "subject"}}Stel een nieuw wachtwoord in{{end}}
+Hoi, je hebt gevraagd om een link waarmee je een nieuw wachtwoord kiest. De link is 30 minuten geldig en werkt maar één keer:
+
+    {{.Link}}
+
+Na het instellen van je nieuwe wachtwoord word je op al je apparaten uitgelogd. Heb je geen nieuw wachtwoord aangevraagd? Dan kun je dit bericht negeren; je wachtwoord blijft ongewijzigd.
+
+Sentinel Bot
+`
+
+const resetPasswordHTMLNL = `<!DOCTYPE html>
+<html lang="nl">
+<head><meta charset="utf-8"><title>Stel een nieuw wachtwoord in</title></head>
+<body>
+<p>Hoi, je hebt gevraagd om een link waarmee je een nieuw wachtwoord kiest. De link is 30 minuten geldig en werkt maar één keer.</p>
+<p><a href="{{.Link}}">Kies een nieuw wachtwoord</a></p>
+<p>Na het instellen van je nieuwe wachtwoord word je op al je apparaten uitgelogd. Heb je geen nieuw wachtwoord aangevraagd? Dan kun je dit bericht negeren; je wachtwoord blijft ongewijzigd.</p>
+<p>Sentinel Bot</p>
+</body>
+</html>
+`
@@ -0,0 +1,116 @@
+// Copyright 2015 Lars Wiegman. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package mail
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestTemplatesRender(t *testing.T) {
+	tmpl := NewTemplates()
+	data := map[string]string{"Link": "https://sentinel.sh/login?token=abc&x=<1>"}
+
+	tests := []struct {
+		locale, subject string
+	}{
+		{"en", "Login link"},
+		{"nl", "Inloglink"},
+		{"nl-BE", "Inloglink"},
+		{"fr", "Login link"},
+		{"", "Login link"},
+	}
+	for _, tt := range tests {
+		m, err := tmpl.Render("login-link", tt.locale, data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m.Subject != tt.subject {
+			t.Errorf("Result should have been %v, but it was %v", tt.subject, m.Subject)
+		}
+	}
+
+	m, err := tmpl.Render("login-link", "en", data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(m.Text, "Hey, you requested") {
+		t.Errorf("Result should have been the login-link text, but it was %v", m.Text)
+	}
+	if !strings.Contains(m.Text, data["Link"]) {
+		t.Errorf("Result should have been a text with %v, but it was %v", data["Link"], m.Text)
+	}
+	// Links are escaped in the HTML part
+	if want := `href="https://sentinel.sh/login?token=abc&amp;x=%3c1%3e"`; !strings.Contains(m.HTML, want) {
+		t.Errorf("Result should have been an HTML part with %v, but it was %v", want, m.HTML)
+	}
+
+	if _, err := tmpl.Render("unknown", "en", data); err == nil {
+		t.Error("Result should have been an error, but it was nil")
+	}
+}
+
+func TestTemplatesMatch(t *testing.T) {
+	tmpl := NewTemplates()
+	tests := []struct {
+		acceptLanguage, want string
+	}{
+		{"nl-BE,nl;q=0.9,en;q=0.8", "nl"},
+		{"de-DE,de;q=0.9,en;q=0.5", "en"},
+		{"en-US;q=0.4,nl;q=0.7", "nl"},
+		{"de", ""},
+		{"", ""},
+		{"*", ""},
+	}
+	for _, tt := range tests {
+		if got := tmpl.Match(tt.acceptLanguage); got != tt.want {
+			t.Errorf("Result should have been %q for %q, but it was %q", tt.want, tt.acceptLanguage, got)
+		}
+	}
+}
+
+func TestTemplatesLoadDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sentinel-templates")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := os.Mkdir(filepath.Join(dir, "de"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{
+		"de/login-link.txt":  `{{define "subject"}}Anmeldelink{{end}}{{.Link}}`,
+		"de/login-link.html": `<a href="{{.Link}}">Anmelden</a>`,
+	}
+	for name, data := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tmpl := NewTemplates()
+	if err := tmpl.LoadDir(dir); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := tmpl.Locales(), []string{"de", "en", "nl"}; strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("Result should have been %v, but it was %v", want, got)
+	}
+	m, err := tmpl.Render("login-link", "de-AT", map[string]string{"Link": "https://sentinel.sh/login"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Subject != "Anmeldelink" || m.Text != "https://sentinel.sh/login" {
+		t.Errorf("Result should have been the German message, but it was %+v", m)
+	}
+
+	// Templates must define a subject
+	if err := tmpl.Add("de", "verify-email", "{{.Link}}", "{{.Link}}"); err == nil {
+		t.Error("Result should have been an error, but it was nil")
+	}
+}
@@ -0,0 +1,93 @@
+// Copyright 2015 Lars Wiegman. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sentinel
+
+import (
+	"errors"
+)
+
+// RecoveryCodeCount is the number of recovery codes issued when TOTP is
+// enabled, each code can be used once instead of a TOTP code.
+const RecoveryCodeCount = 10
+
+var (
+	// ErrTOTPEnabled is returned when TOTP is enrolled while it's enabled,
+	// it must be disabled first.
+	ErrTOTPEnabled = errors.New("totp is already enabled")
+	// ErrTOTPNotEnrolled is returned when TOTP is enabled without a secret.
+	ErrTOTPNotEnrolled = errors.New("totp isn't enrolled")
+	// ErrTOTPReplayed is returned when a code of a time step which was used
+	// before is used again.
+	ErrTOTPReplayed = errors.New("totp code was used before")
+	// ErrRecoveryCodeInvalid is returned when a recovery code is unknown or
+	// was used before.
+	ErrRecoveryCodeInvalid = errors.New("recovery code is invalid or used")
+)
+
+// MFAService stores the second factors of the users: a TOTP secret and
+// single-use recovery codes. The secret is kept on the user.
+type MFAService interface {
+	// EnrollTOTP sets a new TOTP secret of the user which isn't used until
+	// it's enabled, ErrTOTPEnabled is returned when TOTP is enabled.
+	EnrollTOTP(userID int, secret string) error
+	// EnableTOTP enables the enrolled secret, step is the time step of the
+	// code which confirmed it. The recovery codes replace the codes of the
+	// user, only their hashes are stored.
+	EnableTOTP(userID int, step int64, recoveryCodes []string) error
+	// DisableTOTP removes the secret and the recovery codes of the user.
+	DisableTOTP(userID int) error
+	// UseTOTP records the time step of a valid code, ErrTOTPReplayed is
+	// returned when it isn't after the step used last.
+	UseTOTP(userID int, step int64) error
+	// UseRecoveryCode uses the recovery code of the user,
+	// ErrRecoveryCodeInvalid is returned when it's unknown or used.
+	UseRecoveryCode(userID int, code string) error
+}
+
+// MockMFAService is a mock of the MFAService.
+type MockMFAService struct {
+	EnrollTOTPFn      func(userID int, secret string) error
+	EnableTOTPFn      func(userID int, step int64, recoveryCodes []string) error
+	DisableTOTPFn     func(userID int) error
+	UseTOTPFn         func(userID int, step int64) error
+	UseRecoveryCodeFn func(userID int, code string) error
+}
+
+var _ MFAService = &MockMFAService{}
+
+func (s *MockMFAService) EnrollTOTP(userID int, secret string) error {
+	if s.EnrollTOTPFn == nil {
+		return nil
+	}
+	return s.EnrollTOTPFn(userID, secret)
+}
+
+func (s *MockMFAService) EnableTOTP(userID int, step int64, recoveryCodes []string) error {
+	if s.EnableTOTPFn == nil {
+		return nil
+	}
+	return s.EnableTOTPFn(userID, step, recoveryCodes)
+}
+
+func (s *MockMFAService) DisableTOTP(userID int) error {
+	if s.DisableTOTPFn == nil {
+		return nil
+	}
+	return s.DisableTOTPFn(userID)
+}
+
+func (s *MockMFAService) UseTOTP(userID int, step int64) error {
+	if s.UseTOTPFn == nil {
+		return nil
+	}
+	return s.UseTOTPFn(userID, step)
+}
+
+func (s *MockMFAService) UseRecoveryCode(userID int, code string) error {
+	if s.UseRecoveryCodeFn == nil {
+		return nil
+	}
+	return s.UseRecoveryCodeFn(userID, code)
+}
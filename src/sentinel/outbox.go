@@ -0,0 +1,112 @@
+// Copyright 2015 Lars Wiegman. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sentinel
+
+import (
+	"time"
+
+	"code.google.com/p/go-uuid/uuid"
+)
+
+// MailKind is the kind of email message sent to a user.
+type MailKind string
+
+const (
+	// MailVerifyEmail asks the user to verify an email address.
+	MailVerifyEmail MailKind = "verify-email"
+	// MailLoginLink holds a link to login without a password.
+	MailLoginLink MailKind = "login-link"
+	// MailResetPassword holds a link to set a new password.
+	MailResetPassword MailKind = "reset-password"
+)
+
+// OutboxStatus is the delivery state of an email message.
+type OutboxStatus string
+
+const (
+	OutboxPending OutboxStatus = "pending"
+	OutboxSent    OutboxStatus = "sent"
+	OutboxDead    OutboxStatus = "dead" // given up after the maximum number of attempts
+)
+
+// OutboxMessage is an email message waiting in the outbox. The message is
+// stored along with the change which triggers it, the text of the message and
+// the token it carries are only created on delivery.
+type OutboxMessage struct {
+	ID            int          `json:"id"`
+	Kind          MailKind     `json:"kind"`
+	Recipient     string       `json:"recipient"`
+	UserUID       uuid.UUID    `db:"user_uid" json:"userId"`
+	EmailUID      uuid.UUID    `db:"email_uid" json:"emailId"`
+	Locale        string       `json:"locale"` // language requested when the message was stored
+	Status        OutboxStatus `json:"status"`
+	Attempts      int          `json:"attempts"`
+	LastError     string       `db:"last_error" json:"lastError,omitempty"`
+	NextAttemptAt time.Time    `db:"next_attempt_at" json:"nextAttemptDate"`
+	CreatedAt     time.Time    `db:"created_at" json:"createdDate"`
+	UpdatedAt     time.Time    `db:"updated_at" json:"updatedDate"`
+}
+
+// OutboxService stores the email messages to users until they are delivered.
+type OutboxService interface {
+	// Enqueue stores the message for immediate delivery.
+	Enqueue(m *OutboxMessage) error
+	// Due claims at most limit pending messages which are due. Claimed
+	// messages aren't returned again for the duration of the lease.
+	Due(limit int, lease time.Duration) ([]*OutboxMessage, error)
+	// Record stores the state of the message after a delivery attempt.
+	Record(m *OutboxMessage) error
+	// List returns the messages with the given status, all messages when
+	// status is empty.
+	List(status OutboxStatus) ([]*OutboxMessage, error)
+	// Replay schedules a dead message for immediate delivery.
+	Replay(id int) error
+}
+
+// MockOutboxService is a mock of the OutboxService.
+type MockOutboxService struct {
+	EnqueueFn func(m *OutboxMessage) error
+	DueFn     func(limit int, lease time.Duration) ([]*OutboxMessage, error)
+	RecordFn  func(m *OutboxMessage) error
+	ListFn    func(status OutboxStatus) ([]*OutboxMessage, error)
+	ReplayFn  func(id int) error
+}
+
+var _ OutboxService = &MockOutboxService{}
+
+func (s *MockOutboxService) Enqueue(m *OutboxMessage) error {
+	if s.EnqueueFn == nil {
+		return nil
+	}
+	return s.EnqueueFn(m)
+}
+
+func (s *MockOutboxService) Due(limit int, lease time.Duration) ([]*OutboxMessage, error) {
+	if s.DueFn == nil {
+		return nil, nil
+	}
+	return s.DueFn(limit, lease)
+}
+
+func (s *MockOutboxService) Record(m *OutboxMessage) error {
+	if s.RecordFn == nil {
+		return nil
+	}
+	return s.RecordFn(m)
+}
+
+func (s *MockOutboxService) List(status OutboxStatus) ([]*OutboxMessage, error) {
+	if s.ListFn == nil {
+		return nil, nil
+	}
+	return s.ListFn(status)
+}
+
+func (s *MockOutboxService) Replay(id int) error {
+	if s.ReplayFn == nil {
+		return nil
+	}
+	return s.ReplayFn(id)
+}
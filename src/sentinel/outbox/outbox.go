@@ -0,0 +1,165 @@
+// Copyright 2015 Lars Wiegman. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package outbox delivers the email messages in the outbox.
+//
+// Messages are stored in the outbox along with the change which triggers
+// them, so a message is never lost when the mail relay is unavailable.
+// Workers claim the messages which are due, compose and send them, and retry
+// failed messages with an increasing delay. Messages which still fail after
+// the maximum number of attempts are dead; they are kept for inspection and
+// can be replayed.
+package outbox
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"sentinel"
+	"sentinel/mail"
+)
+
+const (
+	// DefaultMaxAttempts is the number of delivery attempts after which a
+	// message is dead.
+	DefaultMaxAttempts = 10
+
+	// DefaultWorkers is the number of messages sent concurrently.
+	DefaultWorkers = 4
+
+	// lease is the duration for which a claimed message isn't handed to
+	// another worker.
+	lease = time.Minute * 5
+
+	// batchSize is the maximum number of messages claimed at once.
+	batchSize = 50
+)
+
+// DefaultBackoff returns the delay before the next attempt after the given
+// number of failed attempts; 30s, 1m, 2m, etc. up to 4h.
+func DefaultBackoff(attempts int) time.Duration {
+	d := 30 * time.Second
+	for i := 1; i < attempts && d < 4*time.Hour; i++ {
+		d *= 2
+	}
+	if d > 4*time.Hour {
+		d = 4 * time.Hour
+	}
+	return d
+}
+
+// ComposeFunc returns the email message for a message in the outbox.
+type ComposeFunc func(m *sentinel.OutboxMessage) (*mail.Message, error)
+
+// Dispatcher sends the messages in the outbox.
+type Dispatcher struct {
+	MaxAttempts int
+	Backoff     func(attempts int) time.Duration
+	Workers     int
+
+	// Wake triggers a delivery run before the next interval, e.g. after a
+	// message is stored.
+	Wake <-chan struct{}
+
+	store   sentinel.OutboxService
+	sender  mail.Sender
+	compose ComposeFunc
+}
+
+// NewDispatcher returns a Dispatcher which sends the messages in the store
+// using the sender.
+func NewDispatcher(store sentinel.OutboxService, sender mail.Sender, compose ComposeFunc) *Dispatcher {
+	return &Dispatcher{
+		MaxAttempts: DefaultMaxAttempts,
+		Backoff:     DefaultBackoff,
+		Workers:     DefaultWorkers,
+		store:       store,
+		sender:      sender,
+		compose:     compose,
+	}
+}
+
+// Deliver makes a single delivery attempt and records the outcome. On error
+// the next attempt is scheduled unless the maximum number of attempts has
+// been reached.
+func (d *Dispatcher) Deliver(m *sentinel.OutboxMessage) error {
+	err := d.send(m)
+
+	m.Attempts++
+	switch {
+	case err == nil:
+		m.Status = sentinel.OutboxSent
+		m.LastError = ""
+	case m.Attempts >= d.MaxAttempts:
+		m.Status = sentinel.OutboxDead
+		m.LastError = err.Error()
+	default:
+		m.Status = sentinel.OutboxPending
+		m.NextAttemptAt = time.Now().UTC().Add(d.Backoff(m.Attempts))
+		m.LastError = err.Error()
+	}
+
+	if rerr := d.store.Record(m); rerr != nil {
+		return rerr
+	}
+	return err
+}
+
+// DeliverDue delivers the messages which are due using the configured number
+// of workers.
+func (d *Dispatcher) DeliverDue() error {
+	messages, err := d.store.Due(batchSize, lease)
+	if err != nil {
+		return err
+	}
+
+	workers := d.Workers
+	if workers < 1 {
+		workers = 1
+	}
+	queue := make(chan *sentinel.OutboxMessage)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for m := range queue {
+				if err := d.Deliver(m); err != nil {
+					log.Printf("sending %s message %d failed with error: %s", m.Kind, m.ID, err)
+				}
+			}
+		}()
+	}
+	for _, m := range messages {
+		queue <- m
+	}
+	close(queue)
+	wg.Wait()
+	return nil
+}
+
+// Run delivers the messages which are due every interval or when woken. It
+// never returns.
+func (d *Dispatcher) Run(interval time.Duration) {
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-tick.C:
+		case <-d.Wake:
+		}
+		if err := d.DeliverDue(); err != nil {
+			log.Println("delivering email messages failed with error:", err)
+		}
+	}
+}
+
+func (d *Dispatcher) send(m *sentinel.OutboxMessage) error {
+	msg, err := d.compose(m)
+	if err != nil {
+		return err
+	}
+	return d.sender.Send(msg)
+}
@@ -0,0 +1,126 @@
+// Copyright 2015 Lars Wiegman. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package outbox
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"sentinel"
+	"sentinel/mail"
+)
+
+func compose(m *sentinel.OutboxMessage) (*mail.Message, error) {
+	msg := &mail.Message{Subject: string(m.Kind), Text: "Hello"}
+	msg.AddRecipient(m.Recipient, "")
+	return msg, nil
+}
+
+func TestDeliver(t *testing.T) {
+	var sent []*mail.Message
+	sender := &mail.MockSender{SendFn: func(m *mail.Message) error {
+		sent = append(sent, m)
+		return nil
+	}}
+	var recorded []*sentinel.OutboxMessage
+	store := &sentinel.MockOutboxService{RecordFn: func(m *sentinel.OutboxMessage) error {
+		recorded = append(recorded, m)
+		return nil
+	}}
+
+	d := NewDispatcher(store, sender, compose)
+	m := &sentinel.OutboxMessage{ID: 1, Kind: sentinel.MailVerifyEmail, Recipient: "jane@example.com", Status: sentinel.OutboxPending}
+	if err := d.Deliver(m); err != nil {
+		t.Fatal(err)
+	}
+
+	if m.Status != sentinel.OutboxSent {
+		t.Errorf("Result should have been %v, but it was %v", sentinel.OutboxSent, m.Status)
+	}
+	if len(sent) != 1 || sent[0].To[0].Email != m.Recipient {
+		t.Errorf("Result should have been a single message to %v, but it was %v", m.Recipient, sent)
+	}
+	if len(recorded) != 1 {
+		t.Errorf("Result should have been %v, but it was %v", 1, len(recorded))
+	}
+}
+
+func TestDeliverRetry(t *testing.T) {
+	sender := &mail.MockSender{SendFn: func(m *mail.Message) error {
+		return errors.New("relay unavailable")
+	}}
+	d := NewDispatcher(&sentinel.MockOutboxService{}, sender, compose)
+	d.MaxAttempts = 2
+
+	m := &sentinel.OutboxMessage{ID: 1, Kind: sentinel.MailLoginLink, Recipient: "jane@example.com", Status: sentinel.OutboxPending}
+
+	before := time.Now().UTC()
+	if err := d.Deliver(m); err == nil {
+		t.Fatal("expected an error")
+	}
+	if m.Status != sentinel.OutboxPending {
+		t.Errorf("Result should have been %v, but it was %v", sentinel.OutboxPending, m.Status)
+	}
+	if m.NextAttemptAt.Before(before.Add(DefaultBackoff(1))) {
+		t.Errorf("next attempt at %v should be after the backoff of %v", m.NextAttemptAt, DefaultBackoff(1))
+	}
+
+	if err := d.Deliver(m); err == nil {
+		t.Fatal("expected an error")
+	}
+	if m.Status != sentinel.OutboxDead {
+		t.Errorf("Result should have been %v, but it was %v", sentinel.OutboxDead, m.Status)
+	}
+	if m.LastError != "relay unavailable" {
+		t.Errorf("Result should have been %v, but it was %v", "relay unavailable", m.LastError)
+	}
+}
+
+func TestDeliverDue(t *testing.T) {
+	var mu sync.Mutex
+	sent := map[string]bool{}
+	sender := &mail.MockSender{SendFn: func(m *mail.Message) error {
+		mu.Lock()
+		sent[m.To[0].Email] = true
+		mu.Unlock()
+		return nil
+	}}
+	store := &sentinel.MockOutboxService{}
+	store.DueFn = func(limit int, lease time.Duration) ([]*sentinel.OutboxMessage, error) {
+		return []*sentinel.OutboxMessage{
+			{ID: 1, Kind: sentinel.MailVerifyEmail, Recipient: "jane@example.com"},
+			{ID: 2, Kind: sentinel.MailVerifyEmail, Recipient: "jess@example.com"},
+			{ID: 3, Kind: sentinel.MailLoginLink, Recipient: "bob@example.com"},
+		}, nil
+	}
+
+	d := NewDispatcher(store, sender, compose)
+	d.Workers = 2
+	if err := d.DeliverDue(); err != nil {
+		t.Fatal(err)
+	}
+	if len(sent) != 3 {
+		t.Errorf("Result should have been %v, but it was %v", 3, len(sent))
+	}
+}
+
+func TestDefaultBackoff(t *testing.T) {
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{1, 30 * time.Second},
+		{2, time.Minute},
+		{3, 2 * time.Minute},
+		{20, 4 * time.Hour},
+	}
+	for _, tt := range tests {
+		if got := DefaultBackoff(tt.attempts); got != tt.want {
+			t.Errorf("Result should have been %v, but it was %v", tt.want, got)
+		}
+	}
+}
@@ -0,0 +1,215 @@
+// Copyright 2015 Lars Wiegman. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package apn
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+const deviceToken = "e2f28cb73f1f47dd171f6749857ded7c462af8d54193893e34ec0ed51dfcee25"
+
+func newKey(t *testing.T) *ecdsa.PrivateKey {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// newServer starts an HTTP/2 stand-in of the provider API and returns a
+// client which sends to it.
+func newServer(t *testing.T, key *ecdsa.PrivateKey, h http.HandlerFunc) (*Client, *httptest.Server) {
+	s := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor != 2 {
+			t.Errorf("Result should have been %v, but it was %v", "HTTP/2", r.Proto)
+		}
+		if err := verifyToken(strings.TrimPrefix(r.Header.Get("Authorization"), "bearer "), &key.PublicKey); err != nil {
+			t.Error(err)
+		}
+		h(w, r)
+	}))
+	s.EnableHTTP2 = true
+	s.StartTLS()
+
+	c := NewClient(NewTokenSource(key, "ABC123DEFG", "DEF123GHIJ"), "sh.sentinel.app")
+	c.Host = s.URL
+	c.HTTPClient = s.Client()
+	return c, s
+}
+
+// verifyToken verifies the ES256 signature of the provider token.
+func verifyToken(token string, pub *ecdsa.PublicKey) error {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return &Error{Reason: ReasonMissingProviderToken}
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || len(sig) != 64 {
+		return &Error{Reason: ReasonInvalidProviderToken}
+	}
+	sum := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	r, s := new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])
+	if !ecdsa.Verify(pub, sum[:], r, s) {
+		return &Error{Reason: ReasonInvalidProviderToken}
+	}
+	return nil
+}
+
+func TestPush(t *testing.T) {
+	key := newKey(t)
+	expiration := time.Unix(1500000000, 0)
+	c, s := newServer(t, key, func(w http.ResponseWriter, r *http.Request) {
+		headers := map[string]string{
+			"apns-topic":       "sh.sentinel.app",
+			"apns-id":          "eabeae54-14a8-11e5-b60b-1697f925ec7b",
+			"apns-priority":    "5",
+			"apns-expiration":  "1500000000",
+			"apns-collapse-id": "login",
+		}
+		for k, v := range headers {
+			if got := r.Header.Get(k); got != v {
+				t.Errorf("%s: Result should have been %v, but it was %v", k, v, got)
+			}
+		}
+		if r.URL.Path != "/3/device/"+deviceToken {
+			t.Errorf("Result should have been %v, but it was %v", "/3/device/"+deviceToken, r.URL.Path)
+		}
+
+		var payload struct {
+			APS   map[string]string `json:"aps"`
+			Email string            `json:"email"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			t.Error(err)
+			return
+		}
+		if payload.APS["alert"] != "Login request" || payload.Email != "jess@example.com" {
+			t.Errorf("Result should have been the payload, but it was %+v", payload)
+		}
+
+		w.Header().Set("apns-id", r.Header.Get("apns-id"))
+	})
+	defer s.Close()
+
+	resp, err := c.Push(&Notification{
+		DeviceToken: deviceToken,
+		ID:          "eabeae54-14a8-11e5-b60b-1697f925ec7b",
+		Priority:    PriorityConserve,
+		Expiration:  expiration,
+		CollapseID:  "login",
+		Alert:       "Login request",
+		Payload:     map[string]interface{}{"email": "jess@example.com"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.ID != "eabeae54-14a8-11e5-b60b-1697f925ec7b" {
+		t.Errorf("Result should have been %v, but it was %v", "eabeae54-14a8-11e5-b60b-1697f925ec7b", resp.ID)
+	}
+}
+
+func TestPushError(t *testing.T) {
+	key := newKey(t)
+	tests := []struct {
+		status       int
+		body         string
+		reason       Reason
+		unregistered bool
+		temporary    bool
+	}{
+		{410, `{"reason":"Unregistered","timestamp":1500000000000}`, ReasonUnregistered, true, false},
+		{400, `{"reason":"BadDeviceToken"}`, ReasonBadDeviceToken, true, false},
+		{429, `{"reason":"TooManyRequests"}`, ReasonTooManyRequests, false, true},
+		{503, `not json`, "", false, true},
+	}
+	for _, tt := range tests {
+		c, s := newServer(t, key, func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(tt.status)
+			w.Write([]byte(tt.body))
+		})
+
+		_, err := c.Push(&Notification{DeviceToken: deviceToken, Alert: "Hello"})
+		s.Close()
+		e, ok := err.(*Error)
+		if !ok {
+			t.Fatalf("Result should have been an *Error, but it was %v", err)
+		}
+		if e.StatusCode != tt.status || e.Reason != tt.reason {
+			t.Errorf("Result should have been %v %v, but it was %v %v", tt.status, tt.reason, e.StatusCode, e.Reason)
+		}
+		if e.Unregistered() != tt.unregistered || e.Temporary() != tt.temporary {
+			t.Errorf("%v: Result should have been %v/%v, but it was %v/%v", tt.reason, tt.unregistered, tt.temporary, e.Unregistered(), e.Temporary())
+		}
+		if tt.reason == ReasonUnregistered && !e.Timestamp.Equal(time.Unix(1500000000, 0)) {
+			t.Errorf("Result should have been %v, but it was %v", time.Unix(1500000000, 0), e.Timestamp)
+		}
+	}
+}
+
+func TestTokenSource(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+	ts := NewTokenSource(newKey(t), "ABC123DEFG", "DEF123GHIJ")
+	ts.now = func() time.Time { return now }
+
+	first, err := ts.Token()
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims, _ := base64.RawURLEncoding.DecodeString(strings.Split(first, ".")[1])
+	if string(claims) != `{"iat":1500000000,"iss":"DEF123GHIJ"}` {
+		t.Errorf("Result should have been the claims, but it was %s", claims)
+	}
+
+	// The token is reused until it's refreshed
+	now = now.Add(TokenRefreshInterval - time.Second)
+	if token, _ := ts.Token(); token != first {
+		t.Error("Result should have been the same token, but it was refreshed")
+	}
+	now = now.Add(time.Second)
+	if token, _ := ts.Token(); token == first {
+		t.Error("Result should have been a new token, but it was the same")
+	}
+}
+
+func TestParseKey(t *testing.T) {
+	key := newKey(t)
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := ioutil.TempFile("", "AuthKey_ABC123DEFG.p8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	pem.Encode(f, &pem.Block{Type: "PRIVATE KEY", Bytes: der})
+
+	parsed, err := LoadKey(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed.D.Cmp(key.D) != 0 {
+		t.Error("Result should have been the key, but it wasn't")
+	}
+	if _, err := ParseKey([]byte("not a key")); err == nil {
+		t.Error("Result should have been an error, but it was nil")
+	}
+}
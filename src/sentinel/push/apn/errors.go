@@ -0,0 +1,103 @@
+// Copyright 2015 Lars Wiegman. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package apn
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"time"
+)
+
+// Reason is the reason Apple gives for rejecting a notification.
+type Reason string
+
+// Reasons of the provider API.
+const (
+	ReasonBadCollapseID               Reason = "BadCollapseId"
+	ReasonBadDeviceToken              Reason = "BadDeviceToken"
+	ReasonBadExpirationDate           Reason = "BadExpirationDate"
+	ReasonBadMessageID                Reason = "BadMessageId"
+	ReasonBadPriority                 Reason = "BadPriority"
+	ReasonBadTopic                    Reason = "BadTopic"
+	ReasonDeviceTokenNotForTopic      Reason = "DeviceTokenNotForTopic"
+	ReasonDuplicateHeaders            Reason = "DuplicateHeaders"
+	ReasonIdleTimeout                 Reason = "IdleTimeout"
+	ReasonMissingDeviceToken          Reason = "MissingDeviceToken"
+	ReasonMissingTopic                Reason = "MissingTopic"
+	ReasonPayloadEmpty                Reason = "PayloadEmpty"
+	ReasonTopicDisallowed             Reason = "TopicDisallowed"
+	ReasonBadCertificate              Reason = "BadCertificate"
+	ReasonBadCertificateEnvironment   Reason = "BadCertificateEnvironment"
+	ReasonExpiredProviderToken        Reason = "ExpiredProviderToken"
+	ReasonForbidden                   Reason = "Forbidden"
+	ReasonInvalidProviderToken        Reason = "InvalidProviderToken"
+	ReasonMissingProviderToken        Reason = "MissingProviderToken"
+	ReasonBadPath                     Reason = "BadPath"
+	ReasonMethodNotAllowed            Reason = "MethodNotAllowed"
+	ReasonUnregistered                Reason = "Unregistered"
+	ReasonPayloadTooLarge             Reason = "PayloadTooLarge"
+	ReasonTooManyProviderTokenUpdates Reason = "TooManyProviderTokenUpdates"
+	ReasonTooManyRequests             Reason = "TooManyRequests"
+	ReasonInternalServerError         Reason = "InternalServerError"
+	ReasonServiceUnavailable          Reason = "ServiceUnavailable"
+	ReasonShutdown                    Reason = "Shutdown"
+)
+
+// Error is a notification rejected by Apple.
+type Error struct {
+	StatusCode int
+	Reason     Reason
+
+	// ID is the apns-id of the notification.
+	ID string
+
+	// Timestamp is the last time the device token was valid, set when the
+	// reason is ReasonUnregistered.
+	Timestamp time.Time
+}
+
+func (e *Error) Error() string {
+	if e.Reason == "" {
+		return "apn: notification rejected with status " + http.StatusText(e.StatusCode)
+	}
+	return "apn: notification rejected: " + string(e.Reason)
+}
+
+// Unregistered reports whether the device token can't be used anymore, the
+// app was removed or the token isn't a token of the app.
+func (e *Error) Unregistered() bool {
+	switch e.Reason {
+	case ReasonUnregistered, ReasonBadDeviceToken, ReasonDeviceTokenNotForTopic:
+		return true
+	}
+	return false
+}
+
+// Temporary reports whether the notification can be sent again later.
+func (e *Error) Temporary() bool {
+	switch e.Reason {
+	case ReasonTooManyRequests, ReasonIdleTimeout, ReasonExpiredProviderToken,
+		ReasonInternalServerError, ReasonServiceUnavailable, ReasonShutdown:
+		return true
+	}
+	return e.StatusCode == http.StatusTooManyRequests || e.StatusCode >= 500
+}
+
+// parseError reads the JSON reason of the response, the error only has a
+// status code when the body isn't understood.
+func parseError(resp *http.Response) *Error {
+	var data struct {
+		Reason    Reason `json:"reason"`
+		Timestamp int64  `json:"timestamp"` // milliseconds since the epoch
+	}
+	json.NewDecoder(io.LimitReader(resp.Body, 1<<16)).Decode(&data)
+
+	e := &Error{StatusCode: resp.StatusCode, Reason: data.Reason}
+	if data.Timestamp != 0 {
+		e.Timestamp = time.Unix(0, data.Timestamp*int64(time.Millisecond))
+	}
+	return e
+}
@@ -0,0 +1,128 @@
+// Copyright 2015 Lars Wiegman. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package apn
+
+import (
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"sync"
+	"time"
+)
+
+// TokenRefreshInterval is the age at which a provider token is replaced.
+// Apple rejects tokens older than an hour and refreshing more often than
+// every 20 minutes.
+const TokenRefreshInterval = 50 * time.Minute
+
+// minTokenAge is the minimum age of a token which is replaced after Apple
+// reported it expired.
+const minTokenAge = 20 * time.Minute
+
+// TokenSource signs the provider tokens with the signing key of the team and
+// caches them until they need to be refreshed.
+type TokenSource struct {
+	key    *ecdsa.PrivateKey
+	keyID  string
+	teamID string
+
+	mu       sync.Mutex
+	token    string
+	issuedAt time.Time
+	now      func() time.Time
+}
+
+// NewTokenSource returns a token source for the key with the given key ID
+// of the team.
+func NewTokenSource(key *ecdsa.PrivateKey, keyID, teamID string) *TokenSource {
+	return &TokenSource{key: key, keyID: keyID, teamID: teamID, now: time.Now}
+}
+
+// LoadKey reads the PKCS #8 encoded signing key of a .p8 file.
+func LoadKey(path string) (*ecdsa.PrivateKey, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseKey(b)
+}
+
+// ParseKey parses the PEM encoded PKCS #8 signing key of a .p8 file.
+func ParseKey(b []byte) (*ecdsa.PrivateKey, error) {
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, errors.New("apn: no PEM encoded key found")
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	ecKey, ok := key.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("apn: signing key isn't an ECDSA key")
+	}
+	return ecKey, nil
+}
+
+// Token returns the current provider token, a new token is signed when it's
+// older than the TokenRefreshInterval.
+func (s *TokenSource) Token() (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	if s.token != "" && now.Sub(s.issuedAt) < TokenRefreshInterval {
+		return s.token, nil
+	}
+	token, err := s.sign(now)
+	if err != nil {
+		return "", err
+	}
+	s.token, s.issuedAt = token, now
+	return token, nil
+}
+
+// expire drops the current token after Apple reported it expired, unless
+// it's too recent to be replaced.
+func (s *TokenSource) expire() {
+	s.mu.Lock()
+	if s.now().Sub(s.issuedAt) >= minTokenAge {
+		s.token = ""
+	}
+	s.mu.Unlock()
+}
+
+// sign returns a JWT signed with ES256, with the key ID in the header and
+// the team ID as issuer.
+func (s *TokenSource) sign(now time.Time) (string, error) {
+	header, err := json.Marshal(map[string]string{"alg": "ES256", "kid": s.keyID})
+	if err != nil {
+		return "", err
+	}
+	claims, err := json.Marshal(map[string]interface{}{"iss": s.teamID, "iat": now.Unix()})
+	if err != nil {
+		return "", err
+	}
+	enc := base64.RawURLEncoding
+	input := enc.EncodeToString(header) + "." + enc.EncodeToString(claims)
+
+	sum := sha256.Sum256([]byte(input))
+	r, ss, err := ecdsa.Sign(rand.Reader, s.key, sum[:])
+	if err != nil {
+		return "", err
+	}
+	// The signature is R and S as 32 byte big-endian integers
+	sig := make([]byte, 64)
+	rb, sb := r.Bytes(), ss.Bytes()
+	copy(sig[32-len(rb):32], rb)
+	copy(sig[64-len(sb):], sb)
+	return input + "." + enc.EncodeToString(sig), nil
+}
@@ -0,0 +1,38 @@
+// Copyright 2015 Lars Wiegman. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package push
+
+import (
+	"time"
+
+	"sentinel/push/apn"
+)
+
+// APNs sends messages to Apple devices.
+type APNs struct {
+	Client *apn.Client
+}
+
+var _ Notifier = &APNs{}
+
+// Notify renders the message as an alert with the payload next to the aps
+// dictionary.
+func (n *APNs) Notify(t Target, m *Message) error {
+	payload := map[string]interface{}{}
+	for k, s := range m.Payload() {
+		payload[k] = s
+	}
+	notification := &apn.Notification{
+		DeviceToken: t.Token,
+		CollapseID:  m.CollapseKey,
+		Alert:       m.Alert,
+		Payload:     payload,
+	}
+	if m.TTL > 0 {
+		notification.Expiration = time.Now().Add(m.TTL)
+	}
+	_, err := n.Client.Push(notification)
+	return err
+}
@@ -0,0 +1,28 @@
+// Copyright 2015 Lars Wiegman. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package push
+
+import "sentinel/push/fcm"
+
+// FCM sends messages to Android devices.
+type FCM struct {
+	Client *fcm.Client
+}
+
+var _ Notifier = &FCM{}
+
+// Notify renders the message as a notification with the payload as data.
+// Login requests are sent with high priority to wake the device.
+func (n *FCM) Notify(t Target, m *Message) error {
+	_, err := n.Client.Send(&fcm.Message{
+		Token:        t.Token,
+		Body:         m.Alert,
+		Data:         m.Payload(),
+		CollapseKey:  m.CollapseKey,
+		TTL:          m.TTL,
+		HighPriority: m.Kind == KindLoginRequest,
+	})
+	return err
+}
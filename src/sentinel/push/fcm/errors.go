@@ -0,0 +1,87 @@
+// Copyright 2015 Lars Wiegman. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fcm
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// ErrorCode is the reason FCM gives for rejecting a message.
+type ErrorCode string
+
+// Error codes of the HTTP v1 API.
+const (
+	CodeUnspecified       ErrorCode = "UNSPECIFIED_ERROR"
+	CodeInvalidArgument   ErrorCode = "INVALID_ARGUMENT"
+	CodeUnregistered      ErrorCode = "UNREGISTERED"
+	CodeSenderIDMismatch  ErrorCode = "SENDER_ID_MISMATCH"
+	CodeQuotaExceeded     ErrorCode = "QUOTA_EXCEEDED"
+	CodeUnavailable       ErrorCode = "UNAVAILABLE"
+	CodeInternal          ErrorCode = "INTERNAL"
+	CodeThirdPartyAuthErr ErrorCode = "THIRD_PARTY_AUTH_ERROR"
+)
+
+// Error is a message rejected by FCM.
+type Error struct {
+	StatusCode int
+	Code       ErrorCode
+	Message    string
+}
+
+func (e *Error) Error() string {
+	if e.Code == "" {
+		return "fcm: message rejected with status " + http.StatusText(e.StatusCode)
+	}
+	return "fcm: message rejected: " + string(e.Code) + " " + e.Message
+}
+
+// Unregistered reports whether the registration token can't be used
+// anymore, the app was removed or the token belongs to another sender.
+func (e *Error) Unregistered() bool {
+	switch e.Code {
+	case CodeUnregistered, CodeSenderIDMismatch:
+		return true
+	}
+	return false
+}
+
+// Temporary reports whether the message can be sent again later.
+func (e *Error) Temporary() bool {
+	switch e.Code {
+	case CodeQuotaExceeded, CodeUnavailable, CodeInternal:
+		return true
+	}
+	return e.StatusCode == http.StatusTooManyRequests || e.StatusCode >= 500
+}
+
+// parseError reads the error code from the details of the response, the
+// error only has a status code when the body isn't understood.
+func parseError(resp *http.Response) *Error {
+	var data struct {
+		Error struct {
+			Message string `json:"message"`
+			Status  string `json:"status"`
+			Details []struct {
+				Type      string    `json:"@type"`
+				ErrorCode ErrorCode `json:"errorCode"`
+			} `json:"details"`
+		} `json:"error"`
+	}
+	json.NewDecoder(io.LimitReader(resp.Body, 1<<16)).Decode(&data)
+
+	e := &Error{StatusCode: resp.StatusCode, Message: data.Error.Message}
+	for _, d := range data.Error.Details {
+		if strings.HasSuffix(d.Type, "google.firebase.fcm.v1.FcmError") {
+			e.Code = d.ErrorCode
+		}
+	}
+	if e.Code == "" && data.Error.Status != "" {
+		e.Code = ErrorCode(data.Error.Status)
+	}
+	return e
+}
@@ -0,0 +1,158 @@
+// Copyright 2015 Lars Wiegman. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package fcm sends push notifications to Android devices using the HTTP v1
+// API of Firebase Cloud Messaging. Requests are authenticated with OAuth 2.0
+// access tokens of a service account.
+package fcm
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Host of the HTTP v1 API.
+const Host = "https://fcm.googleapis.com"
+
+// maxPayload is the maximum size of the data of a message.
+const maxPayload = 4096
+
+// Message is a message to a single device.
+type Message struct {
+	// Token is the registration token of the device.
+	Token string
+
+	// Title and Body of the notification shown to the user, no notification
+	// is shown when both are empty.
+	Title, Body string
+
+	// Data is delivered to the app.
+	Data map[string]string
+
+	// CollapseKey replaces an earlier message with the same key which wasn't
+	// delivered yet.
+	CollapseKey string
+
+	// TTL is the duration in which FCM tries to deliver the message, FCM
+	// uses its default of four weeks when zero.
+	TTL time.Duration
+
+	// HighPriority wakes a sleeping device to deliver the message.
+	HighPriority bool
+}
+
+// body returns the JSON request body of the message.
+func (m *Message) body() ([]byte, error) {
+	type notification struct {
+		Title string `json:"title,omitempty"`
+		Body  string `json:"body,omitempty"`
+	}
+	type android struct {
+		CollapseKey string `json:"collapse_key,omitempty"`
+		Priority    string `json:"priority,omitempty"`
+		TTL         string `json:"ttl,omitempty"`
+	}
+	type message struct {
+		Token        string            `json:"token"`
+		Notification *notification     `json:"notification,omitempty"`
+		Data         map[string]string `json:"data,omitempty"`
+		Android      *android          `json:"android,omitempty"`
+	}
+
+	v := message{Token: m.Token, Data: m.Data, Android: &android{CollapseKey: m.CollapseKey, Priority: "normal"}}
+	if m.Title != "" || m.Body != "" {
+		v.Notification = &notification{Title: m.Title, Body: m.Body}
+	}
+	if m.HighPriority {
+		v.Android.Priority = "high"
+	}
+	if m.TTL > 0 {
+		v.Android.TTL = strconv.FormatInt(int64(m.TTL/time.Second), 10) + "s"
+	}
+
+	data, err := json.Marshal(m.Data)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxPayload {
+		return nil, fmt.Errorf("fcm: data of %d bytes exceeds the maximum of %d", len(data), maxPayload)
+	}
+	return json.Marshal(map[string]interface{}{"message": v})
+}
+
+// Client sends messages to the HTTP v1 API, a Client is safe for concurrent
+// use.
+type Client struct {
+	// Host is the URL of the API.
+	Host string
+
+	// ProjectID is the ID of the Firebase project.
+	ProjectID string
+
+	HTTPClient *http.Client
+
+	tokens *TokenSource
+}
+
+// NewClient returns a client for the project which authenticates with the
+// access tokens of the source.
+func NewClient(tokens *TokenSource, projectID string) *Client {
+	return &Client{
+		Host:       Host,
+		ProjectID:  projectID,
+		HTTPClient: &http.Client{Timeout: 30 * time.Second},
+		tokens:     tokens,
+	}
+}
+
+// Send sends the message and returns the name FCM assigned to it. An *Error
+// is returned when FCM rejects the message.
+func (c *Client) Send(m *Message) (string, error) {
+	if m.Token == "" {
+		return "", errors.New("fcm: message has no registration token")
+	}
+	body, err := m.body()
+	if err != nil {
+		return "", err
+	}
+	token, err := c.tokens.Token()
+	if err != nil {
+		return "", err
+	}
+
+	req, err := http.NewRequest("POST", c.Host+"/v1/projects/"+c.ProjectID+"/messages:send", bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusOK {
+		var data struct {
+			Name string `json:"name"`
+		}
+		err := json.NewDecoder(resp.Body).Decode(&data)
+		io.Copy(ioutil.Discard, resp.Body)
+		return data.Name, err
+	}
+
+	e := parseError(resp)
+	if resp.StatusCode == http.StatusUnauthorized {
+		c.tokens.expire()
+	}
+	return "", e
+}
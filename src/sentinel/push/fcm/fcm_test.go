@@ -0,0 +1,180 @@
+// Copyright 2015 Lars Wiegman. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fcm
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+const registrationToken = "bk3RNwTe3H0:CI2k_HHwgIpoDKCIZvvDMExUdFQ3P1"
+
+// newServer starts a stand-in of the token endpoint and the HTTP v1 API and
+// returns a client which sends to it. The handler receives the messages.
+func newServer(t *testing.T, h http.HandlerFunc) (*Client, *httptest.Server, *int) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exchanges := 0
+	mux := http.NewServeMux()
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		if r.PostFormValue("grant_type") != "urn:ietf:params:oauth:grant-type:jwt-bearer" {
+			t.Errorf("Result should have been the jwt-bearer grant, but it was %v", r.PostFormValue("grant_type"))
+		}
+		if err := verifyAssertion(r.PostFormValue("assertion"), &key.PublicKey); err != nil {
+			t.Error(err)
+		}
+		exchanges++
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"access_token":"ya29.token","expires_in":3600,"token_type":"Bearer"}`))
+	})
+	mux.HandleFunc("/v1/projects/sentinel-app/messages:send", func(w http.ResponseWriter, r *http.Request) {
+		if auth := r.Header.Get("Authorization"); auth != "Bearer ya29.token" {
+			t.Errorf("Result should have been %v, but it was %v", "Bearer ya29.token", auth)
+		}
+		h(w, r)
+	})
+	s := httptest.NewServer(mux)
+
+	tokens, err := NewTokenSource(&Credentials{
+		ProjectID:    "sentinel-app",
+		PrivateKeyID: "8f2e",
+		PrivateKey:   string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})),
+		ClientEmail:  "push@sentinel-app.iam.gserviceaccount.com",
+		TokenURI:     s.URL + "/token",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := NewClient(tokens, "sentinel-app")
+	c.Host = s.URL
+	return c, s, &exchanges
+}
+
+// verifyAssertion verifies the RS256 signature and the scope of the
+// assertion.
+func verifyAssertion(assertion string, pub *rsa.PublicKey) error {
+	parts := strings.Split(assertion, ".")
+	if len(parts) != 3 {
+		return &Error{Message: "malformed assertion"}
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(pub, crypto.SHA256, sum[:], sig); err != nil {
+		return err
+	}
+	b, _ := base64.RawURLEncoding.DecodeString(parts[1])
+	var claims map[string]interface{}
+	json.Unmarshal(b, &claims)
+	if claims["scope"] != Scope {
+		return &Error{Message: "wrong scope"}
+	}
+	return nil
+}
+
+func TestSend(t *testing.T) {
+	c, s, exchanges := newServer(t, func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]interface{}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Error(err)
+			return
+		}
+		expect := map[string]interface{}{
+			"message": map[string]interface{}{
+				"token":        registrationToken,
+				"notification": map[string]interface{}{"body": "Login request"},
+				"data":         map[string]interface{}{"sessionID": "a5828e8b"},
+				"android": map[string]interface{}{
+					"collapse_key": "a5828e8b",
+					"priority":     "high",
+					"ttl":          "300s",
+				},
+			},
+		}
+		if !reflect.DeepEqual(expect, body) {
+			t.Errorf("Result should have been %v, but it was %v", expect, body)
+		}
+		w.Write([]byte(`{"name":"projects/sentinel-app/messages/0:1500415314455276"}`))
+	})
+	defer s.Close()
+
+	m := &Message{
+		Token:        registrationToken,
+		Body:         "Login request",
+		Data:         map[string]string{"sessionID": "a5828e8b"},
+		CollapseKey:  "a5828e8b",
+		TTL:          5 * time.Minute,
+		HighPriority: true,
+	}
+	for i := 0; i < 2; i++ {
+		name, err := c.Send(m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if name != "projects/sentinel-app/messages/0:1500415314455276" {
+			t.Errorf("Result should have been the message name, but it was %v", name)
+		}
+	}
+
+	// The access token is reused
+	if *exchanges != 1 {
+		t.Errorf("Result should have been %v, but it was %v", 1, *exchanges)
+	}
+}
+
+func TestSendError(t *testing.T) {
+	tests := []struct {
+		status       int
+		body         string
+		code         ErrorCode
+		unregistered bool
+		temporary    bool
+	}{
+		{404, `{"error":{"code":404,"message":"Requested entity was not found.","status":"NOT_FOUND","details":[{"@type":"type.googleapis.com/google.firebase.fcm.v1.FcmError","errorCode":"UNREGISTERED"}]}}`, CodeUnregistered, true, false},
+		{400, `{"error":{"code":400,"status":"INVALID_ARGUMENT"}}`, CodeInvalidArgument, false, false},
+		{429, `{"error":{"code":429,"status":"RESOURCE_EXHAUSTED","details":[{"@type":"type.googleapis.com/google.firebase.fcm.v1.FcmError","errorCode":"QUOTA_EXCEEDED"}]}}`, CodeQuotaExceeded, false, true},
+		{503, `not json`, "", false, true},
+	}
+	for _, tt := range tests {
+		c, s, _ := newServer(t, func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(tt.status)
+			w.Write([]byte(tt.body))
+		})
+
+		_, err := c.Send(&Message{Token: registrationToken, Body: "Hello"})
+		s.Close()
+		e, ok := err.(*Error)
+		if !ok {
+			t.Fatalf("Result should have been an *Error, but it was %v", err)
+		}
+		if e.StatusCode != tt.status || e.Code != tt.code {
+			t.Errorf("Result should have been %v %v, but it was %v %v", tt.status, tt.code, e.StatusCode, e.Code)
+		}
+		if e.Unregistered() != tt.unregistered || e.Temporary() != tt.temporary {
+			t.Errorf("%v: Result should have been %v/%v, but it was %v/%v", tt.code, tt.unregistered, tt.temporary, e.Unregistered(), e.Temporary())
+		}
+	}
+}
@@ -0,0 +1,167 @@
+// Copyright 2015 Lars Wiegman. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fcm
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// Scope is the OAuth 2.0 scope of the access tokens.
+const Scope = "https://www.googleapis.com/auth/firebase.messaging"
+
+// tokenExpiryDelta is the time before expiry at which an access token is
+// replaced.
+const tokenExpiryDelta = 5 * time.Minute
+
+// Credentials are the fields of the JSON key file of a service account.
+type Credentials struct {
+	ProjectID    string `json:"project_id"`
+	PrivateKeyID string `json:"private_key_id"`
+	PrivateKey   string `json:"private_key"`
+	ClientEmail  string `json:"client_email"`
+	TokenURI     string `json:"token_uri"`
+}
+
+// LoadCredentials reads the JSON key file of a service account.
+func LoadCredentials(path string) (*Credentials, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	c := &Credentials{}
+	if err := json.Unmarshal(b, c); err != nil {
+		return nil, err
+	}
+	if c.ProjectID == "" || c.ClientEmail == "" || c.TokenURI == "" {
+		return nil, errors.New("fcm: credentials miss project_id, client_email or token_uri")
+	}
+	return c, nil
+}
+
+// TokenSource exchanges assertions signed with the key of the service
+// account for access tokens and caches them until they expire.
+type TokenSource struct {
+	creds      *Credentials
+	key        *rsa.PrivateKey
+	HTTPClient *http.Client
+
+	mu        sync.Mutex
+	token     string
+	expiresAt time.Time
+	now       func() time.Time
+}
+
+// NewTokenSource returns a token source for the service account.
+func NewTokenSource(creds *Credentials) (*TokenSource, error) {
+	block, _ := pem.Decode([]byte(creds.PrivateKey))
+	if block == nil {
+		return nil, errors.New("fcm: no PEM encoded private key found")
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("fcm: private key isn't an RSA key")
+	}
+	return &TokenSource{
+		creds:      creds,
+		key:        rsaKey,
+		HTTPClient: &http.Client{Timeout: 30 * time.Second},
+		now:        time.Now,
+	}, nil
+}
+
+// Token returns the current access token, a new token is requested when it
+// expires within the tokenExpiryDelta.
+func (s *TokenSource) Token() (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	if s.token != "" && now.Add(tokenExpiryDelta).Before(s.expiresAt) {
+		return s.token, nil
+	}
+	assertion, err := s.sign(now)
+	if err != nil {
+		return "", err
+	}
+
+	form := url.Values{
+		"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+		"assertion":  {assertion},
+	}
+	resp, err := s.HTTPClient.PostForm(s.creds.TokenURI, form)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("fcm: token request failed with status %s", resp.Status)
+	}
+	var data struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&data); err != nil {
+		return "", err
+	}
+	if data.AccessToken == "" {
+		return "", errors.New("fcm: token response has no access token")
+	}
+	s.token = data.AccessToken
+	s.expiresAt = now.Add(time.Duration(data.ExpiresIn) * time.Second)
+	return s.token, nil
+}
+
+// expire drops the current token after it was rejected.
+func (s *TokenSource) expire() {
+	s.mu.Lock()
+	s.token = ""
+	s.mu.Unlock()
+}
+
+// sign returns a JWT signed with RS256 which asserts the identity of the
+// service account for an hour.
+func (s *TokenSource) sign(now time.Time) (string, error) {
+	header, err := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT", "kid": s.creds.PrivateKeyID})
+	if err != nil {
+		return "", err
+	}
+	claims, err := json.Marshal(map[string]interface{}{
+		"iss":   s.creds.ClientEmail,
+		"scope": Scope,
+		"aud":   s.creds.TokenURI,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+	enc := base64.RawURLEncoding
+	input := enc.EncodeToString(header) + "." + enc.EncodeToString(claims)
+
+	sum := sha256.Sum256([]byte(input))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, s.key, crypto.SHA256, sum[:])
+	if err != nil {
+		return "", err
+	}
+	return input + "." + enc.EncodeToString(sig), nil
+}
@@ -0,0 +1,59 @@
+// Copyright 2015 Lars Wiegman. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package push
+
+import "sync"
+
+// Sent is a message sent by the MemoryNotifier.
+type Sent struct {
+	Target  Target
+	Message *Message
+}
+
+// MemoryNotifier keeps the messages instead of sending them, it's used in
+// tests and during development.
+type MemoryNotifier struct {
+	// Err is returned by Notify when set, the message isn't kept.
+	Err error
+
+	mu   sync.Mutex
+	sent []Sent
+	c    chan Sent
+}
+
+var _ Notifier = &MemoryNotifier{}
+
+// NewMemoryNotifier returns a notifier which keeps the messages.
+func NewMemoryNotifier() *MemoryNotifier {
+	return &MemoryNotifier{c: make(chan Sent, 16)}
+}
+
+func (n *MemoryNotifier) Notify(t Target, m *Message) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.Err != nil {
+		return n.Err
+	}
+	s := Sent{Target: t, Message: m}
+	n.sent = append(n.sent, s)
+	select {
+	case n.c <- s:
+	default:
+	}
+	return nil
+}
+
+// Sent returns the messages in the order they were sent.
+func (n *MemoryNotifier) Sent() []Sent {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return append([]Sent(nil), n.sent...)
+}
+
+// C receives the messages as they're sent, messages are dropped when nobody
+// receives them.
+func (n *MemoryNotifier) C() <-chan Sent {
+	return n.c
+}
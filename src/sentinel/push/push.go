@@ -0,0 +1,121 @@
+// Copyright 2015 Lars Wiegman. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package push sends notifications to the devices of users. A Message is
+// independent of the push service, each Notifier renders it in the format of
+// the service of its platform.
+package push
+
+import (
+	"errors"
+	"time"
+)
+
+// Platform is the operating system of a device, it determines the push
+// service which delivers the notifications.
+type Platform string
+
+const (
+	PlatformIOS     Platform = "ios"     // Apple Push Notification service
+	PlatformAndroid Platform = "android" // Firebase Cloud Messaging
+)
+
+// Valid reports whether the platform is supported.
+func (p Platform) Valid() bool {
+	switch p {
+	case PlatformIOS, PlatformAndroid:
+		return true
+	}
+	return false
+}
+
+var (
+	ErrUnsupportedPlatform = errors.New("push: unsupported platform")
+	ErrNoDeviceToken       = errors.New("push: device has no push token")
+)
+
+// Kinds of messages.
+const (
+	KindLoginRequest = "login_request" // the user approves or declines a login
+	KindLoginNotice  = "login_notice"  // the user is informed about a login
+)
+
+// Message is a notification to a device.
+type Message struct {
+	// Kind tells the app how to handle the data.
+	Kind string
+
+	// Alert is the text shown to the user.
+	Alert string
+
+	// Data is the structured payload for the app, it's delivered along with
+	// the kind.
+	Data map[string]string
+
+	// CollapseKey replaces an earlier message with the same key which wasn't
+	// delivered or is still displayed.
+	CollapseKey string
+
+	// TTL is the duration in which the push service tries to deliver the
+	// message, it's delivered at most once when zero.
+	TTL time.Duration
+}
+
+// Payload returns the data of the message including its kind.
+func (m *Message) Payload() map[string]string {
+	v := make(map[string]string, len(m.Data)+1)
+	for k, s := range m.Data {
+		v[k] = s
+	}
+	v["kind"] = m.Kind
+	return v
+}
+
+// Target is the device a message is sent to.
+type Target struct {
+	Platform Platform
+	Token    string // push token issued by the push service of the platform
+}
+
+// Notifier sends messages to devices.
+type Notifier interface {
+	Notify(t Target, m *Message) error
+}
+
+// Router sends a message using the notifier of the platform of the target.
+type Router map[Platform]Notifier
+
+var _ Notifier = Router{}
+
+// Notify sends the message, ErrUnsupportedPlatform is returned when there's
+// no notifier for the platform.
+func (r Router) Notify(t Target, m *Message) error {
+	if t.Token == "" {
+		return ErrNoDeviceToken
+	}
+	n, ok := r[t.Platform]
+	if !ok {
+		return ErrUnsupportedPlatform
+	}
+	return n.Notify(t, m)
+}
+
+// Unregistered reports whether the push service rejected the push token for
+// good, e.g. because the app was uninstalled. The device shouldn't be
+// notified again until its app registers a new token.
+func Unregistered(err error) bool {
+	e, ok := err.(interface {
+		Unregistered() bool
+	})
+	return ok && e.Unregistered()
+}
+
+// Temporary reports whether sending the message failed temporarily and can
+// be tried again later.
+func Temporary(err error) bool {
+	e, ok := err.(interface {
+		Temporary() bool
+	})
+	return ok && e.Temporary()
+}
@@ -0,0 +1,64 @@
+// Copyright 2015 Lars Wiegman. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package push
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestRouter(t *testing.T) {
+	ios, android := NewMemoryNotifier(), NewMemoryNotifier()
+	r := Router{PlatformIOS: ios, PlatformAndroid: android}
+	m := &Message{Kind: KindLoginRequest, Alert: "Login request", Data: map[string]string{"sessionID": "a5828e8b"}}
+
+	tests := []struct {
+		target Target
+		err    error
+	}{
+		{Target{PlatformIOS, "e2f28cb7"}, nil},
+		{Target{PlatformAndroid, "bk3RNwTe"}, nil},
+		{Target{"windows", "f81d4fae"}, ErrUnsupportedPlatform},
+		{Target{PlatformIOS, ""}, ErrNoDeviceToken},
+	}
+	for _, tt := range tests {
+		if err := r.Notify(tt.target, m); err != tt.err {
+			t.Errorf("%v: Result should have been %v, but it was %v", tt.target, tt.err, err)
+		}
+	}
+
+	for _, n := range []*MemoryNotifier{ios, android} {
+		sent := n.Sent()
+		if len(sent) != 1 || sent[0].Message != m {
+			t.Errorf("Result should have been the message, but it was %v", sent)
+		}
+	}
+	if s := <-android.C(); s.Target.Token != "bk3RNwTe" {
+		t.Errorf("Result should have been %v, but it was %v", "bk3RNwTe", s.Target.Token)
+	}
+}
+
+func TestMemoryNotifierErr(t *testing.T) {
+	n := NewMemoryNotifier()
+	n.Err = errors.New("unavailable")
+	if err := n.Notify(Target{PlatformIOS, "e2f28cb7"}, &Message{}); err != n.Err {
+		t.Errorf("Result should have been %v, but it was %v", n.Err, err)
+	}
+	if len(n.Sent()) != 0 {
+		t.Errorf("Result should have been no messages, but it was %v", n.Sent())
+	}
+}
+
+func TestPayload(t *testing.T) {
+	m := &Message{Kind: KindLoginNotice, Data: map[string]string{"sessionID": "a5828e8b"}}
+	expect := map[string]string{"kind": KindLoginNotice, "sessionID": "a5828e8b"}
+	if v := m.Payload(); !reflect.DeepEqual(expect, v) {
+		t.Errorf("Result should have been %v, but it was %v", expect, v)
+	}
+	if len(m.Data) != 1 {
+		t.Error("Result should have been the data unchanged, but it was modified")
+	}
+}
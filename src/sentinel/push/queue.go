@@ -0,0 +1,90 @@
+// Copyright 2015 Lars Wiegman. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package push
+
+import (
+	"sync"
+	"time"
+)
+
+// DefaultMaxAttempts is the number of times a message is sent before the
+// queue gives up.
+const DefaultMaxAttempts = 5
+
+// DefaultBackoff returns the delay before the next attempt after the given
+// number of failed attempts; 2s, 4s, 8s, etc. up to 1m.
+func DefaultBackoff(attempts int) time.Duration {
+	d := 2 * time.Second
+	for i := 1; i < attempts && d < time.Minute; i++ {
+		d *= 2
+	}
+	if d > time.Minute {
+		d = time.Minute
+	}
+	return d
+}
+
+// Result is the outcome of sending a message to a target, Err is nil when
+// the push service accepted the message.
+type Result struct {
+	Target   Target
+	Message  *Message
+	Attempts int
+	Err      error
+}
+
+// Queue sends messages in the background. A message which failed
+// temporarily is sent again with an increasing delay, until it was sent
+// MaxAttempts times or its TTL has passed.
+type Queue struct {
+	MaxAttempts int                              // DefaultMaxAttempts when zero
+	Backoff     func(attempts int) time.Duration // DefaultBackoff when nil
+
+	wg sync.WaitGroup
+}
+
+// Send sends the message to the target using n, done is called with the
+// final result.
+func (q *Queue) Send(n Notifier, t Target, m *Message, done func(Result)) {
+	q.wg.Add(1)
+	go func() {
+		defer q.wg.Done()
+		done(q.send(n, t, m))
+	}()
+}
+
+// Wait blocks until the results of the sent messages are handled.
+func (q *Queue) Wait() {
+	q.wg.Wait()
+}
+
+func (q *Queue) send(n Notifier, t Target, m *Message) Result {
+	maxAttempts := q.MaxAttempts
+	if maxAttempts == 0 {
+		maxAttempts = DefaultMaxAttempts
+	}
+	backoff := q.Backoff
+	if backoff == nil {
+		backoff = DefaultBackoff
+	}
+	var deadline time.Time
+	if m.TTL > 0 {
+		deadline = time.Now().Add(m.TTL)
+	}
+
+	res := Result{Target: t, Message: m}
+	for {
+		res.Attempts++
+		res.Err = n.Notify(t, m)
+		if res.Err == nil || !Temporary(res.Err) || res.Attempts >= maxAttempts {
+			return res
+		}
+		d := backoff(res.Attempts)
+		if !deadline.IsZero() && time.Now().Add(d).After(deadline) {
+			return res
+		}
+		time.Sleep(d)
+	}
+}
@@ -0,0 +1,102 @@
+// Copyright 2015 Lars Wiegman. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package push
+
+import (
+	"testing"
+	"time"
+
+	"sentinel/push/apn"
+	"sentinel/push/fcm"
+)
+
+// failingNotifier returns the errors in order, nil once they're used.
+type failingNotifier struct {
+	errs  []error
+	calls int
+}
+
+func (n *failingNotifier) Notify(t Target, m *Message) error {
+	n.calls++
+	if len(n.errs) == 0 {
+		return nil
+	}
+	err := n.errs[0]
+	n.errs = n.errs[1:]
+	return err
+}
+
+func TestClassifyErrors(t *testing.T) {
+	tests := []struct {
+		err                     error
+		unregistered, temporary bool
+	}{
+		{&apn.Error{StatusCode: 410, Reason: apn.ReasonUnregistered}, true, false},
+		{&apn.Error{StatusCode: 400, Reason: apn.ReasonBadDeviceToken}, true, false},
+		{&apn.Error{StatusCode: 503, Reason: apn.ReasonServiceUnavailable}, false, true},
+		{&fcm.Error{StatusCode: 404, Code: fcm.CodeUnregistered}, true, false},
+		{&fcm.Error{StatusCode: 429, Code: fcm.CodeQuotaExceeded}, false, true},
+		{ErrUnsupportedPlatform, false, false},
+	}
+	for _, tt := range tests {
+		if Unregistered(tt.err) != tt.unregistered || Temporary(tt.err) != tt.temporary {
+			t.Errorf("%v: Result should have been %v/%v, but it was %v/%v", tt.err,
+				tt.unregistered, tt.temporary, Unregistered(tt.err), Temporary(tt.err))
+		}
+	}
+}
+
+func TestQueue(t *testing.T) {
+	unavailable := &apn.Error{StatusCode: 503, Reason: apn.ReasonServiceUnavailable}
+	unregistered := &apn.Error{StatusCode: 410, Reason: apn.ReasonUnregistered}
+	target := Target{PlatformIOS, "e2f28cb7"}
+
+	tests := []struct {
+		errs     []error
+		ttl      time.Duration
+		attempts int
+		err      error
+	}{
+		{nil, 0, 1, nil},
+		{[]error{unavailable, unavailable}, 0, 3, nil},
+		{[]error{unregistered, unavailable}, 0, 1, unregistered},
+		{[]error{unavailable, unavailable, unavailable, unavailable}, 0, 3, unavailable},
+		{[]error{unavailable, unavailable}, time.Millisecond * 15, 2, unavailable},
+	}
+	for i, tt := range tests {
+		q := &Queue{MaxAttempts: 3, Backoff: func(attempts int) time.Duration {
+			return time.Millisecond * 10
+		}}
+		n := &failingNotifier{errs: tt.errs}
+		var res Result
+		q.Send(n, target, &Message{Kind: KindLoginRequest, TTL: tt.ttl}, func(r Result) {
+			res = r
+		})
+		q.Wait()
+
+		if res.Attempts != tt.attempts || res.Err != tt.err || n.calls != tt.attempts {
+			t.Errorf("%d: Result should have been %v attempts with %v, but it was %v with %v", i, tt.attempts, tt.err, res.Attempts, res.Err)
+		}
+		if res.Target != target {
+			t.Errorf("Result should have been %v, but it was %v", target, res.Target)
+		}
+	}
+}
+
+func TestDefaultBackoff(t *testing.T) {
+	tests := []struct {
+		attempts int
+		expect   time.Duration
+	}{
+		{1, 2 * time.Second},
+		{3, 8 * time.Second},
+		{10, time.Minute},
+	}
+	for _, tt := range tests {
+		if d := DefaultBackoff(tt.attempts); d != tt.expect {
+			t.Errorf("Result should have been %v, but it was %v", tt.expect, d)
+		}
+	}
+}
@@ -0,0 +1,114 @@
+// Copyright 2015 Lars Wiegman. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sentinel
+
+import (
+	"time"
+)
+
+// RateLimit is the size and refill rate of a token bucket. A bucket starts
+// full, every request takes a token and a token is added at every interval
+// until the bucket holds Burst tokens again.
+type RateLimit struct {
+	Burst    int
+	Interval time.Duration
+}
+
+// LockoutLimit limits the failed logins of an account. The account is locked
+// after Burst consecutive failures and unlocked when a token is added again,
+// each later failure locks it for another interval. A successful login
+// refills the bucket.
+var LockoutLimit = RateLimit{Burst: 10, Interval: 15 * time.Minute}
+
+// TokenBucket is the state of a token bucket. The tokens are refilled on
+// every use, so the bucket doesn't need a timer.
+type TokenBucket struct {
+	Tokens    float64   `db:"tokens"`
+	UpdatedAt time.Time `db:"updated_at"`
+}
+
+// refill adds the tokens of the intervals since the bucket was last used.
+// A bucket which was never used is full.
+func (b *TokenBucket) refill(l RateLimit, now time.Time) {
+	if b.UpdatedAt.IsZero() {
+		b.Tokens = float64(l.Burst)
+	} else if now.After(b.UpdatedAt) {
+		b.Tokens += float64(now.Sub(b.UpdatedAt)) / float64(l.Interval)
+	}
+	if b.Tokens > float64(l.Burst) {
+		b.Tokens = float64(l.Burst)
+	}
+	b.UpdatedAt = now
+}
+
+// Take takes a token from the bucket. When the bucket is empty no token is
+// taken and the duration until a token is available is returned.
+func (b *TokenBucket) Take(l RateLimit, now time.Time) time.Duration {
+	if wait := b.Wait(l, now); wait > 0 {
+		return wait
+	}
+	b.Tokens--
+	return 0
+}
+
+// Wait returns the duration until the bucket holds a token, zero when it
+// holds a token now.
+func (b *TokenBucket) Wait(l RateLimit, now time.Time) time.Duration {
+	b.refill(l, now)
+	if b.Tokens >= 1 {
+		return 0
+	}
+	return time.Duration((1 - b.Tokens) * float64(l.Interval))
+}
+
+// FullAt returns the time at which the bucket is full again, after which it
+// can be forgotten.
+func (b *TokenBucket) FullAt(l RateLimit) time.Time {
+	return b.UpdatedAt.Add(time.Duration((float64(l.Burst) - b.Tokens) * float64(l.Interval)))
+}
+
+// RateLimitsService keeps the token buckets of rate limited requests, keyed
+// by the endpoint and the IP address, email or client of the request.
+type RateLimitsService interface {
+	// Take takes a token from the bucket of key. When the bucket is empty no
+	// token is taken and the duration until a token is available is
+	// returned.
+	Take(key string, limit RateLimit) (time.Duration, error)
+	// Wait returns the duration until the bucket of key holds a token,
+	// without taking it.
+	Wait(key string, limit RateLimit) (time.Duration, error)
+	// Reset refills the bucket of key.
+	Reset(key string) error
+}
+
+// MockRateLimitsService is a mock of the RateLimitsService.
+type MockRateLimitsService struct {
+	TakeFn  func(key string, limit RateLimit) (time.Duration, error)
+	WaitFn  func(key string, limit RateLimit) (time.Duration, error)
+	ResetFn func(key string) error
+}
+
+var _ RateLimitsService = &MockRateLimitsService{}
+
+func (s *MockRateLimitsService) Take(key string, limit RateLimit) (time.Duration, error) {
+	if s.TakeFn == nil {
+		return 0, nil
+	}
+	return s.TakeFn(key, limit)
+}
+
+func (s *MockRateLimitsService) Wait(key string, limit RateLimit) (time.Duration, error) {
+	if s.WaitFn == nil {
+		return 0, nil
+	}
+	return s.WaitFn(key, limit)
+}
+
+func (s *MockRateLimitsService) Reset(key string) error {
+	if s.ResetFn == nil {
+		return nil
+	}
+	return s.ResetFn(key)
+}
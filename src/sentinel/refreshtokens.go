@@ -0,0 +1,106 @@
+// Copyright 2015 Lars Wiegman. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sentinel
+
+import (
+	"errors"
+	"time"
+
+	"code.google.com/p/go-uuid/uuid"
+)
+
+// RefreshTokenTTL is the duration after which an unused refresh token
+// expires.
+const RefreshTokenTTL = time.Hour * 24 * 30
+
+var (
+	ErrRefreshTokenInvalid = errors.New("refresh token is invalid, expired or revoked")
+	ErrRefreshTokenReused  = errors.New("refresh token was already used")
+)
+
+// RefreshToken is used to request a new access token without the user's
+// credentials. A refresh token can be used once, using it issues a new
+// refresh token in the same family. Only the hash of the token is stored.
+type RefreshToken struct {
+	ID        int       `json:"-"`
+	UserID    int       `db:"user_id" json:"-"`
+	UserUID   uuid.UUID `db:"-" json:"-"`
+	Family    uuid.UUID `db:"family" json:"-"`
+	Token     string    `db:"-" json:"refresh_token"`
+	TokenHash string    `db:"token_hash" json:"-"`
+	ClientID  string    `db:"client_id" json:"-"`
+	Scope     string    `db:"scope" json:"-"`
+	IsUsed    bool      `db:"is_used" json:"-"`
+	IsRevoked bool      `db:"is_revoked" json:"-"`
+	ExpiresAt time.Time `db:"expires_at" json:"-"`
+	CreatedAt time.Time `db:"created_at" json:"-"`
+	UpdatedAt time.Time `db:"updated_at" json:"-"`
+}
+
+// RefreshTokensService issues and rotates refresh tokens.
+type RefreshTokensService interface {
+	// Issue creates a refresh token in a new family for the user. The scope
+	// is only set for tokens issued by the OpenID Connect flow and is kept
+	// when the token is rotated.
+	Issue(userID int, clientID, scope string) (*RefreshToken, error)
+	// Get returns the refresh token without using it, whether or not it's
+	// still valid. Unknown tokens return ErrRefreshTokenInvalid.
+	Get(token string) (*RefreshToken, error)
+	// Rotate marks the refresh token as used and issues its successor. When
+	// a used token is presented again the family is revoked and
+	// ErrRefreshTokenReused is returned.
+	Rotate(token string) (*RefreshToken, error)
+	// Revoke revokes the family of the refresh token. Unknown tokens are
+	// ignored.
+	Revoke(token string) error
+	// RevokeUser revokes all refresh tokens of the user.
+	RevokeUser(userID int) error
+}
+
+// MockRefreshTokensService is a mock of the RefreshTokensService.
+type MockRefreshTokensService struct {
+	IssueFn      func(userID int, clientID, scope string) (*RefreshToken, error)
+	GetFn        func(token string) (*RefreshToken, error)
+	RotateFn     func(token string) (*RefreshToken, error)
+	RevokeFn     func(token string) error
+	RevokeUserFn func(userID int) error
+}
+
+var _ RefreshTokensService = &MockRefreshTokensService{}
+
+func (s *MockRefreshTokensService) Issue(userID int, clientID, scope string) (*RefreshToken, error) {
+	if s.IssueFn == nil {
+		return nil, nil
+	}
+	return s.IssueFn(userID, clientID, scope)
+}
+
+func (s *MockRefreshTokensService) Get(token string) (*RefreshToken, error) {
+	if s.GetFn == nil {
+		return nil, nil
+	}
+	return s.GetFn(token)
+}
+
+func (s *MockRefreshTokensService) Rotate(token string) (*RefreshToken, error) {
+	if s.RotateFn == nil {
+		return nil, nil
+	}
+	return s.RotateFn(token)
+}
+
+func (s *MockRefreshTokensService) Revoke(token string) error {
+	if s.RevokeFn == nil {
+		return nil
+	}
+	return s.RevokeFn(token)
+}
+
+func (s *MockRefreshTokensService) RevokeUser(userID int) error {
+	if s.RevokeUserFn == nil {
+		return nil
+	}
+	return s.RevokeUserFn(userID)
+}
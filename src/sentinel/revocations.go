@@ -0,0 +1,90 @@
+// Copyright 2015 Lars Wiegman. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sentinel
+
+import (
+	"time"
+
+	"code.google.com/p/go-uuid/uuid"
+)
+
+// Revocation revokes a single token, identified by its jti claim, or all
+// tokens issued to the user before the revocation was created when JTI is
+// empty. A revocation is kept until the tokens it revokes have expired.
+// IsUsed marks single-use tokens which were used rather than revoked.
+type Revocation struct {
+	ID        int       `json:"-"`
+	JTI       string    `db:"jti" json:"-"`
+	UserUID   uuid.UUID `db:"user_uid" json:"-"`
+	IsUsed    bool      `db:"is_used" json:"-"`
+	ExpiresAt time.Time `db:"expires_at" json:"-"`
+	CreatedAt time.Time `db:"created_at" json:"-"`
+}
+
+// RevokesIssuedAt reports whether a token issued at issuedAt is revoked by
+// the revocation of all tokens of the user. Tokens carry their issue date in
+// seconds, so only tokens issued before the second the revocation was created
+// in are revoked. A token issued right after the revocation, like on a login
+// after a password reset, stays valid.
+func (r *Revocation) RevokesIssuedAt(issuedAt time.Time) bool {
+	return issuedAt.Before(r.CreatedAt.Truncate(time.Second))
+}
+
+// RevocationsService tracks tokens which are revoked before they expire.
+type RevocationsService interface {
+	// Revoke revokes the token with the given ID until it expires.
+	Revoke(jti string, userUID uuid.UUID, expiresAt time.Time) error
+	// RevokeUser revokes all tokens issued to the user before the current
+	// second, see Revocation.RevokesIssuedAt. The revocation is kept until
+	// expiresAt.
+	RevokeUser(userUID uuid.UUID, expiresAt time.Time) error
+	// IsRevoked reports whether the token with the given ID, issued to the
+	// user at issuedAt, was revoked. Lookups may lag behind revocations made
+	// by other instances, use it for the denylist of access tokens only.
+	IsRevoked(jti string, userUID uuid.UUID, issuedAt time.Time) (bool, error)
+	// Use marks the single-use token with the given ID as used until it
+	// expires and reports whether it wasn't used before. Checking and
+	// marking the token is atomic, a token is used once even by concurrent
+	// requests to different instances.
+	Use(jti string, userUID uuid.UUID, expiresAt time.Time) (bool, error)
+}
+
+// MockRevocationsService is a mock of the RevocationsService.
+type MockRevocationsService struct {
+	RevokeFn     func(jti string, userUID uuid.UUID, expiresAt time.Time) error
+	RevokeUserFn func(userUID uuid.UUID, expiresAt time.Time) error
+	IsRevokedFn  func(jti string, userUID uuid.UUID, issuedAt time.Time) (bool, error)
+	UseFn        func(jti string, userUID uuid.UUID, expiresAt time.Time) (bool, error)
+}
+
+var _ RevocationsService = &MockRevocationsService{}
+
+func (s *MockRevocationsService) Revoke(jti string, userUID uuid.UUID, expiresAt time.Time) error {
+	if s.RevokeFn == nil {
+		return nil
+	}
+	return s.RevokeFn(jti, userUID, expiresAt)
+}
+
+func (s *MockRevocationsService) RevokeUser(userUID uuid.UUID, expiresAt time.Time) error {
+	if s.RevokeUserFn == nil {
+		return nil
+	}
+	return s.RevokeUserFn(userUID, expiresAt)
+}
+
+func (s *MockRevocationsService) IsRevoked(jti string, userUID uuid.UUID, issuedAt time.Time) (bool, error) {
+	if s.IsRevokedFn == nil {
+		return false, nil
+	}
+	return s.IsRevokedFn(jti, userUID, issuedAt)
+}
+
+func (s *MockRevocationsService) Use(jti string, userUID uuid.UUID, expiresAt time.Time) (bool, error) {
+	if s.UseFn == nil {
+		return true, nil
+	}
+	return s.UseFn(jti, userUID, expiresAt)
+}
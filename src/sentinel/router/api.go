@@ -18,22 +18,50 @@ func API(baseURL *url.URL) *mux.Router {
 	// m.Path("/user/authorize").Methods("POST").Name(Signin)
 	m.Path("/onetimelogin").Methods("POST").Name(OneTimeLogin)
 	m.Path("/signup").Methods("POST").Name(Signup)
-	// m.Path("/user/activity").Methods("GET").Name(GetActivity)
-	// m.Path("/user/history").Methods("GET").Name(GetHistory)
+	m.Path("/user/activity").Methods("GET").Name(GetActivity)
+	m.Path("/user/history").Methods("GET").Name(GetHistory)
 	m.Path("/user/self").Methods("GET").Name(GetUserDetails)
 	m.Path("/user/self").Methods("PUT").Name(UpdateUserDetails)
+	m.Path("/user/self").Methods("DELETE").Name(ArchiveUser)
+	m.Path("/user/self/logout").Methods("POST").Name(Logout)
+	m.Path("/user/self/totp").Methods("POST").Name(EnrollTOTP)
+	m.Path("/user/self/totp/confirm").Methods("POST").Name(ConfirmTOTP)
+	m.Path("/user/self/totp").Methods("DELETE").Name(DisableTOTP)
+	m.Path("/user/devices").Methods("GET").Name(ListDevices)
+	m.Path("/user/devices").Methods("POST").Name(RegisterDevice)
+	m.Path("/user/devices/{uid:.+}").Methods("PUT").Name(UpdateDevice)
+	m.Path("/user/devices/{uid:.+}").Methods("DELETE").Name(DeleteDevice)
 	m.Path("/email/{uid:.+}").Methods("GET").Name(GetEmail)
 	m.Path("/email").Methods("GET").Name(ListEmail)
 	m.Path("/email").Methods("POST").Name(AddEmail)
 	m.Path("/email/{uid:.+}").Methods("DELETE").Name(DelEmail)
+	m.Path("/email/{uid:.+}/verify/resend").Methods("POST").Name(ResendAckEmail)
+	m.Path("/email/{uid:.+}/primary").Methods("POST").Name(PrimaryEmail)
 	m.Path("/verify").Methods("POST").Name(AckEmail)
+	m.Path("/password/forgot").Methods("POST").Name(ForgotPassword)
+	m.Path("/password/reset").Methods("POST").Name(ResetPassword)
 	// m.Path("/user/service").Methods("POST").Name(AuthService)
 
 	m.Path("/service/{uid:.+}").Methods("GET").Name(Service)
 	m.Path("/service/{uid:.+}/auth").Methods("POST").Name(AuthService)
+	m.Path("/services").Methods("POST").Name(CreateService)
+	m.Path("/services").Methods("GET").Name(ListServices)
+	m.Path("/services/{uid:.+}/secret").Methods("POST").Name(RotateServiceSecret)
+	m.Path("/services/{uid:.+}").Methods("PUT").Name(UpdateService)
+	m.Path("/services/{uid:.+}").Methods("DELETE").Name(DeleteService)
+
+	m.Path("/qauth/login").Methods("POST").Name(QAuthLogin)
+	m.Path("/qauth/status").Methods("POST").Name(QAuthStatus)
 
 	m.Path("/token").Methods("POST").Name(CreateToken)
+	m.Path("/token/revoke").Methods("POST").Name(RevokeToken)
 	m.Path("/pubkey").Methods("GET").Name(PublicKey)
+	m.Path("/.well-known/jwks.json").Methods("GET").Name(JWKS)
+
+	m.Path("/.well-known/openid-configuration").Methods("GET").Name(OpenIDConfiguration)
+	m.Path("/authorize").Methods("GET", "POST").Name(Authorize)
+	m.Path("/authorize/continue").Methods("GET").Name(AuthorizeContinue)
+	m.Path("/userinfo").Methods("GET", "POST").Name(UserInfo)
 	m.Path("/docs").Methods("GET").Name(APIDocs)
 	return m
 }
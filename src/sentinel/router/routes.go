@@ -15,17 +15,45 @@ const (
 	GetHistory        = "getHistory"
 	GetUserDetails    = "getUserDetails"
 	UpdateUserDetails = "updateUserDetails"
+	ArchiveUser       = "archiveUser"
+	Logout            = "logout"
 	GetEmail          = "getEmail"
 	AddEmail          = "addEmail"
 	AckEmail          = "ackEmail"
+	ResendAckEmail    = "resendAckEmail"
+	PrimaryEmail      = "primaryEmail"
 	DelEmail          = "delEmail"
 	ListEmail         = "listEmail"
+	ForgotPassword    = "forgotPassword"
+	ResetPassword     = "resetPassword"
+	EnrollTOTP        = "enrollTOTP"
+	ConfirmTOTP       = "confirmTOTP"
+	DisableTOTP       = "disableTOTP"
+	ListDevices       = "listDevices"
+	RegisterDevice    = "registerDevice"
+	UpdateDevice      = "updateDevice"
+	DeleteDevice      = "deleteDevice"
 
-	Service     = "service"
-	Services    = "services"
-	AuthService = "authService"
+	Service             = "service"
+	Services            = "services"
+	AuthService         = "authService"
+	CreateService       = "createService"
+	ListServices        = "listServices"
+	UpdateService       = "updateService"
+	DeleteService       = "deleteService"
+	RotateServiceSecret = "rotateServiceSecret"
+
+	QAuthLogin  = "qauthLogin"
+	QAuthStatus = "qauthStatus"
 
 	CreateToken = "createToken"
+	RevokeToken = "revokeToken"
 	PublicKey   = "publicKey"
+	JWKS        = "jwks"
 	APIDocs     = "apiDocs"
+
+	OpenIDConfiguration = "openIDConfiguration"
+	Authorize           = "authorize"
+	AuthorizeContinue   = "authorizeContinue"
+	UserInfo            = "userInfo"
 )
@@ -5,12 +5,17 @@
 package sentinel
 
 import (
+	"database/sql/driver"
 	"errors"
+	"fmt"
 	"net/http"
 	"net/url"
+	"strconv"
+	"strings"
 	"time"
 
 	"sentinel/router"
+	"sentinel/validate"
 
 	"code.google.com/p/go-uuid/uuid"
 )
@@ -24,15 +29,183 @@ type Service struct {
 	AuthLevel   int       `db:"authlevel" json:"authLevel"`
 	LastEntryAt time.Time `db:"lastentry_at" json:"lastEntryDate"`
 
+	// Client credentials of the service, the secret is only set when it is
+	// issued
+	ClientID         string `db:"client_id" json:"clientID,omitempty"`
+	ClientSecret     string `db:"-" json:"clientSecret,omitempty"`
+	ClientSecretHash string `db:"client_secret_hash" json:"-"`
+	OwnerID          int    `db:"owner_id" json:"-"`
+
+	// PublicKey verifies the JWT assertions the service authenticates with
+	PublicKey string `db:"public_key" json:"publicKey,omitempty"`
+
+	// RedirectURIs are the redirect URIs the OpenID Connect flow may
+	// redirect to, the service URL is the status endpoint of the qauth flow
+	RedirectURIs RedirectURIs `db:"redirect_uris" json:"redirectUris,omitempty"`
+
 	CreatedAt  time.Time `db:"created_at" json:"-"`
 	UpdatedAt  time.Time `db:"updated_at" json:"-"`
 	IsArchived bool      `db:"is_archived" json:"-"`
 }
 
-// ServicesService interacts with the service-related endpoint in Sentinel's API.
+// RedirectURIs is a list of redirect URIs, stored space delimited.
+type RedirectURIs []string
+
+// Value implements the driver.Valuer interface.
+func (u RedirectURIs) Value() (driver.Value, error) {
+	return strings.Join(u, " "), nil
+}
+
+// Scan implements the sql.Scanner interface.
+func (u *RedirectURIs) Scan(src interface{}) error {
+	switch v := src.(type) {
+	case []byte:
+		*u = strings.Fields(string(v))
+	case string:
+		*u = strings.Fields(v)
+	case nil:
+		*u = nil
+	default:
+		return fmt.Errorf("can't scan %T into RedirectURIs", src)
+	}
+	return nil
+}
+
+// ServiceUpdateOptions holds the properties of a service which can be set by
+// its owner. RedirectURIs replace the registered redirect URIs when set.
+type ServiceUpdateOptions struct {
+	Name, BaseURL, LogoURL, PublicKey string
+	AuthLevel                         int
+	RedirectURIs                      []string
+
+	// Owner of a new service, the API sets it to the authenticated user.
+	// The owner of a service can't be changed, Update ignores it.
+	Owner *uuid.UUID
+}
+
+func (o *ServiceUpdateOptions) ParseForm(v url.Values) error {
+	var parsed bool
+	if s := v.Get("name"); s != "" {
+		if len(s) > 256 {
+			return errors.New("invalid name parameter; exceeds maximum of 256 characters")
+		}
+		o.Name = s
+		parsed = true
+	}
+	if s := v.Get("serviceUrl"); s != "" {
+		if err := validate.URL(s); err != nil {
+			return errors.New("invalid serviceUrl parameter; does not match regexp " + validate.RuleURL.String())
+		}
+		o.BaseURL = s
+		parsed = true
+	}
+	if s := v.Get("serviceLogoUrl"); s != "" {
+		if err := validate.URL(s); err != nil {
+			return errors.New("invalid serviceLogoUrl parameter; does not match regexp " + validate.RuleURL.String())
+		}
+		o.LogoURL = s
+		parsed = true
+	}
+	if s := v.Get("authLevel"); s != "" {
+		switch s {
+		case "1":
+			o.AuthLevel = AuthLevelNotify
+		case "2":
+			o.AuthLevel = AuthLevelFast
+		case "3":
+			o.AuthLevel = AuthLevelSecure
+		default:
+			return errors.New("invalid authLevel parameter; options are 1:Notify, 2:Fast or 3:Secure")
+		}
+		parsed = true
+	}
+	if s := v.Get("publicKey"); s != "" {
+		if !strings.Contains(s, "-----BEGIN PUBLIC KEY-----") {
+			return errors.New("invalid publicKey parameter; expected a PEM encoded public key")
+		}
+		o.PublicKey = s
+		parsed = true
+	}
+	if vs := v["redirectUri"]; len(vs) > 0 {
+		for _, s := range vs {
+			if err := validate.URL(s); err != nil || strings.Contains(s, "#") {
+				return errors.New("invalid redirectUri parameter; expected an absolute URL without fragment")
+			}
+		}
+		o.RedirectURIs = vs
+		parsed = true
+	}
+	if !parsed {
+		return errors.New("found no paramters to parse")
+	}
+	return nil
+}
+
+func (o *ServiceUpdateOptions) form() *url.Values {
+	v := &url.Values{}
+	if o.Name != "" {
+		v.Set("name", o.Name)
+	}
+	if o.BaseURL != "" {
+		v.Set("serviceUrl", o.BaseURL)
+	}
+	if o.LogoURL != "" {
+		v.Set("serviceLogoUrl", o.LogoURL)
+	}
+	if o.AuthLevel != AuthLevelUnknown {
+		v.Set("authLevel", strconv.Itoa(o.AuthLevel))
+	}
+	if o.PublicKey != "" {
+		v.Set("publicKey", o.PublicKey)
+	}
+	for _, s := range o.RedirectURIs {
+		v.Add("redirectUri", s)
+	}
+	return v
+}
+
+// EffectiveAuthLevel returns the auth level of a login request of the user
+// for the service; the stricter of the user's default and the service's
+// requirement. When neither is set a one-tap approval is required.
+func EffectiveAuthLevel(user *User, service *Service) int {
+	level := user.DefaultAuthLevel
+	if service.AuthLevel > level {
+		level = service.AuthLevel
+	}
+	if level == AuthLevelUnknown {
+		level = AuthLevelFast
+	}
+	return level
+}
+
+// ServicesService interacts with the service-related endpoint in Sentinel's
+// API, it's implemented by the API client and the datastore.
 type ServicesService interface {
 	Get(uid uuid.UUID) (*Service, error)
-	Auth(uid uuid.UUID, email, status string) error
+	// Create registers a service owned by the given user and issues its
+	// client credentials.
+	Create(opt ServiceUpdateOptions) (*Service, error)
+	List(opt ServiceListOptions) ([]*Service, error)
+	Update(uid uuid.UUID, opt ServiceUpdateOptions) (*Service, error)
+	Archive(uid uuid.UUID) error
+	// RotateSecret issues a new client secret, the previous secret is
+	// invalidated.
+	RotateSecret(uid uuid.UUID) (*Service, error)
+}
+
+// ServicesClient is the ServicesService of the API client, services request
+// and complete the logins of their users with it.
+type ServicesClient interface {
+	ServicesService
+	Login(serviceID uuid.UUID, email, secret1 string) (*LoginSession, error)
+	Auth(sessionID uuid.UUID, status LoginStatus, secret2, enc1 string) error
+}
+
+// ServicesStore is the ServicesService of the datastore, services are looked
+// up by client ID when they authenticate.
+type ServicesStore interface {
+	ServicesService
+	GetByClientID(clientID string) (*Service, error)
 }
 
 type servicesService struct {
@@ -40,7 +213,7 @@ type servicesService struct {
 }
 
 func (s *servicesService) Get(uid uuid.UUID) (*Service, error) {
-	url, err := s.client.url(router.Service, nil, nil)
+	url, err := s.client.url(router.Service, map[string]string{"uid": uid.String()}, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -61,24 +234,64 @@ func (s *servicesService) Get(uid uuid.UUID) (*Service, error) {
 	return service, nil
 }
 
-func (s *servicesService) Auth(uid uuid.UUID, email, status string) error {
-	u, err := s.client.url(router.AuthService, nil, nil)
+// Login creates a login request for the user with the given email address,
+// see step 2 of the qauth flow.
+func (s *servicesService) Login(serviceID uuid.UUID, email, secret1 string) (*LoginSession, error) {
+	u, err := s.client.url(router.AuthService, map[string]string{"uid": serviceID.String()}, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	body := map[string]string{
+		"email":   email,
+		"secret1": secret1,
+	}
+	req, err := s.client.NewRequest("POST", u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.client.AuthorizeClient(req); err != nil {
+		return nil, err
+	}
+
+	var session LoginSession
+	resp, err := s.client.Do(req, &session)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New("API reponded with status " + http.StatusText(resp.StatusCode))
+	}
+
+	return &session, nil
+}
+
+// Auth accepts or declines the login request identified by the given session
+// ID, see step 6 of the qauth flow.
+func (s *servicesService) Auth(sessionID uuid.UUID, status LoginStatus, secret2, enc1 string) error {
+	u, err := s.client.url(router.QAuthStatus, nil, nil)
 	if err != nil {
 		return err
 	}
 
-	form := &url.Values{
-		"service_id": {uid.String()},
-		"email":      {email},
-		"status":     {status},
+	body := map[string]string{
+		"sessionID": sessionID.String(),
+		"status":    string(status),
+		"secret2":   secret2,
+		"enc1":      enc1,
 	}
-	req, err := s.client.NewRequest("POST", u.String(), form)
+	req, err := s.client.NewRequest("POST", u.String(), body)
 	if err != nil {
 		return err
 	}
 
-	var user User
-	resp, err := s.client.Do(req, &user)
+	if err := s.client.Authorize(req); err != nil {
+		return err
+	}
+
+	resp, err := s.client.Do(req, nil)
 	if err != nil {
 		return err
 	}
@@ -90,19 +303,161 @@ func (s *servicesService) Auth(uid uuid.UUID, email, status string) error {
 	return nil
 }
 
+func (s *servicesService) Create(opt ServiceUpdateOptions) (*Service, error) {
+	u, err := s.client.url(router.CreateService, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := s.client.NewRequest("POST", u.String(), opt.form())
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.client.Authorize(req); err != nil {
+		return nil, err
+	}
+
+	var service Service
+	resp, err := s.client.Do(req, &service)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusCreated {
+		return nil, errors.New("API reponded with status " + http.StatusText(resp.StatusCode))
+	}
+
+	return &service, nil
+}
+
+// List returns the services of the authenticated user in the range of the
+// options, the owner is always the authenticated user.
+func (s *servicesService) List(opt ServiceListOptions) ([]*Service, error) {
+	u, err := s.client.url(router.ListServices, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	if opt.IncludeArchived {
+		u.RawQuery = url.Values{"include_archived": {"true"}}.Encode()
+	}
+
+	req, err := s.client.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if opt.Last > 0 {
+		req.Header.Set("Range-Unit", "items")
+		req.Header.Set("Range", "items="+strconv.FormatUint(opt.First, 10)+"-"+strconv.FormatUint(opt.Last, 10))
+	}
+
+	if err := s.client.Authorize(req); err != nil {
+		return nil, err
+	}
+
+	var services []*Service
+	resp, err := s.client.Do(req, &services)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusPartialContent {
+		return nil, errors.New("API reponded with status " + http.StatusText(resp.StatusCode))
+	}
+	return services, nil
+}
+
+func (s *servicesService) Update(uid uuid.UUID, opt ServiceUpdateOptions) (*Service, error) {
+	u, err := s.client.url(router.UpdateService, map[string]string{"uid": uid.String()}, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := s.client.NewRequest("PUT", u.String(), opt.form())
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.client.Authorize(req); err != nil {
+		return nil, err
+	}
+
+	var service Service
+	if _, err := s.client.Do(req, &service); err != nil {
+		return nil, err
+	}
+	return &service, nil
+}
+
+func (s *servicesService) Archive(uid uuid.UUID) error {
+	u, err := s.client.url(router.DeleteService, map[string]string{"uid": uid.String()}, nil)
+	if err != nil {
+		return err
+	}
+
+	req, err := s.client.NewRequest("DELETE", u.String(), nil)
+	if err != nil {
+		return err
+	}
+
+	if err := s.client.Authorize(req); err != nil {
+		return err
+	}
+
+	resp, err := s.client.Do(req, nil)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode != http.StatusNoContent {
+		return errors.New("API reponded with status " + http.StatusText(resp.StatusCode))
+	}
+
+	return nil
+}
+
+func (s *servicesService) RotateSecret(uid uuid.UUID) (*Service, error) {
+	u, err := s.client.url(router.RotateServiceSecret, map[string]string{"uid": uid.String()}, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := s.client.NewRequest("POST", u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.client.Authorize(req); err != nil {
+		return nil, err
+	}
+
+	var service Service
+	if _, err := s.client.Do(req, &service); err != nil {
+		return nil, err
+	}
+	return &service, nil
+}
+
 type ServiceListOptions struct {
 	// IncludeArchived will include archived/inactive services
 	IncludeArchived bool
 
+	// Owner of the services
+	Owner *uuid.UUID
+
 	ListOptions
 }
 
 type MockServicesService struct {
-	GetFn  func(uid uuid.UUID) (*Service, error)
-	AuthFn func(uid uuid.UUID, email, status string) error
+	GetFn           func(uid uuid.UUID) (*Service, error)
+	CreateFn        func(opt ServiceUpdateOptions) (*Service, error)
+	ListFn          func(opt ServiceListOptions) ([]*Service, error)
+	UpdateFn        func(uid uuid.UUID, opt ServiceUpdateOptions) (*Service, error)
+	ArchiveFn       func(uid uuid.UUID) error
+	RotateSecretFn  func(uid uuid.UUID) (*Service, error)
+	GetByClientIDFn func(clientID string) (*Service, error)
 }
 
-var _ ServicesService = &MockServicesService{}
+var _ ServicesStore = &MockServicesService{}
 
 func (s *MockServicesService) Get(uid uuid.UUID) (*Service, error) {
 	if s.GetFn == nil {
@@ -111,9 +466,44 @@ func (s *MockServicesService) Get(uid uuid.UUID) (*Service, error) {
 	return s.GetFn(uid)
 }
 
-func (s *MockServicesService) Auth(uid uuid.UUID, email, status string) error {
-	if s.AuthFn == nil {
+func (s *MockServicesService) Create(opt ServiceUpdateOptions) (*Service, error) {
+	if s.CreateFn == nil {
+		return nil, nil
+	}
+	return s.CreateFn(opt)
+}
+
+func (s *MockServicesService) List(opt ServiceListOptions) ([]*Service, error) {
+	if s.ListFn == nil {
+		return nil, nil
+	}
+	return s.ListFn(opt)
+}
+
+func (s *MockServicesService) Update(uid uuid.UUID, opt ServiceUpdateOptions) (*Service, error) {
+	if s.UpdateFn == nil {
+		return nil, nil
+	}
+	return s.UpdateFn(uid, opt)
+}
+
+func (s *MockServicesService) Archive(uid uuid.UUID) error {
+	if s.ArchiveFn == nil {
 		return nil
 	}
-	return s.AuthFn(uid, email, status)
+	return s.ArchiveFn(uid)
+}
+
+func (s *MockServicesService) RotateSecret(uid uuid.UUID) (*Service, error) {
+	if s.RotateSecretFn == nil {
+		return nil, nil
+	}
+	return s.RotateSecretFn(uid)
+}
+
+func (s *MockServicesService) GetByClientID(clientID string) (*Service, error) {
+	if s.GetByClientIDFn == nil {
+		return nil, nil
+	}
+	return s.GetByClientIDFn(clientID)
 }
@@ -0,0 +1,121 @@
+// Copyright 2015 Lars Wiegman. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sentinel
+
+import (
+	"errors"
+	"time"
+
+	"code.google.com/p/go-uuid/uuid"
+)
+
+// LoginTimeout is the duration in which a login request needs to be
+// confirmed by the user before it expires.
+const LoginTimeout = time.Minute * 5
+
+// LoginStatus is the state of a login session. A session starts as pending
+// and ends as either accepted, declined or expired.
+type LoginStatus string
+
+const (
+	LoginPending  LoginStatus = "pending"
+	LoginAccepted LoginStatus = "accepted"
+	LoginDeclined LoginStatus = "declined"
+	LoginExpired  LoginStatus = "expired"
+)
+
+var (
+	ErrLoginNotPending   = errors.New("login request is no longer pending")
+	ErrLoginTimeout      = errors.New("login was not confirmed within default timeout")
+	ErrInvalidTransition = errors.New("invalid login status transition")
+)
+
+// CanTransition reports whether a session with status s may move to status t.
+// Only pending sessions can change status.
+func (s LoginStatus) CanTransition(t LoginStatus) bool {
+	if s != LoginPending {
+		return false
+	}
+	switch t {
+	case LoginAccepted, LoginDeclined, LoginExpired:
+		return true
+	}
+	return false
+}
+
+// LoginSession is a login request of a user for a third party service, it is
+// identified by the service using the session ID.
+type LoginSession struct {
+	ID        int         `json:"-"`
+	UID       uuid.UUID   `db:"uid" json:"sessionID"`
+	ServiceID int         `db:"service_id" json:"-"`
+	UserID    int         `db:"user_id" json:"-"`
+	Email     string      `json:"email"`
+	Secret1   string      `db:"secret1" json:"-"`
+	Secret2   string      `db:"secret2" json:"-"`
+	Enc1      string      `db:"enc1" json:"-"`
+	AuthLevel int         `db:"authlevel" json:"authLevel"`
+	Status    LoginStatus `json:"status"`
+	// IsOIDC marks sessions of the OpenID Connect flow, their outcome is
+	// redirected to the service instead of sent to its status endpoint.
+	IsOIDC    bool      `db:"is_oidc" json:"-"`
+	ExpiresAt time.Time `db:"expires_at" json:"expiresAt"`
+	CreatedAt time.Time `db:"created_at" json:"-"`
+	UpdatedAt time.Time `db:"updated_at" json:"-"`
+
+	Service *Service `db:"-" json:"service,omitempty"`
+}
+
+// SessionsService manages the state of login sessions.
+type SessionsService interface {
+	// Create creates a pending login session which expires after the
+	// LoginTimeout.
+	Create(serviceID, userID, authLevel int, email, secret1 string, isOIDC bool) (*LoginSession, error)
+	Get(uid uuid.UUID) (*LoginSession, error)
+	// Transition moves a pending session to the given status, storing the
+	// secrets provided by the user's device.
+	Transition(uid uuid.UUID, status LoginStatus, secret2, enc1 string) (*LoginSession, error)
+	// Expire moves all pending sessions which passed their expiry date to
+	// expired and returns them.
+	Expire() ([]*LoginSession, error)
+}
+
+// MockSessionsService is a mock of the SessionsService.
+type MockSessionsService struct {
+	CreateFn     func(serviceID, userID, authLevel int, email, secret1 string, isOIDC bool) (*LoginSession, error)
+	GetFn        func(uid uuid.UUID) (*LoginSession, error)
+	TransitionFn func(uid uuid.UUID, status LoginStatus, secret2, enc1 string) (*LoginSession, error)
+	ExpireFn     func() ([]*LoginSession, error)
+}
+
+var _ SessionsService = &MockSessionsService{}
+
+func (s *MockSessionsService) Create(serviceID, userID, authLevel int, email, secret1 string, isOIDC bool) (*LoginSession, error) {
+	if s.CreateFn == nil {
+		return nil, nil
+	}
+	return s.CreateFn(serviceID, userID, authLevel, email, secret1, isOIDC)
+}
+
+func (s *MockSessionsService) Get(uid uuid.UUID) (*LoginSession, error) {
+	if s.GetFn == nil {
+		return nil, nil
+	}
+	return s.GetFn(uid)
+}
+
+func (s *MockSessionsService) Transition(uid uuid.UUID, status LoginStatus, secret2, enc1 string) (*LoginSession, error) {
+	if s.TransitionFn == nil {
+		return nil, nil
+	}
+	return s.TransitionFn(uid, status, secret2, enc1)
+}
+
+func (s *MockSessionsService) Expire() ([]*LoginSession, error) {
+	if s.ExpireFn == nil {
+		return nil, nil
+	}
+	return s.ExpireFn()
+}
@@ -0,0 +1,158 @@
+// Copyright 2015 Lars Wiegman. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tokens
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"strings"
+)
+
+// Algorithms of the JWS signed by device keys (RFC 7518, RFC 8037).
+const (
+	ES256 = "ES256"
+	EdDSA = "EdDSA"
+)
+
+var (
+	ErrInvalidDeviceKey = errors.New("invalid key; expected a PEM encoded ECDSA P-256 or Ed25519 public key")
+	ErrInvalidSignature = errors.New("signature is invalid")
+)
+
+// ParseDeviceKey parses the PEM encoded public key a device enrolls and
+// returns the key with the algorithm of its signatures. Only ECDSA P-256 and
+// Ed25519 keys are accepted.
+func ParseDeviceKey(publicKey string) (crypto.PublicKey, string, error) {
+	block, _ := pem.Decode([]byte(publicKey))
+	if block == nil || block.Type != "PUBLIC KEY" {
+		return nil, "", ErrInvalidDeviceKey
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, "", ErrInvalidDeviceKey
+	}
+	switch k := key.(type) {
+	case *ecdsa.PublicKey:
+		if k.Curve != elliptic.P256() {
+			return nil, "", ErrInvalidDeviceKey
+		}
+		return k, ES256, nil
+	case ed25519.PublicKey:
+		return k, EdDSA, nil
+	}
+	return nil, "", ErrInvalidDeviceKey
+}
+
+// SignDevice signs the claims as a compact JWS with the private key of a
+// device, the keyID is set as the kid header. Device apps sign their
+// approvals this way.
+func SignDevice(c Claims, keyID string, key crypto.Signer) (string, error) {
+	var alg string
+	switch key.(type) {
+	case *ecdsa.PrivateKey:
+		alg = ES256
+	case ed25519.PrivateKey:
+		alg = EdDSA
+	default:
+		return "", ErrInvalidDeviceKey
+	}
+
+	header, err := json.Marshal(map[string]string{"alg": alg, "typ": "JWT", "kid": keyID})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(c)
+	if err != nil {
+		return "", err
+	}
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+
+	var sig []byte
+	switch k := key.(type) {
+	case *ecdsa.PrivateKey:
+		h := sha256.Sum256([]byte(signed))
+		r, s, err := ecdsa.Sign(rand.Reader, k, h[:])
+		if err != nil {
+			return "", err
+		}
+		// JWS uses the fixed size concatenation of r and s, not ASN.1
+		sig = make([]byte, 64)
+		r.FillBytes(sig[:32])
+		s.FillBytes(sig[32:])
+	case ed25519.PrivateKey:
+		sig = ed25519.Sign(k, []byte(signed))
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+// VerifyDevice verifies the compact JWS signed by the device with the given
+// public key and returns its claims. The alg header has to match the type of
+// the key. The claims themselves aren't checked, that's up to the caller.
+func VerifyDevice(token, publicKey string) (Claims, error) {
+	key, alg, err := ParseDeviceKey(publicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+	b, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, err
+	}
+	var header struct {
+		Algorithm string `json:"alg"`
+	}
+	if err := json.Unmarshal(b, &header); err != nil {
+		return nil, err
+	}
+	if header.Algorithm != alg {
+		return nil, ErrInvalidSignature
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrInvalidSignature
+	}
+
+	signed := []byte(parts[0] + "." + parts[1])
+	switch k := key.(type) {
+	case *ecdsa.PublicKey:
+		if len(sig) != 64 {
+			return nil, ErrInvalidSignature
+		}
+		h := sha256.Sum256(signed)
+		r := new(big.Int).SetBytes(sig[:32])
+		s := new(big.Int).SetBytes(sig[32:])
+		if !ecdsa.Verify(k, h[:], r, s) {
+			return nil, ErrInvalidSignature
+		}
+	case ed25519.PublicKey:
+		if !ed25519.Verify(k, signed, sig) {
+			return nil, ErrInvalidSignature
+		}
+	}
+
+	b, err = base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, err
+	}
+	var c Claims
+	if err := json.Unmarshal(b, &c); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
@@ -0,0 +1,93 @@
+// Copyright 2015 Lars Wiegman. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tokens
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"strings"
+	"testing"
+)
+
+func marshalPublicKey(t *testing.T, key crypto.PublicKey) string {
+	b, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: b}))
+}
+
+func TestParseDeviceKey(t *testing.T) {
+	p256, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	p384, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	ed, _, _ := ed25519.GenerateKey(rand.Reader)
+
+	tests := []struct {
+		key string
+		alg string
+		err error
+	}{
+		{marshalPublicKey(t, &p256.PublicKey), ES256, nil},
+		{marshalPublicKey(t, ed), EdDSA, nil},
+		{marshalPublicKey(t, &p384.PublicKey), "", ErrInvalidDeviceKey},
+		{publicKey, "", ErrInvalidDeviceKey},
+		{"-----BEGIN PUBLIC KEY-----", "", ErrInvalidDeviceKey},
+	}
+	for _, tt := range tests {
+		_, alg, err := ParseDeviceKey(tt.key)
+		if alg != tt.alg || err != tt.err {
+			t.Errorf("Result should have been %v, %v, but it was %v, %v", tt.alg, tt.err, alg, err)
+		}
+	}
+}
+
+func TestSignAndVerifyDevice(t *testing.T) {
+	p256, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	edPub, edPriv, _ := ed25519.GenerateKey(rand.Reader)
+	other, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	claims := Claims{"sessionID": "373707eb-db20-4b1c-bf8c-505f19d9ccf5", "nonce": "n-0S6_WzA2Mj"}
+	tests := []struct {
+		priv  crypto.Signer
+		pub   crypto.PublicKey
+		valid bool
+	}{
+		{p256, &p256.PublicKey, true},
+		{edPriv, edPub, true},
+		{p256, &other.PublicKey, false},
+		{p256, edPub, false},
+		{edPriv, &p256.PublicKey, false},
+	}
+	for i, tt := range tests {
+		token, err := SignDevice(claims, "device-1", tt.priv)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if kid, _ := KeyID(token); kid != "device-1" {
+			t.Errorf("Result should have been %v, but it was %v", "device-1", kid)
+		}
+		c, err := VerifyDevice(token, marshalPublicKey(t, tt.pub))
+		if tt.valid != (err == nil) {
+			t.Errorf("%d: Result should have been valid %v, but it was %v", i, tt.valid, err)
+			continue
+		}
+		if tt.valid && c["nonce"] != claims["nonce"] {
+			t.Errorf("Result should have been %v, but it was %v", claims["nonce"], c["nonce"])
+		}
+	}
+
+	// A tampered payload doesn't verify
+	token, _ := SignDevice(claims, "device-1", p256)
+	tampered, _ := SignDevice(Claims{"sessionID": "other"}, "device-1", p256)
+	parts, tparts := strings.Split(token, "."), strings.Split(tampered, ".")
+	if _, err := VerifyDevice(parts[0]+"."+tparts[1]+"."+parts[2], marshalPublicKey(t, &p256.PublicKey)); err != ErrInvalidSignature {
+		t.Errorf("Result should have been %v, but it was %v", ErrInvalidSignature, err)
+	}
+}
@@ -0,0 +1,457 @@
+// Copyright 2015 Lars Wiegman. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tokens
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"code.google.com/p/go-uuid/uuid"
+	"github.com/zhevron/jwt"
+)
+
+// KeyStatus is the state of a signing key within a keyring.
+type KeyStatus string
+
+const (
+	// KeyActive is the key used to sign new tokens, a keyring has one
+	// active key.
+	KeyActive KeyStatus = "active"
+	// KeyRetiring keys no longer sign tokens but still verify the tokens
+	// they signed until those have expired.
+	KeyRetiring KeyStatus = "retiring"
+	// KeyRetired keys are no longer used.
+	KeyRetired KeyStatus = "retired"
+)
+
+var (
+	ErrNoActiveKey = errors.New("keyring has no active key")
+	ErrUnknownKey  = errors.New("token was signed with an unknown key")
+	ErrInvalidKey  = errors.New("invalid key; expected a PEM encoded RSA key")
+)
+
+// Key is an RSA signing key. The ID is the JWK thumbprint of the public key
+// (RFC 7638) and is set as the kid header of the tokens signed with the key.
+type Key struct {
+	ID         string    `json:"kid"`
+	Status     KeyStatus `json:"status"`
+	PrivateKey string    `json:"privateKey,omitempty"`
+	PublicKey  string    `json:"publicKey"`
+	CreatedAt  time.Time `json:"createdAt"`
+	UpdatedAt  time.Time `json:"updatedAt"`
+
+	priv *rsa.PrivateKey
+	pub  *rsa.PublicKey
+}
+
+// Keyring holds the keys used to sign and verify tokens. Tokens are signed
+// with the active key and verified with the active or retiring key named by
+// their kid header, so keys can be rotated without invalidating outstanding
+// tokens.
+type Keyring struct {
+	mu   sync.RWMutex
+	keys []*Key
+}
+
+// NewKeyring returns a keyring holding the given keys.
+func NewKeyring(keys ...*Key) (*Keyring, error) {
+	k := &Keyring{}
+	if err := k.set(keys); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// KeyringFromPEM returns a keyring with the given PEM encoded key pair as the
+// active key. The public key is derived from the private key when empty.
+func KeyringFromPEM(privateKey, publicKey string) (*Keyring, error) {
+	now := time.Now().UTC()
+	return NewKeyring(&Key{
+		Status:     KeyActive,
+		PrivateKey: privateKey,
+		PublicKey:  publicKey,
+		CreatedAt:  now,
+		UpdatedAt:  now,
+	})
+}
+
+// LoadKeyring reads a keyring from the JSON file at path.
+func LoadKeyring(path string) (*Keyring, error) {
+	k := &Keyring{}
+	if err := k.Load(path); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// Load replaces the keys of the keyring with the keys in the JSON file at
+// path.
+func (k *Keyring) Load(path string) error {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var v struct {
+		Keys []*Key `json:"keys"`
+	}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	return k.set(v.Keys)
+}
+
+// Save writes the keyring to the JSON file at path. The file holds the
+// private keys and is only readable by its owner.
+func (k *Keyring) Save(path string) error {
+	k.mu.RLock()
+	b, err := json.MarshalIndent(map[string][]*Key{"keys": k.keys}, "", "  ")
+	k.mu.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	// Replace the file atomically so a running server never reads a
+	// partially written keyring
+	f, err := ioutil.TempFile(filepath.Dir(path), ".keyring")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(append(b, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Chmod(0600); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+func (k *Keyring) set(keys []*Key) error {
+	active := 0
+	for _, key := range keys {
+		if err := key.parse(); err != nil {
+			return err
+		}
+		if key.Status == KeyActive {
+			active++
+		}
+	}
+	if active > 1 {
+		return errors.New("keyring has more than one active key")
+	}
+
+	k.mu.Lock()
+	k.keys = keys
+	k.mu.Unlock()
+	return nil
+}
+
+// Keys returns the keys of the keyring, the active key first.
+func (k *Keyring) Keys() []*Key {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	keys := make([]*Key, 0, len(k.keys))
+	for _, status := range []KeyStatus{KeyActive, KeyRetiring, KeyRetired} {
+		for _, key := range k.keys {
+			if key.Status == status {
+				keys = append(keys, key)
+			}
+		}
+	}
+	return keys
+}
+
+// Active returns the key used to sign new tokens or nil when the keyring has
+// no active key.
+func (k *Keyring) Active() *Key {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	for _, key := range k.keys {
+		if key.Status == KeyActive {
+			return key
+		}
+	}
+	return nil
+}
+
+// verifiers returns the keys which verify tokens, the active key first. When
+// kid isn't empty only the key with that ID is returned.
+func (k *Keyring) verifiers(kid string) []*Key {
+	var keys []*Key
+	for _, key := range k.Keys() {
+		if key.Status == KeyRetired || kid != "" && key.ID != kid {
+			continue
+		}
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// Rotate generates a new active key. The active key becomes a retiring key
+// and retiring keys which retired more than retireAfter ago are retired, their
+// private keys are removed. Set retireAfter to the longest TTL of the tokens
+// signed with the keyring.
+func (k *Keyring) Rotate(bits int, retireAfter time.Duration) (*Key, error) {
+	priv, err := rsa.GenerateKey(rand.Reader, bits)
+	if err != nil {
+		return nil, err
+	}
+	pub, err := x509.MarshalPKIXPublicKey(&priv.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	key := &Key{
+		Status:     KeyActive,
+		PrivateKey: string(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(priv)})),
+		PublicKey:  string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pub})),
+		CreatedAt:  now,
+		UpdatedAt:  now,
+	}
+	if err := key.parse(); err != nil {
+		return nil, err
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	for _, old := range k.keys {
+		switch {
+		case old.Status == KeyActive:
+			old.Status = KeyRetiring
+			old.UpdatedAt = now
+		case old.Status == KeyRetiring && now.Sub(old.UpdatedAt) >= retireAfter:
+			old.Status = KeyRetired
+			old.PrivateKey = ""
+			old.priv = nil
+			old.UpdatedAt = now
+		}
+	}
+	k.keys = append(k.keys, key)
+	return key, nil
+}
+
+// Sign signs the claims with the active key and sets its ID as the kid header
+// of the token. Only the RS256 algorithm is supported.
+func (k *Keyring) Sign(c Claims, opt *Options) (string, error) {
+	if opt == nil {
+		opt = &DefaultOptions
+	}
+	if opt.Algorithm != jwt.RS256 {
+		return "", jwt.ErrUnsupportedAlgorithm
+	}
+	key := k.Active()
+	if key == nil || key.priv == nil {
+		return "", ErrNoActiveKey
+	}
+
+	// jwt can't set the kid header, the token is encoded here instead
+	header, err := json.Marshal(map[string]string{
+		"alg": string(opt.Algorithm),
+		"typ": "JWT",
+		"kid": key.ID,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now().UTC()
+	payload := make(map[string]interface{}, len(c)+7)
+	for k, v := range c {
+		payload[k] = v
+	}
+	payload["jti"] = uuid.NewRandom().String()
+	payload["iss"] = opt.Issuer
+	if opt.Audience != "" {
+		payload["aud"] = opt.Audience
+		if _, ok := c["sub"]; !ok {
+			payload["sub"] = uuid.NewRandom().String()
+		}
+	}
+	payload["iat"] = now.Unix()
+	payload["nbf"] = now.Unix()
+	payload["exp"] = now.Add(opt.TTL).Unix()
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return "", err
+	}
+
+	input := encodeSegment(header) + "." + encodeSegment(body)
+	digest := sha256.Sum256([]byte(input))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key.priv, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+	return input + "." + encodeSegment(sig), nil
+}
+
+// Verify verifies the token like Verify using the key named by the kid header
+// of the token. Tokens without a kid header are verified with each active or
+// retiring key.
+func (k *Keyring) Verify(token string, opt *Options) (Claims, error) {
+	t, err := k.VerifyToken(token, opt)
+	if err != nil {
+		return nil, err
+	}
+	return t.Claims, nil
+}
+
+// VerifyToken verifies the token like Verify and returns the registered
+// claims along with the custom claims.
+func (k *Keyring) VerifyToken(token string, opt *Options) (*Token, error) {
+	kid, err := KeyID(token)
+	if err != nil {
+		return nil, err
+	}
+	keys := k.verifiers(kid)
+	if len(keys) == 0 {
+		return nil, ErrUnknownKey
+	}
+
+	for _, key := range keys {
+		var t *Token
+		t, err = VerifyToken(token, key.PublicKey, opt)
+		if err == nil {
+			return t, nil
+		}
+	}
+	return nil, err
+}
+
+// KeyID returns the kid header of the token without verifying the token.
+func KeyID(token string) (string, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", errors.New("malformed token")
+	}
+	b, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[0], "="))
+	if err != nil {
+		return "", err
+	}
+	var v struct {
+		KeyID string `json:"kid"`
+	}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return "", err
+	}
+	return v.KeyID, nil
+}
+
+// JWK is a public RSA key in the JSON Web Key format (RFC 7517).
+type JWK struct {
+	KeyType   string `json:"kty"`
+	Use       string `json:"use"`
+	Algorithm string `json:"alg"`
+	KeyID     string `json:"kid"`
+	Modulus   string `json:"n"`
+	Exponent  string `json:"e"`
+}
+
+// JWKS is a JSON Web Key Set.
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+// JWKS returns the public keys which verify tokens, the active key first.
+func (k *Keyring) JWKS() *JWKS {
+	set := &JWKS{Keys: []JWK{}}
+	for _, key := range k.verifiers("") {
+		n, e := jwkParams(key.pub)
+		set.Keys = append(set.Keys, JWK{
+			KeyType:   "RSA",
+			Use:       "sig",
+			Algorithm: string(jwt.RS256),
+			KeyID:     key.ID,
+			Modulus:   n,
+			Exponent:  e,
+		})
+	}
+	return set
+}
+
+// parse parses the PEM encoded keys and sets the ID of the key. The public
+// key is derived from the private key when empty.
+func (key *Key) parse() error {
+	if key.PrivateKey != "" {
+		b, _ := pem.Decode([]byte(key.PrivateKey))
+		if b == nil {
+			return ErrInvalidKey
+		}
+		priv, err := x509.ParsePKCS1PrivateKey(b.Bytes)
+		if err != nil {
+			v, err := x509.ParsePKCS8PrivateKey(b.Bytes)
+			if err != nil {
+				return ErrInvalidKey
+			}
+			var ok bool
+			if priv, ok = v.(*rsa.PrivateKey); !ok {
+				return ErrInvalidKey
+			}
+		}
+		key.priv = priv
+		if key.PublicKey == "" {
+			pub, err := x509.MarshalPKIXPublicKey(&priv.PublicKey)
+			if err != nil {
+				return err
+			}
+			key.PublicKey = string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pub}))
+		}
+	}
+
+	b, _ := pem.Decode([]byte(key.PublicKey))
+	if b == nil {
+		return ErrInvalidKey
+	}
+	v, err := x509.ParsePKIXPublicKey(b.Bytes)
+	if err != nil {
+		return ErrInvalidKey
+	}
+	pub, ok := v.(*rsa.PublicKey)
+	if !ok {
+		return ErrInvalidKey
+	}
+	key.pub = pub
+
+	if key.ID == "" {
+		key.ID = thumbprint(pub)
+	}
+	return nil
+}
+
+// thumbprint returns the JWK thumbprint of the public key (RFC 7638).
+func thumbprint(pub *rsa.PublicKey) string {
+	n, e := jwkParams(pub)
+	// The members are required to be in lexicographic order
+	sum := sha256.Sum256([]byte(`{"e":"` + e + `","kty":"RSA","n":"` + n + `"}`))
+	return encodeSegment(sum[:])
+}
+
+func jwkParams(pub *rsa.PublicKey) (n, e string) {
+	return encodeSegment(pub.N.Bytes()), encodeSegment(big.NewInt(int64(pub.E)).Bytes())
+}
+
+func encodeSegment(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
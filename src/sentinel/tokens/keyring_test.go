@@ -0,0 +1,116 @@
+// Copyright 2015 Lars Wiegman. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tokens
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestKeyringRotate(t *testing.T) {
+	k, err := KeyringFromPEM(privateKey, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := k.Active()
+
+	tokenStr, err := k.Sign(Claims{"user_id": "373707eb-db20-4b1c-bf8c-505f19d9ccf5"}, &AccessTokenOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if kid, _ := KeyID(tokenStr); kid != first.ID {
+		t.Errorf("Result should have been %v, but it was %v", first.ID, kid)
+	}
+	// Tokens signed by the keyring verify with the plain public key too
+	if _, err := Verify(tokenStr, publicKey, &AccessTokenOptions); err != nil {
+		t.Error(err)
+	}
+
+	second, err := k.Rotate(1024, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.Status != KeyRetiring {
+		t.Errorf("Result should have been %v, but it was %v", KeyRetiring, first.Status)
+	}
+
+	// Outstanding tokens remain valid, new tokens are signed with the new key
+	claims, err := k.Verify(tokenStr, &AccessTokenOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims["user_id"] != "373707eb-db20-4b1c-bf8c-505f19d9ccf5" {
+		t.Errorf("Result should have been %v, but it was %v", "373707eb-db20-4b1c-bf8c-505f19d9ccf5", claims["user_id"])
+	}
+	newStr, err := k.Sign(Claims{}, &AccessTokenOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if kid, _ := KeyID(newStr); kid != second.ID {
+		t.Errorf("Result should have been %v, but it was %v", second.ID, kid)
+	}
+	if n := len(k.JWKS().Keys); n != 2 {
+		t.Errorf("Result should have been %v, but it was %v", 2, n)
+	}
+
+	// The retiring key is retired by the next rotation after retireAfter
+	if _, err := k.Rotate(1024, 0); err != nil {
+		t.Fatal(err)
+	}
+	if first.Status != KeyRetired || first.PrivateKey != "" {
+		t.Errorf("Result should have been a retired key without private key, but it was %v", first.Status)
+	}
+	if _, err := k.Verify(tokenStr, &AccessTokenOptions); err != ErrUnknownKey {
+		t.Errorf("Result should have been %v, but it was %v", ErrUnknownKey, err)
+	}
+	if _, err := k.Verify(newStr, &AccessTokenOptions); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestKeyringSaveAndLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keyring")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "keyring.json")
+
+	k, err := KeyringFromPEM(privateKey, publicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := k.Rotate(1024, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err := k.Save(path); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0600 {
+		t.Errorf("Result should have been %v, but it was %v", os.FileMode(0600), fi.Mode().Perm())
+	}
+
+	tokenStr, err := k.Sign(Claims{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadKeyring(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Active().ID != k.Active().ID {
+		t.Errorf("Result should have been %v, but it was %v", k.Active().ID, loaded.Active().ID)
+	}
+	if _, err := loaded.Verify(tokenStr, nil); err != nil {
+		t.Error(err)
+	}
+}
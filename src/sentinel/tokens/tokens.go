@@ -5,6 +5,10 @@
 package tokens
 
 import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
 	"time"
 
 	"code.google.com/p/go-uuid/uuid"
@@ -12,9 +16,41 @@ import (
 )
 
 var (
-	DefaultOptions     = Options{Algorithm: jwt.RS256, Issuer: "https://sentinel.sh", TTL: time.Hour * 72}
-	VerifyEmailOptions = Options{Algorithm: jwt.RS256, Issuer: "https://sentinel.sh/verify-email", TTL: time.Hour * 72}
-	AccessTokenOptions = Options{Algorithm: jwt.RS256, Issuer: "https://sentinel.sh/access-token", TTL: time.Minute * 60}
+	DefaultOptions      = Options{Algorithm: jwt.RS256, Issuer: "https://sentinel.sh", TTL: time.Hour * 72}
+	VerifyEmailOptions  = Options{Algorithm: jwt.RS256, Issuer: "https://sentinel.sh/verify-email", TTL: time.Hour * 72}
+	AccessTokenOptions  = Options{Algorithm: jwt.RS256, Issuer: "https://sentinel.sh/access-token", TTL: time.Minute * 60}
+	LoginRequestOptions = Options{Algorithm: jwt.RS256, Issuer: "https://sentinel.sh/login-request", TTL: time.Minute * 5}
+	CallbackOptions     = Options{Algorithm: jwt.RS256, Issuer: "https://sentinel.sh/callback", TTL: time.Minute * 5}
+
+	// ResetPasswordOptions are used for the tokens in password reset links,
+	// they can only be used once to set a new password.
+	ResetPasswordOptions = Options{Algorithm: jwt.RS256, Issuer: "https://sentinel.sh/reset-password", TTL: time.Minute * 30}
+
+	// MFAChallengeOptions are used for the tokens which continue a login with
+	// a second factor after the password was checked, they can only be used
+	// once.
+	MFAChallengeOptions = Options{Algorithm: jwt.RS256, Issuer: "https://sentinel.sh/mfa-challenge", TTL: time.Minute * 5}
+
+	// AuthorizeRequestOptions are used for the tokens which carry an
+	// authorization request of the OpenID Connect flow while its login
+	// request is pending. The TTL exceeds the timeout of login requests.
+	AuthorizeRequestOptions = Options{Algorithm: jwt.RS256, Issuer: "https://sentinel.sh/authorize-request", TTL: time.Minute * 10}
+
+	// IDTokenOptions are used for OpenID Connect ID tokens. The issuer is
+	// replaced by the issuer identifier of the deployment, the audience by
+	// the client ID of the service.
+	IDTokenOptions = Options{Algorithm: jwt.RS256, Issuer: "https://sentinel.sh", TTL: time.Hour}
+
+	// OIDCAccessTokenOptions are used for the access tokens issued to
+	// services by the OpenID Connect flow, they're only accepted by the
+	// userinfo endpoint.
+	OIDCAccessTokenOptions = Options{Algorithm: jwt.RS256, Issuer: "https://sentinel.sh/oidc-access-token", TTL: time.Minute * 60}
+
+	// ClientAssertionOptions are used by services to authenticate using a
+	// JWT signed with their private key, the issuer is the client ID of the
+	// service and the audience the issuer identifier of the deployment. The
+	// TTL is the maximum lifetime of an assertion.
+	ClientAssertionOptions = Options{Algorithm: jwt.RS256, Audience: "https://sentinel.sh", TTL: time.Minute * 5}
 )
 
 type Options struct {
@@ -26,6 +62,17 @@ type Options struct {
 
 type Claims map[string]interface{}
 
+// Token is a verified token. ID is the unique identifier of the token, the
+// jti claim, used to revoke the token before it expires.
+type Token struct {
+	ID       string
+	Subject  string
+	Audience string
+	IssuedAt time.Time
+	Expires  time.Time
+	Claims   Claims
+}
+
 func Sign(c Claims, privateKey string, opt *Options) (string, error) {
 	if opt == nil {
 		opt = &DefaultOptions
@@ -34,6 +81,7 @@ func Sign(c Claims, privateKey string, opt *Options) (string, error) {
 	token.Algorithm = opt.Algorithm
 	token.Expires = token.IssuedAt.Add(opt.TTL)
 	token.Issuer = opt.Issuer
+	token.JWTID = uuid.NewRandom().String()
 	token.Claims = c
 	if opt.Audience != "" {
 		token.Audience = opt.Audience
@@ -43,6 +91,16 @@ func Sign(c Claims, privateKey string, opt *Options) (string, error) {
 }
 
 func Verify(token, publicKey string, opt *Options) (Claims, error) {
+	t, err := VerifyToken(token, publicKey, opt)
+	if err != nil {
+		return nil, err
+	}
+	return t.Claims, nil
+}
+
+// VerifyToken verifies the token like Verify and returns the registered
+// claims along with the custom claims.
+func VerifyToken(token, publicKey string, opt *Options) (*Token, error) {
 	if opt == nil {
 		opt = &DefaultOptions
 	}
@@ -53,8 +111,35 @@ func Verify(token, publicKey string, opt *Options) (Claims, error) {
 	if t.Algorithm != opt.Algorithm {
 		return nil, jwt.ErrUnsupportedAlgorithm
 	}
-	if err := t.Verify(opt.Issuer, "", ""); err != nil {
+	if err := t.Verify(opt.Issuer, "", opt.Audience); err != nil {
 		return nil, err
 	}
-	return t.Claims, nil
+	return &Token{
+		ID:       t.JWTID,
+		Subject:  t.Subject,
+		Audience: t.Audience,
+		IssuedAt: t.IssuedAt,
+		Expires:  t.Expires,
+		Claims:   t.Claims,
+	}, nil
+}
+
+// Issuer returns the issuer of the token without verifying the token. Use it
+// to look up the key to verify the token with.
+func Issuer(token string) (string, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", errors.New("malformed token")
+	}
+	b, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return "", err
+	}
+	var v struct {
+		Issuer string `json:"iss"`
+	}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return "", err
+	}
+	return v.Issuer, nil
 }
@@ -77,3 +77,30 @@ func TestFailVerify(t *testing.T) {
 		t.Errorf("Result should have been %v, but it was %v", expect, result)
 	}
 }
+
+func TestVerifyTokenID(t *testing.T) {
+	opt := AccessTokenOptions
+
+	var ids []string
+	for i := 0; i < 2; i++ {
+		tokenStr, err := Sign(Claims{}, privateKey, &opt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		token, err := VerifyToken(tokenStr, publicKey, &opt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if token.ID == "" {
+			t.Fatal("token should have a jti claim")
+		}
+		if expect := token.IssuedAt.Add(opt.TTL); !token.Expires.Equal(expect) {
+			t.Errorf("Result should have been %v, but it was %v", expect, token.Expires)
+		}
+		ids = append(ids, token.ID)
+	}
+
+	if ids[0] == ids[1] {
+		t.Errorf("tokens should have unique IDs, but both were %v", ids[0])
+	}
+}
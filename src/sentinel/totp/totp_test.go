@@ -0,0 +1,81 @@
+// Copyright 2015 Lars Wiegman. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package totp
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// secret is the SHA1 seed of the test vectors in RFC 6238, appendix B, in
+// base32.
+const secret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestCode(t *testing.T) {
+	// The test vectors have 8 digits, the codes are the last 6
+	tests := []struct {
+		unix int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+	}
+	for _, tt := range tests {
+		code, err := Code(secret, Step(time.Unix(tt.unix, 0)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if code != tt.code {
+			t.Errorf("Result should have been %v, but it was %v", tt.code, code)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+	tests := []struct {
+		at    time.Time
+		valid bool
+	}{
+		{now, true},
+		{now.Add(-Period), true},
+		{now.Add(Period), true},
+		{now.Add(-2 * Period), false},
+		{now.Add(2 * Period), false},
+	}
+	for _, tt := range tests {
+		code, _ := Code(secret, Step(tt.at))
+		step, err := Validate(secret, code, now)
+		if valid := err == nil; valid != tt.valid {
+			t.Errorf("Result should have been %v, but it was %v", tt.valid, valid)
+		}
+		if err == nil && step != Step(tt.at) {
+			t.Errorf("Result should have been %v, but it was %v", Step(tt.at), step)
+		}
+	}
+
+	if _, err := Validate(secret, "12345", now); err != ErrInvalidCode {
+		t.Errorf("Result should have been %v, but it was %v", ErrInvalidCode, err)
+	}
+}
+
+func TestNewSecret(t *testing.T) {
+	s, err := NewSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Code(s, 1); err != nil {
+		t.Errorf("Result should have been a base32 secret, but it was %q: %v", s, err)
+	}
+
+	uri := URI(s, "Sentinel", "jess@example.com")
+	if !strings.HasPrefix(uri, "otpauth://totp/Sentinel:jess@example.com?") || !strings.Contains(uri, "secret="+s) {
+		t.Errorf("Result should have been a provisioning URI, but it was %v", uri)
+	}
+}
@@ -23,8 +23,22 @@ const (
 	AuthLevelSecure
 )
 
+// ResendVerificationInterval is the minimum time between two verification
+// messages to the same email address.
+const ResendVerificationInterval = time.Minute * 5
+
 var (
-	ErrUserNotFound = errors.New("user not found")
+	ErrUserNotFound    = errors.New("user not found")
+	ErrResendThrottled = errors.New("verification message was sent recently")
+)
+
+var (
+	// ErrEmailNotVerified is returned when an unverified email is made the
+	// primary email.
+	ErrEmailNotVerified = errors.New("email isn't verified")
+	// ErrPrimaryEmail is returned when the primary email is deleted, another
+	// email must be made primary first.
+	ErrPrimaryEmail = errors.New("primary email can't be deleted")
 )
 
 // User is a reflection of the enduser's profile.
@@ -38,13 +52,17 @@ type User struct {
 	CreatedAt        time.Time    `db:"created_at" json:"-"`
 	UpdatedAt        time.Time    `db:"updated_at" json:"-"`
 	IsArchived       bool         `db:"is_archived" json:"-"`
+	ArchivedAt       *time.Time   `db:"archived_at" json:"-"` // the account is purged after the ArchiveGracePeriod, nil when active
 	AuthEmailList    []*AuthEmail `json:"authEmailList"`
-	DeviceToken      string       `json:"deviceToken"`
+	Locale           string       `json:"locale"` // preferred language of the messages to the user
+	TOTPSecret       string       `db:"totp_secret" json:"-"`
+	TOTPEnabled      bool         `db:"totp_enabled" json:"totpEnabled"`
+	TOTPStep         int64        `db:"totp_step" json:"-"`
 }
 
 type UserUpdateOptions struct {
-	Name, Password, DeviceToken string
-	DefaultAuthLevel            int
+	Name, Password, Locale string
+	DefaultAuthLevel       int
 }
 
 func (o *UserUpdateOptions) ParseForm(v url.Values) error {
@@ -79,8 +97,11 @@ func (o *UserUpdateOptions) ParseForm(v url.Values) error {
 			return errors.New("invalid defaultAuthLevel parameter; options are 1:Notify, 2:Fast or 3:Secure")
 		}
 	}
-	if s := v.Get("deviceToken"); s != "" {
-		o.DeviceToken = s
+	if s := v.Get("locale"); s != "" {
+		if err := validate.Locale(s); err != nil {
+			return errors.New("invalid locale parameter; expecting a language tag like en or nl-BE")
+		}
+		o.Locale = s
 		parsed = true
 	}
 	if !parsed {
@@ -96,10 +117,22 @@ type AuthEmail struct {
 	UserID     int       `db:"user_id" json:"-"`
 	Email      string    `json:"email"`
 	IsVerified bool      `db:"is_verified" json:"isVerified"`
+	IsPrimary  bool      `db:"is_primary" json:"isPrimary"` // receives the notifications, always verified
 	CreatedAt  time.Time `db:"created_at" json:"-"`
 	UpdatedAt  time.Time `db:"updated_at" json:"-"`
 }
 
+// PrimaryEmail returns the email which receives the notifications of the
+// user, nil when the user has no verified email.
+func (u *User) PrimaryEmail() *AuthEmail {
+	for _, e := range u.AuthEmailList {
+		if e.IsPrimary {
+			return e
+		}
+	}
+	return nil
+}
+
 // AuthEmailListOptions is a filter instance.
 type AuthEmailListOptions struct {
 	User *uuid.UUID
@@ -115,7 +148,16 @@ type UsersService interface {
 	ListEmail(*AuthEmailListOptions) ([]*AuthEmail, error)
 	AddEmail(userID uuid.UUID, email string) (*AuthEmail, error)
 	AckEmail(uid uuid.UUID) error
+	// ResendVerification sends a new verification message to the unverified
+	// email, ErrResendThrottled is returned when a message was sent within
+	// the ResendVerificationInterval.
+	ResendVerification(emailID uuid.UUID) error
 	GetEmail(uid uuid.UUID) (*AuthEmail, error)
+	// SetPrimaryEmail makes the verified email the primary email of its
+	// user, ErrEmailNotVerified is returned when it isn't verified.
+	SetPrimaryEmail(emailID uuid.UUID) error
+	// DelEmail deletes the email, ErrPrimaryEmail is returned for the
+	// primary email.
 	DelEmail(uid uuid.UUID) error
 }
 
@@ -205,6 +247,58 @@ func (s *usersService) AckEmail(uid uuid.UUID) error {
 	return nil
 }
 
+func (s *usersService) ResendVerification(emailID uuid.UUID) error {
+	u, err := s.client.url(router.ResendAckEmail, map[string]string{"uid": emailID.String()}, nil)
+	if err != nil {
+		return err
+	}
+
+	req, err := s.client.NewRequest("POST", u.String(), nil)
+	if err != nil {
+		return err
+	}
+	if err := s.client.Authorize(req); err != nil {
+		return err
+	}
+
+	resp, err := s.client.Do(req, nil)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode != http.StatusNoContent {
+		return errors.New("API reponded with status " + http.StatusText(resp.StatusCode))
+	}
+
+	return nil
+}
+
+func (s *usersService) SetPrimaryEmail(emailID uuid.UUID) error {
+	u, err := s.client.url(router.PrimaryEmail, map[string]string{"uid": emailID.String()}, nil)
+	if err != nil {
+		return err
+	}
+
+	req, err := s.client.NewRequest("POST", u.String(), nil)
+	if err != nil {
+		return err
+	}
+	if err := s.client.Authorize(req); err != nil {
+		return err
+	}
+
+	resp, err := s.client.Do(req, nil)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode != http.StatusNoContent {
+		return errors.New("API reponded with status " + http.StatusText(resp.StatusCode))
+	}
+
+	return nil
+}
+
 func (s *usersService) AddEmail(userID uuid.UUID, email string) (*AuthEmail, error) {
 	u, err := s.client.url(router.AddEmail, nil, nil)
 	if err != nil {
@@ -243,8 +337,8 @@ func (s *usersService) ListEmail(*AuthEmailListOptions) ([]*AuthEmail, error) {
 	return nil, nil
 }
 
-func (s *usersService) DelEmail(userID uuid.UUID) error {
-	u, err := s.client.url(router.DelEmail, nil, nil)
+func (s *usersService) DelEmail(uid uuid.UUID) error {
+	u, err := s.client.url(router.DelEmail, map[string]string{"uid": uid.String()}, nil)
 	if err != nil {
 		return err
 	}
@@ -253,6 +347,9 @@ func (s *usersService) DelEmail(userID uuid.UUID) error {
 	if err != nil {
 		return err
 	}
+	if err := s.client.Authorize(req); err != nil {
+		return err
+	}
 
 	resp, err := s.client.Do(req, nil)
 	if err != nil {
@@ -284,15 +381,17 @@ type UserListOptions struct {
 
 // MockUsersService is a mock of the UsersService.
 type MockUsersService struct {
-	SignupFn         func(email, password string) (*User, error)
-	GetUserDetailsFn func(uid uuid.UUID) (*User, error)
-	ListFn           func(UserListOptions) ([]*User, error)
-	AddEmailFn       func(userID uuid.UUID, email string) (*AuthEmail, error)
-	AckEmailFn       func(uid uuid.UUID) error
-	GetEmailFn       func(uid uuid.UUID) (*AuthEmail, error)
-	DelEmailFn       func(id uuid.UUID) error
-	ListEmailFn      func(opt *AuthEmailListOptions) ([]*AuthEmail, error)
-	UpdateDetailsFn  func(userID uuid.UUID, opt UserUpdateOptions) (*User, error)
+	SignupFn             func(email, password string) (*User, error)
+	GetUserDetailsFn     func(uid uuid.UUID) (*User, error)
+	ListFn               func(UserListOptions) ([]*User, error)
+	AddEmailFn           func(userID uuid.UUID, email string) (*AuthEmail, error)
+	AckEmailFn           func(uid uuid.UUID) error
+	ResendVerificationFn func(emailID uuid.UUID) error
+	GetEmailFn           func(uid uuid.UUID) (*AuthEmail, error)
+	SetPrimaryEmailFn    func(emailID uuid.UUID) error
+	DelEmailFn           func(id uuid.UUID) error
+	ListEmailFn          func(opt *AuthEmailListOptions) ([]*AuthEmail, error)
+	UpdateDetailsFn      func(userID uuid.UUID, opt UserUpdateOptions) (*User, error)
 }
 
 var _ UsersService = &MockUsersService{}
@@ -329,6 +428,14 @@ func (s *MockUsersService) AckEmail(uid uuid.UUID) error {
 	return s.AckEmailFn(uid)
 }
 
+// ResendVerification sends a new verification message to the email.
+func (s *MockUsersService) ResendVerification(emailID uuid.UUID) error {
+	if s.ResendVerificationFn == nil {
+		return nil
+	}
+	return s.ResendVerificationFn(emailID)
+}
+
 // AddEmail creates a new email for the user with the given UUID.
 func (s *MockUsersService) AddEmail(userID uuid.UUID, email string) (*AuthEmail, error) {
 	if s.AddEmailFn == nil {
@@ -344,6 +451,13 @@ func (s *MockUsersService) GetEmail(emailID uuid.UUID) (*AuthEmail, error) {
 	return s.GetEmailFn(emailID)
 }
 
+func (s *MockUsersService) SetPrimaryEmail(emailID uuid.UUID) error {
+	if s.SetPrimaryEmailFn == nil {
+		return nil
+	}
+	return s.SetPrimaryEmailFn(emailID)
+}
+
 func (s *MockUsersService) DelEmail(id uuid.UUID) error {
 	if s.DelEmailFn == nil {
 		return nil
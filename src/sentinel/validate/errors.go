@@ -18,4 +18,5 @@ var (
 	ErrNotUUIDv4       = &Error{`expecting an UUIDv4`}
 	ErrNotEmail        = &Error{`expecting an email addres`}
 	ErrNotPassword     = &Error{`expecting a password`}
+	ErrNotLocale       = &Error{`expecting a language tag`}
 )
@@ -21,6 +21,7 @@ var (
 	RuleUUIDv4       = regexp.MustCompile(`^[a-f0-9]{8}-[a-f0-9]{4}-4[a-f0-9]{3}-[89aAbB][a-f0-9]{3}-[a-f0-9]{12}$`) //strict for v4 UUIDs
 	RuleEmail        = regexp.MustCompile(`^[^@\s]+@[^@\s]+$`)
 	RulePassword     = regexp.MustCompile(`.{8,}$`)
+	RuleLocale       = regexp.MustCompile(`^[a-zA-Z]{2,3}([-_][a-zA-Z0-9]{2,8})*$`) // language tag, e.g. en or nl-BE
 )
 
 type Error struct {
@@ -128,6 +129,14 @@ func Password(input string) error {
 	return nil
 }
 
+// Return error if the provided input is not a valid language tag.
+func Locale(input string) error {
+	if RuleLocale.MatchString(input) == false {
+		return ErrNotLocale
+	}
+	return nil
+}
+
 // Return error if the provided input is not validated against
 // the chain of validation rules.
 //
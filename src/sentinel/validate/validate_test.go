@@ -157,3 +157,27 @@ func TestValidateEmail(t *testing.T) {
 		t.Fatalf("Failed validation: %s", err.Error())
 	}
 }
+
+func TestValidateLocale(t *testing.T) {
+	var err error
+
+	err = Locale("nl-BE")
+	if err != nil {
+		t.Fatalf("Failed validation: %s", err.Error())
+	}
+
+	err = Locale("en")
+	if err != nil {
+		t.Fatalf("Failed validation: %s", err.Error())
+	}
+
+	err = Locale("e")
+	if err == nil {
+		t.Fatal("Failed validation: expected an error")
+	}
+
+	err = Locale("en-")
+	if err == nil {
+		t.Fatal("Failed validation: expected an error")
+	}
+}